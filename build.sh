@@ -11,12 +11,31 @@
 
 SECRET_ARN=$1
 
+# The architecture of the Lambda function the layer is built for, x86_64 or arm64
+ARCHITECTURE=${2:-x86_64}
+
 # Make sure that a secret arn was supplied as an argument
 if [[ -z ${SECRET_ARN+z} ]]; then
     echo "Build failed as no SECRET ARN was supplied as the only argument to this script"
 	exit 1
 fi
 
+case "${ARCHITECTURE}" in
+    x86_64) GOARCH=amd64 ;;
+    arm64) GOARCH=arm64 ;;
+    *)
+        echo "Build failed as the architecture ${ARCHITECTURE} is not one of x86_64 or arm64"
+        exit 1
+        ;;
+esac
+
+# The build is stamped with its version, commit, and date, which the version command prints
+VERSION=${VERSION:-$(git describe --tags --always --dirty 2>/dev/null || echo dev)}
+LDFLAGS="-X main.version=${VERSION} -X main.commit=$(git rev-parse HEAD 2>/dev/null) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+if [[ -n "${RELEASES_URL}" ]]; then
+    LDFLAGS="${LDFLAGS} -X main.releasesUrl=${RELEASES_URL}"
+fi
+
 # Remove the output directory if it exists as it may container artifacts from a previous build
 rm -rf ./out
 mkdir out
@@ -25,9 +44,9 @@ mkdir out
 cp -r ./src ./out
 cp -r ./test ./out
 
-# First complile the go code
+# First complile the go code for the Lambda architecture, without cgo so it runs on any Lambda runtime
 cd ./out/src
-go build
+GOOS=linux GOARCH=${GOARCH} CGO_ENABLED=0 go build -ldflags "${LDFLAGS}"
 
 # Make sure that the shell script is executable
 chmod +x get-secrets-layer
@@ -47,4 +66,4 @@ cd ../..
 # Now run the CDK to deploy everything
 cd cdk
 npm install
-npx aws-cdk@2.x deploy --parameters secretArn="${SECRET_ARN}"
+npx aws-cdk@2.x deploy -c architecture="${ARCHITECTURE}" --parameters secretArn="${SECRET_ARN}"
@@ -26,6 +26,10 @@ export class CdkStack extends cdk.Stack {
 
     const secretRegion = cdk.Stack.of(this).region;
 
+    // The layer is built by build.sh for the architecture given with -c architecture=x86_64|arm64
+    const architecture = this.node.tryGetContext('architecture') === 'arm64' ?
+      lambda.Architecture.ARM_64 : lambda.Architecture.X86_64;
+
     // Create a new policy document
     const lambdaPolicy = new iam.PolicyDocument();
     lambdaPolicy.addStatements(new iam.PolicyStatement({
@@ -44,6 +48,7 @@ export class CdkStack extends cdk.Stack {
     // Create the lambda layer
     const getSecretsLayer = new lambda.LayerVersion(this, 'get-secrets-layer', {
       code: lambda.Code.fromAsset('../out/get-secrets-layer.zip'),
+      compatibleArchitectures: [architecture],
       description: 'This layer is used to pull secrets from secret manager and convert to environmental variables',
       removalPolicy: cdk.RemovalPolicy.DESTROY // NOTE: you wouldn't do this in prod, but it's fine for a dev case
     });
@@ -57,6 +62,7 @@ export class CdkStack extends cdk.Stack {
     // Create the lambda and assign the role and layer
     const func = new lambda.Function(this, 'example-get-secrets-lambda', {
       runtime: lambda.Runtime.PYTHON_3_9,
+      architecture: architecture,
       handler: 'lambda_function.lambda_handler',
       code: lambda.Code.fromAsset('../out/example-get-secrets-lambda.zip'),
       layers: [getSecretsLayer, secondExampleLayer],
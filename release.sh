@@ -0,0 +1,39 @@
+#!/bin/bash
+
+#
+# Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+# SPDX-License-Identifier: MIT-0
+#
+# This script is used to build the binary for each of the supported systems and architectures, such as
+# for tooling on macOS or Windows containers, into ./out/release.  The Lambda layer is built by build.sh.
+#
+
+TARGETS="linux/amd64 linux/arm64 darwin/amd64 darwin/arm64 windows/amd64 windows/arm64"
+
+# The build is stamped with its version, commit, and date, which the version command prints
+VERSION=${VERSION:-$(git describe --tags --always --dirty 2>/dev/null || echo dev)}
+LDFLAGS="-X main.version=${VERSION} -X main.commit=$(git rev-parse HEAD 2>/dev/null) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+if [[ -n "${RELEASES_URL}" ]]; then
+    LDFLAGS="${LDFLAGS} -X main.releasesUrl=${RELEASES_URL}"
+fi
+
+rm -rf ./out/release
+mkdir -p ./out/release
+
+cd ./src
+
+for TARGET in ${TARGETS}; do
+    GOOS=${TARGET%/*}
+    GOARCH=${TARGET#*/}
+
+    OUTPUT="../out/release/go-retrieve-secret-${GOOS}-${GOARCH}"
+    if [[ "${GOOS}" == "windows" ]]; then
+        OUTPUT="${OUTPUT}.exe"
+    fi
+
+    echo "Building ${OUTPUT}"
+    if ! GOOS=${GOOS} GOARCH=${GOARCH} CGO_ENABLED=0 go build -ldflags "${LDFLAGS}" -o "${OUTPUT}"; then
+        echo "Build failed for ${TARGET}"
+        exit 1
+    fi
+done
@@ -0,0 +1,238 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// This code is used to write an audit record of who retrieved which secrets and versions, so that
+// every injection of secrets into an environment can be traced without ever recording a value.
+//
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"go-retrieve-secret/pkg/secretenv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// The destinations of -audit-log besides a file
+const AUDIT_STDERR = "stderr"
+const AUDIT_EMF = "emf"
+
+// An identity returned by GetCallerIdentity
+type auditIdentity struct {
+	Account string `json:"account"`
+	Arn     string `json:"arn"`
+	UserId  string `json:"user_id"`
+}
+
+// A secret that was accessed, Cached is set when it came from the -cache-file without an API call
+type auditSecret struct {
+	SecretId  string  `json:"secret_id"`
+	Arn       string  `json:"arn,omitempty"`
+	VersionId string  `json:"version_id,omitempty"`
+	Elapsed   float64 `json:"elapsed_ms"`
+	Cached    bool    `json:"cached,omitempty"`
+	Success   bool    `json:"success"`
+	ErrorType string  `json:"error_type,omitempty"`
+}
+
+// The audit record of a retrieval, it never holds a value of a secret
+type auditRecord struct {
+	Event         string         `json:"event"`
+	Time          string         `json:"time"`
+	CorrelationId string         `json:"correlation_id"`
+	Command       string         `json:"command,omitempty"`
+	Region        string         `json:"region,omitempty"`
+	Caller        *auditIdentity `json:"caller,omitempty"`
+	AssumedRole   *auditIdentity `json:"assumed_role,omitempty"`
+	IdentityError string         `json:"identity_error,omitempty"`
+	Secrets       []auditSecret  `json:"secrets"`
+	Duration      float64        `json:"duration_ms"`
+	Success       bool           `json:"success"`
+	ErrorType     string         `json:"error_type,omitempty"`
+}
+
+// Collects the audit record of a retrieval until it is written, it is safe to use from several goroutines
+type auditRecorder struct {
+	mutex       sync.Mutex
+	caller      *auditIdentity
+	assumedRole *auditIdentity
+	identityErr error
+	secrets     []secretMetric
+	result      *secretenv.Result
+}
+
+// The recorder of the run, nil when -audit-log was not supplied
+var audit *auditRecorder
+
+// This function will record the retrieval of a single secret, it is used as the Observe function of the config
+func (a *auditRecorder) observe(secretId string, elapsed time.Duration, err error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.secrets = append(a.secrets, secretMetric{secretId, elapsed, err})
+}
+
+// This function will record the versions and ARNs of the secrets that were retrieved
+func (a *auditRecorder) observeResult(result *secretenv.Result) {
+	if a == nil {
+		return
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.result = result
+}
+
+// This function will look up who the credentials of the config belong to and, when a role was assumed, who
+// the credentials of the role belong to.  An identity that cannot be looked up is recorded as an error of the
+// record rather than failing the run.
+func (a *auditRecorder) identify(ctx context.Context, cfg aws.Config, role aws.CredentialsProvider) {
+	if a == nil {
+		return
+	}
+
+	caller, err := callerIdentity(ctx, cfg, nil)
+
+	var assumed *auditIdentity
+	if err == nil && role != nil {
+		assumed, err = callerIdentity(ctx, cfg, role)
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.caller, a.assumedRole, a.identityErr = caller, assumed, err
+}
+
+// This function will call GetCallerIdentity with the credentials, or with those of the config when they are nil
+func callerIdentity(ctx context.Context, cfg aws.Config, credentials aws.CredentialsProvider) (*auditIdentity, error) {
+	client := sts.NewFromConfig(cfg, func(o *sts.Options) {
+		if credentials != nil {
+			o.Credentials = credentials
+		}
+	})
+
+	output, err := client.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &auditIdentity{Account: aws.ToString(output.Account), Arn: aws.ToString(output.Arn), UserId: aws.ToString(output.UserId)}, nil
+}
+
+// This function will write the audit record of the secrets recorded since the last record to the -audit-log,
+// as a line of JSON, or as an EMF record on stderr so that CloudWatch Logs keeps it as a structured event
+func (a *auditRecorder) write(destination string, elapsed time.Duration, runErr error) {
+	if a == nil {
+		return
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	// Nothing was accessed since the last record, e.g. when serve stops
+	if len(a.secrets) == 0 && a.result == nil && runErr == nil {
+		return
+	}
+
+	record := auditRecord{
+		Event:         "secrets_accessed",
+		Time:          time.Now().UTC().Format(time.RFC3339Nano),
+		CorrelationId: requestId,
+		Command:       commandName,
+		Region:        region,
+		Caller:        a.caller,
+		AssumedRole:   a.assumedRole,
+		Secrets:       []auditSecret{},
+		Duration:      milliseconds(elapsed),
+		Success:       runErr == nil,
+	}
+
+	if a.identityErr != nil {
+		record.IdentityError = errorType(a.identityErr)
+	}
+	if runErr != nil {
+		record.ErrorType = errorType(runErr)
+	}
+
+	observed := map[string]bool{}
+	for _, secret := range a.secrets {
+		observed[secret.secretId] = true
+
+		entry := auditSecret{SecretId: secret.secretId, Elapsed: milliseconds(secret.elapsed), Success: secret.err == nil}
+		if secret.err != nil {
+			entry.ErrorType = errorType(secret.err)
+		}
+		record.Secrets = append(record.Secrets, entry)
+	}
+
+	if a.result != nil {
+		// The secrets read from the cache file were not retrieved, so they were never observed
+		ids := make([]string, 0, len(a.result.Versions))
+		for secretId := range a.result.Versions {
+			if !observed[secretId] {
+				ids = append(ids, secretId)
+			}
+		}
+		sort.Strings(ids)
+
+		for _, secretId := range ids {
+			record.Secrets = append(record.Secrets, auditSecret{SecretId: secretId, Cached: true, Success: true})
+		}
+
+		for i, secret := range record.Secrets {
+			record.Secrets[i].Arn = a.result.ARNs[secret.SecretId]
+			record.Secrets[i].VersionId = a.result.Versions[secret.SecretId]
+		}
+	}
+
+	a.secrets, a.result = nil, nil
+
+	if err := writeAudit(destination, record); err != nil {
+		warnf("failed to write the audit record to %s: %s", destination, err)
+	}
+}
+
+// This function will write the record to the destination, a file is appended to so that it keeps every record
+func writeAudit(destination string, record auditRecord) error {
+	data, _ := json.Marshal(record)
+
+	switch destination {
+	case AUDIT_STDERR:
+		fmt.Fprintln(os.Stderr, string(data))
+		return nil
+	case AUDIT_EMF:
+		var fields map[string]interface{}
+		json.Unmarshal(data, &fields)
+
+		writeEmf(os.Stderr, metricsNamespace, time.Now().UnixMilli(), []string{}, fields,
+			map[string]float64{"AuditedSecrets": float64(len(record.Secrets))})
+		return nil
+	}
+
+	file, err := os.OpenFile(destination, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(file, string(data)+"\n")
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
@@ -0,0 +1,441 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// This code is used to split the command line into a subcommand, such as retrieve or exec, and its
+// flags, while the legacy form without a subcommand keeps working as it always has.  The subcommands are
+// parsed with the standard flag package rather than a CLI framework, since a framework parses its own
+// command line and would reject the legacy form, where every flag comes before the arguments, and the
+// SECRET_ENV_ variables that fill in the flags of flag.CommandLine.
+//
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go-retrieve-secret/pkg/secretenv"
+)
+
+// The subcommands, the legacy command line without one is the same as retrieve
+const COMMAND_RETRIEVE = "retrieve"
+const COMMAND_EXEC = "exec"
+const COMMAND_SERVE = "serve"
+const COMMAND_VALIDATE = "validate"
+const COMMAND_DIFF = "diff"
+const COMMAND_PUSH = "push"
+const COMMAND_VERSION = "version"
+const COMMAND_HELP = "help"
+
+// A subcommand along with the flags that only it accepts, the flags that are not listed by any command,
+// such as -s and -r, are accepted by every command
+type command struct {
+	name        string
+	usage       string
+	description string
+	flags       []string
+}
+
+// The subcommand given on the command line, empty for the legacy command line
+var commandName string
+
+// The subcommands in the order they are listed by help
+var commands = []command{
+	{COMMAND_RETRIEVE, "retrieve [flags]", "Retrieve the secrets and write them to stdout or the -out file in the -f format",
+		[]string{"f", "format", "print0", "out", "out-mode", "template", "dry-run", "show-sources", "diff-against", "diff-env", "apply", "split-overflow", "env-size-limit",
+			"write-manifest", "summary", "gen-iam-policy", "print-policy", "extension", "extension-name", "port", "rotation-check", "refresh-notify", "exec"}},
+	{COMMAND_EXEC, "exec [flags] -- COMMAND [ARGS...]", "Retrieve the secrets and run the command with them added to its environment, " +
+		"SIGHUP retrieves them again",
+		[]string{"write-manifest", "on-refresh", "max-age", "on-expire", "expire-signal", "out", "out-mode", "f", "format", "print0"}},
+	{COMMAND_SERVE, "serve [flags]", "Retrieve the secrets and serve them over a Unix domain socket or localhost HTTP until stopped",
+		[]string{"listen", "serve-token", "grpc-listen", "grpc-cert", "grpc-key", "grpc-client-ca", "rotation-check", "refresh-notify", "out", "out-mode", "f", "format", "print0", "write-manifest"}},
+	{COMMAND_VALIDATE, "validate [flags]", "Retrieve the secrets and check them with -require without writing any values",
+		nil},
+	{COMMAND_DIFF, "diff [flags] [FILE]", "Print the keys that changed between FILE, or the environment when there is no FILE, and the secrets, " +
+		"-apply then overwrites FILE",
+		[]string{"apply", "f", "format", "out-mode"}},
+	{COMMAND_PUSH, "push [flags] -function NAME -allow KEYS", "Retrieve the secrets and write the allowed keys into the environment of a Lambda function, " +
+		"the changes are only printed unless -yes is supplied",
+		[]string{"function", "allow", "yes"}},
+	{COMMAND_VERSION, "version [flags]", "Print the version, the commit and date it was built from, and the versions of Go and the AWS SDK, " +
+		"-check-update then reports whether a newer release was published",
+		[]string{"check-update", "releases-url"}},
+}
+
+// This function will return the subcommand named, nil when there is none
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+
+	return nil
+}
+
+// This function will determine if the flag is accepted by the subcommand.  Every flag is accepted by the
+// legacy command line.
+func (c *command) accepts(name string) bool {
+	if c == nil {
+		return true
+	}
+
+	for _, cmd := range commands {
+		for _, flagName := range cmd.flags {
+			if flagName != name {
+				continue
+			}
+
+			// The flag belongs to at least one command, so it must belong to this one
+			for _, own := range c.flags {
+				if own == name {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	return true
+}
+
+// This function will split the subcommand from the rest of the arguments.  Anything that is not the name of
+// a subcommand, such as a flag, is the legacy command line.
+func splitCommand(args []string) (string, []string, error) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return "", args, nil
+	}
+
+	if args[0] == COMMAND_HELP {
+		printHelp(args[1:])
+		os.Exit(0)
+	}
+
+	if findCommand(args[0]) == nil {
+		return "", nil, usageError("Unknown command %s, run %s help to list the commands", args[0], programName())
+	}
+
+	return args[0], args[1:], nil
+}
+
+// This function will return the name the program was run as
+func programName() string {
+	return filepath.Base(os.Args[0])
+}
+
+// This function will print the commands, or the usage and flags of a single command
+func printHelp(args []string) {
+	if len(args) > 0 {
+		if cmd := findCommand(args[0]); cmd != nil {
+			commandUsage(cmd)()
+			return
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Usage: %s COMMAND [flags]\n\nCommands:\n", programName())
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", cmd.name, cmd.description)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun %s help COMMAND for the flags of a command.  Without a command the flags of every command are accepted, the same as retrieve.\n", programName())
+	fmt.Fprintf(os.Stderr, "Each flag may also be set with a %s variable, such as %sSECRET_IDS for -s or %sCACHE_FILE for -cache-file, the command line takes precedence.\n",
+		FLAG_ENV_PREFIX, FLAG_ENV_PREFIX, FLAG_ENV_PREFIX)
+}
+
+// This function will return the usage function of the command, it prints the flags that the command accepts
+// in the same form as flag.PrintDefaults
+func commandUsage(cmd *command) func() {
+	return func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s\n\n%s\n\nFlags:\n", programName(), cmd.usage, cmd.description)
+
+		flags := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+		flags.SetOutput(os.Stderr)
+
+		flag.VisitAll(func(f *flag.Flag) {
+			if cmd.accepts(f.Name) {
+				flags.Var(f.Value, f.Name, f.Usage)
+				flags.Lookup(f.Name).DefValue = f.DefValue
+			}
+		})
+
+		flags.PrintDefaults()
+	}
+}
+
+// This function will check that only the flags of the command were supplied and apply the positional
+// arguments of the command
+func applyCommand(cmd *command) error {
+	var rejected []string
+	flag.Visit(func(f *flag.Flag) {
+		if !cmd.accepts(f.Name) {
+			rejected = append(rejected, "-"+f.Name)
+		}
+	})
+
+	if len(rejected) > 0 {
+		return usageError("The %s command does not accept %s, run %s help %s for its flags", cmd.name, strings.Join(rejected, ", "), programName(), cmd.name)
+	}
+
+	switch cmd.name {
+	case COMMAND_RETRIEVE:
+		if flag.NArg() > 0 && !execInPlace {
+			return usageError("Unexpected arguments for the %s command: %s", cmd.name, strings.Join(flag.Args(), " "))
+		}
+	case COMMAND_EXEC:
+		if flag.NArg() == 0 {
+			return usageError("The exec command requires the command to run, e.g. %s exec -s prod/db -- node index.js", programName())
+		}
+	case COMMAND_DIFF:
+		if flag.NArg() > 1 {
+			return usageError("The diff command compares against a single file, e.g. %s diff -s prod/db .env", programName())
+		} else if flag.NArg() == 1 {
+			diffAgainst = flag.Arg(0)
+		} else {
+			diffEnv = true
+		}
+	default:
+		if flag.NArg() > 0 {
+			return usageError("Unexpected arguments for the %s command: %s", cmd.name, strings.Join(flag.Args(), " "))
+		}
+	}
+
+	serveMode = cmd.name == COMMAND_SERVE
+	return nil
+}
+
+// This function will run the command of exec with the values added to the environment of this process,
+// replacing any variables with the same names.  Interrupts are passed on to the command, and a command
+// that fails is reported with its own exit code.  SIGHUP retrieves the secrets again with reload and then,
+// depending on -on-refresh, passes SIGHUP on or restarts the command with the new values.
+func execCommand(values map[string]string, reload func() (map[string]string, error)) error {
+	args := flag.Args()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, stopSignals...)
+	if hangupSignal != nil {
+		signal.Notify(signals, hangupSignal)
+	}
+	defer signal.Stop(signals)
+
+	for {
+		child, err := startChild(args, values)
+
+		if err != nil {
+			return configError("Failed to run %s: %w", args[0], err)
+		}
+
+		done := make(chan error, 1)
+		go func() {
+			done <- child.Wait()
+		}()
+
+		if values, err = superviseChild(child, done, signals, values, reload); err != nil {
+			return childError(args[0], err)
+		} else if values == nil {
+			return nil
+		}
+	}
+}
+
+// This function will replace this process with the command of -exec, with the values added to its
+// environment, so that the command keeps the process id of this one and receives its signals directly as an
+// AWS_LAMBDA_EXEC_WRAPPER or container ENTRYPOINT needs.  flush is called right before, since nothing runs
+// after the process is replaced.  Windows cannot replace a process, so the command is run as exec runs it.
+func replaceCommand(values map[string]string, reload func() (map[string]string, error), flush func()) error {
+	args := flag.Args()
+
+	if !canReplaceProcess {
+		return execCommand(values, reload)
+	}
+
+	path, err := exec.LookPath(args[0])
+
+	if err != nil {
+		return configError("Failed to run %s: %w", args[0], err)
+	}
+
+	debugf("event=exec path=%q keys=%d", path, len(values))
+	flush()
+
+	// The metrics and audit log of the run were already written, so a failure is reported without them
+	err = replaceProcess(path, args, childEnvironment(values))
+	err = configError("Failed to run %s: %w", args[0], err)
+
+	code := ExitCode(err)
+	logExit(err, code)
+	os.Exit(code)
+	return nil
+}
+
+// This function will start the command with the values added to its environment
+func startChild(args []string, values map[string]string) (*exec.Cmd, error) {
+	child := exec.Command(args[0], args[1:]...)
+	child.Stdin, child.Stdout, child.Stderr = os.Stdin, os.Stdout, os.Stderr
+	child.Env = childEnvironment(values)
+
+	return child, child.Start()
+}
+
+// This function will return the environment of this process with the values added, replacing any variables
+// with the same names.  They are left out rather than overridden since a replaced process sees every copy.
+func childEnvironment(values map[string]string) []string {
+	env := make([]string, 0, len(values))
+	for _, variable := range os.Environ() {
+		if _, replaced := values[strings.SplitN(variable, "=", 2)[0]]; !replaced {
+			env = append(env, variable)
+		}
+	}
+
+	for _, key := range secretenv.SortedKeys(values) {
+		env = append(env, key+"="+values[key])
+	}
+
+	return env
+}
+
+// This function will pass the signals on to the child until it exits, returning the error it exited with.
+// When the child was stopped to restart it with refreshed values those values are returned instead.  With
+// -max-age the secrets are retrieved again once they are that old, and the child is stopped with an error
+// when -on-expire is exit or the secrets cannot be retrieved, so it never runs on stale secrets.
+func superviseChild(child *exec.Cmd, done chan error, signals chan os.Signal, values map[string]string, reload func() (map[string]string, error)) (map[string]string, error) {
+	// The lease of the secrets starts again whenever they are refreshed, without -max-age it never runs out
+	var expired <-chan time.Time
+	renewLease := func() {}
+
+	if maxAge > 0 {
+		lease := time.NewTimer(maxAge)
+		defer lease.Stop()
+
+		expired = lease.C
+		renewLease = func() {
+			if !lease.Stop() {
+				select {
+				case <-lease.C:
+				default:
+				}
+			}
+			lease.Reset(maxAge)
+		}
+	}
+
+	for {
+		select {
+		case err := <-done:
+			return nil, err
+		case <-expired:
+			refreshed, restart, err := expireChild(child, done, values, reload)
+
+			if err != nil {
+				return nil, err
+			} else if restart {
+				return refreshed, nil
+			}
+
+			values = refreshed
+			renewLease()
+		case sig := <-signals:
+			if sig != hangupSignal {
+				forwardSignal(child.Process, sig)
+				continue
+			}
+
+			refreshed, err := reload()
+
+			if err != nil {
+				warnf("failed to refresh the secrets, %s keeps the previous values: %s", child.Path, err)
+				continue
+			}
+
+			renewLease()
+
+			// A restart is skipped when the refresh changed nothing
+			if onRefresh == ON_REFRESH_RESTART && secretenv.Checksum(refreshed) == secretenv.Checksum(values) {
+				debugf("event=restart_skipped reason=%q", "the secrets did not change")
+				continue
+			}
+
+			switch onRefresh {
+			case ON_REFRESH_SIGNAL:
+				forwardSignal(child.Process, sig)
+			case ON_REFRESH_RESTART:
+				stopChild(child, done)
+				return refreshed, nil
+			}
+
+			values = refreshed
+		}
+	}
+}
+
+// This function will retrieve the secrets again when their -max-age ran out and apply the -on-expire.  The
+// child is stopped and an error returned with exit, or when the secrets cannot be retrieved.  Otherwise the
+// refreshed values are returned along with whether the child was stopped to restart it, a child is left
+// running when the secrets did not change.
+func expireChild(child *exec.Cmd, done chan error, values map[string]string, reload func() (map[string]string, error)) (map[string]string, bool, error) {
+	debugf("event=lease_expired max_age=%s on_expire=%q", maxAge, onExpire)
+
+	if onExpire == ON_EXPIRE_EXIT {
+		stopChild(child, done)
+		return nil, false, &exitError{code: EXIT_EXPIRED, err: fmt.Errorf("the secrets of %s are older than the -max-age of %s", child.Path, maxAge)}
+	}
+
+	refreshed, err := reload()
+
+	if err != nil {
+		stopChild(child, done)
+		return nil, false, &exitError{code: EXIT_EXPIRED, err: fmt.Errorf("the secrets of %s are older than the -max-age of %s and could not be refreshed: %w", child.Path, maxAge, err)}
+	}
+
+	if secretenv.Checksum(refreshed) == secretenv.Checksum(values) {
+		debugf("event=lease_renewed reason=%q", "the secrets did not change")
+		return refreshed, false, nil
+	}
+
+	if onExpire == ON_EXPIRE_SIGNAL {
+		forwardSignal(child.Process, namedSignals[strings.TrimPrefix(strings.ToUpper(expireSignal), "SIG")])
+		return refreshed, false, nil
+	}
+
+	stopChild(child, done)
+	return refreshed, true, nil
+}
+
+// This function will stop the child with SIGTERM, killing it when it has not exited in time or on Windows
+func stopChild(child *exec.Cmd, done chan error) {
+	terminateProcess(child.Process)
+
+	select {
+	case <-done:
+	case <-time.After(SERVE_SHUTDOWN_TIMEOUT):
+		child.Process.Kill()
+		<-done
+	}
+}
+
+// This function will return the error reported for a child that exited, a command that failed exits with
+// its own exit code
+func childError(name string, err error) error {
+	// The child was stopped because its secrets expired
+	var expiredErr *exitError
+	if errors.As(err, &expiredErr) {
+		return err
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		// A shell reports a command killed by a signal with 128 plus the signal, ExitCode() is -1
+		if sig, killed := killedBy(exitErr.ProcessState); killed {
+			return &exitError{code: 128 + int(sig), err: fmt.Errorf("%s was killed by signal %d (%s)", name, int(sig), sig)}
+		}
+
+		return &exitError{code: exitErr.ExitCode(), err: fmt.Errorf("%s exited with code %d", name, exitErr.ExitCode())}
+	}
+
+	return configError("Failed to run %s: %w", name, err)
+}
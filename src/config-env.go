@@ -0,0 +1,84 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// This code is used to read the flags from SECRET_ENV_ environment variables so that a Lambda
+// layer or a generic wrapper script can run the binary without any arguments.
+//
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// The prefix of the environment variables that set flags
+const FLAG_ENV_PREFIX = "SECRET_ENV_"
+
+// The names of the environment variables for the flags whose names are a single letter, any other flag is
+// set by its name in upper case with - replaced by _, such as SECRET_ENV_CACHE_FILE for -cache-file
+var flagEnvAliases = map[string]string{
+	"SECRET_IDS":   "s",
+	"PARAMETERS":   "p",
+	"REGION":       "r",
+	"ROLE_ARN":     "a",
+	"EXTERNAL_ID":  "e",
+	"SESSION_NAME": "n",
+	"TIMEOUT":      "t",
+	"FORMAT":       "f",
+	"VERBOSE":      "v",
+}
+
+// This function will set each flag that was not supplied on the command line from its SECRET_ENV_
+// environment variable, e.g. SECRET_ENV_SECRET_IDS=DB=prod/db,prod/api for -s.  The flags that the command
+// does not accept are left alone since the variables are usually set for every run of the function.
+// They are read before the config file so that a variable wins over the file.
+func readFlagEnvironment(cmd *command) error {
+	supplied := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		supplied[f.Name] = true
+	})
+
+	var names []string
+	for _, entry := range os.Environ() {
+		if name := strings.SplitN(entry, "=", 2)[0]; strings.HasPrefix(name, FLAG_ENV_PREFIX) {
+			names = append(names, name)
+		}
+	}
+
+	// The flags are set in a fixed order so that errors are reported the same way on every run
+	sort.Strings(names)
+
+	for _, name := range names {
+		flagName := flagEnvName(strings.TrimPrefix(name, FLAG_ENV_PREFIX))
+		f := flag.Lookup(flagName)
+
+		if f == nil {
+			return fmt.Errorf("%s does not set a supported flag", name)
+		}
+
+		value := os.Getenv(name)
+
+		if supplied[flagName] || !cmd.accepts(flagName) || len(strings.TrimSpace(value)) == 0 {
+			continue
+		}
+
+		if err := flag.Set(flagName, value); err != nil {
+			return fmt.Errorf("invalid value for %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// This function will return the name of the flag set by the environment variable without its prefix
+func flagEnvName(name string) string {
+	if alias, ok := flagEnvAliases[name]; ok {
+		return alias
+	}
+
+	return strings.ReplaceAll(strings.ToLower(name), "_", "-")
+}
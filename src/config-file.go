@@ -0,0 +1,100 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// This code is used to read the command line flags from a JSON config file so that a Lambda
+// layer can ship its secrets and output settings alongside the binary.
+//
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// This function will read a JSON object from the file whose keys are the names of the flags, e.g.
+//
+//	{"r": "us-east-1", "s": ["DB=prod/db", "prod/api"], "f": "dotenv", "uppercase": true}
+//
+// and set each flag that was not supplied on the command line, so the command line always wins.  A
+// list sets a repeatable flag, such as -s or -p, once for each of its values.
+func readConfigFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return err
+	}
+
+	var settings map[string]interface{}
+
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.UseNumber()
+
+	if err := decoder.Decode(&settings); err != nil {
+		return fmt.Errorf("the file is not a JSON object: %w", err)
+	}
+
+	// The flags supplied on the command line are left as they are
+	supplied := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		supplied[f.Name] = true
+	})
+
+	// The flags are set in a fixed order so that errors are reported the same way on every run
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := flag.Lookup(name)
+
+		if f == nil || name == "config" {
+			return fmt.Errorf("%s is not a supported flag", name)
+		}
+
+		if supplied[name] {
+			continue
+		}
+
+		values, ok := settings[name].([]interface{})
+		if !ok {
+			values = []interface{}{settings[name]}
+		}
+
+		for _, value := range values {
+			text, err := configValue(value)
+
+			if err != nil {
+				return fmt.Errorf("unsupported value for %s: %w", name, err)
+			}
+
+			if err := f.Value.Set(text); err != nil {
+				return fmt.Errorf("invalid value %q for %s: %w", text, name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// This function will return the text that a JSON value in the config file is passed to its flag as
+func configValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	}
+
+	return "", fmt.Errorf("only strings, numbers, booleans, and lists of them are supported")
+}
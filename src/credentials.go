@@ -0,0 +1,150 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// This code is used to pick where the AWS credentials come from when the default chain of the SDK
+// would pick the wrong ones, e.g. as the entrypoint of an ECS task or an EKS pod on an EC2 node.
+//
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go-v2/credentials/endpointcreds"
+)
+
+// The sources accepted by -credential-source
+const CREDENTIAL_SOURCE_DEFAULT = "default"
+const CREDENTIAL_SOURCE_ENV = "env"
+const CREDENTIAL_SOURCE_CONTAINER = "container"
+const CREDENTIAL_SOURCE_IMDS = "imds"
+
+// The endpoint of the ECS task role credentials that AWS_CONTAINER_CREDENTIALS_RELATIVE_URI is relative to
+const ECS_CREDENTIALS_ENDPOINT = "http://169.254.170.2"
+
+// The variables set by ECS for the task role and by EKS Pod Identity for the role of the pod
+const CONTAINER_RELATIVE_URI_ENV = "AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"
+const CONTAINER_FULL_URI_ENV = "AWS_CONTAINER_CREDENTIALS_FULL_URI"
+const CONTAINER_TOKEN_ENV = "AWS_CONTAINER_AUTHORIZATION_TOKEN"
+const CONTAINER_TOKEN_FILE_ENV = "AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"
+
+// The hosts of the ECS task role and EKS Pod Identity credentials, which may be called over plain HTTP
+var containerHosts = []net.IP{net.ParseIP("169.254.170.2"), net.ParseIP("169.254.170.23"), net.ParseIP("fd00:ec2::23")}
+
+// This function will return the load option that replaces the default credential chain of the SDK with the
+// -credential-source, nil for the default chain.  The default chain already uses the container credentials
+// of ECS and EKS Pod Identity when their variables are set, but it uses static keys in the environment first
+// and falls back to the instance role of the node, so a source can be named to rule the others out.
+func credentialSourceOption() (func(*config.LoadOptions) error, error) {
+	var provider aws.CredentialsProvider
+
+	switch credentialSource {
+	case CREDENTIAL_SOURCE_DEFAULT:
+		return nil, nil
+	case CREDENTIAL_SOURCE_ENV:
+		keyId, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+
+		if len(keyId) == 0 || len(secret) == 0 {
+			return nil, fmt.Errorf("-credential-source env requires AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+		}
+
+		provider = credentials.NewStaticCredentialsProvider(keyId, secret, os.Getenv("AWS_SESSION_TOKEN"))
+	case CREDENTIAL_SOURCE_CONTAINER:
+		endpoint, err := containerCredentialsEndpoint()
+
+		if err != nil {
+			return nil, err
+		}
+
+		provider = endpointcreds.New(endpoint, func(o *endpointcreds.Options) {
+			o.AuthorizationTokenProvider = endpointcreds.TokenProviderFunc(containerAuthorizationToken)
+		})
+	case CREDENTIAL_SOURCE_IMDS:
+		provider = ec2rolecreds.New()
+	}
+
+	debugf("event=credential_source source=%q", credentialSource)
+
+	return config.WithCredentialsProvider(aws.NewCredentialsCache(provider)), nil
+}
+
+// This function will return the endpoint of the container credentials, the full URI of EKS Pod Identity or
+// the path of the ECS task role.  As with the SDK, a full URI over plain HTTP must be a loopback, ECS, or EKS
+// host so that the credentials and the token are not sent over the network in the clear.
+func containerCredentialsEndpoint() (string, error) {
+	if endpoint := os.Getenv(CONTAINER_FULL_URI_ENV); len(endpoint) > 0 {
+		parsed, err := url.Parse(endpoint)
+
+		if err != nil || len(parsed.Hostname()) == 0 {
+			return "", fmt.Errorf("%s is not a URL", CONTAINER_FULL_URI_ENV)
+		}
+
+		if parsed.Scheme == "http" {
+			addresses, err := net.LookupHost(parsed.Hostname())
+
+			if err != nil {
+				return "", fmt.Errorf("Failed to resolve the host of %s: %w", CONTAINER_FULL_URI_ENV, err)
+			}
+
+			for _, address := range addresses {
+				if !containerHost(net.ParseIP(address)) {
+					return "", fmt.Errorf("The host of %s must be a loopback, ECS, or EKS host over http, %s was supplied",
+						CONTAINER_FULL_URI_ENV, parsed.Hostname())
+				}
+			}
+		}
+
+		return endpoint, nil
+	}
+
+	if path := os.Getenv(CONTAINER_RELATIVE_URI_ENV); len(path) > 0 {
+		return ECS_CREDENTIALS_ENDPOINT + path, nil
+	}
+
+	return "", fmt.Errorf("-credential-source container requires %s or %s, which ECS and EKS Pod Identity set",
+		CONTAINER_FULL_URI_ENV, CONTAINER_RELATIVE_URI_ENV)
+}
+
+// This function will determine if the credentials may be retrieved from the address over plain HTTP
+func containerHost(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	if ip.IsLoopback() {
+		return true
+	}
+
+	for _, host := range containerHosts {
+		if ip.Equal(host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// This function will return the token sent with each request for container credentials.  The token file of
+// EKS Pod Identity is read again each time since it is replaced before the token expires.
+func containerAuthorizationToken() (string, error) {
+	if path := os.Getenv(CONTAINER_TOKEN_FILE_ENV); len(path) > 0 {
+		token, err := ioutil.ReadFile(path)
+
+		if err != nil {
+			return "", fmt.Errorf("Failed to read the container authorization token: %w", err)
+		}
+
+		return strings.TrimSpace(string(token)), nil
+	}
+
+	return os.Getenv(CONTAINER_TOKEN_ENV), nil
+}
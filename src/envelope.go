@@ -0,0 +1,168 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// This code is used to write the -f json-envelope document, which holds the variables along with the
+// errors and the metadata of the retrieval, so that a program that runs this one parses a single document
+// instead of the output and the log lines on stderr.
+//
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go-retrieve-secret/pkg/secretenv"
+)
+
+// The output format that wraps the variables in an envelope with the errors and metadata of the retrieval
+const FORMAT_JSON_ENVELOPE = "json-envelope"
+
+// An error of the envelope, the secret id is left out for an error of the whole run
+type envelopeError struct {
+	SecretId  string `json:"secret_id,omitempty"`
+	Error     string `json:"error"`
+	ErrorType string `json:"error_type"`
+	ExitCode  int    `json:"exit_code"`
+}
+
+// The metadata of a secret in the envelope, Cached is set when it came from the -cache-file without an API call
+type envelopeSecret struct {
+	Arn       string  `json:"arn,omitempty"`
+	VersionId string  `json:"version_id,omitempty"`
+	Latency   float64 `json:"latency_ms"`
+	Cached    bool    `json:"cached,omitempty"`
+}
+
+// The metadata of the retrieval in the envelope
+type envelopeMetadata struct {
+	CorrelationId string                    `json:"correlation_id"`
+	Region        string                    `json:"region,omitempty"`
+	Duration      float64                   `json:"duration_ms"`
+	ExitCode      int                       `json:"exit_code"`
+	Secrets       map[string]envelopeSecret `json:"secrets"`
+}
+
+// The document written with -f json-envelope
+type envelopeDocument struct {
+	Variables json.RawMessage  `json:"variables"`
+	Errors    []envelopeError  `json:"errors"`
+	Metadata  envelopeMetadata `json:"metadata"`
+}
+
+// Collects the envelope of the run until it is written, it is safe to use from several goroutines
+type envelopeRecorder struct {
+	mutex     sync.Mutex
+	secrets   map[string]time.Duration
+	result    *secretenv.Result
+	variables string
+}
+
+// The recorder of the run, nil unless -f json-envelope was supplied
+var envelope *envelopeRecorder
+
+// This function will record how long a single secret took, it is used as the Observe function of the config
+func (e *envelopeRecorder) observe(secretId string, elapsed time.Duration, err error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.secrets[secretId] += elapsed
+}
+
+// This function will record the versions and ARNs of the secrets that were retrieved
+func (e *envelopeRecorder) observeResult(result *secretenv.Result) {
+	if e == nil {
+		return
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.result = result
+}
+
+// This function will record the variables formatted as JSON, which are written in the envelope instead of
+// the output once the run is over
+func (e *envelopeRecorder) observeOutput(options secretenv.Config, values map[string]string, raw map[string]interface{}) error {
+	variables, err := options.Format(secretenv.FORMAT_JSON, values, raw)
+
+	if err != nil {
+		return err
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.variables = strings.TrimSpace(variables)
+	return nil
+}
+
+// This function will write the envelope of the run to the -out file or stdout.  It is written when the run
+// failed as well, with no variables, so that the caller always has a document to parse.  The errors are
+// those that are logged, which never hold the values of the secrets.
+func (e *envelopeRecorder) write(elapsed time.Duration, runErr error) {
+	if e == nil {
+		return
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	document := envelopeDocument{
+		Variables: json.RawMessage("{}"),
+		Errors:    []envelopeError{},
+		Metadata: envelopeMetadata{
+			CorrelationId: requestId,
+			Region:        region,
+			Duration:      milliseconds(elapsed),
+			Secrets:       map[string]envelopeSecret{},
+		},
+	}
+
+	if len(e.variables) > 0 {
+		document.Variables = json.RawMessage(e.variables)
+	}
+
+	if runErr != nil {
+		document.Metadata.ExitCode = ExitCode(runErr)
+	}
+
+	if e.result != nil {
+		for secretId, versionId := range e.result.Versions {
+			latency, observed := e.secrets[secretId]
+
+			document.Metadata.Secrets[secretId] = envelopeSecret{
+				Arn:       e.result.ARNs[secretId],
+				VersionId: versionId,
+				Latency:   milliseconds(latency),
+				Cached:    !observed,
+			}
+		}
+
+		for secretId, err := range e.result.Errors {
+			document.Errors = append(document.Errors, envelopeError{secretId, err.Error(), errorType(err), ExitCode(err)})
+		}
+		sort.Slice(document.Errors, func(i, j int) bool { return document.Errors[i].SecretId < document.Errors[j].SecretId })
+	}
+
+	// The error of a -best-effort run only counts the skipped secrets, which are already listed
+	if runErr != nil && (e.result == nil || len(e.result.Errors) == 0) {
+		document.Errors = append(document.Errors, envelopeError{"", runErr.Error(), errorType(runErr), ExitCode(runErr)})
+	}
+
+	data, _ := json.Marshal(document)
+	data = append(data, '\n')
+
+	if len(outFile) > 0 {
+		if err := secretenv.WriteFileAtomic(outFile, data, outFileMode); err != nil {
+			warnf("failed to write the envelope to %s: %s", outFile, err)
+		}
+		return
+	}
+
+	fmt.Print(string(data))
+}
@@ -0,0 +1,167 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// This code is used to categorize failures so that the process exits with a code that tells
+// the calling script what went wrong.
+//
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+
+	"go-retrieve-secret/pkg/secretenv"
+
+	"github.com/aws/smithy-go"
+)
+
+// The exit codes used to report the category of a failure
+const EXIT_CONFIG = 1
+const EXIT_USAGE = 2
+const EXIT_ACCESS_DENIED = 3
+const EXIT_NOT_FOUND = 4
+const EXIT_PARSE = 5
+const EXIT_VALIDATION = 6
+const EXIT_PARTIAL = 7
+const EXIT_EXPIRED = 8
+
+// An error along with the exit code that reports its category
+type exitError struct {
+	code int
+	err  error
+}
+
+// Error is an implementation of the error interface
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap allows errors.As and errors.Is to inspect the underlying error
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// This function will return an error for a problem with the supplied command line arguments
+func usageError(format string, args ...interface{}) error {
+	return &exitError{code: EXIT_USAGE, err: fmt.Errorf(format, args...)}
+}
+
+// This function will return an error for a problem with the configuration or local environment
+func configError(format string, args ...interface{}) error {
+	return &exitError{code: EXIT_CONFIG, err: fmt.Errorf(format, args...)}
+}
+
+// This function will wrap an error returned by an AWS API with the supplied message, using the error
+// code returned by the API to pick the exit code
+func awsError(err error, format string, args ...interface{}) error {
+	return &exitError{code: apiExitCode(err), err: fmt.Errorf(format+": %w", append(args, err)...)}
+}
+
+// This function will return the exit code for the error code returned by an AWS API anywhere in the
+// chain of the error, errors that did not come from an AWS API are reported as configuration errors
+func apiExitCode(err error) int {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "AccessDenied", "AccessDeniedException", "DecryptionFailure", "UnrecognizedClientException",
+			"InvalidClientTokenId", "ExpiredToken", "ExpiredTokenException":
+			return EXIT_ACCESS_DENIED
+		case "ResourceNotFoundException", "ParameterNotFound":
+			return EXIT_NOT_FOUND
+		}
+	}
+
+	return EXIT_CONFIG
+}
+
+// This function will return the exit code for the error.  Errors returned by the secretenv package are
+// categorized by their type or by the AWS API error they wrap, anything else that was not categorized is
+// reported as a configuration error.
+func ExitCode(err error) int {
+	var exitErr *exitError
+	if errors.As(err, &exitErr) {
+		return exitErr.code
+	}
+
+	var inputErr *secretenv.InputError
+	if errors.As(err, &inputErr) {
+		return EXIT_USAGE
+	}
+
+	var parseErr *secretenv.ParseError
+	if errors.As(err, &parseErr) {
+		return EXIT_PARSE
+	}
+
+	var validationErr *secretenv.ValidationError
+	if errors.As(err, &validationErr) {
+		return EXIT_VALIDATION
+	}
+
+	var sizeErr *secretenv.SizeError
+	if errors.As(err, &sizeErr) {
+		return EXIT_VALIDATION
+	}
+
+	return apiExitCode(err)
+}
+
+// A secret that could not be retrieved with -best-effort, as written to the error report
+type secretFailure struct {
+	SecretId  string `json:"secret_id"`
+	Error     string `json:"error"`
+	ErrorType string `json:"error_type"`
+	ExitCode  int    `json:"exit_code"`
+}
+
+// The error report of a -best-effort run, it lists the secrets that could not be retrieved so that the
+// application can decide whether it can run without them
+type errorReport struct {
+	CorrelationId string          `json:"correlation_id"`
+	Retrieved     []string        `json:"retrieved"`
+	Failed        []secretFailure `json:"failed"`
+}
+
+// This function will write the error report of the result.  The report is always written to the
+// -error-report file so that the file never describes an earlier run, and is only written to stderr,
+// as a single line, when a secret could not be retrieved.
+func writeErrorReport(path string, result *secretenv.Result) error {
+	report := errorReport{CorrelationId: requestId, Retrieved: []string{}, Failed: []secretFailure{}}
+
+	for secretId := range result.Versions {
+		report.Retrieved = append(report.Retrieved, secretId)
+	}
+	sort.Strings(report.Retrieved)
+
+	for secretId, err := range result.Errors {
+		report.Failed = append(report.Failed, secretFailure{secretId, err.Error(), errorType(err), ExitCode(err)})
+	}
+	sort.Slice(report.Failed, func(i, j int) bool { return report.Failed[i].SecretId < report.Failed[j].SecretId })
+
+	if len(path) == 0 {
+		if len(report.Failed) == 0 {
+			return nil
+		}
+
+		data, _ := json.Marshal(report)
+		fmt.Fprintln(os.Stderr, string(data))
+		return nil
+	}
+
+	data, _ := json.MarshalIndent(report, "", "    ")
+	return secretenv.WriteFileAtomic(path, append(data, '\n'), 0644)
+}
+
+// This function will return the error reported when a -best-effort run skipped secrets, the output has
+// already been written so the exit code only tells the caller that some of the secrets are missing
+func partialError(result *secretenv.Result) error {
+	if len(result.Errors) == 0 {
+		return nil
+	}
+
+	return &exitError{code: EXIT_PARTIAL, err: fmt.Errorf("%d of the %d secrets could not be retrieved and were skipped", len(result.Errors), len(result.Errors)+len(result.Versions))}
+}
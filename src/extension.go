@@ -0,0 +1,455 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// This code is used to run as an external Lambda extension which retrieves the secrets during
+// init and serves them to the function over a localhost HTTP endpoint, retrieving them again
+// when they are rotated.
+//
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go-retrieve-secret/pkg/secretenv"
+)
+
+// The default port of the local endpoint, the same as the AWS Parameters and Secrets Lambda Extension
+const DEFAULT_EXTENSION_PORT = 2773
+
+// The version of the Lambda Extensions API
+const EXTENSION_API_VERSION = "2020-01-01"
+
+// The header carrying the id that Lambda assigns to the extension when it registers
+const EXTENSION_ID_HEADER = "Lambda-Extension-Identifier"
+
+// The header that requests to the local endpoint must carry the function's session token in
+const EXTENSION_TOKEN_HEADER = "X-Aws-Parameters-Secrets-Token"
+
+// The values served by the extension and by serve, they are replaced when the secrets are rotated
+type extensionState struct {
+	mutex    sync.RWMutex
+	result   *secretenv.Result
+	values   map[string]string
+	raw      map[string]interface{}
+	sources  map[string]string
+	document string
+	checksum string
+
+	// Closed when the served values change, so that the gRPC subscribers are told of each change
+	changed chan struct{}
+
+	// Held while the secrets are refreshed so that only one refresh runs at a time
+	refreshing sync.Mutex
+}
+
+// Retrieves the secrets again and replaces the served values, when force is not set only if at least one
+// of the secrets was rotated
+type refreshFunc func(state *extensionState, force bool) error
+
+// This function will call refresh unless another refresh is still running, reporting whether it was called
+func (s *extensionState) tryRefresh(refresh refreshFunc, force bool) (bool, error) {
+	if !s.refreshing.TryLock() {
+		return false, nil
+	}
+	defer s.refreshing.Unlock()
+
+	return true, refresh(s, force)
+}
+
+// This function will replace the served values with the rendered values of the result
+func (s *extensionState) update(options secretenv.Config, result *secretenv.Result, values map[string]string, raw map[string]interface{}, sources map[string]string) error {
+	document, err := options.Format(secretenv.FORMAT_JSON, values, raw)
+
+	if err != nil {
+		return configError("Failed to format the output: %w", err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	checksum := secretenv.Checksum(values)
+
+	if checksum != s.checksum && s.changed != nil {
+		close(s.changed)
+		s.changed = nil
+	}
+
+	s.result, s.values, s.raw, s.sources, s.document = result, values, raw, sources, document
+	s.checksum = checksum
+	return nil
+}
+
+// This function will return the served values and a channel that is closed the next time they change
+func (s *extensionState) watch() (map[string]string, string, <-chan struct{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.changed == nil {
+		s.changed = make(chan struct{})
+	}
+
+	return s.values, s.checksum, s.changed
+}
+
+// This function will set the ETag of a response to the checksum of the served values and report whether the
+// client already has them, a request whose If-None-Match is the ETag is answered with 304 Not Modified
+func (s *extensionState) notModified(w http.ResponseWriter, r *http.Request) bool {
+	s.mutex.RLock()
+	etag := `"` + s.checksum + `"`
+	s.mutex.RUnlock()
+
+	w.Header().Set("ETag", etag)
+
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+
+	return false
+}
+
+// This function will return the served values in one of the output formats
+func (s *extensionState) format(options secretenv.Config, format string) (string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return options.Format(format, s.values, s.raw)
+}
+
+// This function will return the served values of the keys that came from the secret, nil when no key did
+func (s *extensionState) secret(secretId string) map[string]string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var values map[string]string
+	for key, source := range s.sources {
+		if value, ok := s.values[key]; ok && source == secretId {
+			if values == nil {
+				values = map[string]string{}
+			}
+			values[key] = value
+		}
+	}
+
+	return values
+}
+
+// This function will return the values that are currently served
+func (s *extensionState) get() (*secretenv.Result, map[string]string, string) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.result, s.values, s.document
+}
+
+// An event returned by the Extensions API
+type extensionEvent struct {
+	EventType string `json:"eventType"`
+}
+
+// This function will register with the Lambda Extensions API, serve the values on the loopback interface,
+// and wait for events until Lambda sends SHUTDOWN.  The values are only held in memory unless -out is set.  When -rotation-check
+// is set the secrets are checked for rotation on the first invoke after each interval, in the background so
+// the invoke is not delayed, and refresh is called to replace the values.
+//
+// Lambda runs every file in /opt/extensions without arguments, so the layer should contain a script in
+// /opt/extensions that runs this binary with -extension and the other options.  -extension-name must be
+// the name of that script.
+func RunExtension(state *extensionState, refresh refreshFunc) error {
+	runtimeApi := os.Getenv("AWS_LAMBDA_RUNTIME_API")
+
+	if len(runtimeApi) == 0 {
+		return configError("AWS_LAMBDA_RUNTIME_API is not set, -extension can only be used within Lambda")
+	}
+
+	baseUrl := "http://" + runtimeApi + "/" + EXTENSION_API_VERSION + "/extension"
+
+	extensionId, err := registerExtension(baseUrl)
+
+	if err != nil {
+		return configError("Failed to register the extension: %w", err)
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(extensionPort)))
+
+	if err != nil {
+		return configError("Failed to listen on port %d: %w", extensionPort, err)
+	}
+
+	go http.Serve(listener, secretsHandler(state, os.Getenv("AWS_SESSION_TOKEN"), refresh))
+
+	_, values, _ := state.get()
+	debugf("event=extension_registered port=%d keys=%d", extensionPort, len(values))
+
+	go refreshOnHangup(state, refresh)
+
+	lastCheck := time.Now()
+
+	// Each call blocks until the next invoke or the shutdown of the execution environment
+	for {
+		event, err := nextExtensionEvent(baseUrl, extensionId)
+
+		if err != nil {
+			return configError("Failed to get the next extension event: %w", err)
+		}
+
+		if event.EventType == "SHUTDOWN" {
+			listener.Close()
+			return nil
+		}
+
+		// Lambda freezes the extension between invokes, so the interval is checked when an invoke arrives
+		// instead of with a timer.  A check that is still running is not started again.
+		if rotationCheck > 0 && time.Since(lastCheck) >= rotationCheck {
+			lastCheck = time.Now()
+
+			go func() {
+				if _, err := state.tryRefresh(refresh, false); err != nil {
+					warnf("failed to refresh the rotated secrets, the previous values are still served: %s", err)
+				}
+			}()
+		}
+	}
+}
+
+// This function will check the served secrets for rotation and, when any were rotated or force is set,
+// retrieve the secrets again and serve the new values.  The -out file is replaced with them too.  When
+// -refresh-notify is set the time of the refresh is then written to that file so that the function can tell
+// that new values are available.
+func refreshRotated(retriever *secretenv.Retriever, options secretenv.Config, state *extensionState, force bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout))
+	defer cancel()
+
+	if !force {
+		current, _, _ := state.get()
+		rotated, err := retriever.Rotated(ctx, current)
+
+		if err != nil {
+			return err
+		}
+
+		debugf("event=rotation_check rotated=%d", len(rotated))
+
+		if len(rotated) == 0 {
+			return nil
+		}
+	}
+
+	start := time.Now()
+	result, err := retriever.Refresh(ctx)
+
+	audit.observeResult(result)
+	audit.write(auditLog, time.Since(start), err)
+
+	if err != nil {
+		return err
+	}
+
+	rendered, dat, sources, err := renderResult(options, result)
+
+	if err != nil {
+		return err
+	}
+
+	if err := writeSensitiveManifest(rendered); err != nil {
+		return err
+	}
+
+	if err := addMetadata(ctx, retriever, rendered); err != nil {
+		return err
+	}
+
+	if err := addChecksum(rendered); err != nil {
+		return err
+	}
+
+	// The versions are still replaced when the values did not change, e.g. a rotation to the same password,
+	// so that the next check compares against them, but nothing is rewritten or notified
+	_, previous, _ := state.get()
+	unchanged := secretenv.Checksum(previous) == secretenv.Checksum(rendered)
+
+	if err := state.update(options, result, rendered, dat, sources); err != nil {
+		return err
+	}
+
+	if unchanged {
+		debugf("event=refresh_unchanged forced=%t keys=%d", force, len(rendered))
+		return nil
+	}
+
+	if len(outFile) > 0 {
+		if err := WriteOutputFile(options, outFile, rendered, dat); err != nil {
+			return fmt.Errorf("Failed to write %s: %w", outFile, err)
+		}
+	}
+
+	debugf("event=secrets_refreshed forced=%t keys=%d", force, len(rendered))
+
+	if len(refreshNotify) > 0 {
+		stamp := []byte(time.Now().UTC().Format(time.RFC3339) + "\n")
+
+		if err := secretenv.WriteFileAtomic(refreshNotify, stamp, 0644); err != nil {
+			return fmt.Errorf("Failed to write %s: %w", refreshNotify, err)
+		}
+	}
+
+	return nil
+}
+
+// This function will retrieve the secrets again each time the process receives SIGHUP, whether or not they
+// were rotated.  A SIGHUP that arrives during a refresh is ignored.  Windows has no SIGHUP, so nothing is done.
+func refreshOnHangup(state *extensionState, refresh refreshFunc) {
+	if hangupSignal == nil {
+		return
+	}
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, hangupSignal)
+
+	for range hangup {
+		if started, err := state.tryRefresh(refresh, true); !started {
+			debugf("event=refresh_skipped reason=%q", "a refresh is already running")
+		} else if err != nil {
+			warnf("failed to refresh the secrets, the previous values are still served: %s", err)
+		}
+	}
+}
+
+// This function will refresh the secrets for a POST /refresh request, the response never holds any values
+func serveRefresh(w http.ResponseWriter, state *extensionState, refresh refreshFunc) {
+	started, err := state.tryRefresh(refresh, true)
+
+	switch {
+	case !started:
+		http.Error(w, "a refresh is already running", http.StatusConflict)
+	case err != nil:
+		warnf("failed to refresh the secrets, the previous values are still served: %s", err)
+		http.Error(w, "failed to refresh the secrets", http.StatusInternalServerError)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// This function will register the extension for the INVOKE and SHUTDOWN events and return the id that
+// Lambda assigned to it
+func registerExtension(baseUrl string) (string, error) {
+	body := bytes.NewBufferString(`{"events":["INVOKE","SHUTDOWN"]}`)
+	request, err := http.NewRequest(http.MethodPost, baseUrl+"/register", body)
+
+	if err != nil {
+		return "", err
+	}
+
+	request.Header.Set("Lambda-Extension-Name", extensionName)
+
+	response, err := http.DefaultClient.Do(request)
+
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("register returned status %s", response.Status)
+	}
+
+	return response.Header.Get(EXTENSION_ID_HEADER), nil
+}
+
+// This function will wait for the next event from the Extensions API
+func nextExtensionEvent(baseUrl string, extensionId string) (*extensionEvent, error) {
+	request, err := http.NewRequestWithContext(context.Background(), http.MethodGet, baseUrl+"/event/next", nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	request.Header.Set(EXTENSION_ID_HEADER, extensionId)
+
+	response, err := http.DefaultClient.Do(request)
+
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	data, err := ioutil.ReadAll(response.Body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("event/next returned status %s", response.Status)
+	}
+
+	var event extensionEvent
+
+	if err := json.Unmarshal(data, &event); err != nil {
+		return nil, err
+	}
+
+	return &event, nil
+}
+
+// This function will return the handler for the local endpoint.  GET /secrets returns every value as a JSON
+// object, GET /secrets/KEY returns the value of a single key as text, and POST /refresh retrieves the
+// secrets again, e.g. after the function was told of a rotation.  When the function has a session
+// token each request must carry it in the X-Aws-Parameters-Secrets-Token header, so that only the function
+// and not any other process that can reach the port can read the secrets.
+func secretsHandler(state *extensionState, token string, refresh refreshFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(token) > 0 && subtle.ConstantTimeCompare([]byte(r.Header.Get(EXTENSION_TOKEN_HEADER)), []byte(token)) != 1 {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		if r.URL.Path == "/refresh" && r.Method == http.MethodPost {
+			serveRefresh(w, state, refresh)
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		_, values, document := state.get()
+
+		switch {
+		case r.URL.Path == "/secrets":
+			if state.notModified(w, r) {
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, document)
+		case strings.HasPrefix(r.URL.Path, "/secrets/"):
+			value, ok := values[strings.TrimPrefix(r.URL.Path, "/secrets/")]
+
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			fmt.Fprint(w, value)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
@@ -8,137 +8,2491 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	"encoding/json"
+	"go-retrieve-secret/pkg/secretenv"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/credentials"
-	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
-	"github.com/aws/aws-sdk-go-v2/service/sts"
-
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
 	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/aws/smithy-go/middleware"
+	"golang.org/x/net/http/httpproxy"
 )
 
 // Constants for default values if none are supplied
 const DEFAULT_TIMEOUT = 5000
-const DEFAULT_REGION = "us-east-2"
 const DEFAULT_SESSION = "param_session"
 
+// The orders accepted by -order, sorted by key or grouped by the source each key came from in the order the
+// sources were supplied
+const ORDER_SORTED = "sorted"
+const ORDER_SOURCE = "source"
+
+// What exec does with the command when SIGHUP refreshes the secrets, see -on-refresh
+const ON_REFRESH_NONE = "none"
+const ON_REFRESH_SIGNAL = "signal"
+const ON_REFRESH_RESTART = "restart"
+
+// What exec does when the -max-age of the secrets runs out
+const ON_EXPIRE_RESTART = "restart"
+const ON_EXPIRE_SIGNAL = "signal"
+const ON_EXPIRE_EXIT = "exit"
+
+// The backends accepted by -backend, Secrets Manager or a local JSON file of secrets for testing
+const BACKEND_AWS = "aws"
+const BACKEND_FILE = "file"
+const DEFAULT_RETRIES = 3
+const DEFAULT_RETRY_MODE = RETRY_MODE_STANDARD
+
+// The supported retry modes.  Standard backs off exponentially between attempts, adaptive also slows the
+// calls down when they are throttled.
+const RETRY_MODE_STANDARD = "standard"
+const RETRY_MODE_ADAPTIVE = "adaptive"
+const DEFAULT_CONCURRENCY = 8
+const DEFAULT_FORMAT = secretenv.FORMAT_PIPE
+const DEFAULT_ARRAY_MODE = secretenv.ARRAY_MODE_JSON
+
+// Keys defined by more than one secret take the value of the secret supplied last
+const DEFAULT_MERGE_STRATEGY = secretenv.MERGE_LAST_WINS
+
+// The default separator placed between the parts of a flattened key
+const DEFAULT_SEPARATOR = "_"
+
+// Lambda limits the total size of all environment variables to 4 KB
+const DEFAULT_ENV_SIZE_LIMIT = 4096
+
+// The files written with -out hold the secret values, so by default only the owner can read them
+const DEFAULT_OUT_MODE = "0600"
+
 var (
-	region      string
-	secretArn   string
-	roleArn     string
-	timeout     int
-	sessionName string
+	region           string
+	secretIds        secretIdList
+	secretIdsStdin   bool
+	parameters       parameterList
+	ciphertexts      ciphertextList
+	objects          objectList
+	appConfigs       appConfigList
+	schemeSources    sourceList
+	vaultOptions     secretenv.VaultOptions
+	roleArn          string
+	timeout          = timeoutFlag(DEFAULT_TIMEOUT * time.Millisecond)
+	sessionName      string
+	manifest         string
+	metadata         string
+	metadataFields   []string
+	metadataFile     string
+	newManifest      string
+	summary          bool
+	checkUpdate      bool
+	diffAgainst      string
+	apply            bool
+	diffEnv          bool
+	format           string
+	requestId        string
+	arrayMode        string
+	strictRegion     bool
+	genPolicy        bool
+	envSizeLimit     int
+	splitOverflow    string
+	printPolicy      bool
+	coalesce         coalesceList
+	renames          renameList
+	required         requireList
+	failCollision    bool
+	mergeStrategy    string
+	uppercaseKeys    bool
+	sanitizeKeys     bool
+	stripPrefix      string
+	flatten          bool
+	separator        string
+	retries          int
+	retryMode        string
+	rateLimit        float64
+	rateBurst        int
+	attemptTime      time.Duration
+	callTimeout      time.Duration
+	concurrency      int
+	kmsConcurrency   int
+	endpoint         string
+	endpoints        keyValueMap
+	profile          string
+	externalId       string
+	roleDuration     int
+	secretIdFile     string
+	include          string
+	exclude          string
+	keyPrefix        string
+	outFile          string
+	outMode          string
+	outFileMode      os.FileMode
+	templateFile     string
+	templateText     string
+	configFile       string
+	binaryDir        string
+	verbose          bool
+	logLevel         string
+	logFormat        string
+	traceExporter    string
+	emitMetrics      bool
+	metricsNamespace string
+	batch            bool
+	tagFilters       tagFilterList
+	cacheTtl         time.Duration
+	cacheFile        string
+	cacheKeyId       string
+	validateCache    bool
+	refresh          bool
+	dryRun           bool
+	showSources      bool
+	extension        bool
+	extensionName    string
+	extensionPort    int
+	serveMode        bool
+	listenAddress    string
+	serveToken       string
+	grpcListen       string
+	grpcCert         string
+	grpcKey          string
+	grpcClientCA     string
+	rotationCheck    time.Duration
+	refreshNotify    string
+	checksumVar      string
+	auditLog         string
+	credentialSource string
+	sensitiveFile    string
+	sensitiveHashes  bool
+	checksumFile     string
+	bestEffort       bool
+	errorReportFile  string
+	keyOrder         string
+	print0           bool
+	backend          string
+	transforms       transformList
+	composites       compositeList
+	pushFunction     string
+	pushAllow        string
+	pushYes          bool
+	useFips          bool
+	execInPlace      bool
+	onRefresh        string
+	maxAge           time.Duration
+	onExpire         string
+	expireSignal     string
+	maxSecretSize    int
+	failSizeLimit    bool
+	proxyUrl         string
+	caBundle         string
+	caBundleData     []byte
+	dualStack        bool
+	backendFile      string
+	sessionTags      keyValueMap
+	sourceId         string
+	mfaSerial        string
+	mfaToken         string
+	tokenFile        string
+	fallbacks        string
+	flattenDepth     int
+	decodeNested     bool
 )
 
-// The main function will pull command line arg and retrieve the secret.  The resulting
-// secret will be dumped as JSON to the output
-func main() {
+// The -t option which accepts either a duration such as 5s or a bare number of milliseconds
+type timeoutFlag time.Duration
 
-	// Get all of the command line data and perform the necessary validation
-	getCommandParams()
+// String is an implementation of the flag.Value interface
+func (t *timeoutFlag) String() string {
+	return time.Duration(*t).String()
+}
 
-	// Setup a new context to allow for limited execution time for API calls with a default of 200 milliseconds
-	ctx, cancel := context.WithTimeout(context.TODO(), time.Duration(timeout)*time.Millisecond)
-	defer cancel()
+// Set is an implementation of the flag.Value interface.  A bare number is treated as milliseconds for
+// compatibility with earlier releases where -t only accepted milliseconds.
+func (t *timeoutFlag) Set(value string) error {
+	value = strings.TrimSpace(value)
 
-	// Load the config
-	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region), config.WithRetryer(func() aws.Retryer {
-		// NopRetryer is used here in a global context to avoid retries on API calls
-		return retry.AddWithMaxAttempts(aws.NopRetryer{}, 1)
-	}))
+	if ms, err := strconv.Atoi(value); err == nil {
+		*t = timeoutFlag(time.Duration(ms) * time.Millisecond)
+	} else if d, err := time.ParseDuration(value); err == nil {
+		*t = timeoutFlag(d)
+	} else {
+		return fmt.Errorf("%q is not a duration such as 5s or 1500ms or a number of milliseconds", value)
+	}
+
+	if *t <= 0 {
+		return fmt.Errorf("the timeout must be greater than zero, %q was supplied", value)
+	}
+
+	return nil
+}
+
+// The list of secrets supplied with -s as a comma separated list
+type secretIdList []secretenv.Secret
+
+// String is an implementation of the flag.Value interface
+func (s *secretIdList) String() string {
+	specs := make([]string, len(*s))
+	for i, spec := range *s {
+		specs[i] = spec.String()
+	}
+
+	return strings.Join(specs, ",")
+}
+
+// Set is an implementation of the flag.Value interface.  The flag may be repeated and each value may be a
+// comma separated list.  Each entry is parsed by secretenv.ParseSecretSpec, so it may carry a prefix for
+// its keys and the version to retrieve.  The value - reads the secrets from stdin once the flags are parsed.
+func (s *secretIdList) Set(value string) error {
+	if strings.TrimSpace(value) == "-" {
+		secretIdsStdin = true
+		return nil
+	}
+
+	return s.add(value)
+}
+
+// This function will add each of the comma separated secrets in the value to the list.  A secret that is
+// already in the list with the same prefix and version is only retrieved once.
+func (s *secretIdList) add(value string) error {
+	for _, id := range strings.Split(value, ",") {
+		if len(strings.TrimSpace(id)) == 0 {
+			continue
+		}
+
+		spec, err := secretenv.ParseSecretSpec(id)
+
+		if err != nil {
+			return err
+		}
+
+		if !s.contains(spec) {
+			*s = append(*s, spec)
+		}
+	}
+
+	return nil
+}
+
+// This function will determine if the secret is already in the list
+func (s *secretIdList) contains(spec secretenv.Secret) bool {
+	for _, existing := range *s {
+		if existing == spec {
+			return true
+		}
+	}
+
+	return false
+}
+
+// This function will add the secrets listed in the file to the list, or the secrets read from stdin when
+// the path is -.  Each line may hold one secret or a comma separated list, blank lines and lines starting
+// with # are ignored.  The file may instead be a JSON array of secrets, such as ["DB=prod/db"], or a JSON
+// object mapping each prefix to its secret, such as {"DB": "prod/db"}, an empty prefix adds none.
+func (s *secretIdList) readFile(path string) error {
+	var data []byte
+	var err error
+
+	if path == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(path)
+	}
 
 	if err != nil {
-		panic("configuration error " + err.Error())
+		return err
+	}
+
+	if text := strings.TrimSpace(strings.TrimPrefix(string(data), secretenv.UTF8_BOM)); strings.HasPrefix(text, "[") || strings.HasPrefix(text, "{") {
+		return s.addJson(text)
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if err := s.add(line); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// This function will add the secrets of a JSON array of secrets or a JSON object mapping prefixes to secrets
+func (s *secretIdList) addJson(text string) error {
+	var list []string
+
+	if strings.HasPrefix(text, "[") {
+		if err := json.Unmarshal([]byte(text), &list); err != nil {
+			return fmt.Errorf("the secrets are not a JSON array of strings: %w", err)
+		}
+	} else {
+		var prefixes map[string]string
+
+		if err := json.Unmarshal([]byte(text), &prefixes); err != nil {
+			return fmt.Errorf("the secrets are not a JSON object of prefixes and secrets: %w", err)
+		}
+
+		// The keys of an object are unordered, so the secrets are added in the order of their prefixes
+		names := make([]string, 0, len(prefixes))
+		for prefix := range prefixes {
+			names = append(names, prefix)
+		}
+		sort.Strings(names)
+
+		for _, prefix := range names {
+			if len(prefix) > 0 {
+				list = append(list, prefix+"="+prefixes[prefix])
+			} else {
+				list = append(list, prefixes[prefix])
+			}
+		}
+	}
+
+	for _, id := range list {
+		if len(strings.TrimSpace(id)) == 0 {
+			continue
+		}
+
+		spec, err := secretenv.ParseSecretSpec(id)
+
+		if err != nil {
+			return err
+		}
+
+		if !s.contains(spec) {
+			*s = append(*s, spec)
+		}
+	}
+
+	return nil
+}
+
+// The list of SSM parameters supplied with -p, the flag may be repeated and each value may be a comma
+// separated list
+type parameterList []secretenv.Secret
+
+// String is an implementation of the flag.Value interface
+func (p *parameterList) String() string {
+	specs := make([]string, len(*p))
+	for i, spec := range *p {
+		specs[i] = spec.Id
+		if len(spec.Prefix) > 0 {
+			specs[i] = spec.Prefix + "=" + specs[i]
+		}
+	}
+
+	return strings.Join(specs, ",")
+}
+
+// Set is an implementation of the flag.Value interface.  Each entry is parsed by
+// secretenv.ParseParameterSpec and a parameter that is already in the list is only retrieved once.
+func (p *parameterList) Set(value string) error {
+	for _, name := range strings.Split(value, ",") {
+		if len(strings.TrimSpace(name)) == 0 {
+			continue
+		}
+
+		spec, err := secretenv.ParseParameterSpec(name)
+
+		if err != nil {
+			return err
+		}
+
+		duplicate := false
+		for _, existing := range *p {
+			duplicate = duplicate || existing == spec
+		}
+
+		if !duplicate {
+			*p = append(*p, spec)
+		}
+	}
+
+	return nil
+}
+
+// The list of ciphertexts supplied with -kms, the flag may be repeated
+type ciphertextList []secretenv.Secret
+
+// String is an implementation of the flag.Value interface, the ciphertexts themselves are not included
+func (c *ciphertextList) String() string {
+	names := make([]string, len(*c))
+	for i, spec := range *c {
+		names[i] = secretenv.CiphertextName(spec)
 	}
 
-	// Assume a role to retreive the parameter
-	role, err := AttemptAssumeRole(ctx, cfg)
+	return strings.Join(names, ",")
+}
+
+// Set is an implementation of the flag.Value interface, the value is parsed by secretenv.ParseCiphertextSpec
+func (c *ciphertextList) Set(value string) error {
+	spec, err := secretenv.ParseCiphertextSpec(value)
 
 	if err != nil {
-		panic("Failed to assume role due to error " + err.Error())
+		return err
 	}
 
-	// Get the secret
-	result, err := GetSecret(ctx, cfg, role)
+	*c = append(*c, spec)
+	return nil
+}
+
+// The list of S3 objects supplied with -s3, the flag may be repeated
+type objectList []secretenv.Secret
+
+// String is an implementation of the flag.Value interface
+func (o *objectList) String() string {
+	specs := make([]string, len(*o))
+	for i, spec := range *o {
+		specs[i] = spec.Id
+		if len(spec.Prefix) > 0 {
+			specs[i] = spec.Prefix + "=" + specs[i]
+		}
+	}
+
+	return strings.Join(specs, ",")
+}
+
+// Set is an implementation of the flag.Value interface, the value is parsed by secretenv.ParseObjectSpec
+func (o *objectList) Set(value string) error {
+	spec, err := secretenv.ParseObjectSpec(value)
 
 	if err != nil {
-		panic("Failed to retrieve secret due to error " + err.Error())
+		return err
+	}
+
+	*o = append(*o, spec)
+	return nil
+}
+
+// The list of sources supplied with -source, the flag may be repeated
+type sourceList []secretenv.Secret
+
+// String is an implementation of the flag.Value interface
+func (l *sourceList) String() string {
+	specs := make([]string, len(*l))
+	for i, spec := range *l {
+		specs[i] = spec.Id
+		if len(spec.Prefix) > 0 {
+			specs[i] = spec.Prefix + "=" + specs[i]
+		}
 	}
 
-	// Convert the secret into JSON
-	var dat map[string]interface{}
+	return strings.Join(specs, ",")
+}
+
+// Set is an implementation of the flag.Value interface, the value is parsed by secretenv.ParseSourceSpec
+func (l *sourceList) Set(value string) error {
+	spec, err := secretenv.ParseSourceSpec(value)
 
-	// Convert the secret to JSON
-	if err := json.Unmarshal([]byte(*result.SecretString), &dat); err != nil {
-		fmt.Println("Failed to convert Secret to JSON")
-		fmt.Println(err)
-		panic(err)
+	if err != nil {
+		return err
 	}
 
-	// Get the secret value and dump the output in a manner that a shell script can read the
-	// data from the output
-	for key, value := range dat {
-		fmt.Printf("%s|%s\n", key, value)
+	*l = append(*l, spec)
+	return nil
+}
+
+// The list of AppConfig configurations supplied with -appconfig, the flag may be repeated
+type appConfigList []secretenv.Secret
+
+// String is an implementation of the flag.Value interface
+func (a *appConfigList) String() string {
+	specs := make([]string, len(*a))
+	for i, spec := range *a {
+		specs[i] = spec.Id
+		if len(spec.Prefix) > 0 {
+			specs[i] = spec.Prefix + "=" + specs[i]
+		}
 	}
+
+	return strings.Join(specs, ",")
 }
 
-func getCommandParams() {
-	// Setup command line args
-	flag.StringVar(&region, "r", DEFAULT_REGION, "The Amazon Region to use")
-	flag.StringVar(&secretArn, "s", "", "The ARN for the secret to access")
-	flag.StringVar(&roleArn, "a", "", "The ARN for the role to assume for Secret Access")
-	flag.IntVar(&timeout, "t", DEFAULT_TIMEOUT, "The amount of time to wait for any API call")
-	flag.StringVar(&sessionName, "n", DEFAULT_SESSION, "The name of the session for AWS STS")
+// Set is an implementation of the flag.Value interface, the value is parsed by secretenv.ParseAppConfigSpec
+func (a *appConfigList) Set(value string) error {
+	spec, err := secretenv.ParseAppConfigSpec(value)
 
-	// Parse all of the command line args into the specified vars with the defaults
-	flag.Parse()
+	if err != nil {
+		return err
+	}
 
-	// Verify that the correct number of args were supplied
-	if len(region) == 0 || len(secretArn) == 0 {
-		flag.PrintDefaults()
-		panic("You must supply a region and secret ARN.  -r REGION -s SECRET-ARN [-a ARN for ROLE -t TIMEOUT IN MILLISECONDS -n SESSION NAME]")
+	*a = append(*a, spec)
+	return nil
+}
+
+// The list of -filter options, the flag may be repeated and a secret must have every tag to be selected
+type tagFilterList []secretenv.TagFilter
+
+// String is an implementation of the flag.Value interface
+func (f *tagFilterList) String() string {
+	filters := make([]string, len(*f))
+	for i, filter := range *f {
+		filters[i] = filter.String()
 	}
+
+	return strings.Join(filters, " ")
 }
 
-// This function will attempt to assume the supplied role and return either an error or the assumed role
-func AttemptAssumeRole(ctx context.Context, cfg aws.Config) (*sts.AssumeRoleOutput, error) {
-	if len(roleArn) <= 0 {
-		return nil, nil
+// Set is an implementation of the flag.Value interface
+func (f *tagFilterList) Set(value string) error {
+	filter, err := secretenv.ParseTagFilter(value)
+
+	if err != nil {
+		return err
 	}
 
-	client := sts.NewFromConfig(cfg)
+	*f = append(*f, filter)
+	return nil
+}
+
+// The list of -coalesce options, the flag may be repeated to supply several
+type coalesceList []secretenv.CoalesceRule
+
+// String is an implementation of the flag.Value interface
+func (c *coalesceList) String() string {
+	rules := make([]string, len(*c))
+	for i, rule := range *c {
+		rules[i] = rule.String()
+	}
 
-	return client.AssumeRole(ctx,
-		&sts.AssumeRoleInput{
-			RoleArn:         &roleArn,
-			RoleSessionName: &sessionName,
-		},
-	)
+	return strings.Join(rules, " ")
 }
 
-// This function will return the descrypted version of the Secret from Secret Manager using the supplied
-// assumed role to interact with Secret Manager.  This function will return either an error or the
-// retrieved and decrypted secret.
-func GetSecret(ctx context.Context, cfg aws.Config, assumedRole *sts.AssumeRoleOutput) (*secretsmanager.GetSecretValueOutput, error) {
+// Set is an implementation of the flag.Value interface
+func (c *coalesceList) Set(value string) error {
+	rule, err := secretenv.ParseCoalesceRule(value)
 
-	if assumedRole != nil {
-		client := secretsmanager.NewFromConfig(cfg, func(o *secretsmanager.Options) {
-			o.Credentials = aws.NewCredentialsCache(credentials.NewStaticCredentialsProvider(*assumedRole.Credentials.AccessKeyId, *assumedRole.Credentials.SecretAccessKey, *assumedRole.Credentials.SessionToken))
-		})
-		return client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
-			SecretId: aws.String(secretArn),
-		})
-	} else {
-		client := secretsmanager.NewFromConfig(cfg)
-		return client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
-			SecretId: aws.String(secretArn),
-		})
+	if err != nil {
+		return err
+	}
+
+	*c = append(*c, rule)
+	return nil
+}
+
+// The KEY=VALUE pairs of a repeatable flag, such as -session-tag
+type keyValueMap map[string]string
+
+// String is an implementation of the flag.Value interface
+func (m *keyValueMap) String() string {
+	tags := make([]string, 0, len(*m))
+	for _, key := range secretenv.SortedKeys(*m) {
+		tags = append(tags, key+"="+(*m)[key])
+	}
+
+	return strings.Join(tags, ",")
+}
+
+// Set is an implementation of the flag.Value interface
+func (m *keyValueMap) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+
+	if len(parts) != 2 || len(strings.TrimSpace(parts[0])) == 0 {
+		return fmt.Errorf("%q must be in the form KEY=VALUE", value)
+	}
+
+	if *m == nil {
+		*m = keyValueMap{}
+	}
+
+	(*m)[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	return nil
+}
+
+// The list of -transform options, the flag may be repeated to supply several
+type transformList []secretenv.TransformRule
+
+// String is an implementation of the flag.Value interface
+func (t *transformList) String() string {
+	rules := make([]string, len(*t))
+	for i, rule := range *t {
+		rules[i] = rule.String()
+	}
+
+	return strings.Join(rules, " ")
+}
+
+// Set is an implementation of the flag.Value interface
+func (t *transformList) Set(value string) error {
+	rule, err := secretenv.ParseTransformRule(value)
+
+	if err != nil {
+		return err
+	}
+
+	*t = append(*t, rule)
+	return nil
+}
+
+// The list of -compose options, the flag may be repeated to supply several
+type compositeList []secretenv.CompositeRule
+
+// String is an implementation of the flag.Value interface
+func (c *compositeList) String() string {
+	rules := make([]string, len(*c))
+	for i, rule := range *c {
+		rules[i] = rule.String()
+	}
+
+	return strings.Join(rules, " ")
+}
+
+// Set is an implementation of the flag.Value interface
+func (c *compositeList) Set(value string) error {
+	rule, err := secretenv.ParseCompositeRule(value)
+
+	if err != nil {
+		return err
+	}
+
+	*c = append(*c, rule)
+	return nil
+}
+
+// The list of -rename options, the flag may be repeated to supply several
+type renameList []secretenv.RenameRule
+
+// String is an implementation of the flag.Value interface
+func (r *renameList) String() string {
+	rules := make([]string, len(*r))
+	for i, rule := range *r {
+		rules[i] = rule.String()
+	}
+
+	return strings.Join(rules, " ")
+}
+
+// Set is an implementation of the flag.Value interface
+func (r *renameList) Set(value string) error {
+	rule, err := secretenv.ParseRenameRule(value)
+
+	if err != nil {
+		return err
+	}
+
+	*r = append(*r, rule)
+	return nil
+}
+
+// The list of -require options, the flag may be repeated to supply several
+type requireList []secretenv.RequireRule
+
+// String is an implementation of the flag.Value interface
+func (r *requireList) String() string {
+	rules := make([]string, len(*r))
+	for i, rule := range *r {
+		rules[i] = rule.String()
+	}
+
+	return strings.Join(rules, " ")
+}
+
+// Set is an implementation of the flag.Value interface
+func (r *requireList) Set(value string) error {
+	rule, err := secretenv.ParseRequireRule(value)
+
+	if err != nil {
+		return err
+	}
+
+	*r = append(*r, rule)
+	return nil
+}
+
+// The main function will pull command line arg and retrieve the secret.  The resulting
+// secret will be dumped as JSON to the output.  Any failure is written to stderr and the
+// process exits with a code for the category of the failure, see errors.go.
+func main() {
+	start := time.Now()
+	err := run()
+
+	metrics.write(os.Stderr, metricsNamespace, time.Since(start), err)
+	audit.write(auditLog, time.Since(start), err)
+	envelope.write(time.Since(start), err)
+
+	if err != nil {
+		code := ExitCode(err)
+		logExit(err, code)
+		os.Exit(code)
+	}
+}
+
+// This function will retrieve the secrets and write them to the output, returning an error if
+// any step fails
+func run() error {
+
+	// Capture the start time so that the elapsed time can be reported in the summary
+	start := time.Now()
+
+	// Get all of the command line data and perform the necessary validation
+	if err := getCommandParams(); err != nil {
+		return err
+	}
+
+	if commandName == COMMAND_VERSION {
+		return printVersion()
+	}
+
+	// Setup a new context to limit the time spent on all of the API calls together to the -total-timeout
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Duration(timeout))
+	defer cancel()
+
+	// Load the config, every call is limited to the -call-timeout and reports which deadline it ran out of
+	loadOptions := []func(*config.LoadOptions) error{config.WithRegion(region), config.WithRetryer(newRetryer),
+		config.WithAPIOptions([]func(*middleware.Stack) error{addCallTimeout, addRateLimit})}
+
+	// Spread the calls out to -rate-limit calls per second, such as for hundreds of secrets
+	if rateLimit > 0 {
+		rateBucket = newTokenBucket(rateLimit, rateBurst)
+	}
+
+	// Give up on a single attempt after -attempt-timeout so that a slow attempt is retried instead of using
+	// up all of the -t timeout
+	if attemptTime > 0 {
+		loadOptions = append(loadOptions, config.WithAPIOptions([]func(*middleware.Stack) error{addAttemptTimeout}))
+	}
+
+	// Use the credentials and settings of a named profile from the shared config files, the role supplied
+	// with -a is then assumed using the credentials of the profile
+	if len(profile) > 0 {
+		loadOptions = append(loadOptions, config.WithSharedConfigProfile(profile))
+	}
+
+	// Use the credentials of the -credential-source instead of the first ones found by the SDK
+	credentialsOption, err := credentialSourceOption()
+
+	if err != nil {
+		return configError("%w", err)
+	} else if credentialsOption != nil {
+		loadOptions = append(loadOptions, credentialsOption)
+	}
+
+	// Use the FIPS 140 validated and the dual-stack IPv4 and IPv6 endpoints of every service, such as for
+	// GovCloud or an IPv6-only VPC.  AWS_USE_FIPS_ENDPOINT and AWS_USE_DUALSTACK_ENDPOINT are read by the SDK
+	// as well, and an -endpoint or -service-endpoint is used as is.
+	if useFips {
+		loadOptions = append(loadOptions, config.WithUseFIPSEndpoint(aws.FIPSEndpointStateEnabled))
+	}
+
+	if dualStack {
+		loadOptions = append(loadOptions, config.WithUseDualStackEndpoint(aws.DualStackEndpointStateEnabled))
+	}
+
+	// Every client, of each service, region, and role, sends its calls over the connections of one transport,
+	// which also sends them through the -proxy.  Trust the certificates of the -ca-bundle, e.g. of a proxy
+	// that intercepts TLS.
+	loadOptions = append(loadOptions, config.WithHTTPClient(sharedHTTPClient()))
+
+	if len(caBundle) > 0 {
+		loadOptions = append(loadOptions, config.WithCustomCABundle(bytes.NewReader(caBundleData)))
+	}
+
+	// Send the STS and Secrets Manager calls to the supplied endpoint, such as LocalStack, instead of the
+	// regional AWS endpoints.  The hostname is left as is since such endpoints do not use the per service
+	// host names of AWS.  A service with its own -service-endpoint uses that one instead, and services
+	// without either use the AWS endpoint.
+	if len(endpoint) > 0 || len(endpoints) > 0 {
+		loadOptions = append(loadOptions, config.WithEndpointResolver(aws.EndpointResolverFunc(func(service, region string) (aws.Endpoint, error) {
+			target, ok := endpoints[serviceName(service)]
+			if !ok {
+				target = endpoint
+			}
+
+			if len(target) == 0 {
+				return aws.Endpoint{}, &aws.EndpointNotFoundError{}
+			}
+
+			return aws.Endpoint{URL: target, HostnameImmutable: true, SigningRegion: region}, nil
+		})))
+	}
+
+	// Trace the retrieval and each of the AWS API calls when -trace is set
+	ctx, stopTracing, err := startTracing(ctx, traceExporter, &loadOptions)
+
+	if err != nil {
+		return configError("%w", err)
+	}
+
+	defer stopTracing()
+
+	debugf("event=load_config correlation_id=%q region=%q endpoint=%q profile=%q fips=%t dual_stack=%t retries=%d timeout=%s",
+		requestId, region, endpoint, profile, useFips, dualStack, retries, time.Duration(timeout))
+
+	options := secretenv.Config{
+		Secrets:          secretIds,
+		UppercaseKeys:    uppercaseKeys,
+		SanitizeKeys:     sanitizeKeys,
+		StripPrefixes:    splitList(stripPrefix),
+		Flatten:          flatten,
+		FlattenDepth:     flattenDepth,
+		DecodeNestedJson: decodeNested,
+		Separator:        separator,
+		ArrayMode:        arrayMode,
+		FailOnCollision:  failCollision,
+		MergeStrategy:    mergeStrategy,
+		Coalesce:         coalesce,
+		Renames:          renames,
+		Transforms:       transforms,
+		MaxSecretSize:    maxSecretSize,
+		Composites:       composites,
+		BestEffort:       bestEffort,
+		FallbackRegions:  splitList(fallbacks),
+		Concurrency:      concurrency,
+		KMSConcurrency:   kmsConcurrency,
+		Batch:            batch,
+		Parameters:       parameters,
+		Ciphertexts:      ciphertexts,
+		Objects:          objects,
+		AppConfigs:       appConfigs,
+		Sources:          schemeSources,
+		Include:          splitList(include),
+		Exclude:          splitList(exclude),
+		Warnings:         warningWriter(),
+		Debug:            debugWriter(),
+	}
+
+	// A dry run never writes files, so binary secrets are left base64 encoded
+	if !dryRun {
+		options.BinaryDir = binaryDir
+	}
+
+	// Determine if the secrets have been pinned to specific versions
+	if len(manifest) > 0 {
+		pinned, err := secretenv.ReadManifest(manifest)
+
+		if err != nil {
+			return configError("Failed to read manifest: %w", err)
+		}
+
+		options.Pinned = pinned
+	}
+
+	retrieverOptions := secretenv.Options{
+		Region:      region,
+		Roles:       assumeRoleChain(),
+		SecretRole:  secretRole(),
+		TagFilters:  tagFilters,
+		CacheTTL:    cacheTtl,
+		CacheFile:   cacheFile,
+		Refresh:     refresh,
+		LoadOptions: loadOptions,
+
+		CacheKeyId:    cacheKeyId,
+		ValidateCache: validateCache,
+		Vault:         vaultOptions,
+	}
+
+	// Record how long each secret took and whether the cache was used for the EMF records
+	if emitMetrics {
+		metrics = &metricsRecorder{}
+		options.Observe = metrics.observe
+		retrieverOptions.ObserveCache = metrics.observeCache
+	}
+
+	// Record which secrets and versions were accessed, and by whom, for the -audit-log
+	if len(auditLog) > 0 {
+		audit = &auditRecorder{}
+
+		observe := options.Observe
+		options.Observe = func(secretId string, elapsed time.Duration, err error) {
+			if observe != nil {
+				observe(secretId, elapsed, err)
+			}
+			audit.observe(secretId, elapsed, err)
+		}
+	}
+
+	// Record how long each secret took for the metadata of the -f json-envelope
+	if format == FORMAT_JSON_ENVELOPE {
+		envelope = &envelopeRecorder{secrets: map[string]time.Duration{}}
+
+		observe := options.Observe
+		options.Observe = func(secretId string, elapsed time.Duration, err error) {
+			if observe != nil {
+				observe(secretId, elapsed, err)
+			}
+			envelope.observe(secretId, elapsed, err)
+		}
+	}
+
+	retrieverOptions.Config = options
+
+	// Resolve the secrets from the local file instead of Secrets Manager
+	if backend == BACKEND_FILE {
+		fileClient, err := secretenv.NewFileClient(backendFile)
+
+		if err != nil {
+			return configError("Failed to read the -backend-file: %w", err)
+		}
+
+		retrieverOptions.Backend = fileClient
 	}
+
+	// Load the config and assume a role to retreive the parameter
+	retriever, err := secretenv.NewRetriever(ctx, retrieverOptions)
+
+	if err != nil {
+		return err
+	}
+
+	role := retriever.Credentials()
+	client := retriever.Client()
+
+	if backend == BACKEND_AWS {
+		audit.identify(ctx, retriever.AWSConfig(), role)
+	}
+
+	// Print a least privilege policy for the secrets instead of retrieving the secret values
+	if genPolicy {
+		describe := rotationCheck > 0 || len(metadataFields) > 0 || len(metadataFile) > 0
+		policies, err := retriever.GenerateIamPolicy(ctx, describe)
+
+		if err != nil {
+			return awsError(err, "Failed to generate IAM policy")
+		}
+
+		// The policy of each role of the @role= secrets follows the policy of the caller
+		for _, policy := range policies {
+			if len(policy.RoleArn) > 0 {
+				fmt.Fprintf(os.Stderr, "The policy of the role %s:\n", policy.RoleArn)
+			}
+			fmt.Println(policy)
+		}
+		return nil
+	}
+
+	// Print the resource policy attached to each secret instead of retrieving the secret values
+	if printPolicy {
+		secrets, err := retriever.Secrets(ctx)
+
+		if err != nil {
+			return err
+		}
+
+		for _, secret := range secrets {
+			secretId := secret.Id
+			policy, err := secretenv.GetResourcePolicy(ctx, client, secretId)
+
+			if err != nil {
+				return awsError(err, "Failed to retrieve the resource policy for secret %s", secretId)
+			}
+
+			if len(policy) == 0 {
+				fmt.Fprintln(os.Stderr, "No resource policy is attached to the secret "+secretId)
+			} else {
+				fmt.Println(policy)
+			}
+		}
+		return nil
+	}
+
+	// Retrieve and merge all of the secrets
+	result, err := retriever.Retrieve(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	audit.observeResult(result)
+	envelope.observeResult(result)
+
+	// Report the secrets that were skipped before anything else can fail
+	if bestEffort {
+		if err := writeErrorReport(errorReportFile, result); err != nil {
+			return configError("Failed to write the error report %s: %w", errorReportFile, err)
+		}
+	}
+
+	// Record the versions that were retrieved so that later deploys can be pinned to them
+	if len(newManifest) > 0 && !dryRun {
+		if err := secretenv.WriteManifest(newManifest, result.Versions); err != nil {
+			return configError("Failed to write manifest: %w", err)
+		}
+	}
+
+	rendered, dat, sources, err := renderResult(options, result)
+
+	if err != nil {
+		return err
+	}
+
+	if !dryRun {
+		if err := writeSensitiveManifest(rendered); err != nil {
+			return configError("%w", err)
+		}
+	}
+
+	if err := addMetadata(ctx, retriever, rendered); err != nil {
+		return err
+	}
+
+	if err := addChecksum(rendered); err != nil {
+		return err
+	}
+
+	if keyOrder == ORDER_SOURCE {
+		options.KeyOrder = sourceOrder(rendered, sources)
+	}
+
+	infof("event=secrets_retrieved correlation_id=%q secrets=%d parameters=%d keys=%d elapsed=%s",
+		requestId, len(secretIds), len(parameters), len(rendered), time.Since(start).Round(time.Millisecond))
+
+	// Check that the variables will fit within the Lambda environment size limit, moving the variables
+	// that do not fit into the overflow file when one was supplied
+	if size := secretenv.EnvSize(rendered); envSizeLimit > 0 && size > envSizeLimit {
+		sizeErr := &secretenv.SizeError{Size: size, Limit: envSizeLimit, Largest: secretenv.LargestKeys(rendered, sources, 3)}
+
+		if failSizeLimit && (len(splitOverflow) == 0 || dryRun) {
+			return sizeErr
+		} else if len(splitOverflow) == 0 || dryRun {
+			warnf("%s", sizeErr)
+		} else {
+			var overflow map[string]string
+			rendered, overflow = secretenv.SplitOverflow(rendered, envSizeLimit)
+
+			if err := WriteOutputFile(options, splitOverflow, overflow, dat); err != nil {
+				return configError("Failed to write overflow file %s: %w", splitOverflow, err)
+			}
+		}
+	}
+
+	// The command replaces this process as exec runs it, but without staying around to supervise it
+	if execInPlace {
+		if len(outFile) > 0 {
+			if err := WriteOutputFile(options, outFile, rendered, dat); err != nil {
+				return configError("Failed to write %s: %w", outFile, err)
+			}
+		}
+
+		reload := func() (map[string]string, error) {
+			return reloadSecrets(retriever, options)
+		}
+
+		// Nothing runs once the process is replaced, so the traces, metrics, and audit log are written first
+		flush := func() {
+			stopTracing()
+			metrics.write(os.Stderr, metricsNamespace, time.Since(start), nil)
+			audit.write(auditLog, time.Since(start), nil)
+		}
+
+		return replaceCommand(rendered, reload, flush)
+	}
+
+	switch commandName {
+	case COMMAND_VALIDATE:
+		// The -require rules were checked along with the key names when the secrets were rendered
+		fmt.Fprintf(os.Stderr, "The %d keys of the %d secrets and %d parameters are valid\n", len(rendered), len(secretIds), len(parameters))
+		return partialError(result)
+	case COMMAND_EXEC:
+		// The command may read the file instead of its environment so that SIGHUP can update it
+		if len(outFile) > 0 {
+			if err := WriteOutputFile(options, outFile, rendered, dat); err != nil {
+				return configError("Failed to write %s: %w", outFile, err)
+			}
+		}
+
+		reload := func() (map[string]string, error) {
+			return reloadSecrets(retriever, options)
+		}
+
+		return execCommand(rendered, reload)
+	case COMMAND_PUSH:
+		return pushCommand(ctx, retriever, result, rendered)
+	}
+
+	if extension || serveMode {
+		state := &extensionState{}
+
+		// The function may read the file instead of calling the local endpoint
+		if len(outFile) > 0 {
+			if err := WriteOutputFile(options, outFile, rendered, dat); err != nil {
+				return configError("Failed to write %s: %w", outFile, err)
+			}
+		}
+
+		if err := state.update(options, result, rendered, dat, sources); err != nil {
+			return err
+		}
+
+		// Only the first retrieval is traced and measured, the spans and metrics are sent before the
+		// secrets are served
+		stopTracing()
+		metrics.write(os.Stderr, metricsNamespace, time.Since(start), nil)
+		metrics = nil
+		audit.write(auditLog, time.Since(start), nil)
+
+		refresh := func(state *extensionState, force bool) error {
+			return refreshRotated(retriever, options, state, force)
+		}
+
+		// The secrets are served until the process is stopped
+		if serveMode {
+			return RunServer(state, options, refresh)
+		}
+
+		// The secrets are served until Lambda shuts the execution environment down
+		return RunExtension(state, refresh)
+	}
+
+	if dryRun {
+		// Only the key names are printed so that a new secret can be previewed without exposing its values
+		secretenv.PrintDryRun(os.Stdout, rendered, sources, result.Versions, showSources)
+	} else if diffEnv {
+		// The environment holds many variables that are not secrets, so only the keys of the secrets are
+		// compared and none are reported as removed
+		existing := map[string]string{}
+		for key := range rendered {
+			if value, ok := os.LookupEnv(key); ok {
+				existing[key] = value
+			}
+		}
+
+		secretenv.PrintDiff(os.Stdout, existing, rendered)
+	} else if len(diffAgainst) > 0 {
+		// Preview the changes against the existing file and only overwrite it when asked to
+		existing, err := options.ReadOutputFile(diffAgainst, format)
+
+		if err != nil {
+			return configError("Failed to read %s: %w", diffAgainst, err)
+		}
+
+		secretenv.PrintDiff(os.Stdout, existing, rendered)
+
+		if apply {
+			if err := WriteOutputFile(options, diffAgainst, rendered, dat); err != nil {
+				return configError("Failed to write %s: %w", diffAgainst, err)
+			}
+		}
+	} else if envelope != nil {
+		// The envelope is written once the run is over so that it holds the error of the run as well
+		if err := envelope.observeOutput(options, rendered, dat); err != nil {
+			return configError("Failed to format the output: %w", err)
+		}
+	} else {
+		// Get the secret value and dump the output in a manner that a shell script can read the
+		// data from the output
+		output, err := options.Format(format, rendered, dat)
+
+		// A template replaces the output format, e.g. to write a config file for the runtime
+		if len(templateFile) > 0 {
+			output, err = options.ExecuteTemplate(filepath.Base(templateFile), templateText, result, rendered)
+		}
+
+		if err != nil {
+			return configError("Failed to format the output: %w", err)
+		}
+
+		if len(outFile) > 0 {
+			if err := secretenv.WriteFileAtomic(outFile, []byte(output), outFileMode); err != nil {
+				return configError("Failed to write %s: %w", outFile, err)
+			}
+		} else {
+			fmt.Print(output)
+		}
+	}
+
+	// Write a one line summary to stderr so that it does not mix with the secret data.  Only counts
+	// and names are reported, never the secret values.
+	if summary {
+		fmt.Fprintf(os.Stderr, "correlation_id=%s secrets=%d parameters=%d keys=%d regions=%s role_assumed=%t elapsed=%s\n",
+			requestId, len(secretIds), len(parameters), len(rendered), usedRegions(result, len(parameters) > 0), role != nil,
+			time.Since(start).Round(time.Millisecond))
+	}
+
+	return partialError(result)
+}
+
+// This function will parse and validate the command line arguments, returning a usage error when
+// they are not valid
+func getCommandParams() error {
+	// Setup command line args
+	flag.StringVar(&region, "r", defaultRegion(), "The Amazon Region to use, defaults to AWS_REGION or AWS_DEFAULT_REGION, then the region of the -profile, "+
+		"then the region of the EC2 instance")
+	flag.Var(&secretIds, "s", "The ARN for the secret to access, several may be supplied as a comma separated list or by repeating -s.  "+
+		"A secret may be given as prefix=ARN to add the prefix and -separator to each of its keys, or to name the variable of a plaintext secret, as REGION:ARN to retrieve "+
+		"it from a region other than -r, as ARN@STAGE or ARN@VERSION-ID to retrieve a version other than AWSCURRENT, and as "+
+		"ARN#$.PATH=NAME to only keep the value at the path, named NAME.  ARN@role=ROLE-ARN assumes the role to retrieve the secret, e.g. from another account.  -s - reads the secrets "+
+		"from stdin, one per line or as a JSON array or object, as -s-file - does")
+	flag.Var(&parameters, "p", "The name or ARN of an SSM parameter to merge with the secrets, several may be supplied as a comma "+
+		"separated list or by repeating -p.  A parameter may be given as prefix=NAME to add the prefix and -separator to each of its keys.  A path ending in /, such as "+
+		"/prod/app/, retrieves every parameter below the path")
+	flag.Var(&ciphertexts, "kms", "A base64 ciphertext encrypted directly with KMS to decrypt and merge with the secrets, given as NAME=CIPHERTEXT, "+
+		"[NAME=]env:VARIABLE, or [NAME=]file:PATH, the flag may be repeated.  A JSON object adds each of its keys, any other plaintext is named NAME, "+
+		"or the variable or file name")
+	flag.Var(&objects, "s3", "An env file or JSON object in S3 to merge with the secrets, given as [prefix=]s3://BUCKET/KEY, the flag may be repeated.  "+
+		"Objects encrypted with SSE-KMS are decrypted by S3")
+	flag.Var(&appConfigs, "appconfig", "The configuration deployed with AppConfig to merge with the secrets, such as feature flags, given as "+
+		"[prefix=]APPLICATION/ENVIRONMENT/PROFILE, the flag may be repeated.  JSON and text configurations are supported")
+	flag.Var(&schemeSources, "source", "A source to merge with the secrets given by its scheme, [prefix=]SCHEME://SPEC, the flag may be repeated.  "+
+		"The schemes are sm for a secret, ssm for a parameter or path, s3 for an object, kms for a ciphertext, appconfig for a configuration, "+
+		"file for a local env file or JSON object, and vault for a secret of the Vault KV secrets engine, e.g. sm://prod/db, file:///run/secrets/app.env, or vault://secret/app")
+	flag.StringVar(&vaultOptions.Address, "vault-addr", os.Getenv("VAULT_ADDR"), "The address of the Vault server of the vault://MOUNT/PATH sources, defaults to VAULT_ADDR")
+	flag.StringVar(&vaultOptions.Namespace, "vault-namespace", os.Getenv("VAULT_NAMESPACE"), "The Vault Enterprise namespace of the vault sources, defaults to VAULT_NAMESPACE")
+	flag.StringVar(&vaultOptions.Auth, "vault-auth", secretenv.VAULT_AUTH_TOKEN, "How to log in to Vault, token to use VAULT_TOKEN, approle to log in with the -vault-role "+
+		"role id and VAULT_SECRET_ID, or aws to log in as the -vault-role Vault role with the AWS credentials")
+	flag.StringVar(&vaultOptions.Role, "vault-role", os.Getenv("VAULT_ROLE_ID"), "With -vault-auth approle, the role id, defaults to VAULT_ROLE_ID, with aws, the Vault role")
+	flag.StringVar(&vaultOptions.AuthMount, "vault-auth-mount", "", "The path the Vault auth method is mounted at, defaults to the name of the -vault-auth method")
+	flag.IntVar(&vaultOptions.KVVersion, "vault-kv-version", 2, "The version of the Vault KV secrets engine of the vault sources, 1 or 2")
+	flag.StringVar(&vaultOptions.ServerId, "vault-server-id", "", "With -vault-auth aws, the X-Vault-AWS-IAM-Server-ID header the auth method requires, if any")
+	flag.StringVar(&vaultOptions.CACert, "vault-ca-cert", os.Getenv("VAULT_CACERT"), "A PEM file of the certificate authorities to trust for the Vault server, defaults to VAULT_CACERT")
+	flag.Var(&tagFilters, "filter", "Also retrieve the secrets tagged [tag:]TAG-KEY=TAG-VALUE, or whose names start with "+
+		"name-prefix:PREFIX, when repeated a secret must match every filter")
+	flag.StringVar(&backend, "backend", BACKEND_AWS, "Where the secrets are resolved from, aws for Secrets Manager, or file to read them from the "+
+		"-backend-file without AWS credentials, e.g. to test a function locally")
+	flag.StringVar(&backendFile, "backend-file", "", "With -backend file, a JSON object mapping the name of each secret to its value, "+
+		"e.g. {\"prod/db\": {\"username\": \"admin\"}}")
+	flag.StringVar(&configFile, "config", "", "A JSON file of flag settings, e.g. {\"s\": [\"DB=prod/db\"], \"f\": \"dotenv\"}, flags on the command line take precedence")
+	flag.StringVar(&secretIdFile, "s-file", "", "A file listing the secrets to access in addition to -s, one per line or comma separated, or a JSON array or object of prefixes and secrets, - reads stdin")
+	flag.StringVar(&roleArn, "a", "", "The ARN for the role to assume for Secret Access, a comma separated list is assumed as a chain of roles")
+	flag.StringVar(&externalId, "e", "", "The external id required by the trust policy of the role supplied with -a, or a comma separated list with one per role in the chain, "+
+		"the roles of the @role= secrets use the last one")
+	flag.StringVar(&externalId, "external-id", "", "The same as -e")
+	flag.Var(&timeout, "total-timeout", "The amount of time to wait for all of the API calls together, including assuming the role, either a duration such as "+
+		"5s or 1500ms or a number of milliseconds")
+	flag.Var(&timeout, "t", "The same as -total-timeout")
+	flag.DurationVar(&callTimeout, "call-timeout", 0, "The amount of time to wait for a single API call including its retries, e.g. 2s, so that one slow secret "+
+		"does not use up the -total-timeout of the others, 0 only applies -total-timeout")
+	flag.Var(&sessionTags, "session-tag", "A session tag passed to each role supplied with -a, KEY=VALUE (may be repeated)")
+	flag.StringVar(&tokenFile, "web-identity-token-file", "", "A file holding an OIDC token, e.g. from EKS or GitHub Actions, used to assume the first role supplied with -a "+
+		"with AssumeRoleWithWebIdentity")
+	flag.StringVar(&mfaSerial, "mfa-serial", "", "The ARN of the MFA device required to assume the first role supplied with -a, e.g. from a workstation, "+
+		"the token code is prompted for on stderr unless -mfa-token is supplied")
+	flag.StringVar(&mfaToken, "mfa-token", "", "The current token code of the -mfa-serial device, it can only be used once so a role that must be "+
+		"assumed again, e.g. by serve, is prompted for")
+	flag.StringVar(&sourceId, "source-identity", "", "The source identity of the sessions of the roles supplied with -a, it is recorded in CloudTrail")
+	flag.IntVar(&roleDuration, "role-duration", 0, "The number of seconds the assumed role session lasts, between 900 and 43200, defaults to the AWS default of one hour")
+	flag.StringVar(&sessionName, "n", DEFAULT_SESSION, "The name of the session for AWS STS, or a comma separated list with one per role in the chain")
+	flag.IntVar(&retries, "retries", DEFAULT_RETRIES, "The maximum number of attempts for each API call, 0 or 1 disables retries")
+	flag.StringVar(&retryMode, "retry-mode", DEFAULT_RETRY_MODE, "How failed API calls are retried, one of standard or adaptive")
+	flag.Float64Var(&rateLimit, "rate-limit", 0, "The maximum number of API calls per second, retries included, e.g. 10 for a large set of secrets, 0 does not limit them")
+	flag.IntVar(&rateBurst, "rate-burst", 0, "The number of API calls made at once before -rate-limit applies, defaults to the -rate-limit rounded up")
+	flag.DurationVar(&attemptTime, "attempt-timeout", 0, "The amount of time to wait for a single attempt of an API call before retrying it, e.g. 1s, 0 only applies -call-timeout and -total-timeout")
+	flag.StringVar(&credentialSource, "credential-source", CREDENTIAL_SOURCE_DEFAULT, "Where the AWS credentials come from, default for the chain of the SDK, "+
+		"env for AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, container for the ECS task role or EKS Pod Identity, or imds for the role of the EC2 instance")
+	flag.StringVar(&profile, "profile", os.Getenv("AWS_PROFILE"), "The named profile from the shared AWS config files to use, defaults to AWS_PROFILE")
+	flag.StringVar(&endpoint, "endpoint", "", "A URL to send the STS and Secrets Manager calls to instead of AWS, e.g. http://localhost:4566")
+	flag.StringVar(&endpoint, "endpoint-url", "", "The same as -endpoint")
+	flag.StringVar(&proxyUrl, "proxy", "", "The URL of the HTTP proxy to send the API calls through, e.g. http://proxy.internal:3128, "+
+		"defaults to HTTPS_PROXY, the hosts in NO_PROXY are always called directly")
+	flag.StringVar(&caBundle, "ca-bundle", "", "A PEM file of the certificate authorities to trust for the API calls instead of the system ones, "+
+		"e.g. of a proxy that intercepts TLS, defaults to AWS_CA_BUNDLE")
+	flag.BoolVar(&useFips, "fips", false, "Use the FIPS endpoints of STS, Secrets Manager, and the other services, e.g. for GovCloud, the same as AWS_USE_FIPS_ENDPOINT=true")
+	flag.BoolVar(&dualStack, "dual-stack", false, "Use the dual-stack endpoints that accept IPv6 as well as IPv4, e.g. in an IPv6-only VPC, the same as AWS_USE_DUALSTACK_ENDPOINT=true")
+	flag.Var(&endpoints, "service-endpoint", "A URL to send the calls of one service to, SERVICE=URL (may be repeated), e.g. "+
+		"secretsmanager=https://vpce-123.secretsmanager.us-east-1.vpce.amazonaws.com, the services are secretsmanager, sts, ssm, kms, s3, appconfigdata, and lambda")
+	flag.DurationVar(&cacheTtl, "cache-ttl", 0, "Remember each retrieved secret in memory for this long, e.g. 30s, so repeated lookups skip the API call, 0 disables caching")
+	flag.StringVar(&cacheFile, "cache-file", "", "An encrypted file, e.g. /tmp/secrets.cache, that keeps the retrieved secrets for -cache-ttl so later runs reuse them")
+	flag.StringVar(&cacheKeyId, "cache-key-id", "", "The KMS key, by id, ARN, or alias, that generates the key the -cache-file is encrypted with, "+
+		"so that the file survives the credentials being refreshed, by default the key is derived from the credentials")
+	flag.BoolVar(&validateCache, "cache-validate", false, "Check the version of each secret in the -cache-file with DescribeSecret and retrieve the secrets again when any of them changed")
+	flag.BoolVar(&refresh, "refresh", false, "Retrieve the secrets again and replace the -cache-file even when it has not expired")
+	flag.StringVar(&fallbacks, "fallback-regions", "", "A comma separated list of the regions holding replicas of the secrets, tried in turn when a secret "+
+		"cannot be retrieved from its own region")
+	flag.BoolVar(&bestEffort, "best-effort", false, "Skip the secrets that cannot be retrieved with a warning instead of failing, by default any failure fails the run.  "+
+		"The available secrets are still written, a JSON report of the skipped secrets is written to stderr, and the exit code is 7")
+	flag.StringVar(&keyOrder, "order", ORDER_SORTED, "The order the keys are written in, sorted by name, or source to group them by the secret or "+
+		"parameter they came from in the order those were supplied, sorted by name within each")
+	flag.StringVar(&errorReportFile, "error-report", "", "With -best-effort, a file to write the JSON report of the retrieved and skipped secrets to instead of stderr, "+
+		"it is written on every run")
+	flag.BoolVar(&batch, "batch", false, "Retrieve up to 20 secrets with each BatchGetSecretValue call instead of one GetSecretValue call per secret")
+	flag.IntVar(&concurrency, "concurrency", DEFAULT_CONCURRENCY, "The maximum number of secrets to retrieve at the same time")
+	flag.IntVar(&kmsConcurrency, "kms-concurrency", 0, "The maximum number of the -concurrency retrievals that call Secrets Manager, and so have KMS decrypt a value, "+
+		"at the same time, to stay below the KMS request rate, 0 does not limit them")
+	flag.StringVar(&manifest, "manifest", "", "A JSON file mapping secret ids to the VersionId that must be retrieved")
+	flag.StringVar(&metadata, "metadata", "", "A comma separated list of the metadata of each secret to add as variables such as PROD_DB_LAST_ROTATED, "+
+		"any of rotation-enabled, last-rotated, last-changed, next-rotation, version, or tags")
+	flag.StringVar(&metadataFile, "metadata-file", "", "A JSON file to write the metadata of each secret to, such as its rotation and tags, from DescribeSecret")
+	flag.StringVar(&newManifest, "write-manifest", "", "A JSON file to write the retrieved secret ids and VersionIds to")
+	flag.BoolVar(&verbose, "v", false, "Write diagnostic logging to stderr, secret values are never logged, the same as -log-level debug")
+	flag.StringVar(&logLevel, "log-level", DEFAULT_LOG_LEVEL, "The least severe level written to stderr, one of debug, info, warn, or error")
+	flag.StringVar(&traceExporter, "trace", defaultTraceExporter(), "Trace the AWS API calls with OpenTelemetry, one of none, otlp, or xray, "+
+		"the spans are sent to OTEL_EXPORTER_OTLP_ENDPOINT, defaults to OTEL_TRACES_EXPORTER")
+	flag.BoolVar(&emitMetrics, "metrics", false, "Write CloudWatch Embedded Metric Format records of the retrieval time of each secret, the cache hits, "+
+		"and the failures to stderr")
+	flag.StringVar(&metricsNamespace, "metrics-namespace", DEFAULT_METRICS_NAMESPACE, "The CloudWatch namespace of the -metrics")
+	flag.StringVar(&logFormat, "log-format", DEFAULT_LOG_FORMAT, "The format of the lines written to stderr, text or json")
+	flag.BoolVar(&dryRun, "dry-run", false, "Retrieve the secrets but only print the key names with the values redacted, no files are written")
+	flag.BoolVar(&showSources, "show-sources", false, "With -dry-run, also print the secret each key came from, the VersionId that was retrieved, and the size of the value")
+	flag.DurationVar(&maxAge, "max-age", 0, "With exec, how long the command may run with the same secrets, e.g. 12h, before -on-expire applies, 0 lets it run indefinitely")
+	flag.StringVar(&onExpire, "on-expire", ON_EXPIRE_RESTART, "With -max-age, what happens when the secrets are that old, restart to restart the command with "+
+		"fresh values unless they did not change, signal to rewrite the -out file and send the -expire-signal, or exit to stop the command and exit with code 8")
+	flag.StringVar(&expireSignal, "expire-signal", "HUP", "With -on-expire signal, the signal sent to the command, one of HUP, INT, QUIT, TERM, USR1, or USR2")
+	flag.BoolVar(&execInPlace, "exec", false, "Replace this process with the command after --, with the secrets added to its environment, e.g. to run as an "+
+		"AWS_LAMBDA_EXEC_WRAPPER or a container ENTRYPOINT: -exec -s prod/db -- node index.js")
+	flag.StringVar(&onRefresh, "on-refresh", ON_REFRESH_SIGNAL, "With exec, what happens to the command when SIGHUP retrieves the secrets again and "+
+		"rewrites the -out file, one of signal to pass SIGHUP on, restart to run it again with the new values, or none")
+	flag.StringVar(&pushFunction, "function", "", "With push, the name or ARN of the Lambda function whose environment variables are updated")
+	flag.StringVar(&pushAllow, "allow", "", "With push, a comma separated list of the keys written to the function, glob patterns and regular expressions "+
+		"may be used, only non-sensitive keys should be pushed since anyone who can read the function configuration can read them")
+	flag.BoolVar(&pushYes, "yes", false, "With push, update the function, without it the keys that would change are only printed")
+	flag.BoolVar(&extension, "extension", false, "Run as a Lambda extension that serves the secrets on http://localhost:PORT/secrets instead of printing them")
+	flag.StringVar(&extensionName, "extension-name", filepath.Base(os.Args[0]), "The name the extension registers with, the name of its file in /opt/extensions")
+	flag.IntVar(&extensionPort, "port", DEFAULT_EXTENSION_PORT, "The localhost port the extension serves the secrets on")
+	flag.StringVar(&listenAddress, "listen", DEFAULT_SERVE_ADDRESS, "With serve, the localhost HOST:PORT or the unix:PATH of a Unix domain socket to serve the secrets on")
+	flag.StringVar(&serveToken, "serve-token", os.Getenv(SERVE_TOKEN_ENV), "With serve, the token each request must carry in the "+SERVE_TOKEN_HEADER+
+		" header or as a bearer token, defaults to "+SERVE_TOKEN_ENV+", it is required unless a Unix domain socket is used")
+	flag.StringVar(&grpcListen, "grpc-listen", "", "With serve, also serve the secrets over gRPC on HOST:PORT or unix:PATH, see proto/secrets.proto, "+
+		"the -serve-token is sent in the "+strings.ToLower(SERVE_TOKEN_HEADER)+" metadata")
+	flag.StringVar(&grpcCert, "grpc-cert", "", "With -grpc-listen, the PEM certificate of the gRPC server, it serves over TLS when supplied")
+	flag.StringVar(&grpcKey, "grpc-key", "", "With -grpc-cert, the PEM private key of the certificate")
+	flag.StringVar(&grpcClientCA, "grpc-client-ca", "", "With -grpc-cert, a PEM file of the certificate authorities that sign the client "+
+		"certificates, each client must present one (mTLS)")
+	flag.DurationVar(&rotationCheck, "rotation-check", 0, "With -extension or serve, check the secrets for rotation this often, e.g. 5m, and serve the new values, 0 disables the check")
+	flag.StringVar(&refreshNotify, "refresh-notify", "", "With -rotation-check, a file the time is written to whenever the rotated secrets are refreshed")
+	flag.StringVar(&checksumVar, "checksum-var", "", "A variable, e.g. SECRETS_CHECKSUM, set to the SHA-256 checksum of the other variables so "+
+		"that a script can tell whether a refresh changed anything")
+	flag.StringVar(&checksumFile, "checksum-file", "", "A file to write the SHA-256 checksum of the variables to, it is only rewritten when the checksum changes")
+	flag.StringVar(&auditLog, "audit-log", "", "Write an audit record of the caller identity, the role, and the ARN and VersionId of each secret retrieved, "+
+		"never the values, to stderr, to emf for a CloudWatch Embedded Metric Format record on stderr, or appended to a file")
+	flag.StringVar(&sensitiveFile, "sensitive-manifest", "", "A JSON file listing the names of the variables that hold secrets, for logging middleware "+
+		"to redact their values, the -metadata and -checksum-var variables are not listed")
+	flag.BoolVar(&sensitiveHashes, "sensitive-hashes", false, "With -sensitive-manifest, also write the SHA-256 of each value so that a value can be "+
+		"recognized without holding it, a short value can be guessed from its hash")
+	flag.BoolVar(&checkUpdate, "check-update", false, "With version, check the -releases-url for a newer release")
+	flag.StringVar(&releasesUrl, "releases-url", releasesUrl, "With -check-update, the URL of the latest release as JSON, e.g. "+
+		"https://api.github.com/repos/OWNER/REPO/releases/latest or an object with the version and url")
+	flag.BoolVar(&summary, "summary", false, "Write a one line summary of the retrieval to stderr")
+	flag.StringVar(&binaryDir, "binary-dir", "", "A directory, such as /tmp, to write binary secrets to, the variable of each one is the path of its file "+
+		"instead of the base64 encoded value")
+	flag.StringVar(&outFile, "out", "", "A file to write the output to instead of stdout, it is replaced atomically so a reader never sees a partly written file")
+	flag.StringVar(&templateFile, "template", "", "A Go template to render instead of the -f format, e.g. {{ secret \"prod/db\" \"password\" }} or {{ .DB_PASSWORD }}, "+
+		"usually written to a config file with -out")
+	flag.StringVar(&outMode, "out-mode", DEFAULT_OUT_MODE, "The octal permissions of the files written with -out, -split-overflow, and -apply, on Windows only whether the owner can write them is applied")
+	flag.StringVar(&diffAgainst, "diff-against", "", "An existing output file in the -f format to compare against, the changed keys are printed instead of the secret")
+	flag.BoolVar(&diffEnv, "diff-env", false, "Compare against the environment of this process instead, the keys that would be added or changed are printed instead of the secret")
+	flag.BoolVar(&apply, "apply", false, "Overwrite the -diff-against file with the retrieved secret after printing the changes")
+	flag.StringVar(&format, "f", DEFAULT_FORMAT, "The output format, one of pipe, export, json, yaml, dotenv, env-example, powershell, nul, or json-envelope.  "+
+		"A pipe value cannot hold a newline, export single quotes every value for a shell, nul writes KEY\\0VALUE\\0 for read -d '', "+
+		"and json-envelope writes a single JSON document of the variables, errors, and metadata such as the version of each secret")
+	flag.StringVar(&format, "format", DEFAULT_FORMAT, "The same as -f")
+	flag.BoolVar(&print0, "print0", false, "The same as -f nul")
+	flag.BoolVar(&uppercaseKeys, "uppercase", false, "Convert the keys of the secrets to upper case")
+	flag.BoolVar(&sanitizeKeys, "sanitize-keys", false, "Replace the characters of the keys that cannot be used in environment variable names with _, "+
+		"e.g. api-key.primary becomes api_key_primary, or API_KEY_PRIMARY with -uppercase")
+	flag.StringVar(&stripPrefix, "strip-prefix", "", "A comma separated list of prefixes removed from the keys of the secrets, e.g. prod_, only the first that matches is removed")
+	flag.StringVar(&keyPrefix, "key-prefix", "", "A prefix added to every key, e.g. MYAPP_")
+	flag.BoolVar(&flatten, "flatten", false, "Flatten nested objects into a key per value, e.g. db_host for {\"db\":{\"host\":...}}")
+	flag.IntVar(&flattenDepth, "flatten-depth", 0, "With -flatten, the number of levels of nested objects to flatten, deeper values are kept as JSON, 0 flattens every level")
+	flag.BoolVar(&decodeNested, "decode-nested-json", false, "With -flatten, also flatten the string values that hold a JSON object or array, e.g. a secret encoded as JSON within a secret")
+	flag.StringVar(&separator, "separator", DEFAULT_SEPARATOR, "The separator placed between the parts of flattened and indexed keys")
+	flag.StringVar(&arrayMode, "array-mode", DEFAULT_ARRAY_MODE, "How array values are rendered, one of json, csv, or index")
+	flag.BoolVar(&strictRegion, "strict-region", false, "Fail when the region of a secret ARN differs from the -r region")
+	flag.BoolVar(&genPolicy, "gen-iam-policy", false, "Print the least privilege IAM policies for the calls the other flags make to read the secrets, instead of the secrets")
+	flag.IntVar(&envSizeLimit, "env-size-limit", DEFAULT_ENV_SIZE_LIMIT, "Warn when the environment variables exceed this many bytes, 0 disables the check")
+	flag.BoolVar(&failSizeLimit, "fail-on-size-limit", false, "Fail when the environment variables exceed -env-size-limit instead of warning, "+
+		"unless they are moved to the -split-overflow file")
+	flag.IntVar(&maxSecretSize, "max-secret-size", 0, "Fail when the value of a single secret has more than this many bytes, naming the secret, 0 does not limit the size")
+	flag.StringVar(&splitOverflow, "split-overflow", "", "A file to write the variables that exceed -env-size-limit to instead of the output")
+	flag.BoolVar(&printPolicy, "print-policy", false, "Print the resource policy attached to the secret instead of the secret")
+	flag.StringVar(&include, "include", "", "A comma separated list of the keys to output, glob patterns such as DB_* or regular expressions "+
+		"between slashes such as /^DB_/ may be used, defaults to all keys")
+	flag.StringVar(&exclude, "exclude", "", "A comma separated list of the keys to leave out, such as *_ROOT_PASSWORD, glob patterns and "+
+		"regular expressions may be used, this wins over -include")
+	flag.Var(&renames, "rename", "Rename a key of the merged secrets, FROM=TO (may be repeated), e.g. DB_password=DB_PASSWORD for a secret supplied as DB=ARN")
+	flag.Var(&transforms, "transform", "Transform the value of a key, KEY=TRANSFORM[,TRANSFORM...] (may be repeated), where each TRANSFORM is one of "+
+		"base64-decode, trim, json-escape, or url-encode, e.g. DB_PASSWORD=url-encode.  KEY may be a glob pattern or a regular expression between slashes")
+	flag.Var(&composites, "compose", "Build a key from a Go template over the other keys, NAME=TEMPLATE (may be repeated), e.g. "+
+		"DATABASE_URL=postgres://{{.username}}:{{.password}}@{{.host}}:{{.port}}/{{.dbname}}, the template functions are those of -template")
+	flag.Var(&required, "require", "A key that must be in the output and not empty, KEY[:TYPE] (may be repeated), where TYPE is one of int, number, bool, "+
+		"url, json, or a regular expression between slashes, e.g. DB_PORT:int")
+	flag.Var(&coalesce, "coalesce", "Set OUT to the first non-empty of the listed keys, OUT=KEY1,KEY2 (may be repeated)")
+	flag.BoolVar(&failCollision, "fail-on-collision", false, "Fail when a key is defined by more than one secret instead of using the last one, the same as -merge error")
+	flag.StringVar(&mergeStrategy, "merge", DEFAULT_MERGE_STRATEGY, "How a key defined by more than one secret is merged, one of last-wins, first-wins, or error")
+	flag.StringVar(&requestId, "request-token", "", "The id used to correlate this run in logs, one is generated when not supplied")
+
+	// The subcommand, e.g. go-retrieve-secret serve -s prod/db -listen unix:/run/secrets.sock, is split from
+	// its flags.  The legacy command line has no subcommand.
+	name, args, err := splitCommand(os.Args[1:])
+
+	if err != nil {
+		return err
+	}
+
+	commandName = name
+	cmd := findCommand(name)
+
+	if cmd != nil {
+		flag.CommandLine.Usage = commandUsage(cmd)
+	}
+
+	// Parse all of the command line args into the specified vars with the defaults
+	flag.CommandLine.Parse(args)
+
+	if cmd != nil {
+		if err := applyCommand(cmd); err != nil {
+			return err
+		}
+	}
+
+	// Printing the version needs none of the other flags
+	if commandName == COMMAND_VERSION {
+		if checkUpdate && len(releasesUrl) == 0 {
+			return usageError("The -check-update option requires the -releases-url of the published releases")
+		}
+		return nil
+	}
+
+	// Fill in the flags that were not supplied on the command line from the SECRET_ENV_ variables
+	if err := readFlagEnvironment(cmd); err != nil {
+		return usageError("Failed to read the flags from the environment: %w", err)
+	}
+
+	// Fill in the flags that are still not supplied from the config file
+	if len(configFile) > 0 {
+		if err := readConfigFile(configFile); err != nil {
+			return usageError("Failed to read the config file %s: %w", configFile, err)
+		}
+	}
+
+	if err := configureLogging(logLevel, logFormat, verbose); err != nil {
+		flag.PrintDefaults()
+		return usageError("%w", err)
+	}
+
+	if keyOrder != ORDER_SORTED && keyOrder != ORDER_SOURCE {
+		flag.PrintDefaults()
+		return usageError("Unsupported order %s.  -order must be one of sorted or source", keyOrder)
+	}
+
+	switch backend {
+	case BACKEND_AWS:
+		if len(backendFile) > 0 {
+			flag.PrintDefaults()
+			return usageError("The -backend-file option can only be used with -backend file")
+		}
+	case BACKEND_FILE:
+		if len(backendFile) == 0 {
+			flag.PrintDefaults()
+			return usageError("The -backend file option requires the -backend-file to read the secrets from")
+		}
+
+		// The file has no roles and the cache file is keyed by the AWS credentials, which may not exist
+		if len(roleArn) > 0 || len(cacheFile) > 0 {
+			flag.PrintDefaults()
+			return usageError("The -a and -cache-file options cannot be used with -backend file")
+		}
+	default:
+		flag.PrintDefaults()
+		return usageError("Unsupported backend %s.  -backend must be one of aws or file", backend)
+	}
+
+	if len(proxyUrl) > 0 {
+		if parsed, err := url.Parse(proxyUrl); err != nil || len(parsed.Host) == 0 || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			flag.PrintDefaults()
+			return usageError("The -proxy %s is not an http:// or https:// URL", proxyUrl)
+		}
+	}
+
+	// The bundle is read now so that a missing or malformed file is reported before any calls are made
+	if len(caBundle) > 0 {
+		data, err := ioutil.ReadFile(caBundle)
+
+		if err != nil {
+			return usageError("Failed to read the -ca-bundle: %w", err)
+		}
+
+		// The certificates are only parsed once, by the SDK, since a large bundle takes milliseconds to parse
+		if block, _ := pem.Decode(data); block == nil || block.Type != "CERTIFICATE" {
+			return usageError("The -ca-bundle %s has no PEM certificates", caBundle)
+		}
+
+		caBundleData = data
+	}
+
+	if sensitiveHashes && len(sensitiveFile) == 0 {
+		flag.PrintDefaults()
+		return usageError("The -sensitive-hashes option requires the -sensitive-manifest to write them to")
+	}
+
+	if len(checksumVar) > 0 && !secretenv.IsValidEnvName(checksumVar) {
+		flag.PrintDefaults()
+		return usageError("The -checksum-var %s is not a valid environment variable name", checksumVar)
+	}
+
+	switch onExpire {
+	case ON_EXPIRE_RESTART, ON_EXPIRE_SIGNAL, ON_EXPIRE_EXIT:
+	default:
+		flag.PrintDefaults()
+		return usageError("Unsupported -on-expire %s.  It must be one of restart, signal, or exit", onExpire)
+	}
+
+	if _, ok := namedSignals[strings.TrimPrefix(strings.ToUpper(expireSignal), "SIG")]; !ok && onExpire == ON_EXPIRE_SIGNAL {
+		flag.PrintDefaults()
+		return usageError("Unsupported -expire-signal %s on %s", expireSignal, runtime.GOOS)
+	}
+
+	if maxAge < 0 {
+		flag.PrintDefaults()
+		return usageError("The -max-age must not be negative, %s was supplied", maxAge)
+	}
+
+	switch onRefresh {
+	case ON_REFRESH_NONE, ON_REFRESH_SIGNAL, ON_REFRESH_RESTART:
+	default:
+		flag.PrintDefaults()
+		return usageError("Unsupported -on-refresh %s.  It must be one of signal, restart, or none", onRefresh)
+	}
+
+	if commandName == COMMAND_PUSH && (len(pushFunction) == 0 || len(splitList(pushAllow)) == 0) {
+		flag.PrintDefaults()
+		return usageError("The push command requires the -function to update and the -allow list of the keys to write to it")
+	}
+
+	if len(errorReportFile) > 0 && !bestEffort {
+		flag.PrintDefaults()
+		return usageError("The -error-report option can only be used with -best-effort")
+	}
+
+	if diffEnv && (len(diffAgainst) > 0 || apply) {
+		flag.PrintDefaults()
+		return usageError("The -diff-env option cannot be used with -diff-against or -apply")
+	}
+
+	if execInPlace && flag.NArg() == 0 {
+		flag.PrintDefaults()
+		return usageError("The -exec option requires the command to run after --, e.g. %s -exec -s prod/db -- node index.js", programName())
+	}
+
+	// The process is replaced by the command, so nothing is left to serve the secrets or to print the changes
+	if execInPlace && (extension || dryRun || len(diffAgainst) > 0 || diffEnv) {
+		flag.PrintDefaults()
+		return usageError("The -exec option cannot be used with -extension, -dry-run, -diff-against, or -diff-env")
+	}
+
+	if serveMode && extension {
+		flag.PrintDefaults()
+		return usageError("The -extension option cannot be used with serve")
+	}
+
+	// Any process that can reach the port could otherwise read the secrets
+	if serveMode {
+		if err := checkServeAuthentication(listenAddress, serveToken); err != nil {
+			flag.PrintDefaults()
+			return err
+		}
+	}
+
+	if (len(grpcCert) > 0) != (len(grpcKey) > 0) {
+		flag.PrintDefaults()
+		return usageError("The -grpc-cert and -grpc-key options must be supplied together")
+	}
+
+	if len(grpcClientCA) > 0 && len(grpcCert) == 0 {
+		flag.PrintDefaults()
+		return usageError("The -grpc-client-ca option requires -grpc-cert")
+	}
+
+	if (len(grpcCert) > 0) && len(grpcListen) == 0 {
+		flag.PrintDefaults()
+		return usageError("The -grpc-cert option requires -grpc-listen")
+	}
+
+	// A gRPC port that is not a socket is reachable from the network, so its clients must be known
+	if len(grpcListen) > 0 && !strings.HasPrefix(grpcListen, UNIX_SOCKET_PREFIX) && len(serveToken) == 0 && len(grpcClientCA) == 0 {
+		flag.PrintDefaults()
+		return usageError("-grpc-listen requires a -serve-token or -grpc-client-ca unless it listens on a unix: socket")
+	}
+
+	switch traceExporter {
+	case TRACE_NONE, TRACE_OTLP, TRACE_XRAY:
+	default:
+		flag.PrintDefaults()
+		return usageError("Unsupported trace exporter %s.  -trace must be one of none, otlp, or xray", traceExporter)
+	}
+
+	// Add the secrets listed in the file to those supplied with -s
+	if len(secretIdFile) > 0 {
+		if err := secretIds.readFile(secretIdFile); err != nil {
+			return usageError("Failed to read the secrets from %s: %w", secretIdFile, err)
+		}
+	}
+
+	// Add the secrets piped to -s -, stdin can only be read once so -s-file - already added them
+	if secretIdsStdin && secretIdFile != "-" {
+		if err := secretIds.readFile("-"); err != nil {
+			return usageError("Failed to read the secrets from stdin: %w", err)
+		}
+	}
+
+	// Without -r or the environment variables the region comes from the shared config or the instance
+	// metadata, there is no default region since calling the wrong region fails with misleading errors.  The
+	// file backend only needs a region for the other sources.
+	if len(region) == 0 && (backend == BACKEND_AWS || len(parameters) > 0 || len(ciphertexts) > 0 || len(objects) > 0 || len(appConfigs) > 0 || usesAWSSource()) {
+		resolved, err := resolveRegion()
+
+		if err != nil {
+			return configError("Failed to find the region: %w", err)
+		}
+
+		if len(resolved) == 0 {
+			flag.PrintDefaults()
+			return usageError("No region was found, supply -r REGION or set AWS_REGION")
+		}
+
+		region = resolved
+	}
+
+	// Verify that the correct number of args were supplied
+	if len(secretIds) == 0 && len(parameters) == 0 && len(ciphertexts) == 0 && len(objects) == 0 && len(appConfigs) == 0 && len(schemeSources) == 0 && len(tagFilters) == 0 {
+		flag.PrintDefaults()
+		return usageError("You must supply a region and secret ARN.  -r REGION -s SECRET-ARN [-a ARN for ROLE -t TIMEOUT -n SESSION NAME]")
+	}
+
+	// Verify that the retry mode is one that is supported
+	if retryMode != RETRY_MODE_STANDARD && retryMode != RETRY_MODE_ADAPTIVE {
+		flag.PrintDefaults()
+		return usageError("Unsupported retry mode %s.  -retry-mode must be one of standard or adaptive", retryMode)
+	}
+
+	switch credentialSource {
+	case CREDENTIAL_SOURCE_DEFAULT, CREDENTIAL_SOURCE_ENV, CREDENTIAL_SOURCE_CONTAINER, CREDENTIAL_SOURCE_IMDS:
+	default:
+		flag.PrintDefaults()
+		return usageError("Unsupported credential source %s.  -credential-source must be one of default, env, container, or imds", credentialSource)
+	}
+
+	if credentialSource != CREDENTIAL_SOURCE_DEFAULT && len(profile) > 0 {
+		flag.PrintDefaults()
+		return usageError("The -credential-source option cannot be used with -profile, which has its own credentials")
+	}
+
+	// Verify that the rate limit can be applied
+	if rateLimit < 0 || rateBurst < 0 || (rateBurst > 0 && rateLimit == 0) {
+		flag.PrintDefaults()
+		return usageError("-rate-limit and -rate-burst must not be negative, and -rate-burst requires -rate-limit")
+	}
+
+	// Verify that the merge strategy is one that is supported
+	if mergeStrategy != secretenv.MERGE_LAST_WINS && mergeStrategy != secretenv.MERGE_FIRST_WINS && mergeStrategy != secretenv.MERGE_ERROR {
+		flag.PrintDefaults()
+		return usageError("Unsupported merge strategy %s.  -merge must be one of last-wins, first-wins, or error", mergeStrategy)
+	}
+
+	// Verify that the array mode is one that is supported
+	if arrayMode != secretenv.ARRAY_MODE_JSON && arrayMode != secretenv.ARRAY_MODE_CSV && arrayMode != secretenv.ARRAY_MODE_INDEX {
+		flag.PrintDefaults()
+		return usageError("Unsupported array mode %s.  -array-mode must be one of json, csv, or index", arrayMode)
+	}
+
+	// Verify that the endpoints are absolute URLs
+	urls := []string{endpoint}
+	for _, service := range secretenv.SortedKeys(endpoints) {
+		urls = append(urls, endpoints[service])
+	}
+
+	for _, value := range urls {
+		if len(value) == 0 {
+			continue
+		}
+
+		if parsed, err := url.Parse(value); err != nil || len(parsed.Scheme) == 0 || len(parsed.Host) == 0 {
+			flag.PrintDefaults()
+			return usageError("The endpoint %s must be an absolute URL such as http://localhost:4566", value)
+		}
+	}
+
+	// Verify that the session duration is one that AssumeRole accepts
+	if roleDuration != 0 && (roleDuration < secretenv.MIN_ROLE_DURATION || roleDuration > secretenv.MAX_ROLE_DURATION) {
+		flag.PrintDefaults()
+		return usageError("The -role-duration must be between %d and %d seconds, %d was supplied", secretenv.MIN_ROLE_DURATION, secretenv.MAX_ROLE_DURATION, roleDuration)
+	}
+
+	// Verify that the key filters are well formed glob patterns
+	for _, patterns := range [][]string{splitList(include), splitList(exclude)} {
+		if err := secretenv.ValidatePatterns(patterns); err != nil {
+			flag.PrintDefaults()
+			return usageError("Invalid -include or -exclude: %w", err)
+		}
+	}
+
+	// The Vault credentials are only read from the environment so that they are not visible in the process list
+	vaultOptions.Token = os.Getenv("VAULT_TOKEN")
+	vaultOptions.SecretId = os.Getenv("VAULT_SECRET_ID")
+
+	if metadataFields, err = secretenv.ParseMetadataFields(metadata); err != nil {
+		flag.PrintDefaults()
+		return usageError("Invalid -metadata: %w", err)
+	}
+
+	// The files hold the secret values, so the mode is checked before anything is retrieved
+	mode, err := strconv.ParseUint(outMode, 8, 32)
+
+	if err != nil || mode > 0777 {
+		flag.PrintDefaults()
+		return usageError("The -out-mode must be octal permissions such as 0600, %s was supplied", outMode)
+	}
+
+	outFileMode = os.FileMode(mode)
+
+	// The template is read before anything is retrieved so that a missing file fails fast
+	if len(templateFile) > 0 {
+		data, err := ioutil.ReadFile(templateFile)
+
+		if err != nil {
+			return usageError("Failed to read the template %s: %w", templateFile, err)
+		}
+
+		templateText = string(data)
+	}
+
+	if flattenDepth < 0 {
+		flag.PrintDefaults()
+		return usageError("The -flatten-depth option must not be negative, %d was supplied", flattenDepth)
+	}
+
+	if decodeNested && !flatten {
+		flag.PrintDefaults()
+		return usageError("The -decode-nested-json option can only be used with -flatten")
+	}
+
+	if concurrency < 1 {
+		flag.PrintDefaults()
+		return usageError("The -concurrency option must be at least 1, %d was supplied", concurrency)
+	}
+
+	if kmsConcurrency < 0 {
+		flag.PrintDefaults()
+		return usageError("The -kms-concurrency option must not be negative, %d was supplied", kmsConcurrency)
+	}
+
+	if len(tokenFile) > 0 && len(roleArn) == 0 {
+		flag.PrintDefaults()
+		return usageError("The -web-identity-token-file option requires the role to assume with -a")
+	}
+
+	if len(mfaSerial) > 0 && (len(roleArn) == 0 || len(tokenFile) > 0) {
+		flag.PrintDefaults()
+		return usageError("The -mfa-serial option requires the role to assume with -a and cannot be used with -web-identity-token-file")
+	}
+
+	if len(mfaToken) > 0 && len(mfaSerial) == 0 {
+		flag.PrintDefaults()
+		return usageError("The -mfa-token option requires the -mfa-serial of the device")
+	}
+
+	// The token code is read from stdin, which can only be read once
+	if len(mfaSerial) > 0 && len(mfaToken) == 0 && (secretIdsStdin || secretIdFile == "-") {
+		flag.PrintDefaults()
+		return usageError("The -mfa-token must be supplied when the secrets are read from stdin")
+	}
+
+	// The cache file is only used for as long as the -cache-ttl
+	if len(cacheFile) > 0 && cacheTtl <= 0 {
+		flag.PrintDefaults()
+		return usageError("The -cache-file option requires a -cache-ttl")
+	}
+
+	if (len(cacheKeyId) > 0 || validateCache) && len(cacheFile) == 0 {
+		flag.PrintDefaults()
+		return usageError("The -cache-key-id and -cache-validate options require a -cache-file")
+	}
+
+	// Generate a correlation id so that the logs of a single run can be traced
+	if len(requestId) == 0 {
+		var err error
+		if requestId, err = NewRequestId(); err != nil {
+			return configError("Failed to generate a request id: %w", err)
+		}
+	}
+
+	// Verify that the region embedded in each secret ARN matches the region that was asked for
+	for _, secret := range secretIds {
+		secretId := secret.Id
+		if !strictRegion || !arn.IsARN(secretId) {
+			continue
+		}
+
+		expected, option := region, "-r"
+		if len(secret.Region) > 0 {
+			expected, option = secret.Region, "its region prefix"
+		}
+
+		parsed, err := arn.Parse(secretId)
+
+		if err == nil && parsed.Region != expected {
+			return usageError("The secret %s is in region %s but the region %s was supplied with %s", secretId, parsed.Region, expected, option)
+		}
+	}
+
+	if print0 {
+		if format != DEFAULT_FORMAT && format != secretenv.FORMAT_NUL {
+			flag.PrintDefaults()
+			return usageError("The -print0 option cannot be used with -f %s", format)
+		}
+		format = secretenv.FORMAT_NUL
+	}
+
+	// Verify that the output format is one that is supported
+	switch format {
+	case secretenv.FORMAT_PIPE, secretenv.FORMAT_EXPORT, secretenv.FORMAT_JSON, secretenv.FORMAT_YAML, secretenv.FORMAT_DOTENV,
+		secretenv.FORMAT_ENV_EXAMPLE, secretenv.FORMAT_POWERSHELL, secretenv.FORMAT_NUL, FORMAT_JSON_ENVELOPE:
+	default:
+		flag.PrintDefaults()
+		return usageError("Unsupported output format %s.  -f must be one of pipe, export, json, yaml, dotenv, env-example, powershell, nul, "+
+			"or json-envelope", format)
+	}
+
+	// The envelope describes a single retrieval written to stdout or the -out file, not the files written by
+	// the other modes or what they print instead of the variables
+	if format == FORMAT_JSON_ENVELOPE {
+		envelopeModes := []struct {
+			name string
+			used bool
+		}{
+			{"serve", serveMode}, {"exec", commandName == COMMAND_EXEC || execInPlace}, {"validate", commandName == COMMAND_VALIDATE},
+			{"push", commandName == COMMAND_PUSH}, {"diff", len(diffAgainst) > 0 || diffEnv}, {"-extension", extension},
+			{"-dry-run", dryRun}, {"-template", len(templateFile) > 0}, {"-split-overflow", len(splitOverflow) > 0},
+			{"-gen-iam-policy", genPolicy}, {"-print-policy", printPolicy},
+		}
+
+		for _, mode := range envelopeModes {
+			if mode.used {
+				flag.PrintDefaults()
+				return usageError("-f json-envelope cannot be used with %s", mode.name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// This function will return the default of -r, the standard AWS environment variables as the other AWS
+// tools use them.  It is empty when neither is set, the region is then resolved by resolveRegion.
+func defaultRegion() string {
+	for _, name := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if value := strings.TrimSpace(os.Getenv(name)); len(value) > 0 {
+			return value
+		}
+	}
+
+	return ""
+}
+
+// This function will return the region of the shared config files, for the -profile when one was supplied,
+// or else the region of the EC2 instance from the instance metadata service.  It is empty when neither has
+// a region, a metadata service that cannot be reached, such as off EC2, is the same as having no region.
+// Only the shared config files are read for the region, the same as the SDK does, rather than loading the
+// whole config, which resolves the credentials and parses the AWS_CA_BUNDLE.
+func resolveRegion() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout))
+	defer cancel()
+
+	env, err := config.NewEnvConfig()
+
+	if err != nil {
+		return "", err
+	}
+
+	name := profile
+	if len(name) == 0 {
+		name = env.SharedConfigProfile
+	}
+	if len(name) == 0 {
+		name = config.DefaultSharedConfigProfile
+	}
+
+	shared, err := config.LoadSharedConfigProfile(ctx, name, func(o *config.LoadSharedConfigOptions) {
+		if len(env.SharedConfigFile) > 0 {
+			o.ConfigFiles = []string{env.SharedConfigFile}
+		}
+		if len(env.SharedCredentialsFile) > 0 {
+			o.CredentialsFiles = []string{env.SharedCredentialsFile}
+		}
+	})
+
+	// Only a -profile must exist, the default profile is optional
+	var notExist config.SharedConfigProfileNotExistError
+	if errors.As(err, &notExist) && len(profile) == 0 {
+		err = nil
+	}
+
+	if err != nil || len(shared.Region) > 0 {
+		return shared.Region, err
+	}
+
+	// The client honors AWS_EC2_METADATA_DISABLED and the endpoint settings of the environment and shared
+	// config, a single attempt is made since the service is either there or not
+	client := imds.NewFromConfig(aws.Config{HTTPClient: sharedHTTPClient(), ConfigSources: []interface{}{env, shared}}, func(o *imds.Options) {
+		o.Retryer = retry.AddWithMaxAttempts(retry.NewStandard(), 1)
+	})
+
+	output, err := client.GetRegion(ctx, &imds.GetRegionInput{})
+
+	if err != nil {
+		debugf("event=imds_region success=false error=%q", err)
+		return "", nil
+	}
+
+	return output.Region, nil
+}
+
+// This function will return the distinct regions the secrets were retrieved from as a comma separated list.
+// The region of each secret is taken from the ARN that was returned, so that a REGION: prefix, the region
+// of a role, and a fallback region that answered instead are all reported.  The parameters, and the
+// secrets named without an ARN, are retrieved in the region of -r.
+func usedRegions(result *secretenv.Result, parameters bool) string {
+	used := map[string]bool{}
+
+	if parameters {
+		used[region] = true
+	}
+
+	for secretId := range result.Versions {
+		if _, failed := result.Errors[secretId]; failed {
+			continue
+		}
+
+		if parsed, err := arn.Parse(result.ARNs[secretId]); err == nil {
+			used[parsed.Region] = true
+		} else if parsed, err := arn.Parse(secretId); err == nil {
+			used[parsed.Region] = true
+		} else {
+			used[region] = true
+		}
+	}
+
+	regions := make([]string, 0, len(used))
+	for name := range used {
+		if len(name) > 0 {
+			regions = append(regions, name)
+		}
+	}
+	sort.Strings(regions)
+
+	return strings.Join(regions, ",")
+}
+
+// This function will split a comma separated option into its trimmed entries, dropping empty entries
+func splitList(value string) []string {
+	var entries []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); len(entry) > 0 {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries
+}
+
+// This function will generate a random id in the UUID format which is accepted by the API's that
+// take a ClientRequestToken
+func NewRequestId() (string, error) {
+	b := make([]byte, 16)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	// Set the version (4) and variant bits
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	h := hex.EncodeToString(b)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:], nil
+}
+
+// This function will render the merged secrets into the environment variables that are written to the
+// output, returning them along with the raw values and the sources keyed the same way
+func renderResult(options secretenv.Config, result *secretenv.Result) (map[string]string, map[string]interface{}, map[string]string, error) {
+	dat := result.Values
+	sources := result.Sources
+
+	// Render each of the secret values in the form that is written to the output
+	rendered := options.Render(dat)
+
+	// Decode or escape the values of individual keys
+	if err := options.ApplyTransforms(rendered); err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Normalize alternative key names into their canonical output keys
+	options.ApplyCoalesce(rendered)
+
+	// Build the keys such as connection strings that combine several of the other keys
+	if err := options.ApplyComposites(result, rendered); err != nil {
+		return nil, nil, nil, err
+	}
+
+	// None of the values, including the transformed and composite ones, may appear in anything that is
+	// logged from now on
+	redactValues(rendered)
+
+	// Add the global prefix to every key, it is upper cased along with the keys when -uppercase is used
+	if len(keyPrefix) > 0 {
+		prefix := keyPrefix
+		if uppercaseKeys {
+			prefix = strings.ToUpper(prefix)
+		}
+		rendered = secretenv.PrefixKeys(rendered, prefix)
+
+		// The raw values are keyed the same way so that the json format still finds them
+		raw := make(map[string]interface{}, len(dat))
+		for key, value := range dat {
+			raw[prefix+key] = value
+		}
+		dat = raw
+		sources = secretenv.PrefixKeys(sources, prefix)
+	}
+
+	// Keys that are not valid shell identifiers would run as shell code when the export output is sourced or
+	// be misread by dotenv parsers, and keys that were transformed to follow the environment variable
+	// conventions must still be valid
+	if secretenv.RequiresEnvNames(format) || len(keyPrefix) > 0 || uppercaseKeys || sanitizeKeys {
+		for _, key := range secretenv.SortedKeys(rendered) {
+			if !secretenv.IsValidEnvName(key) {
+				return nil, nil, nil, configError("The key %s is not a valid environment variable name, only A-Z, a-z, 0-9, and _ may be used, -sanitize-keys replaces the other characters", key)
+			}
+		}
+	}
+
+	// Fail before anything is written when a key the application depends on is missing or malformed
+	if err := secretenv.CheckRequired(required, rendered); err != nil {
+		return nil, nil, nil, err
+	}
+
+	return rendered, dat, sources, nil
+}
+
+// This function will determine if any of the -source options is resolved with an AWS service, the local
+// files and Vault need no region
+func usesAWSSource() bool {
+	for _, source := range schemeSources {
+		if !strings.HasPrefix(source.Id, secretenv.SCHEME_FILE+"://") && !strings.HasPrefix(source.Id, secretenv.SCHEME_VAULT+"://") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// This function will return the keys grouped by the position of their source on the command line, the
+// secrets first followed by the parameters, ciphertexts, objects, and configurations, with the keys of each
+// source sorted by name.  Keys whose source is not known, such as the keys of secrets found with -filter,
+// follow at the end.
+func sourceOrder(rendered map[string]string, sources map[string]string) []string {
+	var supplied []string
+	for _, list := range [][]secretenv.Secret{secretIds, parameters, objects, appConfigs} {
+		for _, spec := range list {
+			supplied = append(supplied, spec.Id)
+		}
+	}
+	for _, spec := range ciphertexts {
+		supplied = append(supplied, secretenv.CiphertextName(spec))
+	}
+	for _, spec := range schemeSources {
+		supplied = append(supplied, spec.Id)
+	}
+
+	positions := map[string]int{}
+	for i, id := range supplied {
+		if _, ok := positions[id]; !ok {
+			positions[id] = i
+		}
+	}
+
+	position := func(key string) int {
+		if i, ok := positions[sources[key]]; ok {
+			return i
+		}
+		return len(supplied)
+	}
+
+	keys := secretenv.SortedKeys(rendered)
+	sort.SliceStable(keys, func(i, j int) bool {
+		return position(keys[i]) < position(keys[j])
+	})
+
+	return keys
+}
+
+// This function will return the name a service is given with -service-endpoint, the service id used by the
+// SDK in lower case without spaces, e.g. secretsmanager for Secrets Manager
+func serviceName(service string) string {
+	return strings.ToLower(strings.ReplaceAll(service, " ", ""))
+}
+
+// This function will return the retryer used for every API call.  The backoff delay is cut short by the
+// context so the retries never run past the -t timeout.
+func newRetryer() aws.Retryer {
+	if retries <= 1 {
+		// NopRetryer is used here in a global context to avoid retries on API calls
+		return retry.AddWithMaxAttempts(aws.NopRetryer{}, 1)
+	}
+
+	standard := func(o *retry.StandardOptions) {
+		o.MaxAttempts = retries
+	}
+
+	if retryMode == RETRY_MODE_ADAPTIVE {
+		return retry.NewAdaptiveMode(func(o *retry.AdaptiveModeOptions) {
+			o.StandardOptions = append(o.StandardOptions, standard)
+		})
+	}
+
+	return retry.NewStandard(standard)
+}
+
+// This function will add a middleware before the retry middleware that limits each API call, along with its
+// retries, to the -call-timeout.  A call that runs out of time names the deadline that ran out, the error
+// of the SDK already names the service and operation.
+func addCallTimeout(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("CallTimeout", func(
+		ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler,
+	) (middleware.InitializeOutput, middleware.Metadata, error) {
+		callCtx := ctx
+		if callTimeout > 0 {
+			var cancel context.CancelFunc
+			callCtx, cancel = context.WithTimeout(ctx, callTimeout)
+			defer cancel()
+		}
+
+		out, metadata, err := next.HandleInitialize(callCtx, in)
+
+		if err != nil && errors.Is(callCtx.Err(), context.DeadlineExceeded) {
+			if ctx.Err() != nil {
+				err = fmt.Errorf("the -total-timeout of %s ran out: %w", time.Duration(timeout), err)
+			} else {
+				err = fmt.Errorf("the -call-timeout of %s ran out: %w", callTimeout, err)
+			}
+		}
+
+		return out, metadata, err
+	}), middleware.Before)
+}
+
+// This function will add a middleware after the retry middleware that limits each attempt of an API call
+// to the -attempt-timeout
+func addAttemptTimeout(stack *middleware.Stack) error {
+	return stack.Finalize.Insert(middleware.FinalizeMiddlewareFunc("AttemptTimeout", func(
+		ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler,
+	) (middleware.FinalizeOutput, middleware.Metadata, error) {
+		ctx, cancel := context.WithTimeout(ctx, attemptTime)
+		defer cancel()
+
+		return next.HandleFinalize(ctx, in)
+	}), "Retry", middleware.After)
+}
+
+// This function will return the chain of roles supplied with -a.  When -a is a comma separated list each
+// role is assumed in turn using the credentials of the previous role.
+func assumeRoleChain() []secretenv.AssumeRoleOptions {
+	if len(roleArn) <= 0 {
+		return nil
+	}
+
+	roles := strings.Split(roleArn, ",")
+	sessionNames := perHop(sessionName, len(roles))
+	externalIds := perHop(externalId, len(roles))
+
+	chain := make([]secretenv.AssumeRoleOptions, len(roles))
+	for i, role := range roles {
+		chain[i] = secretenv.AssumeRoleOptions{
+			RoleArn:         strings.TrimSpace(role),
+			SessionName:     sessionNames[i],
+			ExternalId:      externalIds[i],
+			DurationSeconds: int32(roleDuration),
+			Tags:            sessionTags,
+			SourceIdentity:  sourceId,
+		}
+	}
+
+	// The token replaces the credentials of the config, so it can only start the chain
+	chain[0].WebIdentityTokenFile = tokenFile
+
+	// Only the first role is assumed with the credentials of a person, whose policy may require MFA
+	if len(mfaSerial) > 0 {
+		chain[0].SerialNumber = mfaSerial
+		chain[0].TokenProvider = mfaTokenProvider()
+	}
+
+	return chain
+}
+
+// This function will return the token codes of the -mfa-serial device, the -mfa-token the first time the role
+// is assumed and a code prompted for on stderr after that, since stdout holds the secrets
+func mfaTokenProvider() func() (string, error) {
+	var mutex sync.Mutex
+	supplied := mfaToken
+	reader := bufio.NewReader(os.Stdin)
+
+	return func() (string, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if len(supplied) > 0 {
+			code := supplied
+			supplied = ""
+			return code, nil
+		}
+
+		fmt.Fprintf(os.Stderr, "MFA token code for %s: ", mfaSerial)
+		line, err := reader.ReadString('\n')
+
+		if code := strings.TrimSpace(line); len(code) > 0 {
+			return code, nil
+		}
+
+		if err == nil {
+			err = errors.New("no token code was entered")
+		}
+
+		return "", fmt.Errorf("Failed to read the MFA token code: %w", err)
+	}
+}
+
+// This function will return the settings of the roles given with @role= for individual secrets, they use the
+// session name and external id of the last role in the chain and the same duration and source identity
+func secretRole() secretenv.AssumeRoleOptions {
+	hops := len(strings.Split(roleArn, ","))
+	sessionNames := perHop(sessionName, hops)
+	externalIds := perHop(externalId, hops)
+
+	return secretenv.AssumeRoleOptions{
+		SessionName:     strings.TrimSpace(sessionNames[len(sessionNames)-1]),
+		ExternalId:      externalIds[len(externalIds)-1],
+		DurationSeconds: int32(roleDuration),
+		SourceIdentity:  sourceId,
+	}
+}
+
+// This function will return the value to use for each hop of a role chain.  A comma separated value with
+// one entry per hop is applied hop by hop, any other value is reused for every hop since session names and
+// external ids may themselves contain commas.
+func perHop(value string, hops int) []string {
+	values := strings.Split(value, ",")
+
+	if hops == 1 || len(values) != hops {
+		values = make([]string, hops)
+		for i := range values {
+			values[i] = value
+		}
+	}
+
+	for i := range values {
+		values[i] = strings.TrimSpace(values[i])
+	}
+
+	return values
+}
+
+// This function will write the keys and values to a file in the output format selected with -f.  The
+// file is given the -out-mode, only readable by the owner by default since it contains the secret values,
+// and it is replaced atomically so that a reader never sees a partly written file.
+func WriteOutputFile(options secretenv.Config, path string, values map[string]string, raw map[string]interface{}) error {
+	output, err := options.Format(format, values, raw)
+
+	if err != nil {
+		return err
+	}
+
+	return secretenv.WriteFileAtomic(path, []byte(output), outFileMode)
+}
+
+// This function will write the allowed keys of the values into the environment of the -function, printing
+// the keys that change.  The function is only updated with -yes.
+func pushCommand(ctx context.Context, retriever *secretenv.Retriever, result *secretenv.Result, values map[string]string) error {
+	client := secretenv.NewLambdaClient(retriever.AWSConfig(), retriever.Credentials())
+	pushed, err := secretenv.PushEnvironment(ctx, client, pushFunction, values, splitList(pushAllow), pushYes)
+
+	if err != nil {
+		return awsError(err, "Failed to push the secrets")
+	}
+
+	secretenv.PrintDiff(os.Stdout, pushed.Existing, pushed.Pushed)
+
+	switch {
+	case len(pushed.Pushed) == 0:
+		warnf("none of the keys match the -allow list, nothing was pushed to %s", pushFunction)
+	case pushed.Updated:
+		fmt.Fprintf(os.Stderr, "Updated %d keys of the environment of %s\n", len(pushed.Pushed), pushFunction)
+	case pushYes:
+		fmt.Fprintf(os.Stderr, "The environment of %s is already up to date\n", pushFunction)
+	default:
+		fmt.Fprintf(os.Stderr, "Run again with -yes to update the environment of %s\n", pushFunction)
+	}
+
+	return partialError(result)
+}
+
+// The HTTP client of every AWS client, see sharedHTTPClient
+var httpClient *awshttp.BuildableClient
+
+// This function will return the HTTP client shared by every AWS client so that the connections are reused
+// across the secrets, regions, and roles.  It keeps an idle connection for each of the -concurrency calls to
+// a host, and sends the requests through the -proxy, except those to the hosts listed in NO_PROXY.
+func sharedHTTPClient() *awshttp.BuildableClient {
+	if httpClient != nil {
+		return httpClient
+	}
+
+	var proxyFunc func(*url.URL) (*url.URL, error)
+	if len(proxyUrl) > 0 {
+		proxyFunc = (&httpproxy.Config{HTTPProxy: proxyUrl, HTTPSProxy: proxyUrl, NoProxy: os.Getenv("NO_PROXY")}).ProxyFunc()
+	}
+
+	httpClient = awshttp.NewBuildableClient().WithTransportOptions(func(transport *http.Transport) {
+		if concurrency > transport.MaxIdleConnsPerHost {
+			transport.MaxIdleConnsPerHost = concurrency
+		}
+
+		if proxyFunc != nil {
+			transport.Proxy = func(request *http.Request) (*url.URL, error) {
+				return proxyFunc(request.URL)
+			}
+		}
+	})
+
+	return httpClient
+}
+
+// This function will retrieve the secrets again for exec and return the new values, the -out file is
+// replaced with them
+func reloadSecrets(retriever *secretenv.Retriever, options secretenv.Config) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout))
+	defer cancel()
+
+	start := time.Now()
+	result, err := retriever.Refresh(ctx)
+
+	audit.observeResult(result)
+	audit.write(auditLog, time.Since(start), err)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rendered, dat, _, err := renderResult(options, result)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeSensitiveManifest(rendered); err != nil {
+		return nil, err
+	}
+
+	if err := addMetadata(ctx, retriever, rendered); err != nil {
+		return nil, err
+	}
+
+	if err := addChecksum(rendered); err != nil {
+		return nil, err
+	}
+
+	if len(outFile) > 0 {
+		if err := WriteOutputFile(options, outFile, rendered, dat); err != nil {
+			return nil, fmt.Errorf("Failed to write %s: %w", outFile, err)
+		}
+	}
+
+	debugf("event=secrets_refreshed forced=true keys=%d", len(rendered))
+	return rendered, nil
+}
+
+// This function will write the -sensitive-manifest of the rendered values of the secrets, it is written before
+// the metadata and checksum are added since they are not secret
+func writeSensitiveManifest(rendered map[string]string) error {
+	if len(sensitiveFile) == 0 {
+		return nil
+	}
+
+	if err := secretenv.WriteSensitiveManifest(sensitiveFile, rendered, sensitiveHashes, outFileMode); err != nil {
+		return fmt.Errorf("Failed to write %s: %w", sensitiveFile, err)
+	}
+
+	return nil
+}
+
+// This function will add the -checksum-var to the rendered values and write the -checksum-file.  The checksum
+// is of the values before the variable is added, and the file is left alone when it already holds it so that
+// a watcher of the file only sees the changes.
+func addChecksum(rendered map[string]string) error {
+	if len(checksumVar) == 0 && len(checksumFile) == 0 {
+		return nil
+	}
+
+	checksum := secretenv.Checksum(rendered)
+
+	if len(checksumVar) > 0 {
+		if _, ok := rendered[checksumVar]; ok {
+			warnf("the -checksum-var %s is also a key of the secrets, the key of the secrets is kept", checksumVar)
+		} else {
+			rendered[checksumVar] = checksum
+		}
+	}
+
+	if len(checksumFile) > 0 {
+		if existing, err := ioutil.ReadFile(checksumFile); err == nil && strings.TrimSpace(string(existing)) == checksum {
+			debugf("event=checksum_unchanged file=%q", checksumFile)
+			return nil
+		}
+
+		if err := secretenv.WriteFileAtomic(checksumFile, []byte(checksum+"\n"), 0644); err != nil {
+			return fmt.Errorf("Failed to write %s: %w", checksumFile, err)
+		}
+	}
+
+	return nil
+}
+
+// This function will describe the secrets and add the -metadata fields of each of them to the rendered
+// values and write the -metadata-file.  A key of the secrets is never replaced by a metadata field.
+func addMetadata(ctx context.Context, retriever *secretenv.Retriever, rendered map[string]string) error {
+	if len(metadataFields) == 0 && len(metadataFile) == 0 {
+		return nil
+	}
+
+	secrets, err := retriever.Secrets(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	described, err := retriever.Metadata(ctx, secrets)
+
+	if err != nil {
+		return awsError(err, "Failed to describe the secrets")
+	}
+
+	for key, value := range secretenv.MetadataValues(secrets, described, metadataFields) {
+		if _, ok := rendered[key]; ok {
+			warnf("the metadata key %s is also a key of the secrets, the key of the secrets is kept", key)
+			continue
+		}
+
+		rendered[key] = value
+	}
+
+	if len(metadataFile) > 0 {
+		data, _ := json.MarshalIndent(described, "", "    ")
+
+		if err := secretenv.WriteFileAtomic(metadataFile, append(data, '\n'), 0644); err != nil {
+			return configError("Failed to write the metadata file %s: %w", metadataFile, err)
+		}
+	}
+
+	debugf("event=describe_secrets secrets=%d fields=%d", len(described), len(metadataFields))
+	return nil
 }
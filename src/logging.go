@@ -0,0 +1,268 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// This code is used to write the diagnostics, warnings, and errors to stderr at the level and in
+// the format selected on the command line, with any secret value that slips into a line redacted.
+//
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go-retrieve-secret/pkg/secretenv"
+)
+
+// The levels accepted by -log-level, from the most to the least verbose
+const LOG_LEVEL_DEBUG = "debug"
+const LOG_LEVEL_INFO = "info"
+const LOG_LEVEL_WARN = "warn"
+const LOG_LEVEL_ERROR = "error"
+
+// The formats accepted by -log-format
+const LOG_FORMAT_TEXT = "text"
+const LOG_FORMAT_JSON = "json"
+
+// Only warnings and errors are written unless a lower level is asked for, the same as before -log-level
+const DEFAULT_LOG_LEVEL = LOG_LEVEL_WARN
+const DEFAULT_LOG_FORMAT = LOG_FORMAT_TEXT
+
+// Values shorter than this, such as true or 1, are too common to be redacted without mangling the lines
+const MIN_REDACTED_LENGTH = 4
+
+// Writes the lines to stderr, the level and format are set once the command line has been parsed
+type logger struct {
+	mutex    sync.Mutex
+	out      io.Writer
+	level    int
+	format   string
+	redacted []string
+}
+
+// The logger used for every line written to stderr
+var stderrLog = &logger{out: os.Stderr, level: logLevelRank(DEFAULT_LOG_LEVEL), format: DEFAULT_LOG_FORMAT}
+
+// This function will return the rank of the level, a line is written when its rank is at least the rank
+// of the -log-level.  Unknown levels return -1.
+func logLevelRank(level string) int {
+	for rank, name := range []string{LOG_LEVEL_DEBUG, LOG_LEVEL_INFO, LOG_LEVEL_WARN, LOG_LEVEL_ERROR} {
+		if level == name {
+			return rank
+		}
+	}
+
+	return -1
+}
+
+// This function will set the level and format of the logger, -v always selects the debug level
+func configureLogging(level string, format string, verbose bool) error {
+	if verbose {
+		level = LOG_LEVEL_DEBUG
+	}
+
+	rank := logLevelRank(level)
+
+	if rank < 0 {
+		return fmt.Errorf("Unsupported log level %s.  -log-level must be one of debug, info, warn, or error", level)
+	}
+
+	if format != LOG_FORMAT_TEXT && format != LOG_FORMAT_JSON {
+		return fmt.Errorf("Unsupported log format %s.  -log-format must be one of text or json", format)
+	}
+
+	stderrLog.mutex.Lock()
+	defer stderrLog.mutex.Unlock()
+
+	stderrLog.level, stderrLog.format = rank, format
+	return nil
+}
+
+// This function will set the values that are replaced with secretenv.REDACTED in every line written from
+// now on, so that a value quoted in an error message is never logged.  The values replace those of the last
+// call, so the served values of a long running extension or serve are redacted as they are refreshed
+// without the list growing.
+func redactValues(values map[string]string) {
+	redacted := make([]string, 0, len(values))
+	seen := make(map[string]bool, len(values))
+
+	for _, value := range values {
+		if len(value) >= MIN_REDACTED_LENGTH && !seen[value] {
+			seen[value] = true
+			redacted = append(redacted, value)
+		}
+	}
+
+	// The longest values are replaced first so that a value containing another is redacted whole
+	sort.Slice(redacted, func(i, j int) bool {
+		return len(redacted[i]) > len(redacted[j])
+	})
+
+	stderrLog.mutex.Lock()
+	defer stderrLog.mutex.Unlock()
+
+	stderrLog.redacted = redacted
+}
+
+// This function will determine if lines of the level are written
+func (l *logger) enabled(level string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return logLevelRank(level) >= l.level
+}
+
+// This function will write a single line at the level.  Text lines are written as they always were, a
+// JSON line is an object with the time, the level, the key=value fields of the line, and the rest of the
+// text as the msg.
+func (l *logger) write(level string, line string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if logLevelRank(level) < l.level {
+		return
+	}
+
+	line = strings.TrimSuffix(line, "\n")
+	for _, value := range l.redacted {
+		line = strings.ReplaceAll(line, value, secretenv.REDACTED)
+	}
+
+	if l.format == LOG_FORMAT_TEXT {
+		switch level {
+		case LOG_LEVEL_DEBUG, LOG_LEVEL_INFO:
+			fmt.Fprintf(l.out, "level=%s %s\n", level, line)
+		default:
+			fmt.Fprintln(l.out, line)
+		}
+		return
+	}
+
+	fields, msg := parseLogFields(strings.TrimPrefix(line, "Warning: "))
+	fields["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	fields["level"] = level
+	if len(msg) > 0 {
+		fields["msg"] = msg
+	}
+
+	data, _ := json.Marshal(fields)
+	fmt.Fprintln(l.out, string(data))
+}
+
+// This function will split a line into its key=value fields, where a value may be a quoted Go string,
+// and the remaining text.  A level field is dropped since the level is set by the logger.
+func parseLogFields(line string) (map[string]interface{}, string) {
+	fields := map[string]interface{}{}
+	var words []string
+
+	for rest := strings.TrimSpace(line); len(rest) > 0; rest = strings.TrimSpace(rest) {
+		end := strings.IndexAny(rest, " =")
+
+		// A word that is not followed by = is part of the message
+		if end <= 0 || rest[end] == ' ' {
+			word := rest
+			if i := strings.Index(rest, " "); i >= 0 {
+				word = rest[:i]
+			}
+			words = append(words, word)
+			rest = rest[len(word):]
+			continue
+		}
+
+		key := rest[:end]
+		rest = rest[end+1:]
+
+		// Quoted values are always strings, unquoted numbers and booleans keep their type
+		var value interface{}
+		if quoted, err := strconv.QuotedPrefix(rest); err == nil {
+			value, _ = strconv.Unquote(quoted)
+			rest = rest[len(quoted):]
+		} else {
+			word := rest
+			if i := strings.Index(rest, " "); i >= 0 {
+				word = rest[:i]
+			}
+			rest = rest[len(word):]
+
+			if word == "true" || word == "false" {
+				value = word == "true"
+			} else if _, err := strconv.ParseFloat(word, 64); err == nil {
+				value = json.Number(word)
+			} else {
+				value = word
+			}
+		}
+
+		if key != "level" {
+			fields[key] = value
+		}
+	}
+
+	return fields, strings.Join(words, " ")
+}
+
+// Writes each line written to it to the logger at a fixed level, it is passed to the secretenv package
+// as the Warnings and Debug writers
+type levelWriter struct {
+	level string
+}
+
+// Write is an implementation of the io.Writer interface
+func (w levelWriter) Write(data []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		stderrLog.write(w.level, strings.TrimPrefix(line, "level="+w.level+" "))
+	}
+
+	return len(data), nil
+}
+
+// This function will write a diagnostic line to stderr at the debug level, e.g. when -v was supplied.  The
+// line must never include a secret value.
+func debugf(format string, args ...interface{}) {
+	if stderrLog.enabled(LOG_LEVEL_DEBUG) {
+		stderrLog.write(LOG_LEVEL_DEBUG, fmt.Sprintf(format, args...))
+	}
+}
+
+// This function will write a line to stderr at the info level
+func infof(format string, args ...interface{}) {
+	if stderrLog.enabled(LOG_LEVEL_INFO) {
+		stderrLog.write(LOG_LEVEL_INFO, fmt.Sprintf(format, args...))
+	}
+}
+
+// This function will write a warning to stderr
+func warnf(format string, args ...interface{}) {
+	stderrLog.write(LOG_LEVEL_WARN, "Warning: "+fmt.Sprintf(format, args...))
+}
+
+// This function will return where the secretenv package writes its diagnostics, nil when the debug level
+// is not enabled
+func debugWriter() io.Writer {
+	if stderrLog.enabled(LOG_LEVEL_DEBUG) {
+		return levelWriter{LOG_LEVEL_DEBUG}
+	}
+
+	return nil
+}
+
+// This function will return where the secretenv package writes its warnings
+func warningWriter() io.Writer {
+	return levelWriter{LOG_LEVEL_WARN}
+}
+
+// This function will write the error that the process exits with, in JSON along with the exit code
+func logExit(err error, code int) {
+	if stderrLog.format == LOG_FORMAT_JSON {
+		stderrLog.write(LOG_LEVEL_ERROR, fmt.Sprintf("exit_code=%d error=%q", code, err.Error()))
+	} else {
+		stderrLog.write(LOG_LEVEL_ERROR, err.Error())
+	}
+}
@@ -0,0 +1,189 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// This code is used to write CloudWatch Embedded Metric Format records for the retrieval so that
+// slow or failing secret retrievals can be alarmed on without any other instrumentation.
+//
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"go-retrieve-secret/pkg/secretenv"
+
+	"github.com/aws/smithy-go"
+)
+
+// The CloudWatch namespace the metrics are recorded in when -metrics-namespace is not supplied
+const DEFAULT_METRICS_NAMESPACE = "GoRetrieveSecret"
+
+// The duration and outcome of retrieving a single secret
+type secretMetric struct {
+	secretId string
+	elapsed  time.Duration
+	err      error
+}
+
+// Collects the metrics of a run until they are written, it is safe to use from several goroutines
+type metricsRecorder struct {
+	mutex     sync.Mutex
+	secrets   []secretMetric
+	cache     *bool
+	throttles int
+}
+
+// The recorder of the run, nil when -metrics was not supplied
+var metrics *metricsRecorder
+
+// This function will record the retrieval of a single secret, it is used as the Observe function of the config
+func (m *metricsRecorder) observe(secretId string, elapsed time.Duration, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.secrets = append(m.secrets, secretMetric{secretId, elapsed, err})
+}
+
+// This function will record whether the secrets were found in the cache file
+func (m *metricsRecorder) observeCache(hit bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.cache = &hit
+}
+
+// This function will record an attempt of an API call that was throttled, it does nothing without -metrics
+func (m *metricsRecorder) observeThrottle() {
+	if m == nil {
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.throttles++
+}
+
+// This function will write the metrics as EMF records, one line each, with the time of the whole run:
+//
+//   - RetrievalDuration of each secret with the SecretId dimension
+//   - SecretCount, Duration, CacheHit, CacheMiss, Failed, and Throttled for the whole run without dimensions
+//   - Failures of each type of error, such as AccessDeniedException, with the ErrorType dimension
+//
+// The records are written to stderr since stdout holds the secrets, Lambda sends both to CloudWatch Logs.
+func (m *metricsRecorder) write(w io.Writer, namespace string, elapsed time.Duration, runErr error) {
+	if m == nil {
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now().UnixMilli()
+
+	for _, secret := range m.secrets {
+		writeEmf(w, namespace, now, []string{"SecretId"}, map[string]interface{}{"SecretId": secret.secretId},
+			map[string]float64{"RetrievalDuration": milliseconds(secret.elapsed)})
+	}
+
+	run := map[string]float64{"SecretCount": float64(len(m.secrets)), "Duration": milliseconds(elapsed), "Failed": 0,
+		"Throttled": float64(m.throttles)}
+	if runErr != nil {
+		run["Failed"] = 1
+	}
+	if m.cache != nil {
+		run["CacheHit"], run["CacheMiss"] = 0, 1
+		if *m.cache {
+			run["CacheHit"], run["CacheMiss"] = 1, 0
+		}
+	}
+	writeEmf(w, namespace, now, []string{}, nil, run)
+
+	failures := map[string]float64{}
+	for _, secret := range m.secrets {
+		if secret.err != nil {
+			failures[errorType(secret.err)]++
+		}
+	}
+
+	types := make([]string, 0, len(failures))
+	for kind := range failures {
+		types = append(types, kind)
+	}
+	sort.Strings(types)
+
+	for _, kind := range types {
+		writeEmf(w, namespace, now, []string{"ErrorType"}, map[string]interface{}{"ErrorType": kind},
+			map[string]float64{"Failures": failures[kind]})
+	}
+}
+
+// This function will write a single EMF record with the values of the dimensions and metrics
+func writeEmf(w io.Writer, namespace string, timestamp int64, dimensions []string, values map[string]interface{}, measured map[string]float64) {
+	names := make([]string, 0, len(measured))
+	for name := range measured {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	definitions := make([]map[string]string, len(names))
+	record := map[string]interface{}{}
+
+	for i, name := range names {
+		unit := "Count"
+		if name == "Duration" || name == "RetrievalDuration" {
+			unit = "Milliseconds"
+		}
+
+		definitions[i] = map[string]string{"Name": name, "Unit": unit}
+		record[name] = measured[name]
+	}
+
+	for key, value := range values {
+		record[key] = value
+	}
+
+	record["_aws"] = map[string]interface{}{
+		"Timestamp": timestamp,
+		"CloudWatchMetrics": []interface{}{map[string]interface{}{
+			"Namespace":  namespace,
+			"Dimensions": [][]string{dimensions},
+			"Metrics":    definitions,
+		}},
+	}
+
+	data, _ := json.Marshal(record)
+	fmt.Fprintln(w, string(data))
+}
+
+// This function will return the name an error is counted as, the error code of an AWS API error or the
+// kind of error returned by the secretenv package
+func errorType(err error) string {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode()
+	}
+
+	var parseErr *secretenv.ParseError
+	if errors.As(err, &parseErr) {
+		return "ParseError"
+	}
+
+	var inputErr *secretenv.InputError
+	if errors.As(err, &inputErr) {
+		return "InputError"
+	}
+
+	return "Error"
+}
+
+// This function will return the duration as a number of milliseconds
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
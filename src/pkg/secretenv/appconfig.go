@@ -0,0 +1,120 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// This code is used to retrieve the configuration deployed with AWS AppConfig, such as feature flags,
+// so that it can be merged with the secrets and written in the same output formats.
+//
+package secretenv
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/appconfigdata"
+)
+
+// The AppConfig Data operations used by this package.  *appconfigdata.Client implements this interface.
+type AppConfigAPI interface {
+	StartConfigurationSession(ctx context.Context, params *appconfigdata.StartConfigurationSessionInput, optFns ...func(*appconfigdata.Options)) (*appconfigdata.StartConfigurationSessionOutput, error)
+	GetLatestConfiguration(ctx context.Context, params *appconfigdata.GetLatestConfigurationInput, optFns ...func(*appconfigdata.Options)) (*appconfigdata.GetLatestConfigurationOutput, error)
+}
+
+// This function will parse a single configuration profile in the form [prefix=]APPLICATION/ENVIRONMENT/PROFILE,
+// each part is either the name or the id.  The prefix follows the same rules as for secrets.
+func ParseAppConfigSpec(value string) (Secret, error) {
+	name := strings.TrimSpace(value)
+
+	spec := Secret{Id: name}
+	if i := strings.Index(name, "="); i > 0 && IsValidEnvName(name[:i]) {
+		spec.Prefix = name[:i]
+		spec.Id = strings.TrimSpace(name[i+1:])
+	}
+
+	if _, _, _, err := splitAppConfigId(spec.Id); err != nil {
+		return spec, err
+	}
+
+	return spec, nil
+}
+
+// This function will split the id of a configuration profile into its application, environment, and profile
+func splitAppConfigId(id string) (string, string, string, error) {
+	parts := strings.Split(id, "/")
+
+	if len(parts) != 3 || len(parts[0]) == 0 || len(parts[1]) == 0 || len(parts[2]) == 0 {
+		return "", "", "", fmt.Errorf("the configuration %q is not in the form APPLICATION/ENVIRONMENT/PROFILE", id)
+	}
+
+	return parts[0], parts[1], parts[2], nil
+}
+
+// This function will retrieve the deployed configuration of each of the AppConfigs of the config and return
+// the keys and values of each one in the same order as the AppConfigs.  A JSON configuration, which
+// includes feature flags, is converted the same as a secret and text is read as a dotenv file.
+func (c Config) retrieveAppConfigs(ctx context.Context) ([]map[string]interface{}, error) {
+	if c.AppConfigClient == nil {
+		return nil, inputError("AppConfig configurations were supplied but no AppConfig client was configured")
+	}
+
+	results := make([]map[string]interface{}, len(c.AppConfigs))
+
+	for i, spec := range c.AppConfigs {
+		application, environment, profile, err := splitAppConfigId(spec.Id)
+
+		if err != nil {
+			return nil, inputError("%w", err)
+		}
+
+		session, err := c.AppConfigClient.StartConfigurationSession(ctx, &appconfigdata.StartConfigurationSessionInput{
+			ApplicationIdentifier:          aws.String(application),
+			EnvironmentIdentifier:          aws.String(environment),
+			ConfigurationProfileIdentifier: aws.String(profile),
+		})
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to start a session for configuration %s: %w", spec.Id, err)
+		}
+
+		output, err := c.AppConfigClient.GetLatestConfiguration(ctx, &appconfigdata.GetLatestConfigurationInput{
+			ConfigurationToken: session.InitialConfigurationToken,
+		})
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to retrieve configuration %s: %w", spec.Id, err)
+		}
+
+		values, err := parseAppConfig(aws.ToString(output.ContentType), string(output.Configuration))
+
+		if err != nil {
+			return nil, parseError("Failed to convert configuration %s: %w", spec.Id, err)
+		}
+
+		if c.Flatten {
+			values = c.FlattenValues(values)
+		}
+
+		results[i] = values
+	}
+
+	return results, nil
+}
+
+// This function will convert the content of a configuration with the content type into its keys and values
+func parseAppConfig(contentType string, text string) (map[string]interface{}, error) {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0]))
+	trimmed := strings.TrimSpace(strings.TrimPrefix(text, UTF8_BOM))
+
+	switch {
+	case strings.Contains(mediaType, "yaml"):
+		return nil, fmt.Errorf("YAML configurations are not supported, deploy the configuration as JSON or text")
+	case strings.HasPrefix(trimmed, "{"):
+		return parseString("", text)
+	case mediaType == "application/json" && len(trimmed) > 0:
+		return nil, fmt.Errorf("the configuration is not a JSON object")
+	}
+
+	return ParseDotenv(text)
+}
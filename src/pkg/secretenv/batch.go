@@ -0,0 +1,140 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// This code is used to retrieve several secrets with each BatchGetSecretValue call instead of
+// calling GetSecretValue for every secret.
+//
+package secretenv
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/smithy-go"
+)
+
+// BatchGetSecretValue accepts at most this many secret ids in a single call
+const MAX_SECRETS_PER_BATCH = 20
+
+// This function will determine if the secret can be retrieved with BatchGetSecretValue.  The batch call
+// always returns the AWSCURRENT version, so secrets that ask for a version, are pinned by a manifest, or
+// are in another region or retrieved with their own role must be retrieved one at a time.
+func (c Config) batchable(secret Secret) bool {
+	return len(secret.VersionId) == 0 && len(secret.VersionStage) == 0 && len(secret.Region) == 0 && len(secret.RoleArn) == 0 && c.Pinned == nil
+}
+
+// This function will retrieve the batchable secrets into the results, returning which of the secrets were
+// retrieved.  A secret that is not returned by the batch calls, e.g. because it was given as a partial ARN
+// that does not match the name or ARN in the response, is left to be retrieved one at a time.  The errors
+// reported for individual secrets in a response are all returned, wrapping the error of the first secret.
+func (c Config) retrieveBatches(ctx context.Context, client SecretsManagerAPI, results []retrievedSecret) ([]bool, error) {
+	batched := make([]bool, len(c.Secrets))
+
+	var indexes []int
+	for i, secret := range c.Secrets {
+		if c.batchable(secret) {
+			indexes = append(indexes, i)
+		}
+	}
+
+batches:
+	for start := 0; start < len(indexes); start += MAX_SECRETS_PER_BATCH {
+		end := start + MAX_SECRETS_PER_BATCH
+		if end > len(indexes) {
+			end = len(indexes)
+		}
+
+		ids := make([]string, 0, end-start)
+		for _, i := range indexes[start:end] {
+			ids = append(ids, c.Secrets[i].Id)
+		}
+
+		found := map[string]*secretsmanager.GetSecretValueOutput{}
+		var failures []string
+		var firstErr error
+
+		input := &secretsmanager.BatchGetSecretValueInput{SecretIdList: ids}
+		started := time.Now()
+
+		for {
+			output, err := client.BatchGetSecretValue(ctx, input)
+
+			if err != nil {
+				// With BestEffort the secrets of the batch are retrieved one at a time so that each one
+				// that fails is recorded on its own, and with FallbackRegions so that each one may fail over
+				if c.BestEffort || len(c.FallbackRegions) > 0 {
+					continue batches
+				}
+				return nil, fmt.Errorf("Failed to retrieve secrets %s: %w", strings.Join(ids, ","), err)
+			}
+
+			for _, entry := range output.SecretValues {
+				secret := &secretsmanager.GetSecretValueOutput{
+					ARN:           entry.ARN,
+					Name:          entry.Name,
+					SecretBinary:  entry.SecretBinary,
+					SecretString:  entry.SecretString,
+					VersionId:     entry.VersionId,
+					VersionStages: entry.VersionStages,
+				}
+				found[aws.ToString(entry.Name)] = secret
+				found[aws.ToString(entry.ARN)] = secret
+			}
+
+			for _, failure := range output.Errors {
+				apiErr := &smithy.GenericAPIError{Code: aws.ToString(failure.ErrorCode), Message: aws.ToString(failure.Message)}
+				failures = append(failures, aws.ToString(failure.SecretId)+": "+apiErr.Error())
+
+				if firstErr == nil {
+					firstErr = fmt.Errorf("Failed to retrieve secret %s: %w", aws.ToString(failure.SecretId), apiErr)
+				}
+
+				if c.Observe != nil {
+					c.Observe(aws.ToString(failure.SecretId), time.Since(started), apiErr)
+				}
+			}
+
+			if output.NextToken == nil {
+				break
+			}
+			input.NextToken = output.NextToken
+		}
+
+		if firstErr != nil && !c.BestEffort && len(c.FallbackRegions) == 0 {
+			if len(failures) > 1 {
+				return nil, fmt.Errorf("%w (all failures: %s)", firstErr, strings.Join(failures, "; "))
+			}
+			return nil, firstErr
+		}
+
+		for _, i := range indexes[start:end] {
+			secretId := c.Secrets[i].Id
+			output, ok := found[secretId]
+
+			if !ok {
+				continue
+			}
+
+			if c.Observe != nil {
+				c.Observe(secretId, time.Since(started), nil)
+			}
+
+			result, err := c.convertSecret(c.Secrets[i], output)
+
+			if err != nil && !c.BestEffort {
+				return nil, err
+			}
+			result.err = err
+
+			results[i] = result
+			batched[i] = true
+		}
+	}
+
+	return batched, nil
+}
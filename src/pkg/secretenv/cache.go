@@ -0,0 +1,90 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// This code is used to keep retrieved secrets in memory for a short time so that a process
+// that retrieves the same secrets repeatedly does not call Secrets Manager every time.
+//
+package secretenv
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+// A SecretsManagerAPI that remembers the result of each GetSecretValue call for a fixed time.  The
+// secrets are only ever held in memory.  All other operations are passed straight to the wrapped client.
+type CachingClient struct {
+	SecretsManagerAPI
+
+	ttl     time.Duration
+	now     func() time.Time
+	mutex   sync.Mutex
+	entries map[cacheKey]cacheEntry
+}
+
+// The version of a secret that a GetSecretValue call asked for
+type cacheKey struct {
+	secretId     string
+	versionId    string
+	versionStage string
+}
+
+// A remembered GetSecretValue result and when it stops being used
+type cacheEntry struct {
+	output  *secretsmanager.GetSecretValueOutput
+	expires time.Time
+}
+
+// This function will return a client that caches the secrets retrieved through the supplied client for the
+// ttl.  A ttl of zero or less disables caching and the supplied client is returned as is.
+func NewCachingClient(client SecretsManagerAPI, ttl time.Duration) SecretsManagerAPI {
+	if ttl <= 0 {
+		return client
+	}
+
+	return &CachingClient{
+		SecretsManagerAPI: client,
+		ttl:               ttl,
+		now:               time.Now,
+		entries:           map[cacheKey]cacheEntry{},
+	}
+}
+
+// GetSecretValue returns the remembered result for the secret when it has not expired, otherwise the
+// secret is retrieved and remembered.  Failed calls are never remembered.  It is safe to call from several
+// goroutines, two goroutines that miss at the same time both call the wrapped client.
+func (c *CachingClient) GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+	key := cacheKey{aws.ToString(params.SecretId), aws.ToString(params.VersionId), aws.ToString(params.VersionStage)}
+
+	c.mutex.Lock()
+	entry, ok := c.entries[key]
+	c.mutex.Unlock()
+
+	if ok && c.now().Before(entry.expires) {
+		return entry.output, nil
+	}
+
+	output, err := c.SecretsManagerAPI.GetSecretValue(ctx, params, optFns...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	c.entries[key] = cacheEntry{output, c.now().Add(c.ttl)}
+	c.mutex.Unlock()
+
+	return output, nil
+}
+
+// This function will forget every remembered secret so that the next call for each one retrieves it again
+func (c *CachingClient) Flush() {
+	c.mutex.Lock()
+	c.entries = map[cacheKey]cacheEntry{}
+	c.mutex.Unlock()
+}
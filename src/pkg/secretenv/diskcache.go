@@ -0,0 +1,276 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// This code is used to keep the merged secrets in an encrypted file, e.g. in /tmp, so that
+// warm invocations of a Lambda function reuse them instead of calling Secrets Manager again.
+//
+package secretenv
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+// The start of a cache file written by WriteKMSCacheFile, which is followed by the length and the
+// encrypted data key
+const KMS_CACHE_MAGIC = "GRSKMS1\n"
+
+// The KMS operations used for the data key of a cache file.  *kms.Client implements this interface.
+type DataKeyAPI interface {
+	GenerateDataKey(ctx context.Context, params *kms.GenerateDataKeyInput, optFns ...func(*kms.Options)) (*kms.GenerateDataKeyOutput, error)
+	Decrypt(ctx context.Context, params *kms.DecryptInput, optFns ...func(*kms.Options)) (*kms.DecryptOutput, error)
+}
+
+// The contents of a cache file before it is encrypted
+type cacheFile struct {
+	Fingerprint string
+	Expires     time.Time
+	Result      *Result
+}
+
+// This function will derive the key that cache files are encrypted with from the credentials of the AWS
+// config and the log stream of the Lambda execution environment.  Only a process holding the same
+// credentials in the same execution environment can read the cache, and the cache is no longer readable
+// once the credentials are refreshed.
+func EnvironmentKey(ctx context.Context, cfg aws.Config) ([]byte, error) {
+	if cfg.Credentials == nil {
+		return nil, fmt.Errorf("no credentials are available to derive the cache key from")
+	}
+
+	credentials, err := cfg.Credentials.Retrieve(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.New()
+	for _, part := range []string{credentials.SecretAccessKey, credentials.SessionToken, os.Getenv("AWS_LAMBDA_LOG_STREAM_NAME")} {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+
+	return hash.Sum(nil), nil
+}
+
+// This function will return a digest of the options that select the secrets and how they are merged.  A
+// cache file written with different options is never used.
+func (o Options) Fingerprint() string {
+	data, _ := json.Marshal(struct {
+		Region          string
+		Roles           []AssumeRoleOptions
+		TagFilters      []TagFilter
+		Secrets         []Secret
+		Parameters      []Secret
+		Ciphertexts     []Secret
+		Objects         []Secret
+		AppConfigs      []Secret
+		Sources         []Secret
+		Pinned          map[string]string
+		UppercaseKeys   bool
+		SanitizeKeys    bool
+		StripPrefixes   []string
+		Flatten         bool
+		FlattenDepth    int
+		DecodeNested    bool
+		Separator       string
+		FailOnCollision bool
+		MergeStrategy   string
+		Renames         []RenameRule
+		Include         []string
+		Exclude         []string
+		BinaryDir       string
+		MaxSecretSize   int
+	}{o.Region, o.Roles, o.TagFilters, o.Secrets, o.Parameters, o.Ciphertexts, o.Objects, o.AppConfigs, o.Sources, o.Pinned, o.UppercaseKeys, o.SanitizeKeys, o.StripPrefixes, o.Flatten, o.FlattenDepth, o.DecodeNestedJson, o.Separator,
+		o.FailOnCollision, o.MergeStrategy, o.Renames, o.Include, o.Exclude, o.BinaryDir, o.MaxSecretSize})
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// This function will read the merged secrets from the encrypted cache file.  A missing, expired, or
+// unreadable file, or one written for a different fingerprint, is a cache miss and returns nil.
+func ReadCacheFile(path string, key []byte, fingerprint string) (*Result, error) {
+	data, err := ioutil.ReadFile(path)
+
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return openCache(data, key, fingerprint)
+}
+
+// This function will encrypt the merged secrets with AES-GCM and write them to the cache file, which is
+// only readable by the owner.  The file is used until the ttl has passed.
+func WriteCacheFile(path string, key []byte, fingerprint string, ttl time.Duration, result *Result) error {
+	sealed, err := sealCache(key, fingerprint, ttl, result)
+
+	if err != nil {
+		return err
+	}
+
+	return WriteFileAtomic(path, sealed, 0600)
+}
+
+// This function will read the merged secrets from a cache file written by WriteKMSCacheFile.  The data key
+// stored in the file is decrypted with the KMS key, so any process allowed to decrypt with the key can
+// read the file, including after the credentials are refreshed.  A file written with another key or
+// without KMS is a cache miss and returns nil.
+func ReadKMSCacheFile(ctx context.Context, path string, client DataKeyAPI, keyId string, fingerprint string) (*Result, error) {
+	data, err := ioutil.ReadFile(path)
+
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if !bytes.HasPrefix(data, []byte(KMS_CACHE_MAGIC)) {
+		return nil, nil
+	}
+
+	data = data[len(KMS_CACHE_MAGIC):]
+	if len(data) < 4 || int(binary.BigEndian.Uint32(data)) > len(data)-4 {
+		return nil, nil
+	}
+
+	size := int(binary.BigEndian.Uint32(data))
+	blob, sealed := data[4:4+size], data[4+size:]
+
+	output, err := client.Decrypt(ctx, &kms.DecryptInput{
+		CiphertextBlob:    blob,
+		KeyId:             aws.String(keyId),
+		EncryptionContext: map[string]string{"fingerprint": fingerprint},
+	})
+
+	var incorrectKey *types.IncorrectKeyException
+	var invalidCiphertext *types.InvalidCiphertextException
+
+	if errors.As(err, &incorrectKey) || errors.As(err, &invalidCiphertext) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to decrypt the data key with %s: %w", keyId, err)
+	}
+
+	return openCache(sealed, output.Plaintext, fingerprint)
+}
+
+// This function will encrypt the merged secrets with AES-GCM using a new data key generated with the KMS
+// key and write them to the cache file along with the encrypted data key.  The plaintext data key is
+// never written.
+func WriteKMSCacheFile(ctx context.Context, path string, client DataKeyAPI, keyId string, fingerprint string, ttl time.Duration, result *Result) error {
+	output, err := client.GenerateDataKey(ctx, &kms.GenerateDataKeyInput{
+		KeyId:             aws.String(keyId),
+		KeySpec:           types.DataKeySpecAes256,
+		EncryptionContext: map[string]string{"fingerprint": fingerprint},
+	})
+
+	if err != nil {
+		return fmt.Errorf("Failed to generate a data key with %s: %w", keyId, err)
+	}
+
+	sealed, err := sealCache(output.Plaintext, fingerprint, ttl, result)
+
+	if err != nil {
+		return err
+	}
+
+	data := make([]byte, 0, len(KMS_CACHE_MAGIC)+4+len(output.CiphertextBlob)+len(sealed))
+	data = append(data, KMS_CACHE_MAGIC...)
+	data = binary.BigEndian.AppendUint32(data, uint32(len(output.CiphertextBlob)))
+	data = append(data, output.CiphertextBlob...)
+	data = append(data, sealed...)
+
+	return WriteFileAtomic(path, data, 0600)
+}
+
+// This function will decrypt the contents of a cache file, which are a miss when they cannot be
+// decrypted, were written for a different fingerprint, or expired
+func openCache(data []byte, key []byte, fingerprint string) (*Result, error) {
+	gcm, err := newGCM(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// A file that cannot be decrypted was written with other credentials and is simply replaced
+	if len(data) < gcm.NonceSize() {
+		return nil, nil
+	}
+
+	plaintext, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], []byte(fingerprint))
+
+	if err != nil {
+		return nil, nil
+	}
+
+	var cached cacheFile
+	decoder := json.NewDecoder(bytes.NewReader(plaintext))
+	decoder.UseNumber()
+
+	if err := decoder.Decode(&cached); err != nil || cached.Result == nil {
+		return nil, nil
+	}
+
+	if cached.Fingerprint != fingerprint || time.Now().After(cached.Expires) {
+		return nil, nil
+	}
+
+	return cached.Result, nil
+}
+
+// This function will encrypt the merged secrets with AES-GCM, the nonce is followed by the ciphertext
+func sealCache(key []byte, fingerprint string, ttl time.Duration, result *Result) ([]byte, error) {
+	plaintext, err := json.Marshal(cacheFile{fingerprint, time.Now().Add(ttl), result})
+
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, []byte(fingerprint)), nil
+}
+
+// This function will return the AES-GCM cipher for the 32 byte key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, errors.New("the cache key must be 32 bytes")
+	}
+
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,217 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// This code is used to resolve the secrets from a local JSON file instead of Secrets Manager so that
+// the conversion can be tested, e.g. a Lambda run locally, without AWS credentials.
+//
+package secretenv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+)
+
+// The VersionId of every secret resolved by a FileClient
+const FILE_VERSION_ID = "file"
+
+// A SecretsManagerAPI that resolves the secrets from a JSON object mapping the name of each secret to its
+// value.  A string value is the SecretString of the secret and any other value is the SecretString of its
+// JSON, e.g. {"prod/db": {"username": "admin"}, "prod/api-key": "abc"}.  Every version of a secret is the
+// same value and the secrets have no tags or resource policies.
+type FileClient struct {
+	path    string
+	secrets map[string]string
+}
+
+// This function will read the JSON file of secrets for a FileClient.  The file is read again for each call
+// so that a refresh sees the changes made to it.
+func NewFileClient(path string) (*FileClient, error) {
+	secrets, err := readSecretsFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileClient{path: path, secrets: secrets}, nil
+}
+
+// This function will read the secrets of the JSON file
+func readSecretsFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var values map[string]json.RawMessage
+
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(string(data), UTF8_BOM)), &values); err != nil {
+		return nil, fmt.Errorf("the file %s is not a JSON object of secrets: %w", path, err)
+	}
+
+	secrets := map[string]string{}
+
+	for name, value := range values {
+		var text string
+
+		if err := json.Unmarshal(value, &text); err != nil {
+			text = strings.TrimSpace(string(value))
+		}
+
+		secrets[name] = text
+	}
+
+	return secrets, nil
+}
+
+// This function will return a FileClient that resolves each secret named by the map to its SecretString
+func NewFileClientFromValues(secrets map[string]string) *FileClient {
+	return &FileClient{secrets: secrets}
+}
+
+// This function will return the secrets, read again from the file when the client has one
+func (f *FileClient) load() (map[string]string, error) {
+	if len(f.path) == 0 {
+		return f.secrets, nil
+	}
+
+	return readSecretsFile(f.path)
+}
+
+// This function will return the name and value of the secret, the secret may be given by its name or by
+// an ARN ending with its name
+func (f *FileClient) find(secretId *string) (string, string, error) {
+	secrets, err := f.load()
+
+	if err != nil {
+		return "", "", err
+	}
+
+	name := aws.ToString(secretId)
+
+	if value, ok := secrets[name]; ok {
+		return name, value, nil
+	}
+
+	if parsed, err := arn.Parse(name); err == nil {
+		name = strings.TrimPrefix(parsed.Resource, "secret:")
+
+		if value, ok := secrets[name]; ok {
+			return name, value, nil
+		}
+
+		// The ARN of a secret ends with a hyphen and six random characters which are not part of the name
+		if i := strings.LastIndex(name, "-"); i >= 0 && len(name)-i == 7 {
+			if value, ok := secrets[name[:i]]; ok {
+				return name[:i], value, nil
+			}
+		}
+	}
+
+	return "", "", &types.ResourceNotFoundException{Message: aws.String(fmt.Sprintf("Secrets Manager can't find the specified secret %s in the file", aws.ToString(secretId)))}
+}
+
+// GetSecretValue returns the value of the secret from the file
+func (f *FileClient) GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+	name, value, err := f.find(params.SecretId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &secretsmanager.GetSecretValueOutput{
+		ARN:           aws.String(name),
+		Name:          aws.String(name),
+		SecretString:  aws.String(value),
+		VersionId:     aws.String(FILE_VERSION_ID),
+		VersionStages: []string{"AWSCURRENT"},
+	}, nil
+}
+
+// DescribeSecret returns the name of the secret with the VersionId of its only version
+func (f *FileClient) DescribeSecret(ctx context.Context, params *secretsmanager.DescribeSecretInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.DescribeSecretOutput, error) {
+	name, _, err := f.find(params.SecretId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &secretsmanager.DescribeSecretOutput{
+		ARN:                aws.String(name),
+		Name:               aws.String(name),
+		VersionIdsToStages: map[string][]string{FILE_VERSION_ID: {"AWSCURRENT"}},
+	}, nil
+}
+
+// GetResourcePolicy returns no policy for a secret in the file
+func (f *FileClient) GetResourcePolicy(ctx context.Context, params *secretsmanager.GetResourcePolicyInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetResourcePolicyOutput, error) {
+	name, _, err := f.find(params.SecretId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &secretsmanager.GetResourcePolicyOutput{ARN: aws.String(name), Name: aws.String(name)}, nil
+}
+
+// BatchGetSecretValue returns the values of the secrets in the file and an error for each one that is missing
+func (f *FileClient) BatchGetSecretValue(ctx context.Context, params *secretsmanager.BatchGetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.BatchGetSecretValueOutput, error) {
+	output := &secretsmanager.BatchGetSecretValueOutput{}
+
+	for _, secretId := range params.SecretIdList {
+		name, value, err := f.find(aws.String(secretId))
+
+		if err != nil {
+			output.Errors = append(output.Errors, types.APIErrorType{
+				SecretId:  aws.String(secretId),
+				ErrorCode: aws.String("ResourceNotFoundException"),
+				Message:   aws.String(err.Error()),
+			})
+			continue
+		}
+
+		output.SecretValues = append(output.SecretValues, types.SecretValueEntry{
+			ARN:           aws.String(name),
+			Name:          aws.String(name),
+			SecretString:  aws.String(value),
+			VersionId:     aws.String(FILE_VERSION_ID),
+			VersionStages: []string{"AWSCURRENT"},
+		})
+	}
+
+	return output, nil
+}
+
+// ListSecrets returns every secret in the file in the order of their names on a single page.  The filters
+// are not applied, FindSecrets checks each listed secret itself.
+func (f *FileClient) ListSecrets(ctx context.Context, params *secretsmanager.ListSecretsInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.ListSecretsOutput, error) {
+	secrets, err := f.load()
+
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(secrets))
+	for name := range secrets {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	output := &secretsmanager.ListSecretsOutput{}
+	for _, name := range names {
+		output.SecretList = append(output.SecretList, types.SecretListEntry{ARN: aws.String(name), Name: aws.String(name)})
+	}
+
+	return output, nil
+}
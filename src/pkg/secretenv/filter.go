@@ -0,0 +1,133 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// This code is used to find the secrets to retrieve from their tags or names instead of listing
+// the secret ids explicitly.
+//
+package secretenv
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+)
+
+// The prefixes of the filter forms accepted by ParseTagFilter
+const FILTER_TAG = "tag:"
+const FILTER_NAME_PREFIX = "name-prefix:"
+
+// A tag that a secret must have to be selected, or when NamePrefix is set the start of its name
+type TagFilter struct {
+	Key        string
+	Value      string
+	NamePrefix string
+}
+
+// This function will parse a filter in the form [tag:]KEY=VALUE, or name-prefix:PREFIX to select the
+// secrets whose names start with PREFIX, e.g. name-prefix:prod/billing/
+func ParseTagFilter(value string) (TagFilter, error) {
+	if strings.HasPrefix(value, FILTER_NAME_PREFIX) {
+		prefix := strings.TrimSpace(strings.TrimPrefix(value, FILTER_NAME_PREFIX))
+
+		if len(prefix) == 0 {
+			return TagFilter{}, fmt.Errorf("filter %q must be in the form name-prefix:PREFIX", value)
+		}
+
+		return TagFilter{NamePrefix: prefix}, nil
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(value, FILTER_TAG), "=", 2)
+
+	if len(parts) != 2 || len(strings.TrimSpace(parts[0])) == 0 {
+		return TagFilter{}, fmt.Errorf("filter %q must be in the form [tag:]TAG-KEY=TAG-VALUE or name-prefix:PREFIX", value)
+	}
+
+	return TagFilter{Key: strings.TrimSpace(parts[0]), Value: strings.TrimSpace(parts[1])}, nil
+}
+
+// String will return the filter in the form accepted by ParseTagFilter
+func (f TagFilter) String() string {
+	if len(f.NamePrefix) > 0 {
+		return FILTER_NAME_PREFIX + f.NamePrefix
+	}
+
+	return f.Key + "=" + f.Value
+}
+
+// This function will return the ARNs of the secrets that match every one of the filters, in the order that
+// ListSecrets returns them.  ListSecrets matches tag keys and values separately and by prefix, and names
+// without regard to case, so each listed secret is checked for an exact key and value pair and name
+// prefix.  Every page of results is read.
+func FindSecrets(ctx context.Context, client secretsmanager.ListSecretsAPIClient, filters []TagFilter) ([]string, error) {
+	input := &secretsmanager.ListSecretsInput{}
+
+	for _, filter := range filters {
+		if len(filter.NamePrefix) > 0 {
+			input.Filters = append(input.Filters, types.Filter{Key: types.FilterNameStringTypeName, Values: []string{filter.NamePrefix}})
+			continue
+		}
+
+		input.Filters = append(input.Filters,
+			types.Filter{Key: types.FilterNameStringTypeTagKey, Values: []string{filter.Key}},
+			types.Filter{Key: types.FilterNameStringTypeTagValue, Values: []string{filter.Value}},
+		)
+	}
+
+	var arns []string
+	paginator := secretsmanager.NewListSecretsPaginator(client, input)
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, secret := range page.SecretList {
+			if matches(secret, filters) {
+				arns = append(arns, aws.ToString(secret.ARN))
+			}
+		}
+	}
+
+	return arns, nil
+}
+
+// This function will determine if the secret matches every one of the filters
+func matches(secret types.SecretListEntry, filters []TagFilter) bool {
+	for _, filter := range filters {
+		if len(filter.NamePrefix) > 0 && !strings.HasPrefix(aws.ToString(secret.Name), filter.NamePrefix) {
+			return false
+		}
+	}
+
+	return hasTags(secret.Tags, filters)
+}
+
+// This function will determine if the tags include every one of the tag filters
+func hasTags(tags []types.Tag, filters []TagFilter) bool {
+	for _, filter := range filters {
+		if len(filter.NamePrefix) > 0 {
+			continue
+		}
+
+		found := false
+		for _, tag := range tags {
+			if aws.ToString(tag.Key) == filter.Key && aws.ToString(tag.Value) == filter.Value {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,143 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// This code is used to decrypt values that were encrypted directly with KMS, e.g. a base64
+// ciphertext stored in an environment variable, so that they are merged with the secrets.
+//
+package secretenv
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+// The prefixes of a ciphertext that is read from an environment variable or a file instead of being
+// supplied as is
+const CIPHERTEXT_ENV = "env:"
+const CIPHERTEXT_FILE = "file:"
+
+// The KMS operations used by this package.  *kms.Client implements this interface.
+type KMSAPI interface {
+	Decrypt(ctx context.Context, params *kms.DecryptInput, optFns ...func(*kms.Options)) (*kms.DecryptOutput, error)
+}
+
+// This function will parse a single ciphertext in the form [prefix=]SOURCE, where the source is the base64
+// ciphertext itself, env:NAME for an environment variable holding it, or file:PATH for a file holding it.
+// The prefix follows the same rules as for secrets and names the value when the plaintext is not JSON.
+func ParseCiphertextSpec(value string) (Secret, error) {
+	source := strings.TrimSpace(value)
+
+	// The = padding at the end of a base64 ciphertext is not the separator of a prefix
+	spec := Secret{Id: source}
+	if i := strings.Index(source, "="); i > 0 && IsValidEnvName(source[:i]) && len(strings.Trim(source[i:], "=")) > 0 {
+		spec.Prefix = source[:i]
+		spec.Id = strings.TrimSpace(source[i+1:])
+	}
+
+	switch {
+	case len(spec.Id) == 0:
+		return spec, fmt.Errorf("no ciphertext was supplied in %q", source)
+	case len(spec.Prefix) == 0 && !strings.HasPrefix(spec.Id, CIPHERTEXT_ENV) && !strings.HasPrefix(spec.Id, CIPHERTEXT_FILE):
+		return spec, fmt.Errorf("a ciphertext supplied on the command line must be named, e.g. DB_CONFIG=CIPHERTEXT")
+	}
+
+	return spec, nil
+}
+
+// This function will return the name of the ciphertext used in messages and as its source, the ciphertext
+// itself is never included
+func CiphertextName(spec Secret) string {
+	if strings.HasPrefix(spec.Id, CIPHERTEXT_ENV) || strings.HasPrefix(spec.Id, CIPHERTEXT_FILE) {
+		return spec.Id
+	}
+
+	return "kms:" + spec.Prefix
+}
+
+// This function will decrypt the Ciphertexts of the config and return the keys and values of each one in
+// the same order as the Ciphertexts.  The key of a plaintext that is not JSON is the prefix of the
+// ciphertext, the name of its environment variable, or the name of its file without the extension.
+func (c Config) decryptCiphertexts(ctx context.Context) ([]retrievedSecret, error) {
+	if c.KMSClient == nil {
+		return nil, inputError("Ciphertexts were supplied but no KMS client was configured")
+	}
+
+	results := make([]retrievedSecret, len(c.Ciphertexts))
+
+	for i, spec := range c.Ciphertexts {
+		name := CiphertextName(spec)
+		text, keyName, err := readCiphertext(spec)
+
+		if err != nil {
+			return nil, inputError("Failed to read the ciphertext %s: %w", name, err)
+		}
+
+		blob, err := base64.StdEncoding.DecodeString(strings.TrimSpace(text))
+
+		if err != nil {
+			return nil, inputError("The ciphertext %s is not valid base64: %w", name, err)
+		}
+
+		output, err := c.KMSClient.Decrypt(ctx, &kms.DecryptInput{CiphertextBlob: blob})
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decrypt ciphertext %s: %w", name, err)
+		}
+
+		// A plaintext that is not a JSON object is named by the prefix, the same as a plaintext secret
+		plaintext := string(output.Plaintext)
+		named := len(spec.Prefix) > 0 && !strings.HasPrefix(strings.TrimSpace(strings.TrimPrefix(plaintext, UTF8_BOM)), "{")
+		if named {
+			keyName = spec.Prefix
+		}
+
+		values, err := parseString(keyName, plaintext)
+
+		if err != nil {
+			return nil, parseError("Failed to convert ciphertext %s to JSON: %w", name, err)
+		}
+
+		if c.Flatten {
+			values = c.FlattenValues(values)
+		}
+
+		results[i] = retrievedSecret{values: values, named: named}
+	}
+
+	return results, nil
+}
+
+// This function will return the base64 text of the ciphertext along with the key name of its plaintext
+func readCiphertext(spec Secret) (string, string, error) {
+	switch {
+	case strings.HasPrefix(spec.Id, CIPHERTEXT_ENV):
+		name := strings.TrimPrefix(spec.Id, CIPHERTEXT_ENV)
+		text, ok := os.LookupEnv(name)
+
+		if !ok {
+			return "", "", fmt.Errorf("the environment variable %s is not set", name)
+		}
+
+		return text, name, nil
+	case strings.HasPrefix(spec.Id, CIPHERTEXT_FILE):
+		path := strings.TrimPrefix(spec.Id, CIPHERTEXT_FILE)
+		data, err := ioutil.ReadFile(path)
+
+		if err != nil {
+			return "", "", err
+		}
+
+		base := filepath.Base(path)
+		return string(data), ParameterKeyName(strings.TrimSuffix(base, filepath.Ext(base))), nil
+	}
+
+	return spec.Id, spec.Prefix, nil
+}
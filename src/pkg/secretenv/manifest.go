@@ -0,0 +1,45 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// This code is used to read and write the manifest that pins each secret to the VersionId
+// that must be retrieved.
+//
+package secretenv
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// This function will read a manifest file that pins secret ids to the VersionId to retrieve.  The
+// manifest is a JSON object where each key is a secret id and each value is a VersionId.
+func ReadManifest(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var pinned map[string]string
+
+	if err := json.Unmarshal(data, &pinned); err != nil {
+		return nil, fmt.Errorf("manifest %s is not a JSON object of secret ids to VersionIds: %w", path, err)
+	}
+
+	return pinned, nil
+}
+
+// This function will write a manifest file pinning each secret id to the supplied VersionId so that
+// it can be used as the Pinned versions on later runs.  The file is replaced atomically, since a half
+// written manifest would leave every later run failing with secrets that are not pinned.
+func WriteManifest(path string, pinned map[string]string) error {
+	data, err := json.MarshalIndent(pinned, "", "    ")
+
+	if err != nil {
+		return err
+	}
+
+	return WriteFileAtomic(path, append(data, '\n'), 0644)
+}
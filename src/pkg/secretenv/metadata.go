@@ -0,0 +1,160 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// This code is used to describe the secrets, such as when they were last rotated, so that an
+// application or a dashboard can tell how fresh the secrets are without calling the APIs itself.
+//
+package secretenv
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+// The fields of the metadata accepted by ParseMetadataFields
+const METADATA_ROTATION_ENABLED = "rotation-enabled"
+const METADATA_LAST_ROTATED = "last-rotated"
+const METADATA_LAST_CHANGED = "last-changed"
+const METADATA_NEXT_ROTATION = "next-rotation"
+const METADATA_VERSION = "version"
+const METADATA_TAGS = "tags"
+
+// The metadata of a secret from DescribeSecret, the times are empty when Secrets Manager did not return them
+type SecretMetadata struct {
+	Name            string            `json:"name"`
+	ARN             string            `json:"arn"`
+	VersionId       string            `json:"version_id"`
+	RotationEnabled bool              `json:"rotation_enabled"`
+	LastRotated     *time.Time        `json:"last_rotated,omitempty"`
+	LastChanged     *time.Time        `json:"last_changed,omitempty"`
+	NextRotation    *time.Time        `json:"next_rotation,omitempty"`
+	Tags            map[string]string `json:"tags"`
+}
+
+// This function will parse a comma separated list of metadata fields, e.g. last-rotated,rotation-enabled
+func ParseMetadataFields(value string) ([]string, error) {
+	var fields []string
+
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+
+		switch field {
+		case "":
+			continue
+		case METADATA_ROTATION_ENABLED, METADATA_LAST_ROTATED, METADATA_LAST_CHANGED, METADATA_NEXT_ROTATION, METADATA_VERSION, METADATA_TAGS:
+			fields = append(fields, field)
+		default:
+			return nil, fmt.Errorf("metadata field %q must be one of rotation-enabled, last-rotated, last-changed, next-rotation, version, or tags", field)
+		}
+	}
+
+	return fields, nil
+}
+
+// This function will describe each of the secrets, e.g. those returned by Secrets, with the client of its
+// role or region and return their metadata by secret id.  Only DescribeSecret is called, so the values of
+// the secrets are not retrieved.
+func (r *Retriever) Metadata(ctx context.Context, secrets []Secret) (map[string]SecretMetadata, error) {
+	metadata := map[string]SecretMetadata{}
+
+	for _, secret := range secrets {
+		client, err := r.secretClient(ctx, secret)
+
+		if err != nil {
+			return nil, err
+		}
+
+		output, err := client.DescribeSecret(ctx, &secretsmanager.DescribeSecretInput{SecretId: aws.String(secret.Id)})
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to describe secret %s: %w", secret.Id, err)
+		}
+
+		described := SecretMetadata{
+			Name:            aws.ToString(output.Name),
+			ARN:             aws.ToString(output.ARN),
+			VersionId:       currentVersion(output.VersionIdsToStages),
+			RotationEnabled: aws.ToBool(output.RotationEnabled),
+			LastRotated:     utcTime(output.LastRotatedDate),
+			LastChanged:     utcTime(output.LastChangedDate),
+			NextRotation:    utcTime(output.NextRotationDate),
+			Tags:            map[string]string{},
+		}
+
+		for _, tag := range output.Tags {
+			described.Tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+		}
+
+		metadata[secret.Id] = described
+	}
+
+	return metadata, nil
+}
+
+// This function will return the time in UTC, nil when there is no time
+func utcTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+
+	utc := t.UTC()
+	return &utc
+}
+
+// This function will return the fields of the metadata of each secret as environment variables named after
+// the prefix of the secret, or the name of the secret when it has no prefix, e.g. PROD_DB_LAST_ROTATED for
+// prod/db or PROD_DB_TAG_OWNER for its owner tag.  Times are in RFC 3339 form and a time that Secrets Manager
+// did not return, such as the rotation of a secret that was never rotated, is an empty value.
+func MetadataValues(secrets []Secret, metadata map[string]SecretMetadata, fields []string) map[string]string {
+	values := map[string]string{}
+
+	for _, secret := range secrets {
+		described, ok := metadata[secret.Id]
+
+		if !ok {
+			continue
+		}
+
+		base := secret.Prefix
+		if len(base) == 0 {
+			base = SecretKeyName(secret.Id)
+		}
+
+		for _, field := range fields {
+			switch field {
+			case METADATA_ROTATION_ENABLED:
+				values[base+"_ROTATION_ENABLED"] = strconv.FormatBool(described.RotationEnabled)
+			case METADATA_LAST_ROTATED:
+				values[base+"_LAST_ROTATED"] = formatTime(described.LastRotated)
+			case METADATA_LAST_CHANGED:
+				values[base+"_LAST_CHANGED"] = formatTime(described.LastChanged)
+			case METADATA_NEXT_ROTATION:
+				values[base+"_NEXT_ROTATION"] = formatTime(described.NextRotation)
+			case METADATA_VERSION:
+				values[base+"_VERSION_ID"] = described.VersionId
+			case METADATA_TAGS:
+				for key, value := range described.Tags {
+					values[base+"_TAG_"+strings.ToUpper(SanitizeEnvName(key))] = value
+				}
+			}
+		}
+	}
+
+	return values
+}
+
+// This function will format the time in RFC 3339 form, an empty string when there is no time
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+
+	return t.Format(time.RFC3339)
+}
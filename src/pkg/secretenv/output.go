@@ -0,0 +1,703 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// This code is used to format the rendered environment variables in each of the supported
+// output formats, and to read and compare against previously written output.
+//
+package secretenv
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The supported output formats
+const FORMAT_PIPE = "pipe"
+const FORMAT_ENV_EXAMPLE = "env-example"
+const FORMAT_POWERSHELL = "powershell"
+const FORMAT_NUL = "nul"
+const FORMAT_EXPORT = "export"
+const FORMAT_JSON = "json"
+const FORMAT_DOTENV = "dotenv"
+const FORMAT_YAML = "yaml"
+
+// This function will format the keys and values using the supplied output format.  The raw values of
+// the secrets are used by the json format to keep nested objects intact.  Every format writes the keys in
+// the KeyOrder, so the output only changes when the secrets do.
+func (c Config) Format(format string, values map[string]string, raw map[string]interface{}) (string, error) {
+	var builder strings.Builder
+	keys := c.OrderedKeys(values)
+
+	// A key that is not a valid name would run as shell code when the export output is sourced, and could not
+	// be read back from the other formats that are sourced or parsed as variables
+	if RequiresEnvNames(format) {
+		for _, key := range keys {
+			if !IsValidEnvName(key) {
+				return "", fmt.Errorf("the key %s is not a valid environment variable name and cannot be written in the %s format", key, format)
+			}
+		}
+	}
+
+	switch format {
+	case FORMAT_JSON:
+		output, err := c.formatJson(keys, values, raw)
+
+		if err != nil {
+			return "", err
+		}
+
+		builder.WriteString(output)
+		builder.WriteByte('\n')
+	case FORMAT_ENV_EXAMPLE:
+		// Only the key names are written so that the output can be checked in as a template
+		for _, key := range keys {
+			fmt.Fprintf(&builder, "%s=\n", key)
+		}
+	case FORMAT_EXPORT:
+		// Each value is single quoted so that the output can be sourced by a shell without any of the
+		// characters in the value being interpreted, including pipes, newlines, and quotes
+		for _, key := range keys {
+			fmt.Fprintf(&builder, "export %s=%s\n", key, ShellQuote(values[key]))
+		}
+	case FORMAT_DOTENV:
+		for _, key := range keys {
+			fmt.Fprintf(&builder, "%s=%s\n", key, dotenvQuote(values[key]))
+		}
+	case FORMAT_YAML:
+		for _, key := range keys {
+			fmt.Fprintf(&builder, "%s: %s\n", yamlQuote(key), yamlQuote(values[key]))
+		}
+	case FORMAT_POWERSHELL:
+		for _, key := range keys {
+			fmt.Fprintf(&builder, "%s = \"%s\"\n", powerShellVariable(key), powerShellEscaper.Replace(values[key]))
+		}
+	case FORMAT_NUL:
+		// Each key and value is followed by a NUL, the one character that cannot appear in either, so
+		// that any value can be read back with e.g. read -d '' or xargs -0
+		for _, key := range keys {
+			if strings.ContainsRune(values[key], 0) {
+				return "", fmt.Errorf("the value of %s contains a NUL character and cannot be written in the nul format", key)
+			}
+
+			builder.WriteString(key)
+			builder.WriteByte(0)
+			builder.WriteString(values[key])
+			builder.WriteByte(0)
+		}
+	default:
+		// Size the buffer up front, each line holds the key and value plus the delimiter and newline
+		builder.Grow(EnvSize(values) + 2*len(values))
+
+		for _, key := range keys {
+			builder.WriteString(key)
+			builder.WriteByte('|')
+			builder.WriteString(values[key])
+			builder.WriteByte('\n')
+		}
+	}
+
+	return builder.String(), nil
+}
+
+// This function will format the values as a single JSON object with the keys in the supplied order.  A
+// value that was rendered as is from the secret is written as its raw JSON value, so nested objects and
+// arrays stay structured, while values that were derived or replaced, e.g. by a coalesce rule, are
+// written as strings.
+func (c Config) formatJson(keys []string, values map[string]string, raw map[string]interface{}) (string, error) {
+	var builder strings.Builder
+	builder.WriteByte('{')
+
+	for i, key := range keys {
+		var output interface{} = values[key]
+
+		if rawValue, ok := raw[key]; ok {
+			single := map[string]string{}
+			c.renderValue(single, key, rawValue)
+
+			if rendered, ok := single[key]; ok && rendered == values[key] {
+				output = rawValue
+			}
+		}
+
+		name, _ := json.Marshal(key)
+		data, err := json.Marshal(output)
+
+		if err != nil {
+			return "", err
+		}
+
+		if i > 0 {
+			builder.WriteByte(',')
+		}
+		builder.Write(name)
+		builder.WriteByte(':')
+		builder.Write(data)
+	}
+
+	builder.WriteByte('}')
+	return builder.String(), nil
+}
+
+// This function will wrap the value in single quotes for a POSIX shell.  A single quote cannot appear
+// within a single quoted string so each one closes the string, adds an escaped quote, and reopens it.
+func ShellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// This function will return the value as a YAML double quoted scalar.  A JSON string is also a valid YAML
+// double quoted scalar, so the JSON encoding escapes quotes, backslashes, newlines, and control characters.
+func yamlQuote(value string) string {
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+// Escapes the characters that are special within a dotenv double quoted value
+var dotenvEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n", "\r", "\\r")
+
+// This function will return the value as it is written in a dotenv file.  Values made up of only plain
+// characters are written as is, anything else is double quoted with quotes, backslashes, and newlines
+// escaped.
+func dotenvQuote(value string) string {
+	for _, c := range value {
+		if !(c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || strings.ContainsRune("-./:@%+,", c)) {
+			return "\"" + dotenvEscaper.Replace(value) + "\""
+		}
+	}
+
+	return value
+}
+
+// Reverses dotenvEscaper for the values of a dotenv file
+var dotenvUnescaper = strings.NewReplacer("\\\\", "\\", "\\\"", "\"", "\\n", "\n", "\\r", "\r")
+
+// This function will parse the text of a dotenv file into its keys and values.  Blank lines and lines
+// starting with # are skipped, a line may start with export, and a value may be double quoted with the
+// escapes written by the dotenv format, single quoted to be taken as is apart from the quotes written by
+// ShellQuote, over as many lines as it takes, or unquoted, where anything from a space followed by # is a
+// comment.  The error of a malformed line only includes its line number so that no value is ever shown.
+func ParseDotenv(text string) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	lines := strings.Split(strings.TrimPrefix(text, UTF8_BOM), "\n")
+
+	for i := 0; i < len(lines); i++ {
+		number := i + 1
+		line := strings.TrimSpace(strings.TrimSuffix(lines[i], "\r"))
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+
+		parts := strings.SplitN(line, "=", 2)
+		key := strings.TrimSpace(parts[0])
+
+		if len(parts) != 2 || !IsValidEnvName(key) {
+			return nil, fmt.Errorf("line %d is not in the form KEY=VALUE", number)
+		}
+
+		value := strings.TrimSpace(parts[1])
+
+		switch {
+		case len(value) >= 2 && value[0] == '"' && strings.HasSuffix(value, "\""):
+			value = dotenvUnescaper.Replace(value[1 : len(value)-1])
+		case strings.HasPrefix(value, "'"):
+			// A single quoted value written by the export format may span several lines, which are kept as
+			// they are
+			quoted := strings.TrimLeft(lines[i][strings.Index(lines[i], "=")+1:], " \t")
+			unquoted, ok := shellUnquote(strings.TrimRight(quoted, " \t\r"))
+
+			for !ok && i+1 < len(lines) {
+				i++
+				quoted += "\n" + lines[i]
+				unquoted, ok = shellUnquote(strings.TrimRight(quoted, " \t\r"))
+			}
+
+			if !ok {
+				return nil, fmt.Errorf("the value on line %d has no closing quote", number)
+			}
+			value = unquoted
+		case strings.HasPrefix(value, "\""):
+			return nil, fmt.Errorf("the value on line %d has no closing quote", number)
+		default:
+			if j := strings.Index(value, " #"); j >= 0 {
+				value = strings.TrimSpace(value[:j])
+			}
+		}
+
+		values[key] = value
+	}
+
+	return values, nil
+}
+
+// This function will remove the single quotes around a value and the quotes around each of its escaped
+// single quotes, the reverse of ShellQuote.  It returns false when a quote is not closed.
+func shellUnquote(value string) (string, bool) {
+	var builder strings.Builder
+
+	for len(value) > 0 {
+		switch {
+		case strings.HasPrefix(value, `\'`):
+			builder.WriteByte('\'')
+			value = value[2:]
+		case value[0] == '\'':
+			end := strings.IndexByte(value[1:], '\'')
+			if end < 0 {
+				return "", false
+			}
+
+			builder.WriteString(value[1 : end+1])
+			value = value[end+2:]
+		default:
+			return "", false
+		}
+	}
+
+	return builder.String(), true
+}
+
+// This function will determine if every key written in the format must be a valid environment variable name,
+// see IsValidEnvName, which is the case for the formats that are sourced by a shell or parsed as variables
+func RequiresEnvNames(format string) bool {
+	switch format {
+	case FORMAT_EXPORT, FORMAT_DOTENV, FORMAT_ENV_EXAMPLE, FORMAT_POWERSHELL:
+		return true
+	}
+
+	return false
+}
+
+// This function will determine if the key is a valid shell identifier and so can be used as the name of
+// an environment variable
+func IsValidEnvName(key string) bool {
+	if len(key) == 0 || (key[0] >= '0' && key[0] <= '9') {
+		return false
+	}
+
+	for _, c := range key {
+		if !(c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// This function will replace each character of the key that IsValidEnvName does not allow with an _, and
+// add an _ before a leading digit, e.g. api-key.primary becomes api_key_primary
+func SanitizeEnvName(key string) string {
+	name := []rune(key)
+
+	for i, c := range name {
+		if !(c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')) {
+			name[i] = '_'
+		}
+	}
+
+	if len(name) == 0 || (name[0] >= '0' && name[0] <= '9') {
+		return "_" + string(name)
+	}
+
+	return string(name)
+}
+
+// Escapes the characters that are special within a PowerShell double quoted string
+var powerShellEscaper = strings.NewReplacer("`", "``", "$", "`$", "\"", "\"\"")
+
+// Reverses powerShellEscaper for the values of the powershell format
+var powerShellUnescaper = strings.NewReplacer("``", "`", "`$", "$", "\"\"", "\"")
+
+// This function will return the PowerShell variable for the environment variable.  Names that are not
+// plain identifiers must use the braced form of the variable.
+func powerShellVariable(key string) string {
+	for _, c := range key {
+		if !(c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')) {
+			return "${env:" + strings.NewReplacer("`", "``", "}", "`}").Replace(key) + "}"
+		}
+	}
+
+	return "$env:" + key
+}
+
+// This function will return the keys of the supplied values in sorted order
+func SortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// This function will return the keys of the values in the KeyOrder of the config, followed by the keys that
+// are not in the KeyOrder in sorted order
+func (c Config) OrderedKeys(values map[string]string) []string {
+	if len(c.KeyOrder) == 0 {
+		return SortedKeys(values)
+	}
+
+	keys := make([]string, 0, len(values))
+	listed := make(map[string]bool, len(c.KeyOrder))
+
+	for _, key := range c.KeyOrder {
+		if _, ok := values[key]; ok && !listed[key] {
+			keys = append(keys, key)
+			listed[key] = true
+		}
+	}
+
+	for _, key := range SortedKeys(values) {
+		if !listed[key] {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// This function will return the number of bytes the keys and values use when set as environment variables
+func EnvSize(values map[string]string) int {
+	size := 0
+	for key, value := range values {
+		size += len(key) + len(value)
+	}
+
+	return size
+}
+
+// This function will return the SHA-256 checksum of the keys and values in hex, it is the same for the same
+// keys and values whatever order they are in so a refresh that changed nothing has the same checksum.  The
+// checksum is of the JSON object of the values, whose keys are sorted.
+func Checksum(values map[string]string) string {
+	data, _ := json.Marshal(values)
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// A secret, or all of the variables together when there is no Secret, that uses more bytes than the Limit
+type SizeError struct {
+	Secret string
+	Size   int
+	Limit  int
+
+	// The largest keys and how many bytes each uses, see LargestKeys
+	Largest []string
+}
+
+// Error is an implementation of the error interface
+func (e *SizeError) Error() string {
+	message := fmt.Sprintf("the environment variables use %d bytes which exceeds the limit of %d bytes", e.Size, e.Limit)
+	if len(e.Secret) > 0 {
+		message = fmt.Sprintf("the secret %s is %d bytes which exceeds the limit of %d bytes", e.Secret, e.Size, e.Limit)
+	}
+
+	if len(e.Largest) > 0 {
+		message += ", the largest keys are " + strings.Join(e.Largest, ", ")
+	}
+
+	return message
+}
+
+// This function will return up to n of the largest keys along with the number of bytes each uses and the
+// source it came from when it is known, e.g. TLS_CERT (2210 bytes from prod/tls), largest first
+func LargestKeys(values map[string]string, sources map[string]string, n int) []string {
+	keys := SortedKeys(values)
+	sort.SliceStable(keys, func(i, j int) bool {
+		return len(keys[i])+len(values[keys[i]]) > len(keys[j])+len(values[keys[j]])
+	})
+
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+
+	largest := make([]string, len(keys))
+	for i, key := range keys {
+		largest[i] = fmt.Sprintf("%s (%d bytes)", key, len(key)+len(values[key]))
+		if source, ok := sources[key]; ok {
+			largest[i] = fmt.Sprintf("%s (%d bytes from %s)", key, len(key)+len(values[key]), source)
+		}
+	}
+
+	return largest
+}
+
+// This function will split the values into the variables that fit within the limit and the overflow that
+// does not.  Keys are considered in sorted order so that the split is the same on every run.
+func SplitOverflow(values map[string]string, limit int) (map[string]string, map[string]string) {
+	kept := map[string]string{}
+	overflow := map[string]string{}
+	size := 0
+
+	for _, key := range SortedKeys(values) {
+		value := values[key]
+
+		if len(overflow) == 0 && size+len(key)+len(value) <= limit {
+			kept[key] = value
+			size += len(key) + len(value)
+		} else {
+			overflow[key] = value
+		}
+	}
+
+	return kept, overflow
+}
+
+// This function will read a file previously written in the output format and return the keys and values
+// that it contains, as Format rendered them, so that the file can be compared with the values it would be
+// replaced by.  A missing file is treated as being empty.  The error of a malformed file never includes a
+// value.
+func (c Config) ReadOutputFile(path string, format string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+
+	if os.IsNotExist(err) {
+		return map[string]string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return c.ParseOutput(format, string(data))
+}
+
+// This function will parse the text written by Format in the output format back into its keys and values,
+// see ReadOutputFile
+func (c Config) ParseOutput(format string, text string) (map[string]string, error) {
+	values := map[string]string{}
+
+	switch format {
+	case FORMAT_DOTENV, FORMAT_EXPORT, FORMAT_ENV_EXAMPLE:
+		parsed, err := ParseDotenv(text)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for key, value := range parsed {
+			values[key] = value.(string)
+		}
+	case FORMAT_JSON:
+		// The nested values that the json format keeps intact are rendered the same as Format renders them
+		var parsed map[string]interface{}
+		decoder := json.NewDecoder(strings.NewReader(text))
+		decoder.UseNumber()
+
+		if err := decoder.Decode(&parsed); err != nil {
+			return nil, fmt.Errorf("the file is not a JSON object")
+		}
+
+		for key, value := range parsed {
+			single := map[string]string{}
+			c.renderValue(single, key, value)
+
+			if rendered, ok := single[key]; ok {
+				values[key] = rendered
+			} else {
+				data, _ := json.Marshal(value)
+				values[key] = string(data)
+			}
+		}
+	case FORMAT_YAML:
+		for i, line := range strings.Split(text, "\n") {
+			if len(line) == 0 {
+				continue
+			}
+
+			key, value, err := parseYamlLine(line)
+
+			if err != nil {
+				return nil, fmt.Errorf("line %d is not in the form \"KEY\": \"VALUE\"", i+1)
+			}
+			values[key] = value
+		}
+	case FORMAT_POWERSHELL:
+		return parsePowerShell(text)
+	case FORMAT_NUL:
+		fields := strings.Split(text, "\x00")
+
+		// Every key and value is followed by a NUL, so the last field is the empty text after the last value
+		if len(fields)%2 != 1 || len(fields[len(fields)-1]) > 0 {
+			return nil, fmt.Errorf("the file does not hold a NUL after every key and value")
+		}
+
+		for i := 0; i+1 < len(fields); i += 2 {
+			values[fields[i]] = fields[i+1]
+		}
+	default:
+		for _, line := range strings.Split(text, "\n") {
+			if len(line) == 0 {
+				continue
+			}
+
+			parts := strings.SplitN(line, "|", 2)
+			if len(parts) == 2 {
+				values[parts[0]] = parts[1]
+			} else {
+				values[parts[0]] = ""
+			}
+		}
+	}
+
+	return values, nil
+}
+
+// This function will parse the lines of the powershell format.  A value is double quoted and may span
+// several lines, it ends at the first quote that is not doubled or escaped with a backtick.
+func parsePowerShell(text string) (map[string]string, error) {
+	values := map[string]string{}
+
+	for line := 1; len(text) > 0; line++ {
+		if !strings.HasPrefix(text, "$env:") {
+			return nil, fmt.Errorf("line %d is not in the form $env:KEY = \"VALUE\"", line)
+		}
+
+		end := strings.Index(text, " = \"")
+		if end < 0 {
+			return nil, fmt.Errorf("line %d is not in the form $env:KEY = \"VALUE\"", line)
+		}
+
+		key := text[len("$env:"):end]
+		start := end + len(" = \"")
+
+		i := start
+		for ; i < len(text); i++ {
+			if text[i] == '`' || (text[i] == '"' && i+1 < len(text) && text[i+1] == '"') {
+				i++
+			} else if text[i] == '"' {
+				break
+			}
+		}
+
+		if i >= len(text) {
+			return nil, fmt.Errorf("the value on line %d has no closing quote", line)
+		}
+
+		value := text[start:i]
+		values[key] = powerShellUnescaper.Replace(value)
+
+		line += strings.Count(value, "\n")
+		text = strings.TrimPrefix(text[i+1:], "\n")
+	}
+
+	return values, nil
+}
+
+// This function will parse a line of the yaml format, a double quoted key and value separated by a colon
+func parseYamlLine(line string) (string, string, error) {
+	var key, value string
+	decoder := json.NewDecoder(strings.NewReader(line))
+
+	if err := decoder.Decode(&key); err != nil {
+		return "", "", err
+	}
+
+	rest := line[decoder.InputOffset():]
+	if !strings.HasPrefix(rest, ": ") {
+		return "", "", fmt.Errorf("the key is not followed by a colon")
+	}
+
+	if err := json.Unmarshal([]byte(rest[2:]), &value); err != nil {
+		return "", "", err
+	}
+
+	return key, value, nil
+}
+
+// This function will write the data to the file by writing a temporary file in the same directory and
+// renaming it over the path, so a failure part way through never leaves a truncated file behind.  The
+// temporary file is given the mode before any data is written to it.
+func WriteFileAtomic(path string, data []byte, mode os.FileMode) error {
+	temp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+
+	if err != nil {
+		return err
+	}
+
+	// The temporary file is removed when anything fails, after a successful rename this does nothing
+	defer os.Remove(temp.Name())
+
+	if err := temp.Chmod(mode); err != nil {
+		temp.Close()
+		return err
+	}
+
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+
+	if err := temp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(temp.Name(), path)
+}
+
+// The placeholder printed instead of each value by PrintDryRun
+const REDACTED = "<redacted>"
+
+// This function will write each of the keys in sorted order with its value replaced by REDACTED.  When
+// showSources is set the secret each key came from, the VersionId that was retrieved, and the size of the
+// value in bytes are added as a comment, e.g. DB_USER=<redacted> # prod/db 0123...cdef 5 bytes.  Keys that
+// were derived, such as by a coalesce rule, have no source.
+func PrintDryRun(w io.Writer, values map[string]string, sources map[string]string, versions map[string]string, showSources bool) {
+	for _, key := range SortedKeys(values) {
+		if !showSources {
+			fmt.Fprintf(w, "%s=%s\n", key, REDACTED)
+			continue
+		}
+
+		source, version := "-", "-"
+		if id, ok := sources[key]; ok {
+			source = id
+			if versionId, ok := versions[id]; ok && len(versionId) > 0 {
+				version = versionId
+			}
+		}
+
+		fmt.Fprintf(w, "%s=%s # %s %s %d bytes\n", key, REDACTED, source, version, len(values[key]))
+	}
+}
+
+// This function will write the keys that were added, removed, or changed between the existing and new
+// values.  The values themselves are masked so that the diff is safe to share.
+func PrintDiff(w io.Writer, existing map[string]string, values map[string]string) {
+	keys := make([]string, 0, len(existing)+len(values))
+	for key := range existing {
+		keys = append(keys, key)
+	}
+	for key := range values {
+		if _, ok := existing[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		oldValue, inOld := existing[key]
+		newValue, inNew := values[key]
+
+		switch {
+		case !inOld:
+			fmt.Fprintf(w, "+ %s=****\n", key)
+		case !inNew:
+			fmt.Fprintf(w, "- %s=****\n", key)
+		case oldValue != newValue:
+			fmt.Fprintf(w, "~ %s=****\n", key)
+		}
+	}
+}
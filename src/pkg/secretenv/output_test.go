@@ -0,0 +1,303 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// These tests format the variables in each of the output formats and parse the dotenv format back.
+//
+package secretenv
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	values := map[string]string{"B_KEY": "it's $5", "A_KEY": "plain"}
+
+	tests := []struct {
+		format string
+		output string
+	}{
+		{FORMAT_PIPE, "A_KEY|plain\nB_KEY|it's $5\n"},
+		{FORMAT_EXPORT, "export A_KEY='plain'\nexport B_KEY='it'\\''s $5'\n"},
+		{FORMAT_DOTENV, "A_KEY=plain\nB_KEY=\"it's $5\"\n"},
+		{FORMAT_JSON, "{\"A_KEY\":\"plain\",\"B_KEY\":\"it's $5\"}\n"},
+		{FORMAT_YAML, "\"A_KEY\": \"plain\"\n\"B_KEY\": \"it's $5\"\n"},
+		{FORMAT_ENV_EXAMPLE, "A_KEY=\nB_KEY=\n"},
+		{FORMAT_POWERSHELL, "$env:A_KEY = \"plain\"\n$env:B_KEY = \"it's `$5\"\n"},
+		{FORMAT_NUL, "A_KEY\x00plain\x00B_KEY\x00it's $5\x00"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.format, func(t *testing.T) {
+			output, err := Config{}.Format(test.format, values, nil)
+
+			if err != nil {
+				t.Fatalf("Format failed: %s", err)
+			}
+
+			if output != test.output {
+				t.Errorf("Format returned %q, want %q", output, test.output)
+			}
+		})
+	}
+}
+
+func TestFormatPowerShellEscaping(t *testing.T) {
+	tests := []struct {
+		value string
+		line  string
+	}{
+		{value: "plain", line: `$env:KEY = "plain"`},
+		{value: "it's", line: `$env:KEY = "it's"`},
+		{value: "'quoted'", line: `$env:KEY = "'quoted'"`},
+		{value: "a`b", line: "$env:KEY = \"a``b\""},
+		{value: "`$HOME", line: "$env:KEY = \"```$HOME\""},
+		{value: "$HOME", line: "$env:KEY = \"`$HOME\""},
+		{value: "$(Remove-Item C:\\)", line: "$env:KEY = \"`$(Remove-Item C:\\)\""},
+		{value: `say "hi"`, line: `$env:KEY = "say ""hi"""`},
+		{value: "", line: `$env:KEY = ""`},
+	}
+
+	for _, test := range tests {
+		output, err := Config{}.Format(FORMAT_POWERSHELL, map[string]string{"KEY": test.value}, nil)
+
+		if err != nil {
+			t.Fatalf("Format failed: %s", err)
+		}
+
+		if output != test.line+"\n" {
+			t.Errorf("The value %q is written as %q, want %q", test.value, output, test.line+"\n")
+		}
+	}
+}
+
+func TestFormatKeyOrder(t *testing.T) {
+	values := map[string]string{"C": "3", "A": "1", "B": "2"}
+
+	output, err := Config{KeyOrder: []string{"C", "MISSING", "A"}}.Format(FORMAT_PIPE, values, nil)
+
+	if err != nil {
+		t.Fatalf("Format failed: %s", err)
+	}
+
+	if want := "C|3\nA|1\nB|2\n"; output != want {
+		t.Errorf("Format returned %q, want %q", output, want)
+	}
+}
+
+func TestFormatJsonKeepsRawValues(t *testing.T) {
+	raw := map[string]interface{}{"object": map[string]interface{}{"a": "b"}, "replaced": "old"}
+	values := map[string]string{"object": `{"a":"b"}`, "replaced": "new"}
+
+	output, err := Config{}.Format(FORMAT_JSON, values, raw)
+
+	if err != nil {
+		t.Fatalf("Format failed: %s", err)
+	}
+
+	if want := "{\"object\":{\"a\":\"b\"},\"replaced\":\"new\"}\n"; output != want {
+		t.Errorf("Format returned %q, want %q", output, want)
+	}
+}
+
+func TestFormatRejectsInvalidKeys(t *testing.T) {
+	for _, key := range []string{"x;touch /tmp/pwned;y", "A=1;touch /tmp/x;B", "$(id)", "api-key", "1A", ""} {
+		for _, format := range []string{FORMAT_EXPORT, FORMAT_DOTENV, FORMAT_ENV_EXAMPLE, FORMAT_POWERSHELL} {
+			if output, err := (Config{}).Format(format, map[string]string{key: "v"}, nil); err == nil {
+				t.Errorf("Format wrote the key %q in the %s format as %q", key, format, output)
+			}
+		}
+	}
+
+	// The formats that quote their keys can hold any key
+	for _, format := range []string{FORMAT_PIPE, FORMAT_JSON, FORMAT_YAML, FORMAT_NUL} {
+		if _, err := (Config{}).Format(format, map[string]string{"api-key.primary": "v"}, nil); err != nil {
+			t.Errorf("Format failed for the %s format: %s", format, err)
+		}
+	}
+}
+
+func TestFormatNulRejectsNul(t *testing.T) {
+	if _, err := (Config{}).Format(FORMAT_NUL, map[string]string{"KEY": "a\x00b"}, nil); err == nil {
+		t.Error("Format wrote a value holding a NUL in the nul format")
+	}
+}
+
+func TestParseDotenv(t *testing.T) {
+	tests := []struct {
+		name   string
+		text   string
+		values map[string]interface{}
+		err    string
+	}{
+		{
+			name:   "plain",
+			text:   "A=1\nB=two\n",
+			values: map[string]interface{}{"A": "1", "B": "two"},
+		},
+		{
+			name:   "comments and blank lines",
+			text:   "# comment\n\nA=1 # trailing\r\n",
+			values: map[string]interface{}{"A": "1"},
+		},
+		{
+			name:   "export",
+			text:   "export A='it'\nexport B=\"x\"\n",
+			values: map[string]interface{}{"A": "it", "B": "x"},
+		},
+		{
+			name:   "double quoted escapes",
+			text:   `A="line1\nline2 \"quoted\" \\ # not a comment"`,
+			values: map[string]interface{}{"A": "line1\nline2 \"quoted\" \\ # not a comment"},
+		},
+		{
+			name:   "single quoted as is",
+			text:   `A='a\nb $HOME'`,
+			values: map[string]interface{}{"A": `a\nb $HOME`},
+		},
+		{
+			name:   "empty value",
+			text:   "A=\n",
+			values: map[string]interface{}{"A": ""},
+		},
+		{
+			name: "missing equals",
+			text: "A=1\nsecret-value\n",
+			err:  "line 2 is not in the form KEY=VALUE",
+		},
+		{
+			name: "invalid key",
+			text: "1A=1\n",
+			err:  "line 1 is not in the form KEY=VALUE",
+		},
+		{
+			name: "unclosed quote",
+			text: "A=\"secret\n",
+			err:  "the value on line 1 has no closing quote",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			values, err := ParseDotenv(test.text)
+
+			if len(test.err) > 0 {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("ParseDotenv returned %v, want %q", err, test.err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("ParseDotenv failed: %s", err)
+			}
+
+			if !reflect.DeepEqual(values, test.values) {
+				t.Errorf("ParseDotenv returned %v, want %v", values, test.values)
+			}
+		})
+	}
+}
+
+func TestDotenvRoundTrips(t *testing.T) {
+	values := map[string]string{
+		"PLAIN":     "abc-1.2/3:4@5%6+7,8",
+		"SPACES":    "a b  c",
+		"QUOTES":    `it's "quoted"`,
+		"NEWLINES":  "line1\nline2\r\n",
+		"COMMENT":   "a #b",
+		"BACKSLASH": `C:\path\n`,
+		"EMPTY":     "",
+	}
+
+	output, err := Config{}.Format(FORMAT_DOTENV, values, nil)
+
+	if err != nil {
+		t.Fatalf("Format failed: %s", err)
+	}
+
+	parsed, err := ParseDotenv(output)
+
+	if err != nil {
+		t.Fatalf("ParseDotenv failed: %s", err)
+	}
+
+	for key, value := range values {
+		if parsed[key] != value {
+			t.Errorf("The value of %s was read back as %q, want %q", key, parsed[key], value)
+		}
+	}
+}
+
+func TestIsValidEnvName(t *testing.T) {
+	for key, valid := range map[string]bool{
+		"A": true, "_A": true, "a_b_1": true, "": false, "1A": false, "A-B": false, "A.B": false, "A B": false, "A=1": false, "A;B": false,
+	} {
+		if IsValidEnvName(key) != valid {
+			t.Errorf("IsValidEnvName(%q) returned %t, want %t", key, !valid, valid)
+		}
+	}
+}
+
+func TestSanitizeEnvName(t *testing.T) {
+	for key, want := range map[string]string{
+		"api-key.primary": "api_key_primary", "9x": "_9x", "": "_", "ok_1": "ok_1", strings.Repeat("-", 2): "__",
+	} {
+		if got := SanitizeEnvName(key); got != want {
+			t.Errorf("SanitizeEnvName(%q) returned %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestReadOutputFileRoundTrips(t *testing.T) {
+	values := map[string]string{
+		"PLAIN":    "abc",
+		"QUOTES":   `it's "quoted" ''`,
+		"SHELL":    "$HOME `id` $(id) | \\n",
+		"NEWLINES": "line1\nline2\r\n",
+		"OBJECT":   `{"a":"b"}`,
+		"EMPTY":    "",
+	}
+	raw := map[string]interface{}{"OBJECT": map[string]interface{}{"a": "b"}}
+
+	for _, format := range []string{FORMAT_PIPE, FORMAT_EXPORT, FORMAT_DOTENV, FORMAT_JSON, FORMAT_YAML, FORMAT_ENV_EXAMPLE, FORMAT_POWERSHELL, FORMAT_NUL} {
+		t.Run(format, func(t *testing.T) {
+			want := map[string]string{}
+			for key, value := range values {
+				switch {
+				case format == FORMAT_ENV_EXAMPLE:
+					// Only the keys are written
+					want[key] = ""
+				case format == FORMAT_PIPE && strings.Contains(value, "\n"):
+					// A line holds a single key and value
+				default:
+					want[key] = value
+				}
+			}
+
+			output, err := Config{}.Format(format, want, raw)
+
+			if err != nil {
+				t.Fatalf("Format failed: %s", err)
+			}
+
+			// The file written by -diff-against with -apply is compared with the same format on the next run
+			path := t.TempDir() + "/out"
+			if err := WriteFileAtomic(path, []byte(output), 0600); err != nil {
+				t.Fatalf("WriteFileAtomic failed: %s", err)
+			}
+
+			read, err := Config{}.ReadOutputFile(path, format)
+
+			if err != nil {
+				t.Fatalf("ReadOutputFile failed: %s", err)
+			}
+
+			if !reflect.DeepEqual(read, want) {
+				t.Errorf("ReadOutputFile returned %q, want %q", read, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// This code is used to retrieve values from SSM Parameter Store so that they can be merged
+// with the secrets and written in the same output formats.
+//
+package secretenv
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+// GetParameters accepts at most this many names in a single call
+const MAX_PARAMETERS_PER_CALL = 10
+
+// The SSM operations used by this package.  *ssm.Client implements this interface.
+type SSMAPI interface {
+	GetParameters(ctx context.Context, params *ssm.GetParametersInput, optFns ...func(*ssm.Options)) (*ssm.GetParametersOutput, error)
+	GetParametersByPath(ctx context.Context, params *ssm.GetParametersByPathInput, optFns ...func(*ssm.Options)) (*ssm.GetParametersByPathOutput, error)
+}
+
+// This function will parse a single parameter in the form [prefix=]name.  The name may be the name of
+// the parameter or its ARN, and the prefix follows the same rules as for secrets.  A name ending in / is
+// a path, every parameter below the path is retrieved.
+func ParseParameterSpec(value string) (Secret, error) {
+	name := strings.TrimSpace(value)
+
+	spec := Secret{Id: name}
+	if i := strings.Index(name, "="); i > 0 && IsValidEnvName(name[:i]) {
+		spec.Prefix = name[:i]
+		spec.Id = strings.TrimSpace(name[i+1:])
+	}
+
+	if len(spec.Id) == 0 {
+		return spec, fmt.Errorf("no parameter name was supplied in %q", name)
+	}
+
+	return spec, nil
+}
+
+// This function will retrieve the Parameters of the config, decrypting SecureString parameters, and return
+// the keys and values of each one in the same order as the Parameters.  The parameters are requested in
+// batches of MAX_PARAMETERS_PER_CALL.
+func (c Config) retrieveParameters(ctx context.Context) ([]map[string]interface{}, error) {
+	if c.ParameterClient == nil {
+		return nil, inputError("Parameters were supplied but no parameter client was configured")
+	}
+
+	found := map[string]types.Parameter{}
+
+	// Paths are retrieved with their own calls, the remaining names are requested together
+	named := make([]string, 0, len(c.Parameters))
+	for _, parameter := range c.Parameters {
+		if !IsParameterPath(parameter.Id) {
+			named = append(named, parameter.Id)
+		}
+	}
+
+	for start := 0; start < len(named); start += MAX_PARAMETERS_PER_CALL {
+		end := start + MAX_PARAMETERS_PER_CALL
+		if end > len(named) {
+			end = len(named)
+		}
+
+		names := named[start:end]
+
+		output, err := c.ParameterClient.GetParameters(ctx, &ssm.GetParametersInput{
+			Names:          names,
+			WithDecryption: aws.Bool(true),
+		})
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to retrieve parameters %s: %w", strings.Join(names, ","), err)
+		}
+
+		if len(output.InvalidParameters) > 0 {
+			return nil, fmt.Errorf("The parameters %s do not exist or are not accessible", strings.Join(output.InvalidParameters, ","))
+		}
+
+		// A parameter requested by its ARN is returned with its name, so it is found by either
+		for _, parameter := range output.Parameters {
+			found[aws.ToString(parameter.Name)] = parameter
+			found[aws.ToString(parameter.ARN)] = parameter
+		}
+	}
+
+	results := make([]map[string]interface{}, len(c.Parameters))
+
+	for i, spec := range c.Parameters {
+		if IsParameterPath(spec.Id) {
+			values, err := c.retrieveParameterPath(ctx, spec.Id)
+
+			if err != nil {
+				return nil, err
+			}
+
+			results[i] = values
+			continue
+		}
+
+		parameter, ok := found[spec.Id]
+
+		if !ok {
+			return nil, fmt.Errorf("The parameter %s was not returned by SSM", spec.Id)
+		}
+
+		values, err := parseString(ParameterKeyName(spec.Id), aws.ToString(parameter.Value))
+
+		if err != nil {
+			return nil, parseError("Failed to convert parameter %s to JSON: %w", spec.Id, err)
+		}
+
+		if c.Flatten {
+			values = c.FlattenValues(values)
+		}
+
+		results[i] = values
+	}
+
+	return results, nil
+}
+
+// This function will retrieve every parameter below the path, including those in nested paths, and
+// return their keys and values.  The keys are derived from the names relative to the path, e.g. the
+// parameter /prod/app/db/host retrieved with the path /prod/app/ is named DB_HOST.
+func (c Config) retrieveParameterPath(ctx context.Context, path string) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+
+	paginator := ssm.NewGetParametersByPathPaginator(c.ParameterClient, &ssm.GetParametersByPathInput{
+		Path:           aws.String(path),
+		Recursive:      aws.Bool(true),
+		WithDecryption: aws.Bool(true),
+	})
+
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to retrieve the parameters below %s: %w", path, err)
+		}
+
+		for _, parameter := range output.Parameters {
+			name := aws.ToString(parameter.Name)
+			parsed, err := parseString(ParameterKeyName(strings.TrimPrefix(name, path)), aws.ToString(parameter.Value))
+
+			if err != nil {
+				return nil, parseError("Failed to convert parameter %s to JSON: %w", name, err)
+			}
+
+			for key, value := range parsed {
+				values[key] = value
+			}
+		}
+	}
+
+	if c.Flatten {
+		values = c.FlattenValues(values)
+	}
+
+	return values, nil
+}
+
+// This function will determine if the parameter name is a path rather than the name of a single parameter
+func IsParameterPath(name string) bool {
+	return strings.HasPrefix(name, "/") && strings.HasSuffix(name, "/")
+}
+
+// This function will derive a key from the name of the parameter, e.g. the parameter /prod/db-host is
+// named PROD_DB_HOST.
+func ParameterKeyName(name string) string {
+	if parsed, err := arn.Parse(name); err == nil {
+		name = strings.TrimPrefix(parsed.Resource, "parameter")
+	}
+
+	return strings.ToUpper(strings.Map(func(c rune) rune {
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') {
+			return c
+		}
+		return '_'
+	}, strings.TrimPrefix(name, "/")))
+}
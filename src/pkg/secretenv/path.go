@@ -0,0 +1,95 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// This code is used to select a single value out of a large secret with a JSONPath style path
+// so that only the values a function needs are put into its environment.
+//
+package secretenv
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// This function will parse a path in the JSONPath dot notation, e.g. $.credentials.password or
+// $.hosts[0].name, into the object keys and array indexes it is made of.  The leading $ and . may be
+// left out, and a key containing dots or brackets may be quoted as ['key.name'].
+func ParsePath(path string) ([]string, error) {
+	rest := strings.TrimPrefix(path, "$")
+	var parts []string
+
+	for len(rest) > 0 {
+		switch {
+		case strings.HasPrefix(rest, "['"):
+			end := strings.Index(rest, "']")
+			if end < 0 {
+				return nil, fmt.Errorf("the path %q has an unterminated ['", path)
+			}
+			parts = append(parts, rest[2:end])
+			rest = rest[end+2:]
+		case rest[0] == '[':
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("the path %q has an unterminated [", path)
+			}
+			if _, err := strconv.Atoi(rest[1:end]); err != nil {
+				return nil, fmt.Errorf("the path %q has the index %q which is not a number", path, rest[1:end])
+			}
+			parts = append(parts, rest[:end+1])
+			rest = rest[end+1:]
+		default:
+			rest = strings.TrimPrefix(rest, ".")
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("the path %q has an empty key", path)
+			}
+			parts = append(parts, rest[:end])
+			rest = rest[end:]
+		}
+	}
+
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("the path %q does not select a value", path)
+	}
+
+	return parts, nil
+}
+
+// This function will return the value the path selects within the keys and values of a secret along with
+// the name of the last key of the path, which names the value when the secret has no Name
+func selectPath(dat map[string]interface{}, path string) (interface{}, string, error) {
+	parts, err := ParsePath(path)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	var value interface{} = dat
+	name := ""
+
+	for _, part := range parts {
+		switch current := value.(type) {
+		case map[string]interface{}:
+			nested, ok := current[part]
+			if !ok {
+				return nil, "", fmt.Errorf("the path %s was not found, there is no key %s", path, part)
+			}
+			value, name = nested, part
+		case []interface{}:
+			index, err := strconv.Atoi(strings.Trim(part, "[]"))
+			if err != nil || !strings.HasPrefix(part, "[") || index < 0 || index >= len(current) {
+				return nil, "", fmt.Errorf("the path %s was not found, %s is not an index of an array of %d values", path, part, len(current))
+			}
+			value = current[index]
+		default:
+			return nil, "", fmt.Errorf("the path %s was not found, %s is not within an object or array", path, part)
+		}
+	}
+
+	return value, name, nil
+}
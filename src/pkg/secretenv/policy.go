@@ -0,0 +1,324 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// This code is used to generate a least privilege IAM policy that grants the calls made to read
+// and decrypt the supplied secrets and other sources, and to print the resource policy attached
+// to a secret.  No secret values are accessed by either.
+//
+package secretenv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+// The version of the IAM policy language
+const IAM_POLICY_VERSION = "2012-10-17"
+
+// The partition used for the resources of the policy until a secret ARN gives the partition
+const DEFAULT_PARTITION = "aws"
+
+// The KMS operation used to resolve the aliases of the keys that encrypt the secrets.  *kms.Client
+// implements this interface.
+type KeyDescriberAPI interface {
+	DescribeKey(ctx context.Context, params *kms.DescribeKeyInput, optFns ...func(*kms.Options)) (*kms.DescribeKeyOutput, error)
+}
+
+// The structure of an IAM policy document
+type IamPolicy struct {
+	Version   string               `json:"Version"`
+	Statement []IamPolicyStatement `json:"Statement"`
+}
+
+// The structure of a single statement within an IAM policy document
+type IamPolicyStatement struct {
+	Effect   string   `json:"Effect"`
+	Action   []string `json:"Action"`
+	Resource []string `json:"Resource"`
+}
+
+// What GenerateIamPolicy grants.  The embedded Config gives the secrets, parameters, ciphertexts, objects,
+// configurations, and sources that are read, and the clients of the regions and roles of the secrets.
+type PolicyRequest struct {
+	Config
+
+	// The secrets are also found with ListSecrets, e.g. by their tags
+	ListSecrets bool
+
+	// The secrets are described with DescribeSecret, e.g. to check them for rotation or for their metadata
+	DescribeSecrets bool
+
+	// The KMS key, by id, ARN, or alias, that generates and decrypts the data keys of the cache file
+	CacheKeyId string
+
+	// Returns the client that resolves the aliases of the keys in a region, the region of the client passed
+	// to GenerateIamPolicy when empty, with the credentials of the role when roleArn is not empty
+	KeyClient func(ctx context.Context, region string, roleArn string) (KeyDescriberAPI, error)
+}
+
+// A policy returned by GenerateIamPolicy
+type GeneratedPolicy struct {
+	// The role of the @role= secrets the policy is for, empty for the policy of the identity the secrets
+	// are retrieved with, the last of the roles when roles are assumed
+	RoleArn string
+
+	Policy IamPolicy
+}
+
+// This function will convert the policy into indented JSON
+func (p GeneratedPolicy) String() string {
+	data, _ := json.MarshalIndent(p.Policy, "", "    ")
+	return string(data)
+}
+
+// The statements of a policy, each list of actions has a single statement
+type policyBuilder struct {
+	statements []IamPolicyStatement
+}
+
+// This function will allow the actions on the resource, adding it to the statement of the same actions
+func (b *policyBuilder) allow(resource string, actions ...string) {
+	for i, statement := range b.statements {
+		if strings.Join(statement.Action, ",") != strings.Join(actions, ",") {
+			continue
+		}
+
+		for _, existing := range statement.Resource {
+			if existing == resource {
+				return
+			}
+		}
+
+		b.statements[i].Resource = append(statement.Resource, resource)
+		return
+	}
+
+	b.statements = append(b.statements, IamPolicyStatement{Effect: "Allow", Action: actions, Resource: []string{resource}})
+}
+
+// This function will describe each secret with the client of its region and role to resolve its full ARN
+// and the KMS key that encrypts it, and will return the policies granting every call that the request
+// makes.  The first policy is for the identity the secrets are retrieved with, followed by a policy for
+// each role of the @role= secrets, which the first policy may assume.  A secret encrypted with the AWS
+// managed key does not need a KMS statement as the key policy already allows its use through Secrets
+// Manager.  The parameters and configurations are granted in every region and account as their ARNs are
+// not known without retrieving them, and the ciphertexts on every key as only KMS knows their keys.
+func GenerateIamPolicy(ctx context.Context, client SecretsManagerAPI, request PolicyRequest) ([]GeneratedPolicy, error) {
+	builders := map[string]*policyBuilder{"": {}}
+	roles := []string{""}
+
+	builder := func(roleArn string) *policyBuilder {
+		if _, ok := builders[roleArn]; !ok {
+			builders[roleArn] = &policyBuilder{}
+			roles = append(roles, roleArn)
+		}
+		return builders[roleArn]
+	}
+
+	partition := DEFAULT_PARTITION
+	secrets := append([]Secret{}, request.Secrets...)
+	parameters := append([]Secret{}, request.Parameters...)
+	ciphertexts := len(request.Ciphertexts) > 0
+	objects := append([]Secret{}, request.Objects...)
+	appConfigs := len(request.AppConfigs) > 0
+
+	// The sources of the built in providers make the same calls as the secrets, parameters, ciphertexts,
+	// objects, and configurations
+	for _, source := range request.Sources {
+		scheme, spec, _ := splitSource(source.Id)
+
+		switch scheme {
+		case SCHEME_SECRETS_MANAGER:
+			secrets = append(secrets, Secret{Id: spec})
+		case SCHEME_PARAMETER:
+			parameters = append(parameters, Secret{Id: spec})
+		case SCHEME_CIPHERTEXT:
+			ciphertexts = true
+		case SCHEME_OBJECT:
+			objects = append(objects, Secret{Id: S3_SCHEME + spec})
+		case SCHEME_APPCONFIG:
+			appConfigs = true
+		}
+	}
+
+	if request.ListSecrets {
+		builders[""].allow("*", "secretsmanager:ListSecrets")
+	}
+
+	if request.Batch && len(secrets) > 0 {
+		builders[""].allow("*", "secretsmanager:BatchGetSecretValue")
+	}
+
+	for _, spec := range secrets {
+		secretClient, err := request.secretClient(ctx, client, spec)
+
+		if err != nil {
+			return nil, err
+		}
+
+		secret, err := secretClient.DescribeSecret(ctx, &secretsmanager.DescribeSecretInput{
+			SecretId: aws.String(spec.Id),
+		})
+
+		if err != nil {
+			return nil, fmt.Errorf("secret %s: %w", spec.Id, err)
+		}
+
+		secretArn, err := arn.Parse(aws.ToString(secret.ARN))
+
+		if err != nil {
+			return nil, fmt.Errorf("secret %s: %w", spec.Id, err)
+		}
+		partition = secretArn.Partition
+
+		// The secrets of a role are read with the credentials of the role, which the identity assumes
+		if len(spec.RoleArn) > 0 {
+			builders[""].allow(spec.RoleArn, "sts:AssumeRole")
+		}
+
+		policy := builder(spec.RoleArn)
+		policy.allow(secretArn.String(), "secretsmanager:GetSecretValue")
+
+		if request.DescribeSecrets {
+			policy.allow(secretArn.String(), "secretsmanager:DescribeSecret")
+		}
+
+		if keyId := aws.ToString(secret.KmsKeyId); len(keyId) > 0 {
+			keyArn, err := request.keyArn(ctx, secretArn.Region, spec.RoleArn, secretArn, keyId)
+
+			if err != nil {
+				return nil, fmt.Errorf("Failed to resolve the KMS key %s of secret %s: %w", keyId, spec.Id, err)
+			}
+
+			policy.allow(keyArn, "kms:Decrypt")
+		}
+	}
+
+	for _, parameter := range parameters {
+		name := parameter.Id
+		action := "ssm:GetParameters"
+
+		// A path is read with GetParametersByPath, which is granted on the path itself
+		if strings.HasSuffix(name, "/") {
+			name = strings.TrimSuffix(name, "/")
+			action = "ssm:GetParametersByPath"
+		}
+
+		resource := name
+		if !arn.IsARN(name) {
+			resource = arn.ARN{Partition: partition, Service: "ssm", Region: "*", AccountID: "*",
+				Resource: "parameter/" + strings.TrimPrefix(name, "/")}.String()
+		}
+
+		builders[""].allow(resource, action)
+	}
+
+	if ciphertexts {
+		builders[""].allow("*", "kms:Decrypt")
+	}
+
+	for _, object := range objects {
+		bucket, key, err := splitObjectUrl(object.Id)
+
+		if err != nil {
+			return nil, err
+		}
+
+		builders[""].allow(arn.ARN{Partition: partition, Service: "s3", Resource: bucket + "/" + key}.String(), "s3:GetObject")
+	}
+
+	// The configurations may be given by name but IAM only matches the ids of their ARNs
+	if appConfigs {
+		builders[""].allow(arn.ARN{Partition: partition, Service: "appconfig", Region: "*", AccountID: "*", Resource: "application/*"}.String(),
+			"appconfig:StartConfigurationSession", "appconfig:GetLatestConfiguration")
+	}
+
+	if len(request.CacheKeyId) > 0 {
+		keyArn, err := request.keyArn(ctx, "", "", arn.ARN{}, request.CacheKeyId)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to resolve the KMS key %s of the cache file: %w", request.CacheKeyId, err)
+		}
+
+		builders[""].allow(keyArn, "kms:GenerateDataKey", "kms:Decrypt")
+	}
+
+	policies := make([]GeneratedPolicy, 0, len(roles))
+	for _, roleArn := range roles {
+		policies = append(policies, GeneratedPolicy{
+			RoleArn: roleArn,
+			Policy:  IamPolicy{Version: IAM_POLICY_VERSION, Statement: builders[roleArn].statements},
+		})
+	}
+
+	return policies, nil
+}
+
+// This function will return the resource policy attached to the secret, or an empty string when the secret
+// does not have a resource policy.
+func GetResourcePolicy(ctx context.Context, client SecretsManagerAPI, secretId string) (string, error) {
+	result, err := client.GetResourcePolicy(ctx, &secretsmanager.GetResourcePolicyInput{
+		SecretId: aws.String(secretId),
+	})
+
+	if err != nil || result.ResourcePolicy == nil {
+		return "", err
+	}
+
+	return *result.ResourcePolicy, nil
+}
+
+// This function will convert the id of a KMS key into the key ARN that IAM matches.  A key id is in the
+// account and region of the owner ARN, e.g. the secret it encrypts.  An alias, which IAM does not match for
+// Decrypt, and a key id without an owner are resolved with DescribeKey in the region with the credentials of
+// the role.
+func (r PolicyRequest) keyArn(ctx context.Context, region string, roleArn string, owner arn.ARN, keyId string) (string, error) {
+	if parsed, err := arn.Parse(keyId); err == nil && strings.HasPrefix(parsed.Resource, "key/") {
+		return keyId, nil
+	}
+
+	if !arn.IsARN(keyId) && !strings.HasPrefix(keyId, "alias/") && len(owner.AccountID) > 0 {
+		return arn.ARN{
+			Partition: owner.Partition,
+			Service:   "kms",
+			Region:    owner.Region,
+			AccountID: owner.AccountID,
+			Resource:  "key/" + keyId,
+		}.String(), nil
+	}
+
+	// An alias name is resolved in the account of the owner, so its ARN is described
+	if strings.HasPrefix(keyId, "alias/") && len(owner.AccountID) > 0 {
+		keyId = arn.ARN{Partition: owner.Partition, Service: "kms", Region: owner.Region, AccountID: owner.AccountID, Resource: keyId}.String()
+	}
+
+	if r.KeyClient == nil {
+		return "", fmt.Errorf("no KMS client was configured to resolve the key")
+	}
+
+	client, err := r.KeyClient(ctx, region, roleArn)
+
+	if err != nil {
+		return "", err
+	}
+
+	output, err := client.DescribeKey(ctx, &kms.DescribeKeyInput{KeyId: aws.String(keyId)})
+
+	if err != nil {
+		return "", err
+	}
+
+	if output.KeyMetadata == nil || len(aws.ToString(output.KeyMetadata.Arn)) == 0 {
+		return "", fmt.Errorf("DescribeKey did not return the ARN of the key")
+	}
+
+	return aws.ToString(output.KeyMetadata.Arn), nil
+}
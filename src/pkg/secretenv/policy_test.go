@@ -0,0 +1,167 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// These tests generate the IAM policies of a run with fake clients, so that the resources of each
+// region and role are checked without AWS credentials.
+//
+package secretenv
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+// A SecretsManagerAPI of an account and region that describes every secret as encrypted by the key
+type fakeDescriber struct {
+	fakeSecretsManager
+
+	region  string
+	account string
+	keyId   string
+}
+
+// DescribeSecret returns the ARN of the secret in the account and region of the fake
+func (f *fakeDescriber) DescribeSecret(ctx context.Context, params *secretsmanager.DescribeSecretInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.DescribeSecretOutput, error) {
+	return &secretsmanager.DescribeSecretOutput{
+		ARN:      aws.String(fmt.Sprintf("arn:aws:secretsmanager:%s:%s:secret:%s-AbCdEf", f.region, f.account, aws.ToString(params.SecretId))),
+		KmsKeyId: aws.String(f.keyId),
+	}, nil
+}
+
+// A KeyDescriberAPI of a region and role that resolves every alias to the same key
+type fakeKeyDescriber struct {
+	region  string
+	roleArn string
+}
+
+// DescribeKey returns a key ARN naming the region and role of the client and the alias it was given
+func (f fakeKeyDescriber) DescribeKey(ctx context.Context, params *kms.DescribeKeyInput, optFns ...func(*kms.Options)) (*kms.DescribeKeyOutput, error) {
+	return &kms.DescribeKeyOutput{
+		KeyMetadata: &types.KeyMetadata{Arn: aws.String(fmt.Sprintf("key of %s in %s as %q", aws.ToString(params.KeyId), f.region, f.roleArn))},
+	}, nil
+}
+
+func TestGenerateIamPolicy(t *testing.T) {
+	const roleArn = "arn:aws:iam::444455556666:role/reader"
+
+	client := &fakeDescriber{region: "us-east-1", account: "111122223333", keyId: "alias/app"}
+	regional := &fakeDescriber{region: "eu-west-1", account: "111122223333", keyId: "1234abcd-12ab-34cd-56ef-1234567890ab"}
+	role := &fakeDescriber{region: "us-west-2", account: "444455556666", keyId: "arn:aws:kms:us-west-2:444455556666:key/owned"}
+
+	request := PolicyRequest{
+		Config: Config{
+			Secrets:    testSecrets(t, "prod/db", "eu-west-1:prod/eu", "prod/shared@role="+roleArn),
+			Parameters: []Secret{{Id: "/prod/app/"}, {Id: "api-key"}},
+			Objects:    []Secret{{Id: "s3://config/app.env"}},
+			Sources:    []Secret{{Id: "kms://AQICAHh"}},
+			Batch:      true,
+			RegionalClient: func(region string) (SecretsManagerAPI, error) {
+				return regional, nil
+			},
+			RoleClient: func(ctx context.Context, region string, arn string) (SecretsManagerAPI, error) {
+				return role, nil
+			},
+		},
+		ListSecrets:     true,
+		DescribeSecrets: true,
+		KeyClient: func(ctx context.Context, region string, roleArn string) (KeyDescriberAPI, error) {
+			return fakeKeyDescriber{region: region, roleArn: roleArn}, nil
+		},
+	}
+
+	policies, err := GenerateIamPolicy(context.Background(), client, request)
+
+	if err != nil {
+		t.Fatalf("GenerateIamPolicy failed: %s", err)
+	}
+
+	want := []GeneratedPolicy{
+		{
+			Policy: IamPolicy{Version: IAM_POLICY_VERSION, Statement: []IamPolicyStatement{
+				{Effect: "Allow", Action: []string{"secretsmanager:ListSecrets"}, Resource: []string{"*"}},
+				{Effect: "Allow", Action: []string{"secretsmanager:BatchGetSecretValue"}, Resource: []string{"*"}},
+				{Effect: "Allow", Action: []string{"secretsmanager:GetSecretValue"}, Resource: []string{
+					"arn:aws:secretsmanager:us-east-1:111122223333:secret:prod/db-AbCdEf",
+					"arn:aws:secretsmanager:eu-west-1:111122223333:secret:prod/eu-AbCdEf",
+				}},
+				{Effect: "Allow", Action: []string{"secretsmanager:DescribeSecret"}, Resource: []string{
+					"arn:aws:secretsmanager:us-east-1:111122223333:secret:prod/db-AbCdEf",
+					"arn:aws:secretsmanager:eu-west-1:111122223333:secret:prod/eu-AbCdEf",
+				}},
+				// The alias is resolved in the region of the secret, and the key id of the regional secret is in its region
+				{Effect: "Allow", Action: []string{"kms:Decrypt"}, Resource: []string{
+					`key of arn:aws:kms:us-east-1:111122223333:alias/app in us-east-1 as ""`,
+					"arn:aws:kms:eu-west-1:111122223333:key/1234abcd-12ab-34cd-56ef-1234567890ab",
+					"*",
+				}},
+				{Effect: "Allow", Action: []string{"sts:AssumeRole"}, Resource: []string{roleArn}},
+				{Effect: "Allow", Action: []string{"ssm:GetParametersByPath"}, Resource: []string{"arn:aws:ssm:*:*:parameter/prod/app"}},
+				{Effect: "Allow", Action: []string{"ssm:GetParameters"}, Resource: []string{"arn:aws:ssm:*:*:parameter/api-key"}},
+				{Effect: "Allow", Action: []string{"s3:GetObject"}, Resource: []string{"arn:aws:s3:::config/app.env"}},
+			}},
+		},
+		{
+			// The secret of the role is read with the credentials of the role in the region of the role client
+			RoleArn: roleArn,
+			Policy: IamPolicy{Version: IAM_POLICY_VERSION, Statement: []IamPolicyStatement{
+				{Effect: "Allow", Action: []string{"secretsmanager:GetSecretValue"}, Resource: []string{
+					"arn:aws:secretsmanager:us-west-2:444455556666:secret:prod/shared-AbCdEf",
+				}},
+				{Effect: "Allow", Action: []string{"secretsmanager:DescribeSecret"}, Resource: []string{
+					"arn:aws:secretsmanager:us-west-2:444455556666:secret:prod/shared-AbCdEf",
+				}},
+				{Effect: "Allow", Action: []string{"kms:Decrypt"}, Resource: []string{"arn:aws:kms:us-west-2:444455556666:key/owned"}},
+			}},
+		},
+	}
+
+	if !reflect.DeepEqual(policies, want) {
+		t.Errorf("GenerateIamPolicy returned\n%+v\nwant\n%+v", policies, want)
+	}
+}
+
+func TestGenerateIamPolicyResolvesRoleAliases(t *testing.T) {
+	const roleArn = "arn:aws:iam::444455556666:role/reader"
+
+	role := &fakeDescriber{region: "us-west-2", account: "444455556666", keyId: "alias/shared"}
+
+	request := PolicyRequest{
+		Config: Config{
+			Secrets: testSecrets(t, "prod/shared@role="+roleArn),
+			RoleClient: func(ctx context.Context, region string, arn string) (SecretsManagerAPI, error) {
+				return role, nil
+			},
+		},
+		CacheKeyId: "alias/cache",
+		KeyClient: func(ctx context.Context, region string, roleArn string) (KeyDescriberAPI, error) {
+			return fakeKeyDescriber{region: region, roleArn: roleArn}, nil
+		},
+	}
+
+	policies, err := GenerateIamPolicy(context.Background(), newFakeSecretsManager(nil), request)
+
+	if err != nil {
+		t.Fatalf("GenerateIamPolicy failed: %s", err)
+	}
+
+	// The alias of the secret of the role is in the account of the role, so the role describes it
+	if got := policies[1].Policy.Statement[1].Resource; !reflect.DeepEqual(got, []string{
+		`key of arn:aws:kms:us-west-2:444455556666:alias/shared in us-west-2 as "` + roleArn + `"`,
+	}) {
+		t.Errorf("The key of the secret of the role is %v", got)
+	}
+
+	// The cache key is described in the region of the caller
+	if got := policies[0].Policy.Statement[1]; !reflect.DeepEqual(got.Action, []string{"kms:GenerateDataKey", "kms:Decrypt"}) ||
+		!reflect.DeepEqual(got.Resource, []string{`key of alias/cache in  as ""`}) {
+		t.Errorf("The statement of the cache key is %+v", got)
+	}
+}
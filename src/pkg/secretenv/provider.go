@@ -0,0 +1,236 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// This code is used to resolve sources given by a scheme, such as sm://prod/db or vault://kv/app,
+// through providers so that other backends can be added without changing how secrets are merged.
+//
+package secretenv
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// The schemes of the built in providers
+const SCHEME_SECRETS_MANAGER = "sm"
+const SCHEME_PARAMETER = "ssm"
+const SCHEME_OBJECT = "s3"
+const SCHEME_CIPHERTEXT = "kms"
+const SCHEME_APPCONFIG = "appconfig"
+const SCHEME_FILE = "file"
+
+// A scheme is a letter followed by letters, digits, +, -, or .
+var schemePattern = regexp.MustCompile(`^[a-z][a-z0-9+.-]*$`)
+
+// A backend that resolves the sources of its scheme, e.g. the sources vault://kv/app are resolved by the
+// provider named vault.  A provider must be safe to call from several goroutines.
+type Provider interface {
+	// The scheme of the sources the provider resolves
+	Name() string
+
+	// Resolve returns the keys and values of the source, the spec is the part of the source after the
+	// scheme://.  The values are merged as they are, so a nested value should be returned as JSON.
+	Resolve(ctx context.Context, spec string) (map[string]string, error)
+}
+
+// This function will parse a single source in the form [prefix=]SCHEME://SPEC, e.g. DB=sm://prod/db.  The
+// prefix follows the same rules as for secrets.  The Id of the returned source is the whole SCHEME://SPEC.
+func ParseSourceSpec(value string) (Secret, error) {
+	name := strings.TrimSpace(value)
+
+	spec := Secret{Id: name}
+	if i := strings.Index(name, "="); i > 0 && i < strings.Index(name, "://") && IsValidEnvName(name[:i]) {
+		spec.Prefix = name[:i]
+		spec.Id = strings.TrimSpace(name[i+1:])
+	}
+
+	if _, _, err := splitSource(spec.Id); err != nil {
+		return spec, err
+	}
+
+	return spec, nil
+}
+
+// This function will split a source into its scheme and the spec after the scheme://
+func splitSource(value string) (string, string, error) {
+	parts := strings.SplitN(value, "://", 2)
+
+	if len(parts) != 2 || !schemePattern.MatchString(parts[0]) || len(parts[1]) == 0 {
+		return "", "", fmt.Errorf("the source %q is not in the form SCHEME://SPEC, e.g. sm://prod/db", value)
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// This function will resolve the Sources of the config with the provider of each scheme and return the keys
+// and values of each one in the same order as the Sources
+func (c Config) resolveSources(ctx context.Context) ([]map[string]interface{}, error) {
+	providers := map[string]Provider{}
+	for _, provider := range c.Providers {
+		// The first provider for a scheme wins
+		if _, ok := providers[provider.Name()]; !ok {
+			providers[provider.Name()] = provider
+		}
+	}
+
+	results := make([]map[string]interface{}, len(c.Sources))
+
+	for i, source := range c.Sources {
+		scheme, spec, err := splitSource(source.Id)
+
+		if err != nil {
+			return nil, inputError("%w", err)
+		}
+
+		provider, ok := providers[scheme]
+
+		if !ok {
+			return nil, inputError("No provider is configured for the %s scheme of the source %s", scheme, source.Id)
+		}
+
+		start := time.Now()
+		values, err := provider.Resolve(ctx, spec)
+
+		if c.Debug != nil {
+			fmt.Fprintf(c.Debug, "level=debug event=resolve_source source=%q provider=%q keys=%d elapsed=%s success=%t\n",
+				source.Id, scheme, len(values), time.Since(start).Round(time.Millisecond), err == nil)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to resolve source %s: %w", source.Id, err)
+		}
+
+		results[i] = map[string]interface{}{}
+		for key, value := range values {
+			results[i][key] = value
+		}
+	}
+
+	return results, nil
+}
+
+// This function will return the values of a source that were converted into keys and values by the config,
+// after they have been rendered into strings
+func renderSource(values map[string]interface{}, err error) (map[string]string, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	return Config{}.Render(values), nil
+}
+
+// A provider whose Resolve function is a plain function
+type providerFunc struct {
+	name    string
+	resolve func(ctx context.Context, spec string) (map[string]string, error)
+}
+
+// Name is an implementation of the Provider interface
+func (p providerFunc) Name() string {
+	return p.name
+}
+
+// Resolve is an implementation of the Provider interface
+func (p providerFunc) Resolve(ctx context.Context, spec string) (map[string]string, error) {
+	return p.resolve(ctx, spec)
+}
+
+// This function will return a provider with the name that resolves the sources with the function
+func NewProvider(name string, resolve func(ctx context.Context, spec string) (map[string]string, error)) Provider {
+	return providerFunc{name, resolve}
+}
+
+// This function will return the provider of the sm:// sources, the current version of a secret of Secrets
+// Manager, e.g. sm://prod/db
+func NewSecretsManagerProvider(client SecretsManagerAPI) Provider {
+	return NewProvider(SCHEME_SECRETS_MANAGER, func(ctx context.Context, spec string) (map[string]string, error) {
+		output, err := GetSecret(ctx, client, spec, "", "")
+
+		if err != nil {
+			return nil, err
+		}
+
+		return renderSource(ParseSecret(spec, output))
+	})
+}
+
+// This function will return the provider of the ssm:// sources, a parameter or a path of parameters ending
+// in /, e.g. ssm:///prod/app/
+func NewParameterProvider(client SSMAPI) Provider {
+	return NewProvider(SCHEME_PARAMETER, func(ctx context.Context, spec string) (map[string]string, error) {
+		values, err := Config{ParameterClient: client, Parameters: []Secret{{Id: spec}}}.retrieveParameters(ctx)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return renderSource(values[0], nil)
+	})
+}
+
+// This function will return the provider of the s3:// sources, an env file or JSON object, e.g.
+// s3://config-bucket/app.env
+func NewObjectProvider(client S3API) Provider {
+	return NewProvider(SCHEME_OBJECT, func(ctx context.Context, spec string) (map[string]string, error) {
+		values, err := Config{ObjectClient: client, Objects: []Secret{{Id: S3_SCHEME + spec}}}.retrieveObjects(ctx)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return renderSource(values[0], nil)
+	})
+}
+
+// This function will return the provider of the kms:// sources, a base64 ciphertext or env:NAME or
+// file:PATH holding one, e.g. kms://env:DB_PASSWORD_CIPHERTEXT
+func NewCiphertextProvider(client KMSAPI) Provider {
+	return NewProvider(SCHEME_CIPHERTEXT, func(ctx context.Context, spec string) (map[string]string, error) {
+		plaintexts, err := Config{KMSClient: client, Ciphertexts: []Secret{{Id: spec}}}.decryptCiphertexts(ctx)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return renderSource(plaintexts[0].values, nil)
+	})
+}
+
+// This function will return the provider of the appconfig:// sources, a deployed configuration, e.g.
+// appconfig://app/prod/flags
+func NewAppConfigProvider(client AppConfigAPI) Provider {
+	return NewProvider(SCHEME_APPCONFIG, func(ctx context.Context, spec string) (map[string]string, error) {
+		values, err := Config{AppConfigClient: client, AppConfigs: []Secret{{Id: spec}}}.retrieveAppConfigs(ctx)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return renderSource(values[0], nil)
+	})
+}
+
+// This function will return the provider of the file:// sources, a local env file or JSON object, e.g.
+// file:///run/secrets/app.env
+func NewFileProvider() Provider {
+	return NewProvider(SCHEME_FILE, func(ctx context.Context, spec string) (map[string]string, error) {
+		data, err := ioutil.ReadFile(spec)
+
+		if err != nil {
+			return nil, err
+		}
+
+		values, err := parseObject(spec, string(data))
+
+		if err != nil {
+			return nil, parseError("Failed to convert file %s: %w", spec, err)
+		}
+
+		return renderSource(values, nil)
+	})
+}
@@ -0,0 +1,107 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// This code is used to write selected keys into the environment variables of a Lambda function at
+// deploy time, for teams who inject the values when deploying instead of retrieving them at runtime.
+//
+package secretenv
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/aws/aws-sdk-go-v2/service/lambda/types"
+)
+
+// The Lambda operations used by this package.  *lambda.Client implements this interface.
+type LambdaAPI interface {
+	GetFunctionConfiguration(ctx context.Context, params *lambda.GetFunctionConfigurationInput, optFns ...func(*lambda.Options)) (*lambda.GetFunctionConfigurationOutput, error)
+	UpdateFunctionConfiguration(ctx context.Context, params *lambda.UpdateFunctionConfigurationInput, optFns ...func(*lambda.Options)) (*lambda.UpdateFunctionConfigurationOutput, error)
+}
+
+// The changes made to the environment of a function by PushEnvironment
+type PushResult struct {
+	// The values of the pushed keys before and after the push, the keys that were not pushed are left out
+	Existing map[string]string
+	Pushed   map[string]string
+
+	// Whether the function was updated, false when nothing changed or the push was not applied
+	Updated bool
+}
+
+// This function will set the keys of the values that match one of the allowed patterns, which are key names,
+// glob patterns, or regular expressions between slashes the same as an Include pattern, in the environment
+// of the function.  The other variables of the function are left alone.  Only when apply is set is the
+// function updated, otherwise the result reports what would change.  The update carries the RevisionId
+// that was read so that it fails instead of undoing a change made by someone else in between.
+func PushEnvironment(ctx context.Context, client LambdaAPI, function string, values map[string]string, allowed []string, apply bool) (*PushResult, error) {
+	if len(allowed) == 0 {
+		return nil, inputError("At least one key must be allowed to be pushed to %s", function)
+	}
+
+	if err := ValidatePatterns(allowed); err != nil {
+		return nil, inputError("%w", err)
+	}
+
+	current, err := client.GetFunctionConfiguration(ctx, &lambda.GetFunctionConfigurationInput{FunctionName: aws.String(function)})
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the configuration of %s: %w", function, err)
+	}
+
+	variables := map[string]string{}
+	if current.Environment != nil {
+		for key, value := range current.Environment.Variables {
+			variables[key] = value
+		}
+	}
+
+	result := &PushResult{Existing: map[string]string{}, Pushed: map[string]string{}}
+	changed := false
+
+	for key, value := range values {
+		if !matchesAny(allowed, key) {
+			continue
+		}
+
+		existing, ok := variables[key]
+		if ok {
+			result.Existing[key] = existing
+		}
+
+		result.Pushed[key] = value
+		changed = changed || !ok || existing != value
+		variables[key] = value
+	}
+
+	if !apply || !changed {
+		return result, nil
+	}
+
+	_, err = client.UpdateFunctionConfiguration(ctx, &lambda.UpdateFunctionConfigurationInput{
+		FunctionName: aws.String(function),
+		Environment:  &types.Environment{Variables: variables},
+		RevisionId:   current.RevisionId,
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to update the environment of %s: %w", function, err)
+	}
+
+	result.Updated = true
+	return result, nil
+}
+
+// This function will determine if any of the patterns matches the key
+func matchesAny(patterns []string, key string) bool {
+	for _, pattern := range patterns {
+		if matchPattern(pattern, key) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,209 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// This code is used to render the values of the secrets into the strings that are set as
+// environment variables.
+//
+package secretenv
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The supported ways of rendering array values
+const ARRAY_MODE_JSON = "json"
+const ARRAY_MODE_CSV = "csv"
+const ARRAY_MODE_INDEX = "index"
+
+// The most times a string value is decoded as JSON by DecodeNestedJson, a value encoded more times than
+// this is kept as a string
+const MAX_NESTED_JSON_DEPTH = 8
+
+// This function will convert the values of the secret into the strings that are written to the output.
+// Array values are rendered according to the ArrayMode of the config.
+func (c Config) Render(dat map[string]interface{}) map[string]string {
+	rendered := make(map[string]string, len(dat))
+
+	for key, value := range dat {
+		c.renderValue(rendered, key, value)
+	}
+
+	return rendered
+}
+
+// This function will flatten nested objects into a single level where each key is the path to the value
+// joined by the Separator.  When the ArrayMode is index, arrays are flattened as well using the element
+// index as the key.  Values nested more than FlattenDepth levels deep are kept whole and rendered as JSON.
+// With DecodeNestedJson a string holding a JSON object or array is flattened as that object or array.  An
+// explicit stack is used instead of recursion so that deeply nested secrets cannot exhaust the call stack.
+func (c Config) FlattenValues(dat map[string]interface{}) map[string]interface{} {
+	type entry struct {
+		key     string
+		value   interface{}
+		depth   int
+		decoded int
+	}
+
+	flat := make(map[string]interface{}, len(dat))
+	stack := make([]entry, 0, len(dat))
+
+	for key, value := range dat {
+		stack = append(stack, entry{key, value, 0, 0})
+	}
+
+	for len(stack) > 0 {
+		current := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if c.FlattenDepth > 0 && current.depth >= c.FlattenDepth {
+			flat[current.key] = current.value
+			continue
+		}
+
+		switch value := current.value.(type) {
+		case map[string]interface{}:
+			for key, nested := range value {
+				stack = append(stack, entry{current.key + c.Separator + key, nested, current.depth + 1, current.decoded})
+			}
+			if len(value) == 0 {
+				flat[current.key] = value
+			}
+		case []interface{}:
+			if c.ArrayMode != ARRAY_MODE_INDEX {
+				flat[current.key] = value
+				continue
+			}
+			for i, nested := range value {
+				stack = append(stack, entry{fmt.Sprintf("%s%s%d", current.key, c.Separator, i), nested, current.depth + 1, current.decoded})
+			}
+			if len(value) == 0 {
+				flat[current.key] = value
+			}
+		case string:
+			// The decoded value takes the place of the string, at the same depth
+			if decoded, ok := decodeNestedJson(value); ok && c.DecodeNestedJson && current.decoded < MAX_NESTED_JSON_DEPTH {
+				stack = append(stack, entry{current.key, decoded, current.depth, current.decoded + 1})
+				continue
+			}
+			flat[current.key] = value
+		default:
+			flat[current.key] = value
+		}
+	}
+
+	return flat
+}
+
+// This function will decode a string that holds a well formed JSON object or array, other strings, such as
+// a quoted string or a number, are not decoded
+func decodeNestedJson(value string) (interface{}, bool) {
+	trimmed := strings.TrimSpace(value)
+
+	if !(strings.HasPrefix(trimmed, "{") && strings.HasSuffix(trimmed, "}")) && !(strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]")) {
+		return nil, false
+	}
+
+	var decoded interface{}
+	decoder := json.NewDecoder(strings.NewReader(trimmed))
+	decoder.UseNumber()
+
+	if err := decoder.Decode(&decoded); err != nil || decoder.More() {
+		return nil, false
+	}
+
+	return decoded, true
+}
+
+// This function will render a single value into the supplied map.  In index mode an array is expanded
+// into one key per element, e.g. TAGS_0 and TAGS_1, including any nested arrays.  Objects that were not
+// flattened are rendered as compact JSON.
+func (c Config) renderValue(rendered map[string]string, key string, value interface{}) {
+	// Most secrets only hold strings so they are handled without going through fmt
+	if str, ok := value.(string); ok {
+		rendered[key] = str
+		return
+	}
+
+	array, isArray := value.([]interface{})
+
+	switch {
+	case !isArray:
+		rendered[key] = renderScalar(value)
+	case c.ArrayMode == ARRAY_MODE_INDEX:
+		for i, element := range array {
+			if _, nested := element.([]interface{}); nested {
+				c.renderValue(rendered, fmt.Sprintf("%s%s%d", key, c.Separator, i), element)
+			} else {
+				rendered[fmt.Sprintf("%s%s%d", key, c.Separator, i)] = renderElement(element)
+			}
+		}
+	case c.ArrayMode == ARRAY_MODE_CSV:
+		elements := make([]string, len(array))
+		for i, element := range array {
+			elements[i] = renderElement(element)
+		}
+		rendered[key] = strings.Join(elements, ",")
+	default:
+		rendered[key] = renderElement(array)
+	}
+}
+
+// This function will render a value that is not an array.  Numbers are written exactly as they appear in
+// the secret, booleans as true or false, and null as an empty string.  Objects are rendered as compact JSON.
+func renderScalar(value interface{}) string {
+	switch value := value.(type) {
+	case string:
+		return value
+	case json.Number:
+		return value.String()
+	case bool:
+		return strconv.FormatBool(value)
+	case nil:
+		return ""
+	default:
+		return renderElement(value)
+	}
+}
+
+// This function will render an array element.  Strings are used as is while anything else, such as
+// objects and nested arrays, is rendered as compact JSON.
+func renderElement(element interface{}) string {
+	if str, ok := element.(string); ok {
+		return str
+	}
+
+	data, err := json.Marshal(element)
+
+	if err != nil {
+		return fmt.Sprintf("%v", element)
+	}
+
+	return string(data)
+}
+
+// This function will set the output key of each coalesce rule to the value of the first source key that
+// exists and is not empty.  When none of the source keys have a value the output key is left untouched.
+func (c Config) ApplyCoalesce(values map[string]string) {
+	for _, rule := range c.Coalesce {
+		for _, source := range rule.Sources {
+			if value, ok := values[source]; ok && len(value) > 0 {
+				values[rule.Output] = value
+				break
+			}
+		}
+	}
+}
+
+// This function will return the values with the prefix added to each of the keys
+func PrefixKeys(values map[string]string, prefix string) map[string]string {
+	prefixed := make(map[string]string, len(values))
+	for key, value := range values {
+		prefixed[prefix+key] = value
+	}
+
+	return prefixed
+}
@@ -0,0 +1,225 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// These tests render the values of the secrets into the strings set as environment variables.
+//
+package secretenv
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	dat := map[string]interface{}{
+		"string": "value",
+		"number": json.Number("5432"),
+		"float":  json.Number("1.50"),
+		"bool":   true,
+		"null":   nil,
+		"object": map[string]interface{}{"a": "b"},
+		"array":  []interface{}{"x", json.Number("1")},
+	}
+
+	tests := []struct {
+		mode     string
+		rendered map[string]string
+	}{
+		{
+			mode: ARRAY_MODE_JSON,
+			rendered: map[string]string{"string": "value", "number": "5432", "float": "1.50", "bool": "true", "null": "",
+				"object": `{"a":"b"}`, "array": `["x",1]`},
+		},
+		{
+			mode: ARRAY_MODE_CSV,
+			rendered: map[string]string{"string": "value", "number": "5432", "float": "1.50", "bool": "true", "null": "",
+				"object": `{"a":"b"}`, "array": "x,1"},
+		},
+		{
+			mode: ARRAY_MODE_INDEX,
+			rendered: map[string]string{"string": "value", "number": "5432", "float": "1.50", "bool": "true", "null": "",
+				"object": `{"a":"b"}`, "array_0": "x", "array_1": "1"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.mode, func(t *testing.T) {
+			rendered := Config{ArrayMode: test.mode, Separator: "_"}.Render(dat)
+
+			if !reflect.DeepEqual(rendered, test.rendered) {
+				t.Errorf("Render returned %v, want %v", rendered, test.rendered)
+			}
+		})
+	}
+}
+
+func TestRenderNestedArrays(t *testing.T) {
+	dat := map[string]interface{}{
+		"matrix": []interface{}{[]interface{}{"a", "b"}, []interface{}{json.Number("1"), []interface{}{true}}},
+		"hosts":  []interface{}{map[string]interface{}{"name": "a", "port": json.Number("1")}, map[string]interface{}{"name": "b"}},
+		"empty":  []interface{}{},
+	}
+
+	tests := []struct {
+		mode     string
+		rendered map[string]string
+	}{
+		{
+			mode:     ARRAY_MODE_JSON,
+			rendered: map[string]string{"matrix": `[["a","b"],[1,[true]]]`, "hosts": `[{"name":"a","port":1},{"name":"b"}]`, "empty": "[]"},
+		},
+		{
+			// The nested arrays and objects of an element are kept as JSON so that the commas separate the elements
+			mode:     ARRAY_MODE_CSV,
+			rendered: map[string]string{"matrix": `["a","b"],[1,[true]]`, "hosts": `{"name":"a","port":1},{"name":"b"}`, "empty": ""},
+		},
+		{
+			// Nested arrays are indexed at every level while objects are kept as JSON, and an empty array has no
+			// elements to index
+			mode: ARRAY_MODE_INDEX,
+			rendered: map[string]string{"matrix_0_0": "a", "matrix_0_1": "b", "matrix_1_0": "1", "matrix_1_1_0": "true",
+				"hosts_0": `{"name":"a","port":1}`, "hosts_1": `{"name":"b"}`},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.mode, func(t *testing.T) {
+			rendered := Config{ArrayMode: test.mode, Separator: "_"}.Render(dat)
+
+			if !reflect.DeepEqual(rendered, test.rendered) {
+				t.Errorf("Render returned %v, want %v", rendered, test.rendered)
+			}
+		})
+	}
+}
+
+func TestFlattenValues(t *testing.T) {
+	dat := map[string]interface{}{
+		"db": map[string]interface{}{
+			"host":    "localhost",
+			"options": map[string]interface{}{"ssl": true},
+			"empty":   map[string]interface{}{},
+		},
+		"port": json.Number("5432"),
+	}
+
+	tests := []struct {
+		name string
+		cfg  Config
+		flat map[string]interface{}
+	}{
+		{
+			name: "every level",
+			cfg:  Config{Separator: "_"},
+			flat: map[string]interface{}{"db_host": "localhost", "db_options_ssl": true, "db_empty": map[string]interface{}{}, "port": json.Number("5432")},
+		},
+		{
+			name: "one level",
+			cfg:  Config{Separator: "_", FlattenDepth: 1},
+			flat: map[string]interface{}{"db_host": "localhost", "db_options": map[string]interface{}{"ssl": true}, "db_empty": map[string]interface{}{},
+				"port": json.Number("5432")},
+		},
+		{
+			name: "separator",
+			cfg:  Config{Separator: "__"},
+			flat: map[string]interface{}{"db__host": "localhost", "db__options__ssl": true, "db__empty": map[string]interface{}{}, "port": json.Number("5432")},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			flat := test.cfg.FlattenValues(dat)
+
+			if !reflect.DeepEqual(flat, test.flat) {
+				t.Errorf("FlattenValues returned %v, want %v", flat, test.flat)
+			}
+		})
+	}
+}
+
+func TestFlattenValuesDecodesNestedJson(t *testing.T) {
+	// A secret holding another secret as a JSON string, which holds a JSON string of its own
+	var dat map[string]interface{}
+	json.Unmarshal([]byte(`{"db":"{\"host\":\"localhost\",\"options\":\"{\\\"ssl\\\":true}\"}","ports":"[5432, 5433]","quoted":"\"x\"","broken":"{\"host\":"}`), &dat)
+
+	flat := Config{Separator: "_", ArrayMode: ARRAY_MODE_INDEX, DecodeNestedJson: true}.FlattenValues(dat)
+
+	want := map[string]interface{}{"db_host": "localhost", "db_options_ssl": true, "ports_0": json.Number("5432"), "ports_1": json.Number("5433"),
+		"quoted": `"x"`, "broken": `{"host":`}
+	if !reflect.DeepEqual(flat, want) {
+		t.Errorf("FlattenValues returned %v, want %v", flat, want)
+	}
+
+	// Without the option the strings are kept as they are
+	if flat := (Config{Separator: "_"}).FlattenValues(dat); !reflect.DeepEqual(flat, dat) {
+		t.Errorf("FlattenValues returned %v, want %v", flat, dat)
+	}
+
+	// A value encoded more than MAX_NESTED_JSON_DEPTH times stops being decoded
+	value := `{"key":"value"}`
+	for i := 0; i < MAX_NESTED_JSON_DEPTH; i++ {
+		encoded, _ := json.Marshal(map[string]string{"nested": value})
+		value = string(encoded)
+	}
+
+	flat = Config{Separator: "_", DecodeNestedJson: true}.FlattenValues(map[string]interface{}{"deep": value})
+	key := "deep" + strings.Repeat("_nested", MAX_NESTED_JSON_DEPTH)
+	if flat[key] != `{"key":"value"}` || len(flat) != 1 {
+		t.Errorf("FlattenValues returned %v, want the string of %s", flat, key)
+	}
+}
+
+func TestApplyCoalesce(t *testing.T) {
+	tests := []struct {
+		name   string
+		values map[string]string
+		want   string
+		set    bool
+	}{
+		{name: "first wins", values: map[string]string{"host": "a", "hostname": "b"}, want: "a", set: true},
+		{name: "empty skipped", values: map[string]string{"host": "", "hostname": "b"}, want: "b", set: true},
+		{name: "missing skipped", values: map[string]string{"hostname": "b"}, want: "b", set: true},
+		{name: "all empty", values: map[string]string{"host": "", "hostname": ""}, set: false},
+		{name: "none", values: map[string]string{"other": "x"}, set: false},
+		{name: "output replaced", values: map[string]string{"DB_HOST": "old", "hostname": "b"}, want: "b", set: true},
+		{name: "output kept", values: map[string]string{"DB_HOST": "old", "host": ""}, want: "old", set: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := Config{Coalesce: []CoalesceRule{{Output: "DB_HOST", Sources: []string{"host", "hostname"}}}}
+			cfg.ApplyCoalesce(test.values)
+
+			if value, ok := test.values["DB_HOST"]; ok != test.set || value != test.want {
+				t.Errorf("DB_HOST is %q (set %t), want %q (set %t)", value, ok, test.want, test.set)
+			}
+		})
+	}
+}
+
+// The common case of a single small secret with a handful of keys, retrieved, rendered, and formatted
+func BenchmarkFetchSingle(b *testing.B) {
+	client := newFakeSecretsManager(map[string]string{
+		"prod/db": `{"host":"db.example.com","port":5432,"username":"app","password":"p@ss w0rd","ssl":true}`,
+	})
+	cfg := Config{Secrets: []Secret{{Id: "prod/db"}}, Separator: "_", ArrayMode: ARRAY_MODE_JSON}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		result, err := Retrieve(context.Background(), client, cfg)
+
+		if err != nil {
+			b.Fatalf("Retrieve failed: %s", err)
+		}
+
+		rendered := cfg.Render(result.Values)
+
+		if _, err := cfg.Format(FORMAT_PIPE, rendered, result.Values); err != nil {
+			b.Fatalf("Format failed: %s", err)
+		}
+	}
+}
@@ -0,0 +1,483 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// This code is used by Go programs, such as other Lambda functions, that embed the retrieval
+// instead of running the go-retrieve-secret executable.
+//
+package secretenv
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+)
+
+// The options of a Retriever.  The embedded Config selects the secrets and how they are converted, the
+// remaining options select how the AWS config is loaded and the roles that are assumed.
+type Options struct {
+	Config
+
+	// The region of the secrets, the region from the shared config and environment is used when empty
+	Region string
+
+	// The chain of roles assumed before the secrets are retrieved, the credentials from the AWS config are
+	// used when empty
+	Roles []AssumeRoleOptions
+
+	// The settings of the roles of individual secrets, see Secret.RoleArn, whose own RoleArn is ignored.
+	// Each role is assumed with the credentials of the last of the Roles.
+	SecretRole AssumeRoleOptions
+
+	// The secrets with every one of these tags are retrieved as well as the Secrets
+	TagFilters []TagFilter
+
+	// Remember each retrieved secret for this long, 0 always retrieves the secrets again
+	CacheTTL time.Duration
+
+	// An encrypted file, e.g. in /tmp, that the merged secrets are kept in for CacheTTL so that later
+	// processes reuse them, see ReadCacheFile
+	CacheFile string
+
+	// Retrieve the secrets again and replace the CacheFile even when it has not expired
+	Refresh bool
+
+	// The KMS key, by id, ARN, or alias, that generates the data key of the CacheFile, see WriteKMSCacheFile.
+	// The key is derived from the credentials of the AWS config when empty, see EnvironmentKey.
+	CacheKeyId string
+
+	// Creates the data keys of the CacheFile when there is a CacheKeyId, a KMS client is created from the
+	// AWS config when nil
+	CacheKeyClient DataKeyAPI
+
+	// Check the VersionId of each secret in the CacheFile with DescribeSecret and retrieve the secrets again
+	// when any of them has a new version, instead of using the file until it expires
+	ValidateCache bool
+
+	// Called each time the CacheFile is read with whether the secrets were found in it, e.g. to record metrics
+	ObserveCache func(hit bool)
+
+	// Resolves the secrets instead of Secrets Manager when set, such as a FileClient, every region and
+	// role uses it and no roles are assumed.  The other sources still use the AWS config.
+	Backend SecretsManagerAPI
+
+	// Creates the STS clients the Roles are assumed with, the clients are created from the AWS config
+	// when nil
+	STSClient STSClientFunc
+
+	// The options of the provider of the vault:// Sources, see NewVaultProvider
+	Vault VaultOptions
+
+	// Any other options for loading the AWS config, such as the retryer or a shared config profile
+	LoadOptions []func(*config.LoadOptions) error
+}
+
+// Retrieves secrets using the credentials of the assumed role.  A Retriever may be used for several
+// retrievals, e.g. with a CacheTTL to avoid calling Secrets Manager for every retrieval.
+type Retriever struct {
+	Options Options
+
+	awsConfig   aws.Config
+	credentials aws.CredentialsProvider
+	client      SecretsManagerAPI
+}
+
+// This function will load the AWS config, assume the roles of the options, and create the clients used to
+// retrieve the secrets.  The RegionalClient and ParameterClient of the options are created from the AWS
+// config when they were not supplied.
+func NewRetriever(ctx context.Context, options Options) (*Retriever, error) {
+	loadOptions := options.LoadOptions
+	if len(options.Region) > 0 {
+		loadOptions = append([]func(*config.LoadOptions) error{config.WithRegion(options.Region)}, loadOptions...)
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, loadOptions...)
+
+	if err != nil {
+		return nil, fmt.Errorf("configuration error %w", err)
+	}
+
+	role, client, err := options.secretsManagerClients(ctx, cfg)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if options.ParameterClient == nil && len(options.Parameters) > 0 {
+		options.ParameterClient = NewSSMClient(cfg, role)
+	}
+
+	if options.KMSClient == nil && len(options.Ciphertexts) > 0 {
+		options.KMSClient = NewKMSClient(cfg, role)
+	}
+
+	if options.ObjectClient == nil && len(options.Objects) > 0 {
+		options.ObjectClient = NewS3Client(cfg, role)
+	}
+
+	if options.AppConfigClient == nil && len(options.AppConfigs) > 0 {
+		options.AppConfigClient = NewAppConfigClient(cfg, role)
+	}
+
+	providers, err := options.builtinProviders(cfg, role, client)
+
+	if err != nil {
+		return nil, err
+	}
+
+	options.Providers = append(options.Providers, providers...)
+
+	if options.CacheKeyClient == nil && len(options.CacheKeyId) > 0 {
+		options.CacheKeyClient = NewKMSClient(cfg, role)
+	}
+
+	return &Retriever{
+		Options:     options,
+		awsConfig:   cfg,
+		credentials: role,
+		client:      client,
+	}, nil
+}
+
+// This function will assume the Roles and set the RegionalClient and RoleClient of the options when they were
+// not supplied, and return the last role and the Secrets Manager client.  With a Backend no roles are
+// assumed and every region and role uses the Backend.
+func (options *Options) secretsManagerClients(ctx context.Context, cfg aws.Config) (aws.CredentialsProvider, SecretsManagerAPI, error) {
+	if options.Backend != nil {
+		client := NewCachingClient(options.Backend, options.CacheTTL)
+
+		if options.RegionalClient == nil {
+			options.RegionalClient = func(string) (SecretsManagerAPI, error) {
+				return client, nil
+			}
+		}
+
+		if options.RoleClient == nil {
+			options.RoleClient = func(context.Context, string, string) (SecretsManagerAPI, error) {
+				return client, nil
+			}
+		}
+
+		return nil, client, nil
+	}
+
+	if options.STSClient == nil {
+		options.STSClient = NewSTSClients(cfg)
+	}
+
+	start := time.Now()
+	role, err := AssumeRoleChainWith(ctx, options.STSClient, options.Roles)
+
+	if n := len(options.Roles); n > 0 && options.Debug != nil {
+		fmt.Fprintf(options.Debug, "level=debug event=assume_role role_arn=%q session_name=%q hops=%d elapsed=%s success=%t\n",
+			options.Roles[n-1].RoleArn, options.Roles[n-1].SessionName, n, time.Since(start).Round(time.Millisecond), err == nil)
+	}
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to assume role: %w", err)
+	}
+
+	if options.RegionalClient == nil {
+		options.RegionalClient = RegionalClients(cfg, role, options.CacheTTL)
+	}
+
+	if options.RoleClient == nil {
+		options.RoleClient = RoleClients(cfg, role, options.SecretRole, options.CacheTTL)
+	}
+
+	return role, NewCachingClient(NewSecretsManagerClient(cfg, role), options.CacheTTL), nil
+}
+
+// This function will return the built in providers of the schemes used by the Sources that have no
+// provider yet, each one with a client that uses the credentials of the assumed role
+func (options *Options) builtinProviders(cfg aws.Config, role aws.CredentialsProvider, client SecretsManagerAPI) ([]Provider, error) {
+	var providers []Provider
+
+	// A scheme that already has a provider does not need a built in one
+	added := map[string]bool{}
+	for _, provider := range options.Providers {
+		added[provider.Name()] = true
+	}
+
+	for _, source := range options.Sources {
+		scheme, _, _ := splitSource(source.Id)
+
+		if added[scheme] {
+			continue
+		}
+		added[scheme] = true
+
+		switch scheme {
+		case SCHEME_SECRETS_MANAGER:
+			providers = append(providers, NewSecretsManagerProvider(client))
+		case SCHEME_PARAMETER:
+			providers = append(providers, NewParameterProvider(NewSSMClient(cfg, role)))
+		case SCHEME_OBJECT:
+			providers = append(providers, NewObjectProvider(NewS3Client(cfg, role)))
+		case SCHEME_CIPHERTEXT:
+			providers = append(providers, NewCiphertextProvider(NewKMSClient(cfg, role)))
+		case SCHEME_APPCONFIG:
+			providers = append(providers, NewAppConfigProvider(NewAppConfigClient(cfg, role)))
+		case SCHEME_FILE:
+			providers = append(providers, NewFileProvider())
+		case SCHEME_VAULT:
+			credentials := cfg.Credentials
+			if role != nil {
+				credentials = role
+			}
+
+			vault, err := NewVaultProvider(options.Vault, credentials)
+
+			if err != nil {
+				return nil, err
+			}
+
+			providers = append(providers, vault)
+		}
+	}
+
+	return providers, nil
+}
+
+// This function will return the Secrets Manager client of the retriever
+func (r *Retriever) Client() SecretsManagerAPI {
+	return r.client
+}
+
+// This function will return the credentials of the last role that was assumed, which are refreshed before
+// they expire, nil when no roles were assumed
+func (r *Retriever) Credentials() aws.CredentialsProvider {
+	return r.credentials
+}
+
+// This function will return the AWS config the clients of the retriever were created from
+func (r *Retriever) AWSConfig() aws.Config {
+	return r.awsConfig
+}
+
+// This function will return the Secrets of the options along with the secrets found by the TagFilters.
+// A secret that was listed explicitly is not added a second time.
+func (r *Retriever) Secrets(ctx context.Context) ([]Secret, error) {
+	secrets := append([]Secret{}, r.Options.Secrets...)
+
+	if len(r.Options.TagFilters) == 0 {
+		return secrets, nil
+	}
+
+	arns, err := FindSecrets(ctx, r.client, r.Options.TagFilters)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list the secrets matching the tag filters: %w", err)
+	}
+
+	if r.Options.Debug != nil {
+		fmt.Fprintf(r.Options.Debug, "level=debug event=list_secrets filters=%d matched=%d\n", len(r.Options.TagFilters), len(arns))
+	}
+
+	for _, secretArn := range arns {
+		spec := Secret{Id: secretArn}
+
+		duplicate := false
+		for _, existing := range secrets {
+			duplicate = duplicate || existing == spec
+		}
+
+		if !duplicate {
+			secrets = append(secrets, spec)
+		}
+	}
+
+	return secrets, nil
+}
+
+// This function will return the policies that grant the calls made to retrieve the secrets of the options,
+// including the secrets found by the TagFilters, see GenerateIamPolicy.  With describe the secrets are also
+// granted DescribeSecret, as the rotation checks and the metadata of the secrets need.
+func (r *Retriever) GenerateIamPolicy(ctx context.Context, describe bool) ([]GeneratedPolicy, error) {
+	secrets, err := r.Secrets(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	request := PolicyRequest{
+		Config:          r.Options.Config,
+		ListSecrets:     len(r.Options.TagFilters) > 0,
+		DescribeSecrets: describe || r.Options.ValidateCache,
+		CacheKeyId:      r.Options.CacheKeyId,
+	}
+	request.Secrets = secrets
+
+	// A Backend has no KMS keys to resolve
+	if r.Options.Backend == nil {
+		request.KeyClient = r.keyClients()
+	}
+
+	return GenerateIamPolicy(ctx, r.client, request)
+}
+
+// This function will return a function that creates a KMS client for a region and role, for use as the
+// KeyClient of a PolicyRequest.  Each role is assumed with the settings of the SecretRole, the same as the
+// RoleClient of the options.
+func (r *Retriever) keyClients() func(context.Context, string, string) (KeyDescriberAPI, error) {
+	roles := map[string]aws.CredentialsProvider{}
+
+	base := r.awsConfig.Copy()
+	if r.credentials != nil {
+		base.Credentials = r.credentials
+	}
+
+	return func(ctx context.Context, region string, roleArn string) (KeyDescriberAPI, error) {
+		regional := base.Copy()
+		if len(region) > 0 {
+			regional.Region = region
+		}
+
+		if len(roleArn) == 0 {
+			return NewKMSClient(regional, nil), nil
+		}
+
+		role, ok := roles[roleArn]
+		if !ok {
+			options := r.Options.SecretRole
+			options.RoleArn = roleArn
+			options.WebIdentityTokenFile = ""
+
+			providers, err := roleChainProviders(NewSTSClients(base), []AssumeRoleOptions{options})
+
+			if err != nil {
+				return nil, err
+			}
+
+			role = providers[0]
+			roles[roleArn] = role
+		}
+
+		return NewKMSClient(regional, role), nil
+	}
+}
+
+// This function will retrieve and merge the secrets, see Retrieve.  When there is a CacheFile the secrets
+// are read from it instead while it has not expired.
+func (r *Retriever) Retrieve(ctx context.Context) (*Result, error) {
+	if len(r.Options.CacheFile) == 0 || r.Options.CacheTTL <= 0 {
+		return r.retrieve(ctx)
+	}
+
+	// A CacheKeyId generates a new data key for each file, otherwise the key is derived from the credentials
+	var key []byte
+
+	if len(r.Options.CacheKeyId) == 0 {
+		var err error
+		if key, err = EnvironmentKey(ctx, r.awsConfig); err != nil {
+			return nil, fmt.Errorf("Failed to derive the key of the cache file %s: %w", r.Options.CacheFile, err)
+		}
+	}
+
+	fingerprint := r.Options.Fingerprint()
+
+	if !r.Options.Refresh {
+		result, err := r.readCacheFile(ctx, key, fingerprint)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read the cache file %s: %w", r.Options.CacheFile, err)
+		}
+
+		if result != nil && r.Options.ValidateCache {
+			rotated, err := r.Rotated(ctx, result)
+
+			if r.Options.Debug != nil {
+				fmt.Fprintf(r.Options.Debug, "level=debug event=validate_cache path=%q rotated=%d success=%t\n", r.Options.CacheFile, len(rotated), err == nil)
+			}
+
+			// The file is a miss when the versions cannot be checked, the retrieval then reports the error
+			if err != nil || len(rotated) > 0 {
+				result = nil
+			}
+		}
+
+		if r.Options.Debug != nil {
+			fmt.Fprintf(r.Options.Debug, "level=debug event=read_cache path=%q hit=%t\n", r.Options.CacheFile, result != nil)
+		}
+
+		if r.Options.ObserveCache != nil {
+			r.Options.ObserveCache(result != nil)
+		}
+
+		if result != nil {
+			return result, nil
+		}
+	}
+
+	result, err := r.retrieve(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// A cache that cannot be written only costs the next process a retrieval, so it does not fail this one
+	if err := r.writeCacheFile(ctx, key, fingerprint, result); err != nil && r.Options.Warnings != nil {
+		fmt.Fprintf(r.Options.Warnings, "Warning: failed to write the cache file %s: %s\n", r.Options.CacheFile, err)
+	}
+
+	return result, nil
+}
+
+// This function will read the CacheFile with the data key of the CacheKeyId, or with the key when there is none
+func (r *Retriever) readCacheFile(ctx context.Context, key []byte, fingerprint string) (*Result, error) {
+	if len(r.Options.CacheKeyId) > 0 {
+		return ReadKMSCacheFile(ctx, r.Options.CacheFile, r.Options.CacheKeyClient, r.Options.CacheKeyId, fingerprint)
+	}
+
+	return ReadCacheFile(r.Options.CacheFile, key, fingerprint)
+}
+
+// This function will write the CacheFile with a new data key of the CacheKeyId, or with the key when there is none
+func (r *Retriever) writeCacheFile(ctx context.Context, key []byte, fingerprint string, result *Result) error {
+	if len(r.Options.CacheKeyId) > 0 {
+		return WriteKMSCacheFile(ctx, r.Options.CacheFile, r.Options.CacheKeyClient, r.Options.CacheKeyId, fingerprint, r.Options.CacheTTL, result)
+	}
+
+	return WriteCacheFile(r.Options.CacheFile, key, fingerprint, r.Options.CacheTTL, result)
+}
+
+// This function will retrieve and merge the secrets without the CacheFile
+func (r *Retriever) retrieve(ctx context.Context) (*Result, error) {
+	secrets, err := r.Secrets(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := r.Options.Config
+	cfg.Secrets = secrets
+
+	return Retrieve(ctx, r.client, cfg)
+}
+
+// This function will retrieve and merge the secrets and return the values of the environment variables,
+// after the transform, coalesce, and composite rules have been applied.
+func (r *Retriever) Resolve(ctx context.Context) (map[string]string, error) {
+	result, err := r.Retrieve(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	values := r.Options.Render(result.Values)
+
+	if err := r.Options.ApplyTransforms(values); err != nil {
+		return nil, err
+	}
+
+	r.Options.ApplyCoalesce(values)
+
+	if err := r.Options.ApplyComposites(result, values); err != nil {
+		return nil, err
+	}
+
+	return values, nil
+}
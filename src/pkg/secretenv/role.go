@@ -0,0 +1,336 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// This code is used to assume the roles used to access the secrets and to create the clients
+// that use the credentials of the assumed role.
+//
+package secretenv
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/appconfigdata"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/aws-sdk-go-v2/service/sts/types"
+)
+
+// The range of session durations in seconds accepted by AssumeRole
+const MIN_ROLE_DURATION = 900
+const MAX_ROLE_DURATION = 43200
+
+// The credentials of an assumed role are refreshed this long before they expire, so that a call never
+// starts with credentials that are about to expire
+const ROLE_EXPIRY_WINDOW = time.Minute
+
+// The STS operations used by this package.  *sts.Client implements this interface.
+type STSAPI interface {
+	AssumeRole(ctx context.Context, params *sts.AssumeRoleInput, optFns ...func(*sts.Options)) (*sts.AssumeRoleOutput, error)
+	AssumeRoleWithWebIdentity(ctx context.Context, params *sts.AssumeRoleWithWebIdentityInput, optFns ...func(*sts.Options)) (*sts.AssumeRoleWithWebIdentityOutput, error)
+}
+
+// Creates the STS client that makes its calls with the credentials, the credentials of the config are used
+// when they are nil
+type STSClientFunc func(credentials aws.CredentialsProvider) STSAPI
+
+// A single role to assume, one hop of a role chain
+type AssumeRoleOptions struct {
+	RoleArn     string
+	SessionName string
+
+	// The external id required by the trust policy of the role, omitted when empty
+	ExternalId string
+
+	// The number of seconds the session lasts, AWS applies its default of one hour when zero
+	DurationSeconds int32
+
+	// The session tags passed to the role, e.g. for attribute based access control of the secrets
+	Tags map[string]string
+
+	// The source identity of the session, it is recorded in CloudTrail for every call made with the role
+	SourceIdentity string
+
+	// A file holding an OIDC token, e.g. from EKS or GitHub Actions, the role is then assumed with
+	// AssumeRoleWithWebIdentity instead of with the credentials of the config.  Only the first role of a
+	// chain may use a token.
+	WebIdentityTokenFile string
+
+	// The ARN or serial number of the MFA device required by the trust policy of the role, and the function
+	// that returns its current token code each time the role is assumed, e.g. by prompting for it
+	SerialNumber  string
+	TokenProvider func() (string, error)
+}
+
+// This function will return the credentials of the last of the roles, each role is assumed with the
+// credentials of the previous role, starting with the credentials of the config.  The credentials of each
+// role are cached and the role is assumed again shortly before they expire, so a long running process never
+// uses expired credentials.  Every role is assumed once before returning so that a role that cannot be
+// assumed fails straight away, a failure of a chain reports which hop failed.  Nil is returned when no roles
+// were supplied.
+func AssumeRoleChain(ctx context.Context, cfg aws.Config, roles []AssumeRoleOptions) (aws.CredentialsProvider, error) {
+	return AssumeRoleChainWith(ctx, NewSTSClients(cfg), roles)
+}
+
+// This function will assume the roles the same as AssumeRoleChain with the STS clients created by newClient
+func AssumeRoleChainWith(ctx context.Context, newClient STSClientFunc, roles []AssumeRoleOptions) (aws.CredentialsProvider, error) {
+	providers, err := roleChainProviders(newClient, roles)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i, provider := range providers {
+		if _, err := provider.Retrieve(ctx); err != nil {
+			if len(roles) > 1 {
+				return nil, fmt.Errorf("hop %d of %d (%s): %w", i+1, len(roles), roles[i].RoleArn, err)
+			}
+			return nil, err
+		}
+	}
+
+	if len(providers) == 0 {
+		return nil, nil
+	}
+
+	return providers[len(providers)-1], nil
+}
+
+// This function will return the cached credentials of each role of the chain without assuming any of them,
+// the STS client of each role uses the credentials of the previous role
+func roleChainProviders(newClient STSClientFunc, roles []AssumeRoleOptions) ([]aws.CredentialsProvider, error) {
+	var providers []aws.CredentialsProvider
+	var previous aws.CredentialsProvider
+
+	for i, role := range roles {
+		var provider aws.CredentialsProvider
+
+		if len(role.WebIdentityTokenFile) > 0 {
+			if i > 0 {
+				return nil, fmt.Errorf("hop %d of %d (%s): only the first role of a chain can be assumed with a web identity token", i+1, len(roles), role.RoleArn)
+			}
+
+			// The call is not signed, the token is the only proof of identity, so no credentials need to be configured
+			provider = stscreds.NewWebIdentityRoleProvider(newClient(aws.AnonymousCredentials{}), role.RoleArn, identityTokenFile(role.WebIdentityTokenFile),
+				func(o *stscreds.WebIdentityRoleOptions) {
+					o.RoleSessionName = role.SessionName
+					o.Duration = time.Duration(role.DurationSeconds) * time.Second
+				})
+		} else {
+			provider = stscreds.NewAssumeRoleProvider(newClient(previous), role.RoleArn, role.apply)
+		}
+
+		previous = aws.NewCredentialsCache(provider, func(o *aws.CredentialsCacheOptions) {
+			o.ExpiryWindow = ROLE_EXPIRY_WINDOW
+		})
+		providers = append(providers, previous)
+	}
+
+	return providers, nil
+}
+
+// This function will set the options of the AssumeRole calls of the role
+func (role AssumeRoleOptions) apply(o *stscreds.AssumeRoleOptions) {
+	o.RoleSessionName = role.SessionName
+
+	// Roles that are assumed across accounts may require an external id in their trust policy
+	if len(role.ExternalId) > 0 {
+		o.ExternalID = aws.String(role.ExternalId)
+	}
+
+	// AWS applies its default duration of one hour when none is supplied
+	o.Duration = time.Duration(role.DurationSeconds) * time.Second
+
+	// The tags are passed in a fixed order so that the requests are the same on every refresh
+	for _, key := range SortedKeys(role.Tags) {
+		o.Tags = append(o.Tags, types.Tag{Key: aws.String(key), Value: aws.String(role.Tags[key])})
+	}
+
+	if len(role.SourceIdentity) > 0 {
+		o.SourceIdentity = aws.String(role.SourceIdentity)
+	}
+
+	// Roles that people assume from a workstation may require MFA in their trust policy
+	if len(role.SerialNumber) > 0 {
+		o.SerialNumber = aws.String(role.SerialNumber)
+		o.TokenProvider = role.TokenProvider
+	}
+}
+
+// A web identity token file, the token is read again each time the role is assumed since tools such as
+// EKS replace the file before the token expires
+type identityTokenFile string
+
+// GetIdentityToken is an implementation of the stscreds.IdentityTokenRetriever interface
+func (f identityTokenFile) GetIdentityToken() ([]byte, error) {
+	token, err := ioutil.ReadFile(string(f))
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the web identity token: %w", err)
+	}
+
+	return bytes.TrimSpace(token), nil
+}
+
+// This function will return the function that creates the STS clients from the config
+func NewSTSClients(cfg aws.Config) STSClientFunc {
+	return func(credentials aws.CredentialsProvider) STSAPI {
+		return sts.NewFromConfig(cfg, func(o *sts.Options) {
+			if credentials != nil {
+				o.Credentials = credentials
+			}
+		})
+	}
+}
+
+// This function will create a Secrets Manager client that uses the credentials, such as those of an assumed
+// role, when they were supplied, otherwise the credentials from the config are used.
+func NewSecretsManagerClient(cfg aws.Config, credentials aws.CredentialsProvider) *secretsmanager.Client {
+	return secretsmanager.NewFromConfig(cfg, func(o *secretsmanager.Options) {
+		if credentials != nil {
+			o.Credentials = credentials
+		}
+	})
+}
+
+// This function will create an SSM client that uses the credentials, such as those of an assumed role,
+// when they were supplied, otherwise the credentials from the config are used.
+func NewSSMClient(cfg aws.Config, credentials aws.CredentialsProvider) *ssm.Client {
+	return ssm.NewFromConfig(cfg, func(o *ssm.Options) {
+		if credentials != nil {
+			o.Credentials = credentials
+		}
+	})
+}
+
+// This function will create a KMS client that uses the credentials, such as those of an assumed role,
+// when they were supplied, otherwise the credentials from the config are used.
+func NewKMSClient(cfg aws.Config, credentials aws.CredentialsProvider) *kms.Client {
+	return kms.NewFromConfig(cfg, func(o *kms.Options) {
+		if credentials != nil {
+			o.Credentials = credentials
+		}
+	})
+}
+
+// This function will create an AppConfig Data client that uses the credentials, such as those of an assumed
+// role, when they were supplied, otherwise the credentials from the config are used.
+func NewAppConfigClient(cfg aws.Config, credentials aws.CredentialsProvider) *appconfigdata.Client {
+	return appconfigdata.NewFromConfig(cfg, func(o *appconfigdata.Options) {
+		if credentials != nil {
+			o.Credentials = credentials
+		}
+	})
+}
+
+// This function will create an S3 client that uses the credentials, such as those of an assumed role,
+// when they were supplied, otherwise the credentials from the config are used.  Path style URLs are used when the config
+// has its own endpoint resolver, since endpoints such as LocalStack do not serve a host name per bucket.
+func NewS3Client(cfg aws.Config, credentials aws.CredentialsProvider) *s3.Client {
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.UsePathStyle = cfg.EndpointResolver != nil || cfg.EndpointResolverWithOptions != nil
+		if credentials != nil {
+			o.Credentials = credentials
+		}
+	})
+}
+
+// This function will create a Lambda client that uses the credentials, such as those of an assumed role,
+// when they were supplied, otherwise the credentials from the config are used.
+func NewLambdaClient(cfg aws.Config, credentials aws.CredentialsProvider) *lambda.Client {
+	return lambda.NewFromConfig(cfg, func(o *lambda.Options) {
+		if credentials != nil {
+			o.Credentials = credentials
+		}
+	})
+}
+
+// This function will return a function that creates a Secrets Manager client for a region other than the
+// region of the config, for use as the RegionalClient of a Config.  The clients share the credentials, such
+// as those of an assumed role, and one client is kept per region so that secrets in the same region reuse it.
+// Each client remembers the secrets it retrieved for the cacheTTL, see NewCachingClient.
+func RegionalClients(cfg aws.Config, credentials aws.CredentialsProvider, cacheTTL time.Duration) func(string) (SecretsManagerAPI, error) {
+	var mutex sync.Mutex
+	clients := map[string]SecretsManagerAPI{}
+
+	return func(region string) (SecretsManagerAPI, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if client, ok := clients[region]; ok {
+			return client, nil
+		}
+
+		regional := cfg.Copy()
+		regional.Region = region
+
+		client := NewCachingClient(NewSecretsManagerClient(regional, credentials), cacheTTL)
+		clients[region] = client
+
+		return client, nil
+	}
+}
+
+// This function will return a function that creates a Secrets Manager client for a role and region, for use
+// as the RoleClient of a Config.  Each role is assumed with the settings of the template, using the
+// credentials when they were supplied, and one client is kept per region and role.  The credentials of each
+// role are cached and refreshed before they expire the same as those of AssumeRoleChain, and each client
+// remembers the secrets it retrieved for the cacheTTL, see NewCachingClient.
+func RoleClients(cfg aws.Config, credentials aws.CredentialsProvider, template AssumeRoleOptions, cacheTTL time.Duration) func(context.Context, string, string) (SecretsManagerAPI, error) {
+	var mutex sync.Mutex
+	roles := map[string]aws.CredentialsProvider{}
+	clients := map[string]SecretsManagerAPI{}
+
+	base := cfg.Copy()
+	if credentials != nil {
+		base.Credentials = credentials
+	}
+
+	return func(ctx context.Context, region string, roleArn string) (SecretsManagerAPI, error) {
+		mutex.Lock()
+
+		role, ok := roles[roleArn]
+		if !ok {
+			options := template
+			options.RoleArn = roleArn
+			options.WebIdentityTokenFile = ""
+
+			providers, _ := roleChainProviders(NewSTSClients(base), []AssumeRoleOptions{options})
+			role = providers[0]
+			roles[roleArn] = role
+		}
+
+		key := region + "|" + roleArn
+		client, ok := clients[key]
+		if !ok {
+			regional := cfg.Copy()
+			if len(region) > 0 {
+				regional.Region = region
+			}
+
+			client = NewCachingClient(NewSecretsManagerClient(regional, role), cacheTTL)
+			clients[key] = client
+		}
+
+		mutex.Unlock()
+
+		// The role is assumed without holding the lock so that the other roles are not held up, the cache
+		// only lets one caller assume the role while the others wait for its credentials
+		if _, err := role.Retrieve(ctx); err != nil {
+			return nil, err
+		}
+
+		return client, nil
+	}
+}
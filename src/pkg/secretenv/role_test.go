@@ -0,0 +1,132 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// These tests assume roles with a fake STS client, so that the refreshing of the credentials is tested
+// without AWS credentials.
+//
+package secretenv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/aws-sdk-go-v2/service/sts/types"
+)
+
+// An STSAPI whose sessions last for the duration, every AssumeRole call returns a new access key
+type fakeSTS struct {
+	duration time.Duration
+
+	mutex sync.Mutex
+	calls []sts.AssumeRoleInput
+}
+
+// AssumeRole returns the credentials of a new session
+func (f *fakeSTS) AssumeRole(ctx context.Context, params *sts.AssumeRoleInput, optFns ...func(*sts.Options)) (*sts.AssumeRoleOutput, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.calls = append(f.calls, *params)
+
+	return &sts.AssumeRoleOutput{
+		Credentials: &types.Credentials{
+			AccessKeyId:     aws.String(fmt.Sprintf("AKID%d", len(f.calls))),
+			SecretAccessKey: aws.String("secret"),
+			SessionToken:    aws.String("token"),
+			Expiration:      aws.Time(time.Now().Add(f.duration)),
+		},
+	}, nil
+}
+
+// AssumeRoleWithWebIdentity is not used by these tests
+func (f *fakeSTS) AssumeRoleWithWebIdentity(ctx context.Context, params *sts.AssumeRoleWithWebIdentityInput, optFns ...func(*sts.Options)) (*sts.AssumeRoleWithWebIdentityOutput, error) {
+	return nil, errors.New("AssumeRoleWithWebIdentity is not supported by the fake")
+}
+
+// This function will return the number of AssumeRole calls so far
+func (f *fakeSTS) count() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return len(f.calls)
+}
+
+func TestAssumeRoleChainRefreshesCredentials(t *testing.T) {
+	tests := []struct {
+		name     string
+		duration time.Duration
+		calls    int
+	}{
+		// Credentials that are still valid for longer than the ROLE_EXPIRY_WINDOW are reused
+		{name: "valid", duration: time.Hour, calls: 1},
+
+		// Credentials that expire within the ROLE_EXPIRY_WINDOW are refreshed by assuming the role again,
+		// as a long running serve or extension does when the session of the role runs out
+		{name: "expiring", duration: ROLE_EXPIRY_WINDOW / 2, calls: 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := &fakeSTS{duration: test.duration}
+			newClient := func(aws.CredentialsProvider) STSAPI { return client }
+
+			role, err := AssumeRoleChainWith(context.Background(), newClient, []AssumeRoleOptions{
+				{RoleArn: "arn:aws:iam::111122223333:role/reader", SessionName: "test", ExternalId: "external"},
+			})
+
+			if err != nil {
+				t.Fatalf("AssumeRoleChainWith failed: %s", err)
+			}
+
+			var keys []string
+			for i := 0; i < 2; i++ {
+				credentials, err := role.Retrieve(context.Background())
+
+				if err != nil {
+					t.Fatalf("Retrieve failed: %s", err)
+				}
+				keys = append(keys, credentials.AccessKeyID)
+			}
+
+			if client.count() != test.calls {
+				t.Errorf("The role was assumed %d times, want %d", client.count(), test.calls)
+			}
+
+			if refreshed := keys[0] != keys[1]; refreshed != (test.calls > 1) {
+				t.Errorf("The credentials were %s, refreshed is %t", keys, refreshed)
+			}
+
+			if externalId := aws.ToString(client.calls[0].ExternalId); externalId != "external" {
+				t.Errorf("The role was assumed with the external id %q, want %q", externalId, "external")
+			}
+		})
+	}
+}
+
+func TestRegionalClientsCache(t *testing.T) {
+	cfg := aws.Config{Region: "us-east-1", Credentials: aws.AnonymousCredentials{}}
+
+	for _, ttl := range []time.Duration{0, time.Minute} {
+		clients := RegionalClients(cfg, nil, ttl)
+
+		first, _ := clients("eu-west-1")
+		second, _ := clients("eu-west-1")
+		other, _ := clients("us-west-2")
+
+		if first != second || first == other {
+			t.Errorf("The clients of a region are not reused, or the regions share a client")
+		}
+
+		// The clients of the other regions remember the secrets for the -cache-ttl as the default client does
+		if _, cached := first.(*CachingClient); cached != (ttl > 0) {
+			t.Errorf("The regional client with the cache ttl %s caches is %t", ttl, cached)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// This code is used by long running processes, such as the Lambda extension, to detect that a
+// secret was rotated and retrieve its new value.
+//
+package secretenv
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+// The staging label of the version of a secret that is retrieved when no version is asked for
+const CURRENT_STAGE = "AWSCURRENT"
+
+// This function will return the ids of the secrets whose AWSCURRENT version is no longer the version in
+// the result, along with any secret that is not in the result at all, e.g. a newly tagged secret matching
+// the TagFilters.  Only DescribeSecret is called, so the values of the secrets are not retrieved.  Secrets
+// that ask for a version, or are pinned by a manifest, never rotate and are not checked.
+func (r *Retriever) Rotated(ctx context.Context, result *Result) ([]string, error) {
+	secrets, err := r.Secrets(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var rotated []string
+
+	for _, secret := range secrets {
+		if len(secret.VersionId) > 0 || len(secret.VersionStage) > 0 || r.Options.Pinned != nil {
+			continue
+		}
+
+		version, ok := result.Versions[secret.Id]
+
+		if !ok {
+			rotated = append(rotated, secret.Id)
+			continue
+		}
+
+		client, err := r.secretClient(ctx, secret)
+
+		if err != nil {
+			return nil, err
+		}
+
+		output, err := client.DescribeSecret(ctx, &secretsmanager.DescribeSecretInput{SecretId: aws.String(secret.Id)})
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to describe secret %s: %w", secret.Id, err)
+		}
+
+		if currentVersion(output.VersionIdsToStages) != version {
+			rotated = append(rotated, secret.Id)
+		}
+	}
+
+	return rotated, nil
+}
+
+// This function will return the client of the role or region of the secret, or the client of the retriever
+// when the secret has neither
+func (r *Retriever) secretClient(ctx context.Context, secret Secret) (SecretsManagerAPI, error) {
+	return r.Options.secretClient(ctx, r.client, secret)
+}
+
+// This function will return the VersionId that has the AWSCURRENT staging label
+func currentVersion(versions map[string][]string) string {
+	for versionId, stages := range versions {
+		for _, stage := range stages {
+			if stage == CURRENT_STAGE {
+				return versionId
+			}
+		}
+	}
+
+	return ""
+}
+
+// This function will retrieve the secrets again, ignoring the in memory cache and the CacheFile, and
+// replace the CacheFile with the new values
+func (r *Retriever) Refresh(ctx context.Context) (*Result, error) {
+	if caching, ok := r.client.(*CachingClient); ok {
+		caching.Flush()
+	}
+
+	refresh := r.Options.Refresh
+	r.Options.Refresh = true
+	defer func() { r.Options.Refresh = refresh }()
+
+	return r.Retrieve(ctx)
+}
@@ -0,0 +1,137 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// This code is used to retrieve env files and JSON config objects from S3 so that they can be
+// merged with the secrets under the same rules as any other source.
+//
+package secretenv
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// The scheme of the URL of an S3 object
+const S3_SCHEME = "s3://"
+
+// The largest object read from S3, a config object is far smaller and anything larger is most likely the
+// wrong object
+const MAX_OBJECT_SIZE = 1024 * 1024
+
+// The S3 operations used by this package.  *s3.Client implements this interface.
+type S3API interface {
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+// This function will parse a single object in the form [prefix=]s3://BUCKET/KEY.  The prefix follows the
+// same rules as for secrets.
+func ParseObjectSpec(value string) (Secret, error) {
+	name := strings.TrimSpace(value)
+
+	spec := Secret{Id: name}
+	if i := strings.Index(name, "="); i > 0 && IsValidEnvName(name[:i]) {
+		spec.Prefix = name[:i]
+		spec.Id = strings.TrimSpace(name[i+1:])
+	}
+
+	if _, _, err := splitObjectUrl(spec.Id); err != nil {
+		return spec, err
+	}
+
+	return spec, nil
+}
+
+// This function will split the URL of an object into its bucket and key
+func splitObjectUrl(value string) (string, string, error) {
+	if !strings.HasPrefix(value, S3_SCHEME) {
+		return "", "", fmt.Errorf("the object %q is not an s3://BUCKET/KEY URL", value)
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(value, S3_SCHEME), "/", 2)
+
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 || strings.HasSuffix(parts[1], "/") {
+		return "", "", fmt.Errorf("the object %q is not an s3://BUCKET/KEY URL", value)
+	}
+
+	// A key with spaces or other special characters may be given escaped
+	key, err := url.PathUnescape(parts[1])
+
+	if err != nil {
+		return "", "", fmt.Errorf("the key of the object %q is not valid: %w", value, err)
+	}
+
+	return parts[0], key, nil
+}
+
+// This function will retrieve the Objects of the config and return the keys and values of each one in the
+// same order as the Objects.  Objects encrypted with SSE-S3 or SSE-KMS are decrypted by S3, the role only
+// needs kms:Decrypt on the key of an SSE-KMS object.  An object holding a JSON object is converted the same
+// as a secret and anything else is read as a dotenv file, unless its key ends in .json.
+func (c Config) retrieveObjects(ctx context.Context) ([]map[string]interface{}, error) {
+	if c.ObjectClient == nil {
+		return nil, inputError("S3 objects were supplied but no S3 client was configured")
+	}
+
+	results := make([]map[string]interface{}, len(c.Objects))
+
+	for i, spec := range c.Objects {
+		bucket, key, err := splitObjectUrl(spec.Id)
+
+		if err != nil {
+			return nil, inputError("%w", err)
+		}
+
+		output, err := c.ObjectClient.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to retrieve object %s: %w", spec.Id, err)
+		}
+
+		data, err := ioutil.ReadAll(io.LimitReader(output.Body, MAX_OBJECT_SIZE+1))
+		output.Body.Close()
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read object %s: %w", spec.Id, err)
+		}
+
+		if len(data) > MAX_OBJECT_SIZE {
+			return nil, inputError("The object %s is larger than %d bytes", spec.Id, MAX_OBJECT_SIZE)
+		}
+
+		values, err := parseObject(key, string(data))
+
+		if err != nil {
+			return nil, parseError("Failed to convert object %s: %w", spec.Id, err)
+		}
+
+		if c.Flatten {
+			values = c.FlattenValues(values)
+		}
+
+		results[i] = values
+	}
+
+	return results, nil
+}
+
+// This function will convert the text of an object with the key into its keys and values
+func parseObject(key string, text string) (map[string]interface{}, error) {
+	trimmed := strings.TrimSpace(strings.TrimPrefix(text, UTF8_BOM))
+
+	if strings.HasPrefix(trimmed, "{") {
+		return parseString(key, text)
+	} else if strings.EqualFold(path.Ext(key), ".json") {
+		return nil, fmt.Errorf("the object is not a JSON object")
+	}
+
+	return ParseDotenv(text)
+}
@@ -0,0 +1,1040 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// This package is used to retrieve values from AWS Secrets Manager and convert them into
+// the keys and values of environment variables.  All of the options are supplied through
+// Config and the Secrets Manager client is supplied through the SecretsManagerAPI interface
+// so that the retrieval can be tested without calling AWS.
+//
+package secretenv
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+)
+
+// The byte order mark that may prefix a UTF-8 secret string
+const UTF8_BOM = "\ufeff"
+
+// The ways a key defined by more than one secret is merged.  With last-wins the secret supplied last
+// replaces the value, with first-wins the secret supplied first keeps it, and with error the retrieval fails.
+const MERGE_LAST_WINS = "last-wins"
+const MERGE_FIRST_WINS = "first-wins"
+const MERGE_ERROR = "error"
+
+// The Secrets Manager operations used by this package.  *secretsmanager.Client implements this
+// interface.
+type SecretsManagerAPI interface {
+	GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error)
+	DescribeSecret(ctx context.Context, params *secretsmanager.DescribeSecretInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.DescribeSecretOutput, error)
+	GetResourcePolicy(ctx context.Context, params *secretsmanager.GetResourcePolicyInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetResourcePolicyOutput, error)
+	BatchGetSecretValue(ctx context.Context, params *secretsmanager.BatchGetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.BatchGetSecretValueOutput, error)
+	ListSecrets(ctx context.Context, params *secretsmanager.ListSecretsInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.ListSecretsOutput, error)
+}
+
+// The options used to retrieve the secrets and to convert them into environment variables
+type Config struct {
+	// The secrets to retrieve, in the order that they are merged
+	Secrets []Secret
+
+	// The VersionId that must be retrieved for each secret id, nil when the secrets are not pinned
+	Pinned map[string]string
+
+	// Convert the keys of the secrets to upper case
+	UppercaseKeys bool
+
+	// Replace each character of a key that cannot be used in an environment variable name with an _, so
+	// that api-key.primary becomes api_key_primary, see SanitizeEnvName
+	SanitizeKeys bool
+
+	// The prefixes removed from the keys of the secrets before the prefix of the secret is added, e.g.
+	// prod_ turns prod_password into password.  Only the first prefix that matches is removed.
+	StripPrefixes []string
+
+	// The order Format writes the keys in, the keys that are not listed follow in sorted order.  The keys
+	// are sorted when empty so that the output is the same on every run.
+	KeyOrder []string
+
+	// Flatten nested objects into a key per value
+	Flatten bool
+
+	// The number of levels of nested objects that are flattened, deeper values are kept as JSON.  All
+	// levels are flattened when zero.
+	FlattenDepth int
+
+	// Flatten the string values that hold a JSON object or array as well, e.g. a secret whose value holds
+	// another secret encoded as JSON, see FlattenValues
+	DecodeNestedJson bool
+
+	// The separator placed between the parts of prefixed, flattened, and indexed keys
+	Separator string
+
+	// How array values are rendered, one of the ARRAY_MODE constants
+	ArrayMode string
+
+	// Fail when a key is defined by more than one secret instead of using the last one, the same as a
+	// MergeStrategy of MERGE_ERROR
+	FailOnCollision bool
+
+	// How a key defined by more than one secret is merged, one of the MERGE constants, defaults to
+	// MERGE_LAST_WINS
+	MergeStrategy string
+
+	// Returns the client for a region other than the region of the client passed to Retrieve, it is called
+	// for each secret that has a Region and must be safe to call from several goroutines
+	RegionalClient func(region string) (SecretsManagerAPI, error)
+
+	// Returns the client that uses the credentials of a role for a region, or for the region of the client
+	// passed to Retrieve when region is empty.  It is called for each secret that has a RoleArn and must be
+	// safe to call from several goroutines.
+	RoleClient func(ctx context.Context, region string, roleArn string) (SecretsManagerAPI, error)
+
+	// The regions holding replicas of the secrets, they are tried in turn when a secret cannot be retrieved
+	// from its own region, e.g. during an outage or when it is throttled
+	FallbackRegions []string
+
+	// The SSM parameters to retrieve, they are merged after the secrets
+	Parameters []Secret
+
+	// The client used to retrieve the Parameters
+	ParameterClient SSMAPI
+
+	// The values encrypted directly with KMS, see ParseCiphertextSpec, they are merged after the Parameters
+	Ciphertexts []Secret
+
+	// The client used to decrypt the Ciphertexts
+	KMSClient KMSAPI
+
+	// The S3 objects to retrieve, see ParseObjectSpec, they are merged after the Ciphertexts
+	Objects []Secret
+
+	// The client used to retrieve the Objects
+	ObjectClient S3API
+
+	// The AppConfig configurations to retrieve, see ParseAppConfigSpec, they are merged after the Objects
+	AppConfigs []Secret
+
+	// The client used to retrieve the AppConfigs
+	AppConfigClient AppConfigAPI
+
+	// The sources given by a scheme, see ParseSourceSpec, they are resolved by the Providers and merged
+	// after the AppConfigs
+	Sources []Secret
+
+	// The providers of the schemes of the Sources, the first provider with the name of a scheme is used
+	Providers []Provider
+
+	// Retrieve the current version of the secrets with BatchGetSecretValue, secrets that ask for a version
+	// or region are still retrieved one at a time
+	Batch bool
+
+	// The maximum number of secrets that are retrieved at the same time, 0 or less retrieves them one
+	// at a time
+	Concurrency int
+
+	// The maximum number of GetSecretValue calls made at the same time, each of which has KMS decrypt the
+	// value, so that the KMS request rate stays below its own throttling limits.  Only the calls are
+	// limited while the rest of the Concurrency, such as converting the values, carries on, so at most the
+	// lower of the two are made at once.  0 or less does not limit the calls beyond the Concurrency.
+	KMSConcurrency int
+
+	// The rules applied by ApplyCoalesce
+	Coalesce []CoalesceRule
+
+	// The largest number of bytes the value of a single secret may have, a larger secret fails with a
+	// SizeError.  0 does not limit the size.
+	MaxSecretSize int
+
+	// The rules applied by ApplyTransforms, before the Coalesce rules
+	Transforms []TransformRule
+
+	// The keys built from templates over the other keys by ApplyComposites, after the Coalesce rules
+	Composites []CompositeRule
+
+	// The keys renamed after the secrets are merged, the names are those of the merged keys so they
+	// include the prefix of the secret and are sanitized and upper cased when SanitizeKeys and
+	// UppercaseKeys are set
+	Renames []RenameRule
+
+	// The key names or glob patterns, e.g. DB_*, of the keys to keep.  All keys are kept when empty.
+	Include []string
+
+	// The key names or glob patterns of the keys to drop, a key that matches both lists is dropped
+	Exclude []string
+
+	// Where warnings, such as a key being replaced by a later secret, are written.  Warnings are
+	// discarded when this is nil.
+	Warnings io.Writer
+
+	// Where diagnostics, such as each secret that is retrieved and how long it took, are written as
+	// key=value lines.  The values of the secrets are never written.  Nothing is written when this is nil.
+	Debug io.Writer
+
+	// Called for each secret that is retrieved with how long it took and why it failed, e.g. to record
+	// metrics.  The secrets of a batch share the time of the batch.  It must be safe to call from several
+	// goroutines.
+	Observe func(secretId string, elapsed time.Duration, err error)
+
+	// A directory that binary secrets are written to, one file per secret only readable by the owner.
+	// The variable of the secret is then the path of its file instead of the base64 encoded value.
+	BinaryDir string
+
+	// Keep going when a secret cannot be retrieved, the failure is recorded in the Errors of the result
+	// and the keys of the other secrets are still returned
+	BestEffort bool
+
+	// The slots of the KMSConcurrency, shared by the workers of a retrieval
+	decrypts chan struct{}
+}
+
+// The merged secrets returned by Retrieve
+type Result struct {
+	// The merged keys and values of all of the secrets
+	Values map[string]interface{}
+
+	// The id of the secret each key came from
+	Sources map[string]string
+
+	// The VersionId that was retrieved for each secret id
+	Versions map[string]string
+
+	// The ARN of each secret id that was retrieved, e.g. for an audit of the secrets that were accessed
+	ARNs map[string]string
+
+	// The error of each secret id that could not be retrieved, only ever filled in with BestEffort
+	Errors map[string]error
+}
+
+// An error caused by the input supplied to this package, such as a malformed secret id, rather than
+// by the AWS APIs or the contents of the secrets
+type InputError struct {
+	Err error
+}
+
+// Error is an implementation of the error interface
+func (e *InputError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap allows errors.As and errors.Is to inspect the underlying error
+func (e *InputError) Unwrap() error {
+	return e.Err
+}
+
+// An error caused by a secret or parameter whose value could not be converted, such as malformed JSON
+type ParseError struct {
+	Err error
+}
+
+// Error is an implementation of the error interface
+func (e *ParseError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap allows errors.As and errors.Is to inspect the underlying error
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// This function will return a ParseError with the formatted message
+func parseError(format string, args ...interface{}) error {
+	return &ParseError{fmt.Errorf(format, args...)}
+}
+
+// This function will return an InputError with the formatted message
+func inputError(format string, args ...interface{}) error {
+	return &InputError{Err: fmt.Errorf(format, args...)}
+}
+
+// This function will retrieve each of the secrets in the config and merge their keys and values.  The
+// secrets are retrieved concurrently, up to the Concurrency of the config, and every secret is attempted
+// even when another fails.  The secrets are always merged in the order they were supplied, so when the
+// same key is found in more than one secret the MergeStrategy decides which value is kept.  Keys of
+// a secret with a prefix can only collide with the same prefixed key from another secret.
+func Retrieve(ctx context.Context, client SecretsManagerAPI, cfg Config) (*Result, error) {
+	warnings := cfg.Warnings
+	if warnings == nil {
+		warnings = ioutil.Discard
+	}
+
+	secrets, err := cfg.retrieveAll(ctx, client)
+
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{
+		Values:   map[string]interface{}{},
+		Sources:  map[string]string{},
+		Versions: map[string]string{},
+		ARNs:     map[string]string{},
+		Errors:   map[string]error{},
+	}
+
+	for i, secret := range cfg.Secrets {
+		if secrets[i].err != nil {
+			fmt.Fprintf(warnings, "Warning: skipping secret %s: %s\n", secret.Id, secrets[i].err)
+			result.Errors[secret.Id] = secrets[i].err
+			continue
+		}
+
+		result.Versions[secret.Id] = secrets[i].versionId
+		if len(secrets[i].arn) > 0 {
+			result.ARNs[secret.Id] = secrets[i].arn
+		}
+
+		// The prefix of a plaintext secret is the name of its variable, so it is not added again
+		if secrets[i].named {
+			secret.Prefix = ""
+		}
+
+		if err := cfg.merge(result, secret, secrets[i].values, warnings); err != nil {
+			return nil, err
+		}
+	}
+
+	// Parameters are merged after the secrets so that a parameter replaces a key of the same name
+	if len(cfg.Parameters) > 0 {
+		parameters, err := cfg.retrieveParameters(ctx)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for i, parameter := range cfg.Parameters {
+			if err := cfg.merge(result, parameter, parameters[i], warnings); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(cfg.Ciphertexts) > 0 {
+		plaintexts, err := cfg.decryptCiphertexts(ctx)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for i, ciphertext := range cfg.Ciphertexts {
+			source := Secret{Id: CiphertextName(ciphertext), Prefix: ciphertext.Prefix}
+			if plaintexts[i].named {
+				source.Prefix = ""
+			}
+
+			if err := cfg.merge(result, source, plaintexts[i].values, warnings); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(cfg.Objects) > 0 {
+		objects, err := cfg.retrieveObjects(ctx)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for i, object := range cfg.Objects {
+			if err := cfg.merge(result, object, objects[i], warnings); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(cfg.AppConfigs) > 0 {
+		configurations, err := cfg.retrieveAppConfigs(ctx)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for i, configuration := range cfg.AppConfigs {
+			if err := cfg.merge(result, configuration, configurations[i], warnings); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(cfg.Sources) > 0 {
+		sources, err := cfg.resolveSources(ctx)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for i, source := range cfg.Sources {
+			if err := cfg.merge(result, source, sources[i], warnings); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := cfg.applyRenames(result, warnings); err != nil {
+		return nil, err
+	}
+
+	// Only the keys that were asked for are kept, so unused credentials in a shared secret never reach
+	// the environment
+	for key := range result.Values {
+		if !cfg.KeepKey(key) {
+			delete(result.Values, key)
+			delete(result.Sources, key)
+		}
+	}
+
+	return result, nil
+}
+
+// This function will rename the keys of the result using the Renames of the config.  Renaming a key onto
+// a key that another secret already defines is an error rather than silently replacing its value.
+func (c Config) applyRenames(result *Result, warnings io.Writer) error {
+	for _, rule := range c.Renames {
+		value, ok := result.Values[rule.From]
+
+		if !ok {
+			fmt.Fprintf(warnings, "Warning: the key %s to rename to %s was not found in any secret\n", rule.From, rule.To)
+			continue
+		}
+
+		if rule.From == rule.To {
+			continue
+		}
+
+		if previous, ok := result.Sources[rule.To]; ok {
+			return inputError("The key %s from secret %s cannot be renamed to %s which is already defined by secret %s",
+				rule.From, result.Sources[rule.From], rule.To, previous)
+		}
+
+		result.Values[rule.To] = value
+		result.Sources[rule.To] = result.Sources[rule.From]
+		delete(result.Values, rule.From)
+		delete(result.Sources, rule.From)
+	}
+
+	return nil
+}
+
+// This function will determine if the key passes the Include and Exclude lists of the config.  The
+// patterns have been checked by ValidatePatterns.
+func (c Config) KeepKey(key string) bool {
+	for _, pattern := range c.Exclude {
+		if matchPattern(pattern, key) {
+			return false
+		}
+	}
+
+	if len(c.Include) == 0 {
+		return true
+	}
+
+	for _, pattern := range c.Include {
+		if matchPattern(pattern, key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// This function will determine if a single Include or Exclude pattern matches the key.  A pattern between
+// slashes, e.g. /^DB_(USER|PASSWORD)$/, is a regular expression and anything else is a glob pattern
+// matched with path.Match.
+func matchPattern(pattern string, key string) bool {
+	if expression, ok := regexPattern(pattern); ok {
+		matched, _ := regexp.MatchString(expression, key)
+		return matched
+	}
+
+	matched, _ := path.Match(pattern, key)
+	return matched
+}
+
+// This function will return the regular expression of a pattern between slashes
+func regexPattern(pattern string) (string, bool) {
+	if len(pattern) >= 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		return pattern[1 : len(pattern)-1], true
+	}
+
+	return "", false
+}
+
+// This function will return an error for the first of the glob patterns or regular expressions that is
+// malformed
+func ValidatePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if expression, ok := regexPattern(pattern); ok {
+			if _, err := regexp.Compile(expression); err != nil {
+				return fmt.Errorf("the pattern %q is not a valid regular expression: %w", pattern, err)
+			}
+		} else if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("the pattern %q is not a valid glob pattern", pattern)
+		}
+	}
+
+	return nil
+}
+
+// This function will merge the keys and values of a secret or parameter into the result.  When a key
+// is already in the result the MergeStrategy decides if the new value replaces it, is ignored, or fails.
+func (c Config) merge(result *Result, secret Secret, values map[string]interface{}, warnings io.Writer) error {
+	secretId := secret.Id
+
+	// The original key each transformed key came from, two keys of the same secret that end up with the
+	// same name would otherwise replace each other in a random order
+	originals := make(map[string]string, len(values))
+
+	for original, value := range values {
+		key := c.TransformKey(secret, original)
+
+		if other, ok := originals[key]; ok {
+			if other > original {
+				other, original = original, other
+			}
+			return fmt.Errorf("The keys %s and %s of secret %s are both converted to the key %s", other, original, secretId, key)
+		}
+		originals[key] = original
+
+		if previous, ok := result.Sources[key]; ok {
+			switch c.mergeStrategy() {
+			case MERGE_ERROR:
+				return fmt.Errorf("The key %s is defined by both secret %s and secret %s", key, previous, secretId)
+			case MERGE_FIRST_WINS:
+				fmt.Fprintf(warnings, "Warning: the key %s from secret %s is kept, the value from secret %s is ignored\n", key, previous, secretId)
+				continue
+			}
+			fmt.Fprintf(warnings, "Warning: the key %s from secret %s is replaced by the value from secret %s\n", key, previous, secretId)
+		}
+
+		result.Values[key] = value
+		result.Sources[key] = secretId
+	}
+
+	return nil
+}
+
+// This function will return the name a key of the secret is merged as, after the StripPrefixes are
+// removed, the prefix of the secret is added, and the key is sanitized and upper cased
+func (c Config) TransformKey(secret Secret, key string) string {
+	for _, prefix := range c.StripPrefixes {
+		if len(prefix) > 0 && len(key) > len(prefix) && strings.HasPrefix(key, prefix) {
+			key = key[len(prefix):]
+			break
+		}
+	}
+
+	if len(secret.Prefix) > 0 {
+		key = secret.Prefix + c.Separator + key
+	}
+
+	if c.SanitizeKeys {
+		key = SanitizeEnvName(key)
+	}
+
+	if c.UppercaseKeys {
+		key = strings.ToUpper(key)
+	}
+
+	return key
+}
+
+// This function will return the MergeStrategy of the config, FailOnCollision selects MERGE_ERROR
+func (c Config) mergeStrategy() string {
+	if c.FailOnCollision {
+		return MERGE_ERROR
+	}
+
+	if len(c.MergeStrategy) == 0 {
+		return MERGE_LAST_WINS
+	}
+
+	return c.MergeStrategy
+}
+
+// The keys and values of a single retrieved secret along with the VersionId that was retrieved
+type retrievedSecret struct {
+	values    map[string]interface{}
+	versionId string
+	arn       string
+
+	// The secret is plaintext and its value is already named by the prefix of the secret
+	named bool
+
+	// Why the secret could not be retrieved, only ever set with BestEffort
+	err error
+}
+
+// This function will retrieve all of the secrets in the config using a bounded number of goroutines.  The
+// results are returned in the same order as the secrets.  When secrets fail the error of the first of them
+// is returned followed by the errors of the others.
+func (c Config) retrieveAll(ctx context.Context, client SecretsManagerAPI) ([]retrievedSecret, error) {
+	workers := c.Concurrency
+	if workers < 1 {
+		workers = 1
+	}
+
+	results := make([]retrievedSecret, len(c.Secrets))
+	remaining := make([]int, 0, len(c.Secrets))
+
+	// The secrets that can be batched are retrieved first and only the rest are retrieved one at a time
+	if c.Batch {
+		batched, err := c.retrieveBatches(ctx, client, results)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range c.Secrets {
+			if !batched[i] {
+				remaining = append(remaining, i)
+			}
+		}
+	} else {
+		for i := range c.Secrets {
+			remaining = append(remaining, i)
+		}
+	}
+
+	if c.KMSConcurrency > 0 {
+		c.decrypts = make(chan struct{}, c.KMSConcurrency)
+	}
+
+	indexes := make(chan int)
+
+	// Every secret is attempted so that all of the failures are reported together.  The errors are kept
+	// by index so that they are reported in the order the secrets were supplied.
+	var wg sync.WaitGroup
+	errs := make([]error, len(c.Secrets))
+
+	for w := 0; w < workers && w < len(remaining); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := range indexes {
+				result, err := c.retrieveSecret(ctx, client, c.Secrets[i])
+
+				if err != nil {
+					errs[i] = err
+					continue
+				}
+
+				results[i] = result
+			}
+		}()
+	}
+
+	// Once the context is done the secrets that were not handed out yet fail with its error, so that they are
+	// reported instead of silently missing from the output
+	for n, i := range remaining {
+		if err := ctx.Err(); err != nil {
+			for _, j := range remaining[n:] {
+				errs[j] = fmt.Errorf("The secret %s was not retrieved: %w", c.Secrets[j].Id, err)
+			}
+			break
+		}
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	var firstErr error
+	failures := []string{}
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+
+		if c.BestEffort {
+			results[i].err = err
+			continue
+		}
+
+		if firstErr == nil {
+			firstErr = err
+		}
+		failures = append(failures, err.Error())
+	}
+
+	if len(failures) > 1 {
+		return nil, fmt.Errorf("%w (%d more failed: %s)", firstErr, len(failures)-1, strings.Join(failures[1:], "; "))
+	}
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	return results, nil
+}
+
+// This function will retrieve a single secret, honouring the version pinned for it, and convert it into its
+// keys and values.  The keys are flattened when Flatten is set so that collisions between the flattened keys
+// of different secrets are detected when they are merged.
+func (c Config) retrieveSecret(ctx context.Context, client SecretsManagerAPI, secret Secret) (retrievedSecret, error) {
+	secretId := secret.Id
+	versionId := secret.VersionId
+
+	if c.Pinned != nil {
+		pinnedId, ok := c.Pinned[secretId]
+		if !ok || len(pinnedId) == 0 {
+			return retrievedSecret{}, fmt.Errorf("The secret %s is not pinned to a version in the manifest", secretId)
+		}
+		if len(versionId) > 0 && versionId != pinnedId {
+			return retrievedSecret{}, inputError("The secret %s asks for version %s but the manifest pins version %s", secretId, versionId, pinnedId)
+		}
+		versionId = pinnedId
+	}
+
+	client, err := c.secretClient(ctx, client, secret)
+
+	if err != nil {
+		return retrievedSecret{}, err
+	}
+
+	// Get the secret
+	start := time.Now()
+	output, err := c.getSecret(ctx, client, secretId, versionId, secret.VersionStage)
+
+	if c.Debug != nil {
+		fmt.Fprintf(c.Debug, "level=debug event=get_secret secret_id=%q region=%q version_id=%q version_stage=%q elapsed=%s success=%t\n",
+			secretId, secret.Region, versionId, secret.VersionStage, time.Since(start).Round(time.Millisecond), err == nil)
+	}
+
+	if c.Observe != nil {
+		c.Observe(secretId, time.Since(start), err)
+	}
+
+	if err != nil && failover(err) {
+		if replica, replicaErr := c.getReplica(ctx, secret, versionId); replicaErr == nil {
+			output, err = replica, nil
+		}
+	}
+
+	if err != nil {
+		var notFound *types.ResourceNotFoundException
+		if len(versionId) > 0 && errors.As(err, &notFound) {
+			return retrievedSecret{}, fmt.Errorf("The pinned version %s of secret %s no longer exists: %w", versionId, secretId, err)
+		} else if len(secret.VersionStage) > 0 && errors.As(err, &notFound) {
+			return retrievedSecret{}, fmt.Errorf("No version of secret %s has the staging label %s: %w", secretId, secret.VersionStage, err)
+		}
+
+		var invalid *types.InvalidParameterException
+		if errors.As(err, &invalid) {
+			return retrievedSecret{}, inputError("The secret id %q was rejected as invalid.  Check that it is not empty, that it is "+
+				"a well formed ARN or secret name, and that it has no stray whitespace: %s", secretId, invalid.ErrorMessage())
+		}
+		return retrievedSecret{}, fmt.Errorf("Failed to retrieve secret %s: %w", secretId, err)
+	}
+
+	return c.convertSecret(secret, output)
+}
+
+// This function will return the client of the role or region of the secret, or the client when the secret
+// has neither.  Secrets owned by other accounts are retrieved with a client for their role, and secrets
+// replicated into other regions with a client for their region.  A secret given by its ARN is in the region
+// of the ARN, which the client of a role must call as well.
+func (c Config) secretClient(ctx context.Context, client SecretsManagerAPI, secret Secret) (SecretsManagerAPI, error) {
+	if len(secret.RoleArn) > 0 {
+		if c.RoleClient == nil {
+			return nil, inputError("The secret %s asks for role %s but no role client was configured", secret.Id, secret.RoleArn)
+		}
+
+		roleClient, err := c.RoleClient(ctx, secret.ResolvedRegion(), secret.RoleArn)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to assume role %s for secret %s: %w", secret.RoleArn, secret.Id, err)
+		}
+
+		return roleClient, nil
+	} else if len(secret.Region) > 0 {
+		if c.RegionalClient == nil {
+			return nil, inputError("The secret %s asks for region %s but no regional client was configured", secret.Id, secret.Region)
+		}
+
+		regional, err := c.RegionalClient(secret.Region)
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create a client for region %s: %w", secret.Region, err)
+		}
+
+		return regional, nil
+	}
+
+	return client, nil
+}
+
+// This function will determine if a failure to retrieve a secret may succeed with a replica in another
+// region.  A secret id that was rejected as invalid is just as invalid in every region.
+func failover(err error) bool {
+	var invalid *types.InvalidParameterException
+	return !errors.As(err, &invalid)
+}
+
+// This function will try to retrieve the secret from each of the FallbackRegions in turn and return the
+// first that succeeds.  The ARN of a replica holds the region of the replica, so the region of an ARN is
+// replaced while a secret name is the same in every region.
+func (c Config) getReplica(ctx context.Context, secret Secret, versionId string) (*secretsmanager.GetSecretValueOutput, error) {
+	err := fmt.Errorf("no fallback regions were configured")
+
+	for _, region := range c.FallbackRegions {
+		if region == secret.Region || c.RegionalClient == nil {
+			continue
+		}
+
+		var client SecretsManagerAPI
+		var clientErr error
+
+		if len(secret.RoleArn) > 0 && c.RoleClient != nil {
+			client, clientErr = c.RoleClient(ctx, region, secret.RoleArn)
+		} else {
+			client, clientErr = c.RegionalClient(region)
+		}
+
+		if clientErr != nil {
+			err = clientErr
+			continue
+		}
+
+		secretId := secret.Id
+		if parsed, parseErr := arn.Parse(secretId); parseErr == nil {
+			parsed.Region = region
+			secretId = parsed.String()
+		}
+
+		start := time.Now()
+		var output *secretsmanager.GetSecretValueOutput
+		output, err = c.getSecret(ctx, client, secretId, versionId, secret.VersionStage)
+
+		if c.Debug != nil {
+			fmt.Fprintf(c.Debug, "level=debug event=get_secret_replica secret_id=%q region=%q elapsed=%s success=%t\n",
+				secretId, region, time.Since(start).Round(time.Millisecond), err == nil)
+		}
+
+		if err == nil {
+			return output, nil
+		}
+	}
+
+	return nil, err
+}
+
+// This function will convert a retrieved secret into its keys and values, flattening them when Flatten is set.
+// A plaintext secret supplied as NAME=ARN is a single variable called NAME rather than one named after the
+// secret.
+func (c Config) convertSecret(secret Secret, output *secretsmanager.GetSecretValueOutput) (retrievedSecret, error) {
+	secretId := secret.Id
+
+	// A secret that could never fit in the environment is reported by name instead of failing later with a
+	// limit of Lambda.  A binary secret written to the BinaryDir is not in the environment.
+	size := len(aws.ToString(output.SecretString))
+	if output.SecretString == nil && len(c.BinaryDir) == 0 {
+		size = base64.StdEncoding.EncodedLen(len(output.SecretBinary))
+	}
+
+	if c.MaxSecretSize > 0 && size > c.MaxSecretSize {
+		return retrievedSecret{}, &SizeError{Secret: secretId, Size: size, Limit: c.MaxSecretSize}
+	}
+
+	// Convert the secret into JSON
+	dat, err := ParseSecret(secretId, output)
+
+	if err != nil {
+		return retrievedSecret{}, parseError("Failed to convert Secret %s to JSON: %w", secretId, err)
+	}
+
+	// Only the value selected by the path is kept, so the rest of a shared secret never reaches the environment
+	if len(secret.Path) > 0 {
+		if IsPlaintext(output) {
+			return retrievedSecret{}, parseError("The path %s cannot be used with secret %s which is not a JSON object", secret.Path, secretId)
+		}
+
+		value, name, err := selectPath(dat, secret.Path)
+
+		if err != nil {
+			return retrievedSecret{}, parseError("Failed to select a value from secret %s: %w", secretId, err)
+		}
+
+		if len(secret.Name) > 0 {
+			name = secret.Name
+		}
+		dat = map[string]interface{}{name: value}
+	}
+
+	named := len(secret.Prefix) > 0 && IsPlaintext(output)
+	if named {
+		dat = map[string]interface{}{secret.Prefix: dat[SecretKeyName(secretId)]}
+	}
+
+	// Binary secrets such as certificates and keystores are written to a file named after their key
+	if output.SecretString == nil && len(c.BinaryDir) > 0 {
+		for key := range dat {
+			path := filepath.Join(c.BinaryDir, key)
+
+			if err := WriteFileAtomic(path, output.SecretBinary, 0600); err != nil {
+				return retrievedSecret{}, fmt.Errorf("Failed to write binary secret %s to %s: %w", secretId, path, err)
+			}
+			dat[key] = path
+		}
+	}
+
+	if c.Flatten {
+		dat = c.FlattenValues(dat)
+	}
+
+	return retrievedSecret{values: dat, versionId: aws.ToString(output.VersionId), arn: aws.ToString(output.ARN), named: named}, nil
+}
+
+// This function will determine if the secret is plaintext, or binary, rather than a JSON object of keys
+// and values
+func IsPlaintext(output *secretsmanager.GetSecretValueOutput) bool {
+	if output.SecretString == nil {
+		return true
+	}
+
+	return !strings.HasPrefix(strings.TrimSpace(strings.TrimPrefix(*output.SecretString, UTF8_BOM)), "{")
+}
+
+// This function will retrieve the secret with GetSecret once one of the slots of the KMSConcurrency is free
+func (c Config) getSecret(ctx context.Context, client SecretsManagerAPI, secretId string, versionId string, versionStage string) (*secretsmanager.GetSecretValueOutput, error) {
+	if c.decrypts != nil {
+		select {
+		case c.decrypts <- struct{}{}:
+			defer func() { <-c.decrypts }()
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	return GetSecret(ctx, client, secretId, versionId, versionStage)
+}
+
+// This function will return the descrypted version of the Secret from Secret Manager using the supplied
+// client.  This function will return either an error or the retrieved and decrypted secret.  An empty
+// versionId and versionStage will retrieve the AWSCURRENT version of the secret.
+func GetSecret(ctx context.Context, client SecretsManagerAPI, secretId string, versionId string, versionStage string) (*secretsmanager.GetSecretValueOutput, error) {
+
+	input := &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(secretId),
+	}
+
+	if len(versionId) > 0 {
+		input.VersionId = aws.String(versionId)
+	}
+
+	if len(versionStage) > 0 {
+		input.VersionStage = aws.String(versionStage)
+	}
+
+	return client.GetSecretValue(ctx, input)
+}
+
+// This function will convert the retrieved secret into its keys and values.  A secret stored as binary
+// has no keys, so it is base64 encoded and returned under a single key named after the secret.  The
+// same applies to a secret string that is not a JSON object, such as a plain token or a JSON string.
+func ParseSecret(secretId string, result *secretsmanager.GetSecretValueOutput) (map[string]interface{}, error) {
+	if result.SecretString == nil {
+		return map[string]interface{}{
+			SecretKeyName(secretId): base64.StdEncoding.EncodeToString(result.SecretBinary),
+		}, nil
+	}
+
+	return parseString(SecretKeyName(secretId), *result.SecretString)
+}
+
+// This function will convert the text of a secret or parameter into its keys and values.  Text that is not
+// a JSON object is returned under the single supplied key.
+func parseString(name string, text string) (map[string]interface{}, error) {
+	// Secrets authored with some Windows editors start with a UTF-8 byte order mark which is not
+	// valid JSON, so it is removed before the secret is converted
+	secretString := strings.TrimPrefix(text, UTF8_BOM)
+
+	var value interface{}
+
+	if err := decodeJson(secretString, &value); err != nil {
+		// A secret that looks like a JSON object or array was meant to be JSON and is malformed,
+		// anything else is a plain string secret
+		trimmed := strings.TrimSpace(secretString)
+		if strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") {
+			return nil, redactJsonError(err)
+		}
+
+		value = secretString
+	}
+
+	if dat, ok := value.(map[string]interface{}); ok {
+		return dat, nil
+	}
+
+	return map[string]interface{}{name: value}, nil
+}
+
+// This function will decode the JSON text into the value.  Numbers are decoded as json.Number so that
+// large integers such as account ids keep every digit instead of passing through a float64.
+func decodeJson(text string, value *interface{}) error {
+	decoder := json.NewDecoder(strings.NewReader(text))
+	decoder.UseNumber()
+
+	if err := decoder.Decode(value); err != nil {
+		return err
+	}
+
+	// Anything after the first JSON value means the secret is not a single JSON document
+	var extra interface{}
+	if err := decoder.Decode(&extra); err != io.EOF {
+		if err == nil {
+			err = errors.New("unexpected data after the JSON value")
+		}
+		return err
+	}
+
+	return nil
+}
+
+// This function will replace an error from decoding a secret with one that never includes any part of the
+// secret.  The errors of the JSON decoder quote the offending character, which would be written to the logs.
+func redactJsonError(err error) error {
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return fmt.Errorf("the secret is not valid JSON, the error is at byte offset %d", syntaxErr.Offset)
+	}
+
+	return errors.New("the secret is not valid JSON")
+}
+
+// This function will derive a key from the name of the secret, e.g. the secret
+// arn:aws:secretsmanager:us-east-2:111122223333:secret:prod/db-cert-AbCdEf is named PROD_DB_CERT.
+func SecretKeyName(secretId string) string {
+	name := secretId
+
+	if parsed, err := arn.Parse(secretId); err == nil {
+		name = strings.TrimPrefix(parsed.Resource, "secret:")
+
+		// The ARN of a secret ends with a hyphen and six random characters which are not part of the name
+		if i := strings.LastIndex(name, "-"); i >= 0 && len(name)-i == 7 {
+			name = name[:i]
+		}
+	}
+
+	return strings.ToUpper(strings.Map(func(c rune) rune {
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') {
+			return c
+		}
+		return '_'
+	}, name))
+}
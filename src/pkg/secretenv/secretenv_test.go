@@ -0,0 +1,579 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// These tests retrieve secrets from a fake Secrets Manager client, so that the conversion and merging of
+// the secrets is tested without AWS credentials.
+//
+package secretenv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+)
+
+// A SecretsManagerAPI that returns the SecretString of each secret id in the map, any other secret is
+// not found.  Every call is counted, and beforeGet is called before each GetSecretValue when set.
+type fakeSecretsManager struct {
+	secrets   map[string]string
+	beforeGet func(secretId string)
+
+	mutex sync.Mutex
+	calls []string
+}
+
+// This function will return a fake client of the secrets
+func newFakeSecretsManager(secrets map[string]string) *fakeSecretsManager {
+	return &fakeSecretsManager{secrets: secrets}
+}
+
+// GetSecretValue returns the secret from the map
+func (f *fakeSecretsManager) GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+	secretId := aws.ToString(params.SecretId)
+
+	f.mutex.Lock()
+	f.calls = append(f.calls, secretId)
+	f.mutex.Unlock()
+
+	if f.beforeGet != nil {
+		f.beforeGet(secretId)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	value, ok := f.secrets[secretId]
+	if !ok {
+		return nil, &types.ResourceNotFoundException{Message: aws.String("Secrets Manager can't find the specified secret.")}
+	}
+
+	return &secretsmanager.GetSecretValueOutput{
+		ARN:          aws.String("arn:aws:secretsmanager:us-east-1:111122223333:secret:" + secretId + "-AbCdEf"),
+		Name:         aws.String(secretId),
+		SecretString: aws.String(value),
+		VersionId:    aws.String("v-" + secretId),
+	}, nil
+}
+
+// DescribeSecret is not used by these tests
+func (f *fakeSecretsManager) DescribeSecret(ctx context.Context, params *secretsmanager.DescribeSecretInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.DescribeSecretOutput, error) {
+	return nil, errors.New("DescribeSecret is not supported by the fake")
+}
+
+// GetResourcePolicy is not used by these tests
+func (f *fakeSecretsManager) GetResourcePolicy(ctx context.Context, params *secretsmanager.GetResourcePolicyInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetResourcePolicyOutput, error) {
+	return nil, errors.New("GetResourcePolicy is not supported by the fake")
+}
+
+// BatchGetSecretValue is not used by these tests
+func (f *fakeSecretsManager) BatchGetSecretValue(ctx context.Context, params *secretsmanager.BatchGetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.BatchGetSecretValueOutput, error) {
+	return nil, errors.New("BatchGetSecretValue is not supported by the fake")
+}
+
+// ListSecrets is not used by these tests
+func (f *fakeSecretsManager) ListSecrets(ctx context.Context, params *secretsmanager.ListSecretsInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.ListSecretsOutput, error) {
+	return nil, errors.New("ListSecrets is not supported by the fake")
+}
+
+// This function will return a Retriever of the secrets that resolves them with the client
+func newTestRetriever(t *testing.T, client SecretsManagerAPI, cfg Config) *Retriever {
+	t.Helper()
+
+	// The shared config files of the machine running the tests must not change the results
+	t.Setenv("AWS_CONFIG_FILE", "/nonexistent")
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", "/nonexistent")
+
+	retriever, err := NewRetriever(context.Background(), Options{Config: cfg, Region: "us-east-1", Backend: client})
+
+	if err != nil {
+		t.Fatalf("NewRetriever failed: %s", err)
+	}
+
+	return retriever
+}
+
+// This function will parse the secret specs, failing the test when one is malformed
+func testSecrets(t *testing.T, specs ...string) []Secret {
+	t.Helper()
+
+	secrets := make([]Secret, len(specs))
+	for i, spec := range specs {
+		secret, err := ParseSecretSpec(spec)
+
+		if err != nil {
+			t.Fatalf("ParseSecretSpec(%q) failed: %s", spec, err)
+		}
+		secrets[i] = secret
+	}
+
+	return secrets
+}
+
+func TestRetrieverRetrieve(t *testing.T) {
+	client := newFakeSecretsManager(map[string]string{
+		"prod/db":    `{"username":"admin","password":"p|w"}`,
+		"prod/token": "abc123",
+		"prod/list":  `["a","b"]`,
+	})
+
+	tests := []struct {
+		name     string
+		specs    []string
+		values   map[string]interface{}
+		versions map[string]string
+		err      string
+	}{
+		{
+			name:     "json object",
+			specs:    []string{"prod/db"},
+			values:   map[string]interface{}{"username": "admin", "password": "p|w"},
+			versions: map[string]string{"prod/db": "v-prod/db"},
+		},
+		{
+			name:     "plain string",
+			specs:    []string{"prod/token"},
+			values:   map[string]interface{}{"PROD_TOKEN": "abc123"},
+			versions: map[string]string{"prod/token": "v-prod/token"},
+		},
+		{
+			name:     "named plain string",
+			specs:    []string{"API_TOKEN=prod/token"},
+			values:   map[string]interface{}{"API_TOKEN": "abc123"},
+			versions: map[string]string{"prod/token": "v-prod/token"},
+		},
+		{
+			name:     "json array is not an object",
+			specs:    []string{"prod/list"},
+			values:   map[string]interface{}{"PROD_LIST": []interface{}{"a", "b"}},
+			versions: map[string]string{"prod/list": "v-prod/list"},
+		},
+		{
+			name:     "prefixed json object",
+			specs:    []string{"DB=prod/db"},
+			values:   map[string]interface{}{"DB_username": "admin", "DB_password": "p|w"},
+			versions: map[string]string{"prod/db": "v-prod/db"},
+		},
+		{
+			name:  "not found",
+			specs: []string{"prod/db", "prod/missing"},
+			err:   "Failed to retrieve secret prod/missing",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			retriever := newTestRetriever(t, client, Config{Secrets: testSecrets(t, test.specs...), Separator: "_", Concurrency: 4})
+
+			result, err := retriever.Retrieve(context.Background())
+
+			if len(test.err) > 0 {
+				var notFound *types.ResourceNotFoundException
+				if err == nil || !errors.As(err, &notFound) || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Retrieve returned %v, want a not found error containing %q", err, test.err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Retrieve failed: %s", err)
+			}
+
+			if !reflect.DeepEqual(result.Values, test.values) {
+				t.Errorf("Retrieve returned the values %v, want %v", result.Values, test.values)
+			}
+
+			if !reflect.DeepEqual(result.Versions, test.versions) {
+				t.Errorf("Retrieve returned the versions %v, want %v", result.Versions, test.versions)
+			}
+		})
+	}
+}
+
+func TestRetrieveStripsBom(t *testing.T) {
+	// Secrets saved by some Windows editors start with a UTF-8 byte order mark
+	client := newFakeSecretsManager(map[string]string{
+		"prod/db":    UTF8_BOM + `{"username":"admin","port":5432}`,
+		"prod/token": UTF8_BOM + "abc123",
+	})
+
+	result, err := Retrieve(context.Background(), client, Config{Secrets: testSecrets(t, "prod/db", "prod/token")})
+
+	if err != nil {
+		t.Fatalf("Retrieve of the secrets with a byte order mark failed: %s", err)
+	}
+
+	want := map[string]interface{}{"username": "admin", "port": json.Number("5432"), "PROD_TOKEN": "abc123"}
+	if !reflect.DeepEqual(result.Values, want) {
+		t.Errorf("Retrieve returned %q, want %q", result.Values, want)
+	}
+}
+
+func TestRetrieveKeepsNumbers(t *testing.T) {
+	client := newFakeSecretsManager(map[string]string{
+		"prod/ids": `{"max":9223372036854775807,"min":-9223372036854775808,"account":123456789012,"larger":123456789012345678901234,"port":5432,"ratio":1.50,"flag":true,"none":null}`,
+	})
+
+	result, err := Retrieve(context.Background(), client, Config{Secrets: testSecrets(t, "prod/ids")})
+
+	if err != nil {
+		t.Fatalf("Retrieve failed: %s", err)
+	}
+
+	// Numbers keep every digit as written instead of passing through a float64
+	want := map[string]string{"max": "9223372036854775807", "min": "-9223372036854775808", "account": "123456789012",
+		"larger": "123456789012345678901234", "port": "5432", "ratio": "1.50", "flag": "true", "none": ""}
+	if rendered := (Config{}).Render(result.Values); !reflect.DeepEqual(rendered, want) {
+		t.Errorf("Render returned %v, want %v", rendered, want)
+	}
+}
+
+func TestRetrieveBestEffort(t *testing.T) {
+	client := newFakeSecretsManager(map[string]string{"prod/db": `{"username":"admin"}`})
+
+	result, err := Retrieve(context.Background(), client, Config{Secrets: testSecrets(t, "prod/db", "prod/missing"), BestEffort: true})
+
+	if err != nil {
+		t.Fatalf("Retrieve failed: %s", err)
+	}
+
+	if !reflect.DeepEqual(result.Values, map[string]interface{}{"username": "admin"}) {
+		t.Errorf("Retrieve returned the values %v, want only those of prod/db", result.Values)
+	}
+
+	if _, ok := result.Errors["prod/missing"]; !ok || len(result.Errors) != 1 {
+		t.Errorf("Retrieve returned the errors %v, want only prod/missing", result.Errors)
+	}
+}
+
+func TestRetrieveCancelled(t *testing.T) {
+	for _, bestEffort := range []bool{false, true} {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		// The context is done once the first secret was retrieved, so the others are never handed to a worker
+		client := newFakeSecretsManager(map[string]string{"a": `{"a":"v"}`, "b": `{"b":"v"}`, "c": `{"c":"v"}`})
+		client.beforeGet = func(string) { cancel() }
+
+		result, err := Retrieve(ctx, client, Config{Secrets: testSecrets(t, "a", "b", "c"), Concurrency: 1, BestEffort: bestEffort})
+		cancel()
+
+		if !bestEffort {
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("Retrieve returned %v, want the error of the cancelled context", err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("Retrieve failed: %s", err)
+		}
+
+		for _, secretId := range []string{"b", "c"} {
+			if !errors.Is(result.Errors[secretId], context.Canceled) {
+				t.Errorf("The secret %s that was never retrieved has the error %v, want the error of the cancelled context", secretId, result.Errors[secretId])
+			}
+			if _, ok := result.Versions[secretId]; ok {
+				t.Errorf("The secret %s that was never retrieved has a version", secretId)
+			}
+		}
+	}
+}
+
+func TestRetrieveMalformedSecretIsRedacted(t *testing.T) {
+	const marker = "MARKER-hunter2"
+
+	for _, text := range []string{
+		`{"password":"` + marker + `","port":}`,
+		`{"password":"` + marker,
+		`{` + marker + `}`,
+		`[` + marker + `]`,
+		"\ufeff{'password': '" + marker + "'}",
+	} {
+		for _, bestEffort := range []bool{false, true} {
+			client := newFakeSecretsManager(map[string]string{"prod/db": text})
+
+			var debug, warnings safeBuffer
+			var observed error
+			cfg := Config{
+				Secrets:    testSecrets(t, "prod/db"),
+				BestEffort: bestEffort,
+				Debug:      &debug,
+				Warnings:   &warnings,
+				Observe:    func(secretId string, elapsed time.Duration, err error) { observed = err },
+			}
+
+			result, err := Retrieve(context.Background(), client, cfg)
+
+			if bestEffort && err == nil {
+				err = result.Errors["prod/db"]
+			}
+
+			if err == nil {
+				t.Fatalf("Retrieve of the malformed secret %q did not fail", text)
+			}
+
+			for name, output := range map[string]string{"error": err.Error(), "debug log": debug.String(), "warnings": warnings.String(), "observed error": fmt.Sprint(observed)} {
+				// The errors of the JSON decoder quote the offending character, which is part of the secret
+				if strings.Contains(output, marker) || strings.Contains(output, "invalid character") {
+					t.Errorf("The %s of the malformed secret %q holds its contents: %s", name, text, output)
+				}
+			}
+
+			if !strings.Contains(err.Error(), "prod/db") {
+				t.Errorf("The error %q does not name the secret", err)
+			}
+		}
+	}
+}
+
+func TestRetrieveKMSConcurrency(t *testing.T) {
+	secrets := map[string]string{}
+	var specs []string
+	for i := 0; i < 12; i++ {
+		secretId := fmt.Sprintf("secret%d", i)
+		secrets[secretId] = fmt.Sprintf(`{"key%d":"v"}`, i)
+		specs = append(specs, secretId)
+	}
+
+	for _, test := range []struct {
+		kmsConcurrency int
+		limit          int
+	}{
+		{kmsConcurrency: 2, limit: 2},
+		{kmsConcurrency: 0, limit: 6},
+	} {
+		// Each call holds its slot long enough for the other workers to pile up behind it
+		var mutex sync.Mutex
+		calls, most := 0, 0
+
+		client := newFakeSecretsManager(secrets)
+		client.beforeGet = func(string) {
+			mutex.Lock()
+			calls++
+			if calls > most {
+				most = calls
+			}
+			mutex.Unlock()
+
+			time.Sleep(10 * time.Millisecond)
+
+			mutex.Lock()
+			calls--
+			mutex.Unlock()
+		}
+
+		result, err := Retrieve(context.Background(), client, Config{Secrets: testSecrets(t, specs...), Concurrency: 6, KMSConcurrency: test.kmsConcurrency})
+
+		if err != nil {
+			t.Fatalf("Retrieve failed: %s", err)
+		}
+
+		if len(result.Values) != len(secrets) {
+			t.Errorf("Retrieve returned %d keys, want %d", len(result.Values), len(secrets))
+		}
+
+		if most > test.limit || most < 2 {
+			t.Errorf("With a KMS concurrency of %d there were %d calls at the same time, want at most %d", test.kmsConcurrency, most, test.limit)
+		}
+	}
+}
+
+func TestRetrieveRoleRegion(t *testing.T) {
+	const secretArn = "arn:aws:secretsmanager:eu-west-1:111122223333:secret:prod/db-AbCdEf"
+	const roleArn = "arn:aws:iam::111122223333:role/reader"
+
+	client := newFakeSecretsManager(map[string]string{secretArn: `{"a":"1"}`, "prod/db": `{"b":"2"}`})
+
+	var mutex sync.Mutex
+	regions := map[string]string{}
+
+	cfg := Config{
+		Secrets: testSecrets(t, secretArn+"@role="+roleArn, "us-west-2:prod/db@role="+roleArn),
+		RoleClient: func(ctx context.Context, region string, role string) (SecretsManagerAPI, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			regions[role+" "+region] = region
+			return client, nil
+		},
+	}
+
+	if _, err := Retrieve(context.Background(), client, cfg); err != nil {
+		t.Fatalf("Retrieve failed: %s", err)
+	}
+
+	// The client of the role calls the region of the ARN, unless the secret names its own region
+	want := map[string]string{roleArn + " eu-west-1": "eu-west-1", roleArn + " us-west-2": "us-west-2"}
+	if !reflect.DeepEqual(regions, want) {
+		t.Errorf("The role clients were created for %v, want %v", regions, want)
+	}
+}
+
+func TestRetrieveMerge(t *testing.T) {
+	client := newFakeSecretsManager(map[string]string{
+		"first":  `{"host":"first-host","user":"first-user"}`,
+		"second": `{"host":"second-host","port":"5432"}`,
+	})
+
+	tests := []struct {
+		name     string
+		cfg      Config
+		values   map[string]interface{}
+		sources  map[string]string
+		err      string
+		warnings string
+	}{
+		{
+			name:     "last wins by default",
+			values:   map[string]interface{}{"host": "second-host", "user": "first-user", "port": "5432"},
+			sources:  map[string]string{"host": "second", "user": "first", "port": "second"},
+			warnings: "the key host from secret first is replaced by the value from secret second",
+		},
+		{
+			name:     "first wins",
+			cfg:      Config{MergeStrategy: MERGE_FIRST_WINS},
+			values:   map[string]interface{}{"host": "first-host", "user": "first-user", "port": "5432"},
+			sources:  map[string]string{"host": "first", "user": "first", "port": "second"},
+			warnings: "the key host from secret first is kept, the value from secret second is ignored",
+		},
+		{
+			name: "error",
+			cfg:  Config{MergeStrategy: MERGE_ERROR},
+			err:  "The key host is defined by both secret first and secret second",
+		},
+		{
+			name: "fail on collision",
+			cfg:  Config{FailOnCollision: true},
+			err:  "The key host is defined by both secret first and secret second",
+		},
+		{
+			name:    "uppercase keys",
+			cfg:     Config{UppercaseKeys: true, Include: []string{"HOST"}},
+			values:  map[string]interface{}{"HOST": "second-host"},
+			sources: map[string]string{"HOST": "second"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var warnings safeBuffer
+
+			// The secrets are retrieved concurrently but always merged in the order they were supplied
+			cfg := test.cfg
+			cfg.Secrets = testSecrets(t, "first", "second")
+			cfg.Concurrency = 2
+			cfg.Warnings = &warnings
+
+			result, err := Retrieve(context.Background(), client, cfg)
+
+			if len(test.err) > 0 {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("Retrieve returned %v, want %q", err, test.err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Retrieve failed: %s", err)
+			}
+
+			if !reflect.DeepEqual(result.Values, test.values) {
+				t.Errorf("Retrieve returned the values %v, want %v", result.Values, test.values)
+			}
+
+			if !reflect.DeepEqual(result.Sources, test.sources) {
+				t.Errorf("Retrieve returned the sources %v, want %v", result.Sources, test.sources)
+			}
+
+			if !strings.Contains(warnings.String(), test.warnings) {
+				t.Errorf("Retrieve warned %q, want %q", warnings.String(), test.warnings)
+			}
+		})
+	}
+}
+
+func TestRetrieveCollisionWinner(t *testing.T) {
+	client := newFakeSecretsManager(map[string]string{
+		"c": `{"key":"from-c","shared":"from-c"}`,
+		"a": `{"key":"from-a"}`,
+		"b": `{"key":"from-b","shared":"from-b"}`,
+	})
+
+	// The secret supplied first finishes last, so neither the names nor the order the retrievals end in
+	// decide which value is kept
+	client.beforeGet = func(secretId string) {
+		if secretId == "c" {
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	tests := []struct {
+		strategy string
+		key      string
+		shared   string
+	}{
+		{strategy: MERGE_LAST_WINS, key: "from-b", shared: "from-b"},
+		{strategy: MERGE_FIRST_WINS, key: "from-c", shared: "from-c"},
+	}
+
+	for _, test := range tests {
+		result, err := Retrieve(context.Background(), client, Config{Secrets: testSecrets(t, "c", "a", "b"), Concurrency: 3, MergeStrategy: test.strategy})
+
+		if err != nil {
+			t.Fatalf("Retrieve failed: %s", err)
+		}
+
+		if result.Values["key"] != test.key || result.Values["shared"] != test.shared {
+			t.Errorf("With %s the values are %v, want key %s and shared %s", test.strategy, result.Values, test.key, test.shared)
+		}
+
+		if source := result.Sources["key"]; source != strings.TrimPrefix(test.key, "from-") {
+			t.Errorf("With %s the key came from %s, want the secret of %s", test.strategy, source, test.key)
+		}
+	}
+}
+
+func TestRetrieveTransformedKeyCollision(t *testing.T) {
+	client := newFakeSecretsManager(map[string]string{"keys": `{"api-key":"a","api_key":"b"}`})
+
+	_, err := Retrieve(context.Background(), client, Config{Secrets: testSecrets(t, "keys"), SanitizeKeys: true})
+
+	want := "The keys api-key and api_key of secret keys are both converted to the key api_key"
+	if err == nil || err.Error() != want {
+		t.Fatalf("Retrieve returned %v, want %q", err, want)
+	}
+}
+
+// A buffer the warnings are written to, the writes are serialized since the secrets are retrieved concurrently
+type safeBuffer struct {
+	mutex sync.Mutex
+	text  string
+}
+
+// Write is an implementation of io.Writer
+func (b *safeBuffer) Write(data []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.text += string(data)
+	return len(data), nil
+}
+
+// This function will return what was written so far
+func (b *safeBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.text
+}
@@ -0,0 +1,51 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// This code is used to write the manifest of the sensitive variables so that logging middleware can
+// redact their values should an application ever log them.
+//
+package secretenv
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+)
+
+// The manifest of the sensitive variables, the names are sorted and SHA256 is only filled in when asked for
+type SensitiveManifest struct {
+	Sensitive []string          `json:"sensitive"`
+	SHA256    map[string]string `json:"sha256,omitempty"`
+}
+
+// This function will return the manifest of the variables, with the SHA-256 of each value in hex when hashes
+// is set so a log scrubber can recognize a value without holding it.  The hash of a short or guessable value
+// can be reversed by trying candidates, so hashes should only be written where the values could be read.
+func NewSensitiveManifest(values map[string]string, hashes bool) SensitiveManifest {
+	manifest := SensitiveManifest{Sensitive: SortedKeys(values)}
+
+	if hashes {
+		manifest.SHA256 = map[string]string{}
+
+		for key, value := range values {
+			sum := sha256.Sum256([]byte(value))
+			manifest.SHA256[key] = hex.EncodeToString(sum[:])
+		}
+	}
+
+	return manifest
+}
+
+// This function will write the manifest of the variables to the file, it is replaced atomically so a reader
+// never sees a partly written manifest
+func WriteSensitiveManifest(path string, values map[string]string, hashes bool, mode os.FileMode) error {
+	data, err := json.MarshalIndent(NewSensitiveManifest(values, hashes), "", "    ")
+
+	if err != nil {
+		return err
+	}
+
+	return WriteFileAtomic(path, append(data, '\n'), mode)
+}
@@ -0,0 +1,299 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// This code is used to parse the text form of the secrets to retrieve and of the rules to
+// coalesce alternative keys, as supplied on the command line.
+//
+package secretenv
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+)
+
+// The text that starts the role of a secret, e.g. prod/db@role=arn:aws:iam::123456789012:role/reader
+const ROLE_SPEC_PREFIX = "@role="
+
+// A secret to retrieve along with the optional prefix that is added to each of its keys, the optional
+// region it is retrieved from, and the optional version of the secret to retrieve
+type Secret struct {
+	Prefix       string
+	Region       string
+	Id           string
+	VersionId    string
+	VersionStage string
+
+	// The role assumed to retrieve the secret, e.g. in the account that owns it, instead of the role used
+	// for the other secrets
+	RoleArn string
+
+	// A path such as $.credentials.password selecting the only value of the secret that is kept, see
+	// ParsePath, and the name of its key which defaults to the last part of the path
+	Path string
+	Name string
+}
+
+// A rule which sets Output to the first of the Sources with a non-empty value
+type CoalesceRule struct {
+	Output  string
+	Sources []string
+}
+
+// A rule which sets the key Name to the Go template Template executed over the rendered values, e.g.
+// DATABASE_URL=postgres://{{.username}}:{{.password}}@{{.host}}/{{.dbname}}
+type CompositeRule struct {
+	Name     string
+	Template string
+}
+
+// A rule which renames the key From of the merged secrets to To
+type RenameRule struct {
+	From string
+	To   string
+}
+
+// This function will parse a single secret in the form [prefix=][region:]id[@version][@role=ARN][#path[=name]].  The
+// prefix must be a valid identifier, so a secret name that itself contains an = is not mistaken for a
+// prefix unless the text before it is an identifier.
+//
+// The region, e.g. us-east-1:arn:aws:secretsmanager:..., retrieves the secret from a region other than the
+// default one.  Secret names cannot contain a colon, so any text before the first colon of an id that is
+// not an ARN is taken as the region.
+//
+// The version may be a staging label, e.g. my-secret@AWSPREVIOUS, or a VersionId.  The text after the
+// last @ is always the version, so a secret whose name contains an @ can be retrieved by adding
+// @AWSCURRENT.
+//
+// The role, e.g. prod/db@role=arn:aws:iam::123456789012:role/reader, is assumed to retrieve the secret
+// instead of using the credentials of the other secrets.  The text after @role= is always the role.
+//
+// The path, e.g. prod/db#$.credentials.password=DB_PASSWORD, keeps only the selected value of the secret.
+// Secret names cannot contain a #, so the text after the first # is always the path.
+func ParseSecretSpec(value string) (Secret, error) {
+	// Secret ids often come from generated lists which may carry stray whitespace
+	id := strings.TrimSpace(value)
+
+	spec := Secret{Id: id}
+
+	if i := strings.Index(id, "#"); i >= 0 {
+		spec.Id = strings.TrimSpace(id[:i])
+		spec.Path = strings.TrimSpace(id[i+1:])
+
+		if j := strings.LastIndex(spec.Path, "="); j >= 0 {
+			spec.Name = strings.TrimSpace(spec.Path[j+1:])
+			spec.Path = strings.TrimSpace(spec.Path[:j])
+		}
+
+		if _, err := ParsePath(spec.Path); err != nil {
+			return spec, err
+		}
+
+		if j := strings.LastIndex(id, "="); len(spec.Name) == 0 && j > i {
+			return spec, fmt.Errorf("no key name was supplied after the = of path %s", spec.Path)
+		}
+	}
+
+	// The role ARN holds colons and may hold an @, so it is removed before the region and version
+	if i := strings.Index(spec.Id, ROLE_SPEC_PREFIX); i >= 0 {
+		spec.RoleArn = strings.TrimSpace(spec.Id[i+len(ROLE_SPEC_PREFIX):])
+		spec.Id = strings.TrimSpace(spec.Id[:i])
+
+		if parsed, err := arn.Parse(spec.RoleArn); err != nil || parsed.Service != "iam" || !strings.HasPrefix(parsed.Resource, "role/") {
+			return spec, fmt.Errorf("the role %q of secret %s is not an IAM role ARN", spec.RoleArn, spec.Id)
+		}
+	}
+
+	if i := strings.Index(spec.Id, "="); i > 0 && IsValidEnvName(spec.Id[:i]) {
+		spec.Prefix = spec.Id[:i]
+		spec.Id = strings.TrimSpace(spec.Id[i+1:])
+	}
+
+	if i := strings.Index(spec.Id, ":"); i > 0 && !strings.HasPrefix(spec.Id, "arn:") {
+		spec.Region = strings.TrimSpace(spec.Id[:i])
+		spec.Id = strings.TrimSpace(spec.Id[i+1:])
+	}
+
+	if i := strings.LastIndex(spec.Id, "@"); i >= 0 {
+		version := strings.TrimSpace(spec.Id[i+1:])
+		spec.Id = strings.TrimSpace(spec.Id[:i])
+
+		if len(version) == 0 {
+			return spec, fmt.Errorf("no version was supplied after the @ for secret %s", spec.Id)
+		} else if IsVersionId(version) {
+			spec.VersionId = version
+		} else {
+			spec.VersionStage = version
+		}
+	}
+
+	if len(spec.Id) == 0 {
+		return spec, fmt.Errorf("no secret id was supplied in %q", id)
+	}
+
+	if err := ValidateSecretId(spec.Id); err != nil {
+		return spec, err
+	}
+
+	return spec, nil
+}
+
+// This function will check that the secret id is either a well formed Secrets Manager ARN or a plausible
+// secret name, so that a mistyped id is reported before any API is called.  Secret names are at most 512
+// characters of letters, digits, and /_+=.@-
+func ValidateSecretId(id string) error {
+	if strings.HasPrefix(id, "arn:") {
+		parsed, err := arn.Parse(id)
+
+		if err != nil {
+			return fmt.Errorf("the secret ARN %q is malformed: %w", id, err)
+		}
+
+		if parsed.Service != "secretsmanager" || !strings.HasPrefix(parsed.Resource, "secret:") || len(parsed.Resource) == len("secret:") ||
+			len(parsed.Region) == 0 || len(parsed.AccountID) == 0 {
+			return fmt.Errorf("the ARN %q is not a Secrets Manager secret ARN, arn:PARTITION:secretsmanager:REGION:ACCOUNT:secret:NAME is expected", id)
+		}
+
+		return nil
+	}
+
+	if len(id) > 512 {
+		return fmt.Errorf("the secret name %q is longer than 512 characters", id)
+	}
+
+	for _, c := range id {
+		if !((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || strings.ContainsRune("/_+=.@-", c)) {
+			return fmt.Errorf("the secret name %q contains the character %q, only letters, digits, and /_+=.@- may be used", id, c)
+		}
+	}
+
+	return nil
+}
+
+// This function will return the region the secret is retrieved from, the Region when there is one, otherwise
+// the region of the ARN the secret is given by, and empty for a secret name in the region of the client
+func (s Secret) ResolvedRegion() string {
+	if len(s.Region) > 0 {
+		return s.Region
+	}
+
+	if parsed, err := arn.Parse(s.Id); err == nil {
+		return parsed.Region
+	}
+
+	return ""
+}
+
+// String will return the secret in the form accepted by ParseSecretSpec
+func (s Secret) String() string {
+	spec := s.Id
+	if len(s.Region) > 0 {
+		spec = s.Region + ":" + spec
+	}
+	if len(s.Prefix) > 0 {
+		spec = s.Prefix + "=" + spec
+	}
+	if len(s.VersionId) > 0 {
+		spec += "@" + s.VersionId
+	} else if len(s.VersionStage) > 0 {
+		spec += "@" + s.VersionStage
+	}
+	if len(s.RoleArn) > 0 {
+		spec += ROLE_SPEC_PREFIX + s.RoleArn
+	}
+	if len(s.Path) > 0 {
+		spec += "#" + s.Path
+	}
+	if len(s.Name) > 0 {
+		spec += "=" + s.Name
+	}
+
+	return spec
+}
+
+// This function will determine if the version is a VersionId rather than a staging label.  Secrets
+// Manager generates VersionIds in the UUID format, e.g. 01234567-89ab-cdef-0123-456789abcdef.
+func IsVersionId(version string) bool {
+	if len(version) != 36 {
+		return false
+	}
+
+	for i, c := range version {
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !((c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// This function will parse a coalesce rule in the form OUT=KEY1,KEY2
+func ParseCoalesceRule(value string) (CoalesceRule, error) {
+	parts := strings.SplitN(value, "=", 2)
+
+	if len(parts) != 2 || len(strings.TrimSpace(parts[0])) == 0 || len(strings.TrimSpace(parts[1])) == 0 {
+		return CoalesceRule{}, fmt.Errorf("coalesce option %q must be in the form OUT=KEY1,KEY2", value)
+	}
+
+	rule := CoalesceRule{Output: strings.TrimSpace(parts[0])}
+	for _, source := range strings.Split(parts[1], ",") {
+		if source = strings.TrimSpace(source); len(source) > 0 {
+			rule.Sources = append(rule.Sources, source)
+		}
+	}
+
+	return rule, nil
+}
+
+// String will return the rule in the form accepted by ParseCoalesceRule
+func (r CoalesceRule) String() string {
+	return r.Output + "=" + strings.Join(r.Sources, ",")
+}
+
+// This function will parse a composite rule in the form NAME=TEMPLATE, the template is parsed so that a
+// malformed one is reported before any secrets are retrieved
+func ParseCompositeRule(value string) (CompositeRule, error) {
+	parts := strings.SplitN(value, "=", 2)
+
+	if len(parts) != 2 || !IsValidEnvName(strings.TrimSpace(parts[0])) || len(parts[1]) == 0 {
+		return CompositeRule{}, fmt.Errorf("compose option %q must be in the form NAME=TEMPLATE where NAME is a valid variable name", value)
+	}
+
+	rule := CompositeRule{Name: strings.TrimSpace(parts[0]), Template: parts[1]}
+
+	if _, err := newTemplate(rule.Name, nil, nil).Parse(rule.Template); err != nil {
+		return CompositeRule{}, fmt.Errorf("the template of %s is not valid: %w", rule.Name, err)
+	}
+
+	return rule, nil
+}
+
+// String will return the rule in the form accepted by ParseCompositeRule
+func (r CompositeRule) String() string {
+	return r.Name + "=" + r.Template
+}
+
+// This function will parse a rename rule in the form FROM=TO, e.g. password=DB_PASSWORD
+func ParseRenameRule(value string) (RenameRule, error) {
+	parts := strings.SplitN(value, "=", 2)
+
+	if len(parts) != 2 || len(strings.TrimSpace(parts[0])) == 0 || len(strings.TrimSpace(parts[1])) == 0 {
+		return RenameRule{}, fmt.Errorf("rename option %q must be in the form FROM=TO", value)
+	}
+
+	return RenameRule{From: strings.TrimSpace(parts[0]), To: strings.TrimSpace(parts[1])}, nil
+}
+
+// String will return the rule in the form accepted by ParseRenameRule
+func (r RenameRule) String() string {
+	return r.From + "=" + r.To
+}
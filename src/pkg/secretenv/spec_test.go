@@ -0,0 +1,118 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// These tests parse the text form of the secrets and of the coalesce rules.
+//
+package secretenv
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseSecretSpec(t *testing.T) {
+	const secretArn = "arn:aws:secretsmanager:eu-west-1:111122223333:secret:prod/db-AbCdEf"
+	const roleArn = "arn:aws:iam::111122223333:role/reader"
+	const versionId = "01234567-89ab-cdef-0123-456789abcdef"
+
+	tests := []struct {
+		spec   string
+		secret Secret
+		err    string
+	}{
+		{spec: "prod/db", secret: Secret{Id: "prod/db"}},
+		{spec: "  prod/db\t", secret: Secret{Id: "prod/db"}},
+		{spec: "DB=prod/db", secret: Secret{Prefix: "DB", Id: "prod/db"}},
+		{spec: "us-west-2:prod/db", secret: Secret{Region: "us-west-2", Id: "prod/db"}},
+		{spec: "DB=us-west-2:prod/db", secret: Secret{Prefix: "DB", Region: "us-west-2", Id: "prod/db"}},
+		{spec: secretArn, secret: Secret{Id: secretArn}},
+		{spec: "prod/db@AWSPREVIOUS", secret: Secret{Id: "prod/db", VersionStage: "AWSPREVIOUS"}},
+		{spec: "prod/db@" + versionId, secret: Secret{Id: "prod/db", VersionId: versionId}},
+		{spec: "prod/db@role=" + roleArn, secret: Secret{Id: "prod/db", RoleArn: roleArn}},
+		{spec: "prod/db@AWSPENDING@role=" + roleArn, secret: Secret{Id: "prod/db", VersionStage: "AWSPENDING", RoleArn: roleArn}},
+		{spec: "prod/db#$.password", secret: Secret{Id: "prod/db", Path: "$.password"}},
+		{spec: "prod/db#$.credentials.password=DB_PASSWORD", secret: Secret{Id: "prod/db", Path: "$.credentials.password", Name: "DB_PASSWORD"}},
+		{spec: "a=b=c", secret: Secret{Prefix: "a", Id: "b=c"}},
+		{spec: "my-app=prod/db", secret: Secret{Id: "my-app=prod/db"}},
+		{spec: "", err: "no secret id was supplied"},
+		{spec: "prod/db@", err: "no version was supplied"},
+		{spec: "prod/db@role=arn:aws:s3:::bucket", err: "is not an IAM role ARN"},
+		{spec: "prod/db#$.password=", err: "no key name was supplied"},
+		{spec: "prod db", err: "contains the character ' '"},
+		{spec: "arn:aws:s3:::bucket/key", err: "is not a Secrets Manager secret ARN"},
+		{spec: "prod/" + strings.Repeat("a", 512), err: "is longer than 512 characters"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			secret, err := ParseSecretSpec(test.spec)
+
+			if len(test.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("ParseSecretSpec returned %v, want an error containing %q", err, test.err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("ParseSecretSpec failed: %s", err)
+			}
+
+			if secret != test.secret {
+				t.Errorf("ParseSecretSpec returned %+v, want %+v", secret, test.secret)
+			}
+		})
+	}
+}
+
+func TestSecretStringRoundTrips(t *testing.T) {
+	for _, spec := range []string{
+		"prod/db",
+		"DB=us-west-2:prod/db@AWSPREVIOUS",
+		"prod/db@role=arn:aws:iam::111122223333:role/reader",
+		"prod/db#$.credentials.password=DB_PASSWORD",
+	} {
+		secret, err := ParseSecretSpec(spec)
+
+		if err != nil {
+			t.Fatalf("ParseSecretSpec(%q) failed: %s", spec, err)
+		}
+
+		if secret.String() != spec {
+			t.Errorf("The secret parsed from %q is written as %q", spec, secret.String())
+		}
+	}
+}
+
+func TestParseCoalesceRule(t *testing.T) {
+	tests := []struct {
+		value  string
+		output string
+		keys   string
+		err    bool
+	}{
+		{value: "DB_HOST=host,hostname", output: "DB_HOST", keys: "host,hostname"},
+		{value: "DB_HOST = host , hostname ", output: "DB_HOST", keys: "host,hostname"},
+		{value: "DB_HOST", err: true},
+		{value: "=host", err: true},
+		{value: "DB_HOST=", err: true},
+	}
+
+	for _, test := range tests {
+		rule, err := ParseCoalesceRule(test.value)
+
+		if test.err {
+			if err == nil {
+				t.Errorf("ParseCoalesceRule(%q) returned %+v, want an error", test.value, rule)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("ParseCoalesceRule(%q) failed: %s", test.value, err)
+		} else if rule.Output != test.output || strings.Join(rule.Sources, ",") != test.keys {
+			t.Errorf("ParseCoalesceRule(%q) returned %+v, want %s=%s", test.value, rule, test.output, test.keys)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// This code is used to render a Go template, such as an appsettings.json file, with the values
+// of the secrets instead of writing them out as environment variables.
+//
+package secretenv
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"text/template"
+)
+
+// This function will execute the template text, in which the values of the secrets are available as
+//
+//	{{ secret "prod/db" "password" }}          the key password of the secret prod/db
+//	{{ secret "plain" }}                       the only key of a secret, e.g. a plaintext secret
+//	{{ .DB_PASSWORD }}                         a key of the output, after the keys were merged and renamed
+//	{{ secret "prod/db" "password" | json }}   the value as a quoted JSON string
+//
+// The key of the secret function is the key within the secret, before the prefix of the secret is added
+// or the key is transformed.  A secret or key that does not exist fails the template instead of leaving
+// an empty value behind.
+func (c Config) ExecuteTemplate(name string, text string, result *Result, values map[string]string) (string, error) {
+	parsed, err := newTemplate(name, &c, result).Parse(text)
+
+	if err != nil {
+		return "", err
+	}
+
+	var output bytes.Buffer
+	if err := parsed.Execute(&output, values); err != nil {
+		return "", err
+	}
+
+	return output.String(), nil
+}
+
+// This function will return an empty template with the functions available to the templates, the secret
+// function looks the secrets up in the result
+func newTemplate(name string, c *Config, result *Result) *template.Template {
+	lookup := func(secretId string, key ...string) (string, error) {
+		if c == nil {
+			return "", fmt.Errorf("no secrets were retrieved")
+		}
+		return c.templateSecret(result, secretId, key)
+	}
+
+	return template.New(name).Option("missingkey=error").Funcs(template.FuncMap{
+		"secret": lookup,
+		"json":   templateJson,
+	})
+}
+
+// This function will set the Name of each of the Composites of the config to its template executed over the
+// values, which are the rendered values the same as for ExecuteTemplate.  The composites are built in the
+// order they were supplied, so a composite may use the ones before it.  A template that uses a key that
+// does not exist fails instead of building a value with a part missing.
+func (c Config) ApplyComposites(result *Result, values map[string]string) error {
+	for _, rule := range c.Composites {
+		value, err := c.ExecuteTemplate(rule.Name, rule.Template, result, values)
+
+		if err != nil {
+			return inputError("Failed to build %s: %w", rule.Name, err)
+		}
+
+		values[rule.Name] = value
+	}
+
+	return nil
+}
+
+// This function will return the rendered value of a key of one of the retrieved secrets.  When no key is
+// supplied the secret must have exactly one key.
+func (c Config) templateSecret(result *Result, secretId string, key []string) (string, error) {
+	if len(key) > 1 {
+		return "", fmt.Errorf("secret takes a secret id and at most one key, %d keys were supplied", len(key))
+	}
+
+	var secret *Secret
+	for _, candidate := range append(append([]Secret{}, c.Secrets...), c.Parameters...) {
+		if candidate.Id == secretId {
+			secret = &candidate
+			break
+		}
+	}
+
+	if secret == nil {
+		return "", fmt.Errorf("the secret %s is not one of the secrets that were retrieved", secretId)
+	}
+
+	if len(key) == 0 {
+		var only []string
+		for merged, source := range result.Sources {
+			if source == secretId {
+				only = append(only, merged)
+			}
+		}
+
+		if len(only) != 1 {
+			return "", fmt.Errorf("the secret %s has %d keys, the key to use must be supplied", secretId, len(only))
+		}
+
+		return renderScalar(result.Values[only[0]]), nil
+	}
+
+	// The key is found under the name it was merged as, or the name it was renamed to
+	merged := c.TransformKey(*secret, key[0])
+	for _, rule := range c.Renames {
+		if rule.From == merged {
+			merged = rule.To
+		}
+	}
+
+	if value, ok := result.Values[merged]; ok && result.Sources[merged] == secretId {
+		return renderScalar(value), nil
+	}
+
+	return "", fmt.Errorf("the secret %s has no key %s", secretId, key[0])
+}
+
+// This function will return the value as JSON, e.g. a quoted and escaped string
+func templateJson(value interface{}) (string, error) {
+	data, err := json.Marshal(value)
+
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
@@ -0,0 +1,125 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// This code is used to transform the rendered values of individual keys, such as decoding a PEM
+// that was stored base64 encoded, so that no shell post-processing step is needed.
+//
+package secretenv
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// The transforms accepted by ParseTransformRule
+const TRANSFORM_BASE64_DECODE = "base64-decode"
+const TRANSFORM_TRIM = "trim"
+const TRANSFORM_JSON_ESCAPE = "json-escape"
+const TRANSFORM_URL_ENCODE = "url-encode"
+
+// A rule which applies the Transforms in turn to the value of each key matching the Key, which is a key name,
+// a glob pattern, or a regular expression between slashes the same as an Include pattern
+type TransformRule struct {
+	Key        string
+	Transforms []string
+}
+
+// This function will parse a transform rule in the form KEY=TRANSFORM[,TRANSFORM...], e.g.
+// TLS_CERT=base64-decode,trim
+func ParseTransformRule(value string) (TransformRule, error) {
+	parts := strings.SplitN(value, "=", 2)
+
+	if len(parts) != 2 || len(strings.TrimSpace(parts[0])) == 0 || len(strings.TrimSpace(parts[1])) == 0 {
+		return TransformRule{}, fmt.Errorf("transform option %q must be in the form KEY=TRANSFORM[,TRANSFORM...]", value)
+	}
+
+	rule := TransformRule{Key: strings.TrimSpace(parts[0])}
+
+	if err := ValidatePatterns([]string{rule.Key}); err != nil {
+		return TransformRule{}, err
+	}
+
+	for _, name := range strings.Split(parts[1], ",") {
+		name = strings.TrimSpace(name)
+
+		switch name {
+		case TRANSFORM_BASE64_DECODE, TRANSFORM_TRIM, TRANSFORM_JSON_ESCAPE, TRANSFORM_URL_ENCODE:
+			rule.Transforms = append(rule.Transforms, name)
+		default:
+			return TransformRule{}, fmt.Errorf("transform %q of %q must be one of base64-decode, trim, json-escape, or url-encode", name, value)
+		}
+	}
+
+	return rule, nil
+}
+
+// String will return the rule in the form accepted by ParseTransformRule
+func (r TransformRule) String() string {
+	return r.Key + "=" + strings.Join(r.Transforms, ",")
+}
+
+// This function will apply the Transforms of the config to the rendered values in the order the rules were
+// supplied, so a key matched by several rules has each of them applied in turn.  A value that cannot be
+// transformed, such as one that is not base64, is an error naming the key but never the value.
+func (c Config) ApplyTransforms(values map[string]string) error {
+	for _, rule := range c.Transforms {
+		for _, key := range SortedKeys(values) {
+			if !matchPattern(rule.Key, key) {
+				continue
+			}
+
+			value := values[key]
+
+			for _, name := range rule.Transforms {
+				var err error
+				if value, err = transform(name, value); err != nil {
+					return parseError("Failed to %s the value of %s: %w", name, key, err)
+				}
+			}
+
+			values[key] = value
+		}
+	}
+
+	return nil
+}
+
+// This function will apply a single transform to the value
+func transform(name string, value string) (string, error) {
+	switch name {
+	case TRANSFORM_BASE64_DECODE:
+		// Encoded values are often wrapped or copied with a trailing newline, so whitespace is ignored
+		encoded := strings.Join(strings.Fields(value), "")
+
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			decoded, err = base64.RawStdEncoding.DecodeString(encoded)
+		}
+
+		if err != nil {
+			return "", fmt.Errorf("the value is not base64")
+		}
+
+		return string(decoded), nil
+	case TRANSFORM_TRIM:
+		return strings.TrimSpace(value), nil
+	case TRANSFORM_JSON_ESCAPE:
+		data, err := json.Marshal(value)
+
+		if err != nil {
+			return "", err
+		}
+
+		// The value is escaped to go inside a JSON string, so the quotes around it are left off
+		return string(data[1 : len(data)-1]), nil
+	case TRANSFORM_URL_ENCODE:
+		// A space is %20 so that the value can be used in the user info and path of a URL as well as a query
+		return strings.ReplaceAll(url.QueryEscape(value), "+", "%20"), nil
+	}
+
+	return "", fmt.Errorf("unsupported transform %s", name)
+}
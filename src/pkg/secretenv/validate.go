@@ -0,0 +1,140 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// This code is used to check that the keys an application depends on are present and well
+// formed, so that a misconfigured secret fails loudly instead of producing empty variables.
+//
+package secretenv
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The types a required key can be checked for, a key without a type only has to be non-empty
+const REQUIRE_INT = "int"
+const REQUIRE_NUMBER = "number"
+const REQUIRE_BOOL = "bool"
+const REQUIRE_URL = "url"
+const REQUIRE_JSON = "json"
+
+// A key that must be present in the output along with the type or regular expression its value must match
+type RequireRule struct {
+	Key string
+
+	// One of the REQUIRE constants, empty when the value only has to be non-empty
+	Type string
+
+	// A regular expression the whole value must match, empty when there is none
+	Pattern string
+}
+
+// The keys that failed the RequireRules, the message lists every one of them so that they can all be
+// fixed at once
+type ValidationError struct {
+	Problems []string
+}
+
+// Error is an implementation of the error interface
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%d of the required keys are missing or malformed: %s", len(e.Problems), strings.Join(e.Problems, "; "))
+}
+
+// This function will parse a required key in the form KEY[:TYPE], e.g. DB_PORT:int, where the type is one
+// of the REQUIRE constants or a regular expression between slashes, e.g. DB_HOST:/^[a-z0-9.-]+$/
+func ParseRequireRule(value string) (RequireRule, error) {
+	rule := RequireRule{Key: strings.TrimSpace(value)}
+
+	if i := strings.Index(value, ":"); i >= 0 {
+		rule.Key = strings.TrimSpace(value[:i])
+
+		constraint := strings.TrimSpace(value[i+1:])
+		if expression, ok := regexPattern(constraint); ok {
+			if _, err := regexp.Compile(expression); err != nil {
+				return rule, fmt.Errorf("the pattern %q of the required key %s is not a valid regular expression: %w", constraint, rule.Key, err)
+			}
+			rule.Pattern = expression
+		} else {
+			switch constraint {
+			case REQUIRE_INT, REQUIRE_NUMBER, REQUIRE_BOOL, REQUIRE_URL, REQUIRE_JSON:
+				rule.Type = constraint
+			default:
+				return rule, fmt.Errorf("unsupported type %q for the required key %s, one of int, number, bool, url, json, or /REGEX/ is expected", constraint, rule.Key)
+			}
+		}
+	}
+
+	if len(rule.Key) == 0 {
+		return rule, fmt.Errorf("required key option %q must be in the form KEY[:TYPE]", value)
+	}
+
+	return rule, nil
+}
+
+// String will return the rule in the form accepted by ParseRequireRule
+func (r RequireRule) String() string {
+	if len(r.Pattern) > 0 {
+		return r.Key + ":/" + r.Pattern + "/"
+	} else if len(r.Type) > 0 {
+		return r.Key + ":" + r.Type
+	}
+
+	return r.Key
+}
+
+// This function will check the rendered values against each of the rules and return a ValidationError
+// listing every key that is missing, empty, or malformed.  The values are never included in the message.
+func CheckRequired(rules []RequireRule, values map[string]string) error {
+	var problems []string
+
+	for _, rule := range rules {
+		value, ok := values[rule.Key]
+
+		switch {
+		case !ok:
+			problems = append(problems, rule.Key+" is missing")
+		case len(value) == 0:
+			problems = append(problems, rule.Key+" is empty")
+		case len(rule.Pattern) > 0:
+			if matched, _ := regexp.MatchString("^(?:"+rule.Pattern+")$", value); !matched {
+				problems = append(problems, fmt.Sprintf("%s does not match /%s/", rule.Key, rule.Pattern))
+			}
+		case !hasType(rule.Type, value):
+			problems = append(problems, fmt.Sprintf("%s is not a valid %s", rule.Key, rule.Type))
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+
+	return nil
+}
+
+// This function will determine if the value can be read as the type, any value is a valid empty type
+func hasType(kind string, value string) bool {
+	var err error
+
+	switch kind {
+	case REQUIRE_INT:
+		_, err = strconv.ParseInt(value, 10, 64)
+	case REQUIRE_NUMBER:
+		_, err = strconv.ParseFloat(value, 64)
+	case REQUIRE_BOOL:
+		_, err = strconv.ParseBool(value)
+	case REQUIRE_URL:
+		var parsed *url.URL
+		if parsed, err = url.Parse(value); err == nil && (len(parsed.Scheme) == 0 || len(parsed.Host) == 0) {
+			return false
+		}
+	case REQUIRE_JSON:
+		return json.Valid([]byte(value))
+	}
+
+	return err == nil
+}
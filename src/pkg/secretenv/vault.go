@@ -0,0 +1,375 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// This code is used to resolve the vault:// sources from the KV secrets engine of HashiCorp Vault,
+// so that a hybrid environment can merge secrets from Vault with those of Secrets Manager.
+//
+package secretenv
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/smithy-go"
+)
+
+// The scheme of the sources resolved from Vault
+const SCHEME_VAULT = "vault"
+
+// The ways of logging in to Vault
+const VAULT_AUTH_TOKEN = "token"
+const VAULT_AUTH_APPROLE = "approle"
+const VAULT_AUTH_AWS = "aws"
+
+// The largest response read from Vault
+const MAX_VAULT_RESPONSE_SIZE = 1024 * 1024
+
+// The sts:GetCallerIdentity request that is signed to log in with the aws auth method
+const vaultIdentityBody = "Action=GetCallerIdentity&Version=2011-06-15"
+
+// The options of the Vault provider
+type VaultOptions struct {
+	// The address of the Vault server, e.g. https://vault.internal:8200
+	Address string
+
+	// The Vault Enterprise namespace of the secrets, none when empty
+	Namespace string
+
+	// How the provider logs in, one of token, approle, or aws
+	Auth string
+
+	// The path the auth method is mounted at, defaults to the name of the method
+	AuthMount string
+
+	// With token, the token that reads the secrets
+	Token string
+
+	// With approle, the role id and secret id, with aws, the Vault role, the secret id is not used
+	Role     string
+	SecretId string
+
+	// With aws, the value of the X-Vault-AWS-IAM-Server-ID header when the auth method requires one
+	ServerId string
+
+	// The version of the KV secrets engine, 1 or 2, a source is read from /v1/MOUNT/data/PATH with version 2
+	KVVersion int
+
+	// A PEM file of the certificate authorities to trust for the Vault server in addition to the system ones
+	CACert string
+}
+
+// A Provider that reads the vault:// sources from the KV secrets engine.  The spec of a source is the mount of
+// the engine followed by the path of the secret, e.g. vault://secret/app reads secret/app.  The provider logs
+// in once and logs in again when the token is rejected, e.g. after it expired.
+type VaultProvider struct {
+	options     VaultOptions
+	client      *http.Client
+	credentials aws.CredentialsProvider
+
+	mutex sync.Mutex
+	token string
+}
+
+// This function will create the Vault provider.  The credentials sign the login request of the aws auth
+// method and are not used by the other methods.
+func NewVaultProvider(options VaultOptions, credentials aws.CredentialsProvider) (*VaultProvider, error) {
+	if len(options.Address) == 0 {
+		return nil, inputError("The address of the Vault server is required for the vault sources")
+	}
+
+	switch options.Auth {
+	case VAULT_AUTH_TOKEN:
+		if len(options.Token) == 0 {
+			return nil, inputError("A Vault token is required to read the vault sources with the token auth method")
+		}
+	case VAULT_AUTH_APPROLE:
+		if len(options.Role) == 0 || len(options.SecretId) == 0 {
+			return nil, inputError("The role id and secret id are required to log in to Vault with approle")
+		}
+	case VAULT_AUTH_AWS:
+		if len(options.Role) == 0 || credentials == nil {
+			return nil, inputError("The Vault role and AWS credentials are required to log in to Vault with aws")
+		}
+	default:
+		return nil, inputError("Unsupported Vault auth method %s, it must be one of token, approle, or aws", options.Auth)
+	}
+
+	if options.KVVersion == 0 {
+		options.KVVersion = 2
+	} else if options.KVVersion != 1 && options.KVVersion != 2 {
+		return nil, inputError("The version of the Vault KV secrets engine must be 1 or 2, %d was supplied", options.KVVersion)
+	}
+
+	if len(options.AuthMount) == 0 {
+		options.AuthMount = options.Auth
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if len(options.CACert) > 0 {
+		data, err := ioutil.ReadFile(options.CACert)
+
+		if err != nil {
+			return nil, inputError("Failed to read the Vault CA certificate %s: %w", options.CACert, err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, inputError("The Vault CA certificate %s holds no PEM certificates", options.CACert)
+		}
+
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+
+	return &VaultProvider{
+		options:     options,
+		client:      &http.Client{Transport: transport},
+		credentials: credentials,
+		token:       options.Token,
+	}, nil
+}
+
+// Name is an implementation of the Provider interface
+func (v *VaultProvider) Name() string {
+	return SCHEME_VAULT
+}
+
+// Resolve is an implementation of the Provider interface, it returns the keys of the secret at the path
+func (v *VaultProvider) Resolve(ctx context.Context, spec string) (map[string]string, error) {
+	mount, path, ok := strings.Cut(strings.Trim(spec, "/"), "/")
+
+	if !ok || len(mount) == 0 || len(path) == 0 {
+		return nil, inputError("The Vault source %s must be in the form vault://MOUNT/PATH", spec)
+	}
+
+	apiPath := mount + "/" + path
+	if v.options.KVVersion == 2 {
+		apiPath = mount + "/data/" + path
+	}
+
+	token, err := v.login(ctx, false)
+
+	if err != nil {
+		return nil, err
+	}
+
+	status, body, err := v.call(ctx, http.MethodGet, apiPath, token, nil)
+
+	// A token that expired is replaced once, a token supplied with the token method cannot be replaced
+	if err == nil && status == http.StatusForbidden && v.options.Auth != VAULT_AUTH_TOKEN {
+		if token, err = v.login(ctx, true); err != nil {
+			return nil, err
+		}
+
+		status, body, err = v.call(ctx, http.MethodGet, apiPath, token, nil)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if status != http.StatusOK {
+		return nil, vaultError(status, body)
+	}
+
+	var response struct {
+		Data json.RawMessage `json:"data"`
+	}
+
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("the response of Vault for %s is not JSON: %w", spec, err)
+	}
+
+	data := response.Data
+	if v.options.KVVersion == 2 {
+		var versioned struct {
+			Data json.RawMessage `json:"data"`
+		}
+
+		if err := json.Unmarshal(data, &versioned); err != nil {
+			return nil, fmt.Errorf("the response of Vault for %s is not a KV version 2 secret: %w", spec, err)
+		}
+
+		data = versioned.Data
+	}
+
+	// A deleted version of a KV version 2 secret has no data
+	if len(data) == 0 || string(data) == "null" {
+		return nil, inputError("The Vault secret %s has no data, its current version may have been deleted", spec)
+	}
+
+	values, err := parseString(SecretKeyName(path), string(data))
+
+	if err != nil {
+		return nil, parseError("Failed to convert the Vault secret %s: %w", spec, err)
+	}
+
+	return Config{}.Render(values), nil
+}
+
+// This function will return the token of the provider, logging in when there is none or when asked to
+// replace it
+func (v *VaultProvider) login(ctx context.Context, replace bool) (string, error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if len(v.token) > 0 && !replace {
+		return v.token, nil
+	}
+
+	var request map[string]interface{}
+
+	switch v.options.Auth {
+	case VAULT_AUTH_TOKEN:
+		return v.token, nil
+	case VAULT_AUTH_APPROLE:
+		request = map[string]interface{}{"role_id": v.options.Role, "secret_id": v.options.SecretId}
+	case VAULT_AUTH_AWS:
+		var err error
+		if request, err = v.identityRequest(ctx); err != nil {
+			return "", err
+		}
+	}
+
+	payload, _ := json.Marshal(request)
+	status, body, err := v.call(ctx, http.MethodPost, "auth/"+v.options.AuthMount+"/login", "", payload)
+
+	if err != nil {
+		return "", err
+	} else if status != http.StatusOK {
+		return "", fmt.Errorf("Failed to log in to Vault with %s: %w", v.options.Auth, vaultError(status, body))
+	}
+
+	var response struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+
+	if err := json.Unmarshal(body, &response); err != nil || len(response.Auth.ClientToken) == 0 {
+		return "", fmt.Errorf("Failed to log in to Vault with %s: the response has no token", v.options.Auth)
+	}
+
+	v.token = response.Auth.ClientToken
+	return v.token, nil
+}
+
+// This function will sign a sts:GetCallerIdentity request with the AWS credentials for the aws auth method,
+// Vault sends the request to STS to find out who is logging in
+func (v *VaultProvider) identityRequest(ctx context.Context) (map[string]interface{}, error) {
+	credentials, err := v.credentials.Retrieve(ctx)
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to retrieve the AWS credentials to log in to Vault: %w", err)
+	}
+
+	request, err := http.NewRequest(http.MethodPost, "https://sts.amazonaws.com/", strings.NewReader(vaultIdentityBody))
+
+	if err != nil {
+		return nil, err
+	}
+
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	if len(v.options.ServerId) > 0 {
+		request.Header.Set("X-Vault-AWS-IAM-Server-ID", v.options.ServerId)
+	}
+
+	hash := sha256.Sum256([]byte(vaultIdentityBody))
+
+	if err := v4.NewSigner().SignHTTP(ctx, credentials, request, hex.EncodeToString(hash[:]), "sts", "us-east-1", time.Now()); err != nil {
+		return nil, fmt.Errorf("Failed to sign the request to log in to Vault: %w", err)
+	}
+
+	headers, _ := json.Marshal(request.Header)
+
+	return map[string]interface{}{
+		"role":                    v.options.Role,
+		"iam_http_request_method": request.Method,
+		"iam_request_url":         base64.StdEncoding.EncodeToString([]byte(request.URL.String())),
+		"iam_request_body":        base64.StdEncoding.EncodeToString([]byte(vaultIdentityBody)),
+		"iam_request_headers":     base64.StdEncoding.EncodeToString(headers),
+	}, nil
+}
+
+// This function will call the Vault API and return the status and body of the response
+func (v *VaultProvider) call(ctx context.Context, method string, path string, token string, payload []byte) (int, []byte, error) {
+	url := strings.TrimSuffix(v.options.Address, "/") + "/v1/" + path
+
+	request, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(payload))
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if len(token) > 0 {
+		request.Header.Set("X-Vault-Token", token)
+	}
+
+	if len(v.options.Namespace) > 0 {
+		request.Header.Set("X-Vault-Namespace", v.options.Namespace)
+	}
+
+	if payload != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	response, err := v.client.Do(request)
+
+	if err != nil {
+		return 0, nil, fmt.Errorf("Failed to call Vault: %w", err)
+	}
+
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, MAX_VAULT_RESPONSE_SIZE))
+
+	if err != nil {
+		return 0, nil, fmt.Errorf("Failed to read the response of Vault: %w", err)
+	}
+
+	return response.StatusCode, body, nil
+}
+
+// This function will return the error of a failed Vault call, the errors in its body never hold the values
+// of the secrets.  A denied or missing secret is reported with the code of the same Secrets Manager error so
+// that it is categorized the same.
+func vaultError(status int, body []byte) error {
+	var response struct {
+		Errors []string `json:"errors"`
+	}
+
+	message := fmt.Sprintf("Vault returned %d", status)
+	if err := json.Unmarshal(body, &response); err == nil && len(response.Errors) > 0 {
+		message += ": " + strings.Join(response.Errors, ", ")
+	}
+
+	switch status {
+	case http.StatusForbidden:
+		return &smithy.GenericAPIError{Code: "AccessDeniedException", Message: message}
+	case http.StatusNotFound:
+		return &smithy.GenericAPIError{Code: "ResourceNotFoundException", Message: message}
+	}
+
+	return errors.New(message)
+}
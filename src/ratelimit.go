@@ -0,0 +1,109 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// This code is used to spread the API calls of a large set of secrets out over time with a token
+// bucket, and to count the attempts that were throttled, so that a burst stays under the API quotas.
+//
+package main
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// A token bucket that allows a burst of calls and then one call every 1/rate seconds, it is safe to use
+// from several goroutines
+type tokenBucket struct {
+	mutex  sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// The bucket shared by every API call of the run, nil when -rate-limit was not supplied
+var rateBucket *tokenBucket
+
+// This function will create a bucket that is full, the burst is at least one call
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = int(math.Max(1, math.Ceil(rate)))
+	}
+
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// This function will take a token from the bucket, waiting until one is added when the bucket is empty.  A
+// context that is done stops the wait and its error is returned.
+func (b *tokenBucket) wait(ctx context.Context) (time.Duration, error) {
+	b.mutex.Lock()
+
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+
+	// The token is taken now, so the callers waiting together are spaced out instead of all waking at once
+	b.tokens--
+	delay := time.Duration(0)
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+
+	b.mutex.Unlock()
+
+	if delay <= 0 {
+		return 0, nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return delay, nil
+	case <-ctx.Done():
+		// The call is not made, so its token is given back
+		b.mutex.Lock()
+		b.tokens++
+		b.mutex.Unlock()
+
+		return 0, ctx.Err()
+	}
+}
+
+// This function will add a middleware after the retry middleware that takes a token for each attempt of an
+// API call, so that the retries are limited as well, and counts the attempts that were throttled
+func addRateLimit(stack *middleware.Stack) error {
+	return stack.Finalize.Insert(middleware.FinalizeMiddlewareFunc("RateLimit", func(
+		ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler,
+	) (middleware.FinalizeOutput, middleware.Metadata, error) {
+		if rateBucket != nil {
+			delay, err := rateBucket.wait(ctx)
+
+			if err != nil {
+				return middleware.FinalizeOutput{}, middleware.Metadata{}, err
+			}
+
+			if delay > 0 {
+				debugf("event=rate_limited service=%q operation=%q delay=%s", awsmiddleware.GetServiceID(ctx),
+					awsmiddleware.GetOperationName(ctx), delay.Round(time.Millisecond))
+			}
+		}
+
+		out, metadata, err := next.HandleFinalize(ctx, in)
+
+		if err != nil && retry.IsErrorThrottles(retry.DefaultThrottles).IsErrorThrottle(err).Bool() {
+			debugf("event=throttled service=%q operation=%q", awsmiddleware.GetServiceID(ctx), awsmiddleware.GetOperationName(ctx))
+			metrics.observeThrottle()
+		}
+
+		return out, metadata, err
+	}), "Retry", middleware.After)
+}
@@ -0,0 +1,291 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// This code is used to serve the secrets over gRPC next to the HTTP server of serve, so that services
+// in any language can read the secrets and subscribe to the values pushed whenever they are refreshed.
+// The service is described in proto/secrets.proto and only uses the well known types of protobuf, so a
+// client is generated from that file alone.
+//
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	grpcmetadata "google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// The name of the service in proto/secrets.proto
+const GRPC_SERVICE_NAME = "secretenv.v1.Secrets"
+
+// The metadata key that calls must carry the -serve-token in, gRPC metadata keys are lower case
+var grpcTokenKey = strings.ToLower(SERVE_TOKEN_HEADER)
+
+// The gRPC service of serve
+type secretsService struct {
+	state *extensionState
+
+	// Closed when the server is stopped so that the subscriptions end
+	stopping chan struct{}
+}
+
+// The description of the service that generated code would register, written out since the messages are
+// the well known types and need no generated code
+var secretsServiceDesc = grpc.ServiceDesc{
+	ServiceName: GRPC_SERVICE_NAME,
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "GetSecret", Handler: grpcGetSecretHandler},
+		{MethodName: "ListKeys", Handler: grpcListKeysHandler},
+	},
+	Streams: []grpc.StreamDesc{
+		{StreamName: "Subscribe", Handler: grpcSubscribeHandler, ServerStreams: true},
+	},
+	Metadata: "proto/secrets.proto",
+}
+
+// This function will create the gRPC server of -grpc-listen, with TLS when -grpc-cert is supplied and
+// requiring a client certificate signed by -grpc-client-ca when it is supplied
+func newGrpcServer(state *extensionState, token string) (*grpc.Server, *secretsService, error) {
+	options := []grpc.ServerOption{
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if err := grpcAuthorize(ctx, token); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := grpcAuthorize(stream.Context(), token); err != nil {
+				return err
+			}
+			return handler(srv, stream)
+		}),
+	}
+
+	if len(grpcCert) > 0 {
+		config, err := grpcTLSConfig()
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		options = append(options, grpc.Creds(credentials.NewTLS(config)))
+	}
+
+	service := &secretsService{state: state, stopping: make(chan struct{})}
+
+	server := grpc.NewServer(options...)
+	server.RegisterService(&secretsServiceDesc, service)
+
+	return server, service, nil
+}
+
+// This function will return the TLS config of the server from -grpc-cert, -grpc-key, and -grpc-client-ca
+func grpcTLSConfig() (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(grpcCert, grpcKey)
+
+	if err != nil {
+		return nil, configError("Failed to load the gRPC certificate %s: %w", grpcCert, err)
+	}
+
+	config := &tls.Config{Certificates: []tls.Certificate{certificate}, MinVersion: tls.VersionTLS12}
+
+	if len(grpcClientCA) > 0 {
+		data, err := ioutil.ReadFile(grpcClientCA)
+
+		if err != nil {
+			return nil, configError("Failed to read the gRPC client CA %s: %w", grpcClientCA, err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, configError("The gRPC client CA %s holds no PEM certificates", grpcClientCA)
+		}
+
+		config.ClientCAs, config.ClientAuth = pool, tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+// This function will serve the gRPC service on the listener until stop is called, which waits for the calls
+// in progress for at most SERVE_SHUTDOWN_TIMEOUT
+func serveGrpc(state *extensionState, listener net.Listener) (stop func(), err error) {
+	server, service, err := newGrpcServer(state, serveToken)
+
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	debugf("event=grpc_listening address=%q tls=%t mtls=%t", grpcListen, len(grpcCert) > 0, len(grpcClientCA) > 0)
+
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			warnf("failed to serve the secrets over gRPC: %s", err)
+		}
+	}()
+
+	return func() {
+		close(service.stopping)
+
+		stopped := make(chan struct{})
+		go func() {
+			server.GracefulStop()
+			close(stopped)
+		}()
+
+		select {
+		case <-stopped:
+		case <-time.After(SERVE_SHUTDOWN_TIMEOUT):
+			server.Stop()
+		}
+	}, nil
+}
+
+// This function will check the token of a call when there is one, in the x-secrets-token or authorization
+// metadata as the HTTP server checks the headers
+func grpcAuthorize(ctx context.Context, token string) error {
+	if len(token) == 0 {
+		return nil
+	}
+
+	md, _ := grpcmetadata.FromIncomingContext(ctx)
+
+	header, authorization := "", ""
+	if values := md.Get(grpcTokenKey); len(values) > 0 {
+		header = values[0]
+	}
+	if values := md.Get("authorization"); len(values) > 0 {
+		authorization = values[0]
+	}
+
+	if !validToken(header, authorization, token) {
+		return status.Error(codes.PermissionDenied, "forbidden")
+	}
+
+	return nil
+}
+
+// GetSecret returns the values of the keys that came from a single secret, as GET /secret/ID does
+func (s *secretsService) GetSecret(ctx context.Context, secretId *wrapperspb.StringValue) (*structpb.Struct, error) {
+	values := s.state.secret(secretId.GetValue())
+
+	if values == nil {
+		return nil, status.Errorf(codes.NotFound, "no key came from the secret %s", secretId.GetValue())
+	}
+
+	return grpcValues(values), nil
+}
+
+// ListKeys returns the sorted names of the served keys, without their values
+func (s *secretsService) ListKeys(ctx context.Context, _ *emptypb.Empty) (*structpb.ListValue, error) {
+	_, values, _ := s.state.get()
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	list := &structpb.ListValue{Values: make([]*structpb.Value, len(keys))}
+	for i, key := range keys {
+		list.Values[i] = structpb.NewStringValue(key)
+	}
+
+	return list, nil
+}
+
+// Subscribe sends every served value at once and again each time a refresh changes them, until the client
+// cancels the call or the server is stopped.  A refresh that changes nothing sends nothing.
+func (s *secretsService) Subscribe(_ *emptypb.Empty, stream grpc.ServerStream) error {
+	values, checksum, changed := s.state.watch()
+
+	// The checksum of the first values lets a client that reconnects tell whether they changed while it was away
+	stream.SetHeader(grpcmetadata.Pairs("etag", checksum))
+
+	for {
+		if err := stream.SendMsg(grpcValues(values)); err != nil {
+			return err
+		}
+
+		debugf("event=grpc_subscription_sent keys=%d", len(values))
+
+		select {
+		case <-changed:
+		case <-stream.Context().Done():
+			return nil
+		case <-s.stopping:
+			return nil
+		}
+
+		values, _, changed = s.state.watch()
+	}
+}
+
+// This function will return the values as a protobuf struct of strings
+func grpcValues(values map[string]string) *structpb.Struct {
+	fields := make(map[string]*structpb.Value, len(values))
+	for key, value := range values {
+		fields[key] = structpb.NewStringValue(value)
+	}
+
+	return &structpb.Struct{Fields: fields}
+}
+
+// The handlers of the methods, as generated code would call the service
+
+func grpcGetSecretHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(wrapperspb.StringValue)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+
+	if interceptor == nil {
+		return srv.(*secretsService).GetSecret(ctx, in)
+	}
+
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + GRPC_SERVICE_NAME + "/GetSecret"}
+	return interceptor(ctx, in, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(*secretsService).GetSecret(ctx, req.(*wrapperspb.StringValue))
+	})
+}
+
+func grpcListKeysHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+
+	if interceptor == nil {
+		return srv.(*secretsService).ListKeys(ctx, in)
+	}
+
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + GRPC_SERVICE_NAME + "/ListKeys"}
+	return interceptor(ctx, in, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(*secretsService).ListKeys(ctx, req.(*emptypb.Empty))
+	})
+}
+
+func grpcSubscribeHandler(srv interface{}, stream grpc.ServerStream) error {
+	in := new(emptypb.Empty)
+	if err := stream.RecvMsg(in); err != nil {
+		return err
+	}
+
+	return srv.(*secretsService).Subscribe(in, stream)
+}
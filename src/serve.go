@@ -0,0 +1,249 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// This code is used to run as a long lived sidecar, e.g. on ECS or EC2, which keeps the secrets in
+// memory and serves them over a Unix domain socket or a localhost HTTP port.
+//
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"go-retrieve-secret/pkg/secretenv"
+)
+
+// The address served on when -listen is not supplied
+const DEFAULT_SERVE_ADDRESS = "127.0.0.1:2773"
+
+// The prefix of a -listen address that is the path of a Unix domain socket
+const UNIX_SOCKET_PREFIX = "unix:"
+
+// The header that requests to the server must carry the -serve-token in, or as a bearer token in the
+// Authorization header
+const SERVE_TOKEN_HEADER = "X-Secrets-Token"
+
+// The scheme of the Authorization header that carries the -serve-token
+const BEARER_PREFIX = "Bearer "
+
+// The environment variable the -serve-token is read from when the flag is not supplied, so that the token
+// does not have to be on the command line
+const SERVE_TOKEN_ENV = "RETRIEVE_SECRET_TOKEN"
+
+// The longest time spent finishing the requests in progress when the server is stopped
+const SERVE_SHUTDOWN_TIMEOUT = 5 * time.Second
+
+// This function will serve the values until the process receives SIGINT or SIGTERM.  When -rotation-check
+// is set the secrets are checked for rotation that often and refresh is called to replace the values, and
+// SIGHUP or POST /refresh replaces them whether or not they were rotated.  With -grpc-listen the values
+// are served over gRPC as well and pushed to its subscribers whenever they change.
+func RunServer(state *extensionState, options secretenv.Config, refresh refreshFunc) error {
+	listener, err := serveListener(listenAddress)
+
+	if err != nil {
+		return configError("Failed to listen on %s: %w", listenAddress, err)
+	}
+
+	server := &http.Server{Handler: serveHandler(state, options, serveToken, refresh), ReadHeaderTimeout: 10 * time.Second}
+
+	stopGrpc := func() {}
+	if len(grpcListen) > 0 {
+		grpcListener, err := serveListener(grpcListen)
+
+		if err != nil {
+			listener.Close()
+			return configError("Failed to listen on %s: %w", grpcListen, err)
+		}
+
+		if stopGrpc, err = serveGrpc(state, grpcListener); err != nil {
+			listener.Close()
+			return err
+		}
+	}
+
+	_, values, _ := state.get()
+	debugf("event=serve_listening address=%q keys=%d", listenAddress, len(values))
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, stopSignals...)
+
+	go refreshOnHangup(state, refresh)
+
+	if rotationCheck > 0 {
+		ticker := time.NewTicker(rotationCheck)
+		defer ticker.Stop()
+
+		go func() {
+			for range ticker.C {
+				// A check that is still running when the next one is due is not started again
+				if _, err := state.tryRefresh(refresh, false); err != nil {
+					warnf("failed to refresh the rotated secrets, the previous values are still served: %s", err)
+				}
+			}
+		}()
+	}
+
+	go func() {
+		<-stop
+
+		ctx, cancel := context.WithTimeout(context.Background(), SERVE_SHUTDOWN_TIMEOUT)
+		defer cancel()
+
+		server.Shutdown(ctx)
+		stopGrpc()
+	}()
+
+	if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+		return configError("Failed to serve the secrets: %w", err)
+	}
+
+	return nil
+}
+
+// This function will listen on the address, either host:port or unix:PATH.  A socket is only accessible
+// by the owner and a stale socket left behind by an earlier run is replaced, any other file at the path is
+// left alone and fails the listen.
+func serveListener(address string) (net.Listener, error) {
+	if !strings.HasPrefix(address, UNIX_SOCKET_PREFIX) {
+		return net.Listen("tcp", address)
+	}
+
+	path := strings.TrimPrefix(address, UNIX_SOCKET_PREFIX)
+
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s already exists and is not a socket", path)
+		}
+
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return listenUnix(path)
+}
+
+// This function will check that serve can only be reached by the callers that know the token.  A Unix
+// domain socket is only reachable by the users its permissions allow, while any process, or any host for
+// an address that is not loopback, can connect to a TCP port, so a port requires a token.
+func checkServeAuthentication(address string, token string) error {
+	if len(token) == 0 && !strings.HasPrefix(address, UNIX_SOCKET_PREFIX) {
+		return usageError("serve requires a -serve-token or %s unless it listens on a unix: socket", SERVE_TOKEN_ENV)
+	}
+
+	return nil
+}
+
+// This function will determine if a request carries the token, in the value of the X-Secrets-Token header
+// or as the bearer token of the Authorization header.  Every request is allowed when there is no token.
+func validToken(header string, authorization string, token string) bool {
+	if len(token) == 0 {
+		return true
+	}
+
+	supplied := header
+	if len(supplied) == 0 && strings.HasPrefix(authorization, BEARER_PREFIX) {
+		supplied = strings.TrimPrefix(authorization, BEARER_PREFIX)
+	}
+
+	return subtle.ConstantTimeCompare([]byte(supplied), []byte(token)) == 1
+}
+
+// This function will return the handler of the server.  GET /env returns every value in the format of the
+// format query parameter, json by default or any other -f format such as dotenv, and GET /secret/ID returns
+// the values of the keys that came from a single secret as a JSON object.  POST /refresh retrieves the
+// secrets again.  When there is a token each request must carry it in the X-Secrets-Token header or as a
+// bearer token.
+func serveHandler(state *extensionState, options secretenv.Config, token string, refresh refreshFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !validToken(r.Header.Get(SERVE_TOKEN_HEADER), r.Header.Get("Authorization"), token) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		if r.URL.Path == "/refresh" && r.Method == http.MethodPost {
+			serveRefresh(w, state, refresh)
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		switch {
+		case r.URL.Path == "/env":
+			format := r.URL.Query().Get("format")
+			if len(format) == 0 {
+				format = secretenv.FORMAT_JSON
+			}
+
+			if !servedFormat(format) {
+				http.Error(w, "unsupported format "+format, http.StatusBadRequest)
+				return
+			}
+
+			if state.notModified(w, r) {
+				return
+			}
+
+			output, err := state.format(options, format)
+
+			if err != nil {
+				http.Error(w, "failed to format the secrets", http.StatusInternalServerError)
+				return
+			}
+
+			if format == secretenv.FORMAT_JSON {
+				w.Header().Set("Content-Type", "application/json")
+			} else {
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			}
+			fmt.Fprint(w, output)
+		case strings.HasPrefix(r.URL.EscapedPath(), "/secret/"):
+			// Secret ids contain slashes, so an id may be sent as is or escaped
+			secretId, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/secret/"))
+
+			if err != nil {
+				http.NotFound(w, r)
+				return
+			}
+
+			values := state.secret(secretId)
+
+			if values == nil {
+				http.NotFound(w, r)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(values)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// This function will determine if the format can be requested from the server, env-example is left out
+// since it has no values
+func servedFormat(format string) bool {
+	switch format {
+	case secretenv.FORMAT_PIPE, secretenv.FORMAT_EXPORT, secretenv.FORMAT_JSON, secretenv.FORMAT_YAML, secretenv.FORMAT_DOTENV,
+		secretenv.FORMAT_POWERSHELL, secretenv.FORMAT_NUL:
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,106 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// These tests check that serve only answers the callers that carry the -serve-token, over HTTP and
+// gRPC, and that it refuses to listen on a TCP port without one.
+//
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	grpcmetadata "google.golang.org/grpc/metadata"
+
+	"go-retrieve-secret/pkg/secretenv"
+)
+
+const testServeToken = "s3cr3t-token"
+
+func TestCheckServeAuthentication(t *testing.T) {
+	tests := []struct {
+		address string
+		token   string
+		valid   bool
+	}{
+		{address: DEFAULT_SERVE_ADDRESS, token: "", valid: false},
+		{address: "0.0.0.0:2773", token: "", valid: false},
+		{address: "[::1]:2773", token: "", valid: false},
+		{address: DEFAULT_SERVE_ADDRESS, token: testServeToken, valid: true},
+		{address: UNIX_SOCKET_PREFIX + "/run/secrets.sock", token: "", valid: true},
+	}
+
+	for _, test := range tests {
+		if err := checkServeAuthentication(test.address, test.token); (err == nil) != test.valid {
+			t.Errorf("checkServeAuthentication(%q, %q) returned %v, want valid %t", test.address, test.token, err, test.valid)
+		}
+	}
+}
+
+func TestServeHandlerToken(t *testing.T) {
+	state := &extensionState{}
+	if err := state.update(secretenv.Config{}, &secretenv.Result{}, map[string]string{"KEY": "value"}, nil, map[string]string{"KEY": "prod/db"}); err != nil {
+		t.Fatalf("update failed: %s", err)
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		headers map[string]string
+		status  int
+	}{
+		{name: "missing token", token: testServeToken, status: http.StatusForbidden},
+		{name: "wrong token", token: testServeToken, headers: map[string]string{SERVE_TOKEN_HEADER: "wrong"}, status: http.StatusForbidden},
+		{name: "wrong bearer", token: testServeToken, headers: map[string]string{"Authorization": BEARER_PREFIX + "wrong"}, status: http.StatusForbidden},
+		{name: "token without bearer", token: testServeToken, headers: map[string]string{"Authorization": testServeToken}, status: http.StatusForbidden},
+		{name: "header", token: testServeToken, headers: map[string]string{SERVE_TOKEN_HEADER: testServeToken}, status: http.StatusOK},
+		{name: "bearer", token: testServeToken, headers: map[string]string{"Authorization": BEARER_PREFIX + testServeToken}, status: http.StatusOK},
+		{name: "socket without token", token: "", status: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/env", nil)
+			for key, value := range test.headers {
+				request.Header.Set(key, value)
+			}
+
+			recorder := httptest.NewRecorder()
+			serveHandler(state, secretenv.Config{}, test.token, nil).ServeHTTP(recorder, request)
+
+			if recorder.Code != test.status {
+				t.Errorf("GET /env returned %d, want %d", recorder.Code, test.status)
+			}
+
+			// A refused request is never answered with the values
+			if test.status != http.StatusOK && strings.Contains(recorder.Body.String(), "value") {
+				t.Errorf("The forbidden response holds %q", recorder.Body.String())
+			}
+		})
+	}
+}
+
+func TestGrpcAuthorize(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata []string
+		valid    bool
+	}{
+		{name: "missing token", valid: false},
+		{name: "wrong token", metadata: []string{grpcTokenKey, "wrong"}, valid: false},
+		{name: "token", metadata: []string{grpcTokenKey, testServeToken}, valid: true},
+		{name: "bearer", metadata: []string{"authorization", BEARER_PREFIX + testServeToken}, valid: true},
+	}
+
+	for _, test := range tests {
+		ctx := grpcmetadata.NewIncomingContext(context.Background(), grpcmetadata.Pairs(test.metadata...))
+
+		if err := grpcAuthorize(ctx, testServeToken); (err == nil) != test.valid {
+			t.Errorf("grpcAuthorize with the %s returned %v, want valid %t", test.name, err, test.valid)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// This code is used to handle the signals of Linux, macOS, and the other Unix systems, where SIGHUP
+// refreshes the secrets, the signals are passed on to the command run by exec, and -exec replaces the
+// process with its command.  The sockets of serve are created with a umask that only lets the owner connect.
+//
+
+//go:build !windows
+
+package main
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// The signals that stop serve and that exec passes on to its command
+var stopSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// The signal that retrieves the secrets again, nil on systems that have none
+var hangupSignal os.Signal = syscall.SIGHUP
+
+// The signals that -expire-signal may name
+var namedSignals = map[string]os.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"TERM": syscall.SIGTERM,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
+
+// This function will pass the signal on to the command run by exec
+func forwardSignal(process *os.Process, sig os.Signal) error {
+	return process.Signal(sig)
+}
+
+// This function will ask the command run by exec to exit
+func terminateProcess(process *os.Process) error {
+	return process.Signal(syscall.SIGTERM)
+}
+
+// This function will return the signal that killed the command run by exec, if it was killed by one
+func killedBy(state *os.ProcessState) (syscall.Signal, bool) {
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return status.Signal(), true
+	}
+
+	return 0, false
+}
+
+// Whether the process can be replaced by the command of -exec
+const canReplaceProcess = true
+
+// This function will replace this process with the command, it only returns when the command cannot be run
+func replaceProcess(path string, args []string, env []string) error {
+	return syscall.Exec(path, args, env)
+}
+
+// This function will listen on the Unix domain socket at the path.  The socket is created with a umask that
+// leaves it only accessible by the owner, so it is never reachable with wider permissions, not even until a
+// chmod.  The umask is that of the whole process so it is restored straight away.
+func listenUnix(path string) (net.Listener, error) {
+	previous := syscall.Umask(0177)
+	defer syscall.Umask(previous)
+
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,69 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// This code is used to handle the console events of Windows, which has no SIGHUP, so the secrets are
+// only refreshed by -rotation-check or POST /refresh, and a process can only be killed.  Windows has no
+// umask either, so the sockets of serve have their permissions set once they are created.
+//
+
+//go:build windows
+
+package main
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// The signals that stop serve and that exec passes on to its command, Go reports Ctrl+C as os.Interrupt and
+// closing the console, logging off, or shutting down as SIGTERM
+var stopSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// The signal that retrieves the secrets again, nil on systems that have none
+var hangupSignal os.Signal
+
+// The signals that -expire-signal may name, Windows cannot send any of them to another process
+var namedSignals = map[string]os.Signal{}
+
+// This function will pass the signal on to the command run by exec.  Windows cannot send a signal to another
+// process, but the console sends Ctrl+C to the command as well, so the signal is not passed on.
+func forwardSignal(process *os.Process, sig os.Signal) error {
+	return nil
+}
+
+// This function will ask the command run by exec to exit, Windows can only kill it
+func terminateProcess(process *os.Process) error {
+	return process.Kill()
+}
+
+// This function will return the signal that killed the command run by exec, a command on Windows is never
+// killed by a signal
+func killedBy(state *os.ProcessState) (syscall.Signal, bool) {
+	return 0, false
+}
+
+// Whether the process can be replaced by the command of -exec, Windows has no exec so the command is run as a child
+const canReplaceProcess = false
+
+// This function will replace this process with the command, which Windows cannot do
+func replaceProcess(path string, args []string, env []string) error {
+	return syscall.EWINDOWS
+}
+
+// This function will listen on the Unix domain socket at the path, only accessible by the owner
+func listenUnix(path string) (net.Listener, error) {
+	listener, err := net.Listen("unix", path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
@@ -0,0 +1,103 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// This code is used to trace the STS, Secrets Manager, and SSM calls with OpenTelemetry so that
+// the time spent retrieving the secrets during a cold start shows up in the traces.
+//
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/github.com/aws/aws-sdk-go-v2/otelaws"
+	"go.opentelemetry.io/contrib/propagators/aws/xray"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// The exporters accepted by -trace.  Both send the spans with OTLP over HTTP, configured with the standard
+// OTEL_EXPORTER_OTLP environment variables, xray uses X-Ray trace ids and continues the trace in
+// _X_AMZN_TRACE_ID so that the spans can be sent on to X-Ray by the ADOT collector.
+const TRACE_NONE = "none"
+const TRACE_OTLP = "otlp"
+const TRACE_XRAY = "xray"
+
+// The name of the span covering the whole retrieval
+const TRACE_SPAN_NAME = "retrieve-secrets"
+
+// The longest time spent sending the spans before the process exits
+const TRACE_FLUSH_TIMEOUT = 2 * time.Second
+
+// This function will return the exporter used when -trace is not supplied, OTEL_TRACES_EXPORTER when it is set
+func defaultTraceExporter() string {
+	if exporter := os.Getenv("OTEL_TRACES_EXPORTER"); len(exporter) > 0 {
+		return exporter
+	}
+
+	return TRACE_NONE
+}
+
+// This function will start the span covering the retrieval and add the middleware that traces each AWS API
+// call to the load options.  The returned function ends the span and sends the spans, it may be called more
+// than once.  Nothing is traced with TRACE_NONE.
+func startTracing(ctx context.Context, exporter string, loadOptions *[]func(*config.LoadOptions) error) (context.Context, func(), error) {
+	if exporter == TRACE_NONE {
+		return ctx, func() {}, nil
+	}
+
+	client, err := otlptracehttp.New(ctx)
+
+	if err != nil {
+		return ctx, nil, fmt.Errorf("Failed to create the trace exporter: %w", err)
+	}
+
+	providerOptions := []sdktrace.TracerProviderOption{sdktrace.WithBatcher(client)}
+
+	if exporter == TRACE_XRAY {
+		providerOptions = append(providerOptions, sdktrace.WithIDGenerator(xray.NewIDGenerator()))
+
+		// Lambda passes the trace of the invoke in the environment rather than in a request header
+		carrier := propagation.MapCarrier{"X-Amzn-Trace-Id": os.Getenv("_X_AMZN_TRACE_ID")}
+		ctx = xray.Propagator{}.Extract(ctx, carrier)
+		otel.SetTextMapPropagator(xray.Propagator{})
+	}
+
+	provider := sdktrace.NewTracerProvider(providerOptions...)
+	otel.SetTracerProvider(provider)
+
+	var apiOptions []func(*middleware.Stack) error
+	otelaws.AppendMiddlewares(&apiOptions)
+	*loadOptions = append(*loadOptions, config.WithAPIOptions(apiOptions))
+
+	ctx, span := provider.Tracer("go-retrieve-secret").Start(ctx, TRACE_SPAN_NAME, trace.WithAttributes(
+		attribute.String("correlation_id", requestId),
+		attribute.Int("secrets", len(secretIds)),
+		attribute.Int("parameters", len(parameters)),
+	))
+
+	var once sync.Once
+	return ctx, func() {
+		once.Do(func() {
+			span.End()
+
+			flushCtx, cancel := context.WithTimeout(context.Background(), TRACE_FLUSH_TIMEOUT)
+			defer cancel()
+
+			if err := provider.Shutdown(flushCtx); err != nil {
+				warnf("failed to send the traces: %s", err)
+			}
+		})
+	}, nil
+}
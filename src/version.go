@@ -0,0 +1,231 @@
+//
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+//
+// This code is used to report exactly which build is running, e.g. in a Lambda layer shared by several
+// teams, and to check a releases endpoint for a newer release of the layer.
+//
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The build of the binary, set when building with e.g. -ldflags "-X main.version=1.2.3 -X main.commit=$(git rev-parse HEAD)
+// -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)", the commit and date of the checkout are used when they are not set
+var version = "dev"
+var commit = ""
+var buildDate = ""
+
+// The default of -releases-url, set when building with -ldflags "-X main.releasesUrl=URL" so that every copy
+// of a layer checks the endpoint it is published to
+var releasesUrl = ""
+
+// The module of the AWS SDK and the service module whose versions are reported
+const SDK_MODULE = "github.com/aws/aws-sdk-go-v2"
+const SDK_SECRETS_MANAGER_MODULE = SDK_MODULE + "/service/secretsmanager"
+
+// The largest response read from the releases endpoint
+const MAX_RELEASE_RESPONSE_SIZE = 1024 * 1024
+
+// A release returned by the -releases-url, either a GitHub release or an object with the version and url
+type release struct {
+	TagName string `json:"tag_name"`
+	HtmlUrl string `json:"html_url"`
+	Version string `json:"version"`
+	Url     string `json:"url"`
+}
+
+// This function will return the version, along with the commit it was built from when it is known
+func versionText() string {
+	text := version
+
+	if revision, _, _ := buildCommit(); len(revision) >= 12 {
+		text += " (" + revision[:12] + ")"
+	}
+
+	return fmt.Sprintf("%s %s %s %s/%s", programName(), text, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
+
+// This function will return the commit and date of the build, from the -ldflags or else from the checkout
+// it was built in, and whether the checkout had changes that were not committed
+func buildCommit() (string, string, bool) {
+	revision, date, modified := commit, buildDate, false
+
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if len(revision) == 0 {
+					revision = setting.Value
+				}
+			case "vcs.time":
+				if len(date) == 0 {
+					date = setting.Value
+				}
+			case "vcs.modified":
+				modified = len(commit) == 0 && setting.Value == "true"
+			}
+		}
+	}
+
+	return revision, date, modified
+}
+
+// This function will return the version of each of the modules the binary was built with, empty when the
+// module is not one of its dependencies
+func moduleVersion(path string) string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range info.Deps {
+			if dep.Path == path {
+				return dep.Version
+			}
+		}
+	}
+
+	return ""
+}
+
+// This function will print the version and the details of the build, then check the -releases-url for a
+// newer release when -check-update was supplied
+func printVersion() error {
+	fmt.Println(versionText())
+
+	revision, date, modified := buildCommit()
+
+	if len(revision) == 0 {
+		revision = "unknown"
+	} else if modified {
+		revision += " (modified)"
+	}
+
+	if len(date) == 0 {
+		date = "unknown"
+	}
+
+	fmt.Printf("  version:        %s\n", version)
+	fmt.Printf("  commit:         %s\n", revision)
+	fmt.Printf("  built:          %s\n", date)
+	fmt.Printf("  go:             %s\n", runtime.Version())
+	fmt.Printf("  aws-sdk-go-v2:  %s\n", moduleVersion(SDK_MODULE))
+	fmt.Printf("  secretsmanager: %s\n", moduleVersion(SDK_SECRETS_MANAGER_MODULE))
+
+	if !checkUpdate {
+		return nil
+	}
+
+	latest, url, err := latestRelease(releasesUrl)
+
+	if err != nil {
+		return configError("Failed to check %s for a newer release: %w", releasesUrl, err)
+	}
+
+	switch comparison, ok := compareVersions(latest, version); {
+	case !ok:
+		fmt.Printf("The latest release is %s, this build of %s cannot be compared with it\n", latest, version)
+	case comparison > 0:
+		fmt.Printf("A newer release %s is available: %s\n", latest, url)
+	default:
+		fmt.Printf("This is the latest release, %s\n", latest)
+	}
+
+	return nil
+}
+
+// This function will return the version and the url of the latest release from the endpoint
+func latestRelease(endpoint string) (string, string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout))
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	request.Header.Set("Accept", "application/json")
+	request.Header.Set("User-Agent", programName()+"/"+version)
+
+	response, err := sharedHTTPClient().Do(request)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("the endpoint returned %d", response.StatusCode)
+	}
+
+	var latest release
+	if err := json.NewDecoder(io.LimitReader(response.Body, MAX_RELEASE_RESPONSE_SIZE)).Decode(&latest); err != nil {
+		return "", "", fmt.Errorf("the response is not a release: %w", err)
+	}
+
+	name, url := latest.TagName, latest.HtmlUrl
+	if len(name) == 0 {
+		name, url = latest.Version, latest.Url
+	}
+
+	if len(name) == 0 {
+		return "", "", fmt.Errorf("the response has no tag_name or version")
+	}
+
+	return name, url, nil
+}
+
+// This function will compare two semantic versions, such as v1.2.3, returning a positive number when a is
+// newer.  The pre-release and build suffixes are ignored, and a version that is not semantic, such as dev,
+// cannot be compared.
+func compareVersions(a string, b string) (int, bool) {
+	parse := func(value string) ([3]int, bool) {
+		var parts [3]int
+
+		value = strings.TrimPrefix(strings.TrimSpace(value), "v")
+		if i := strings.IndexAny(value, "-+"); i >= 0 {
+			value = value[:i]
+		}
+
+		fields := strings.Split(value, ".")
+		if len(fields) == 0 || len(fields) > 3 {
+			return parts, false
+		}
+
+		for i, field := range fields {
+			number, err := strconv.Atoi(field)
+
+			if err != nil || number < 0 {
+				return parts, false
+			}
+
+			parts[i] = number
+		}
+
+		return parts, true
+	}
+
+	left, okLeft := parse(a)
+	right, okRight := parse(b)
+
+	if !okLeft || !okRight {
+		return 0, false
+	}
+
+	for i := range left {
+		if left[i] != right[i] {
+			return left[i] - right[i], true
+		}
+	}
+
+	return 0, true
+}